@@ -0,0 +1,337 @@
+// Package client is a Go SDK for the API. It performs the ECDH login
+// handshake, signs every request with the derived secret, refreshes the
+// session token before it expires and optionally encrypts the bodies of the
+// user and role resources.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/app-api/util"
+)
+
+// ErrMfaRequired is returned by Login when the user has to complete the
+// login with VerifyMfa.
+var ErrMfaRequired = errors.New("client: second factor required")
+
+// ErrNotLoggedIn is returned by calls that need a session before Login.
+var ErrNotLoggedIn = errors.New("client: not logged in")
+
+// Error is a non 2xx response of the API.
+type Error struct {
+	Status int    `json:"-"`
+	Code   string `json:"code"`
+	Msg    string `json:"error,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Msg != "" {
+		return fmt.Sprintf("client: %d %s: %s", e.Status, e.Code, e.Msg)
+	}
+	return fmt.Sprintf("client: %d %s", e.Status, e.Code)
+}
+
+// LoginUser is the user returned by a successful login.
+type LoginUser struct {
+	Email       string         `json:"email"`
+	Name        string         `json:"name"`
+	Roles       []string       `json:"roles,omitempty"`
+	Privileges  map[string]any `json:"privileges,omitempty"`
+	MfaRequired bool           `json:"mfa_required,omitempty"`
+}
+
+type loginObject struct {
+	PublicKey    string     `json:"public_key,omitempty"`
+	Kid          string     `json:"kid,omitempty"`
+	Email        string     `json:"email"`
+	Password     string     `json:"password,omitempty"`
+	Token        string     `json:"token,omitempty"`
+	RefreshToken string     `json:"refresh_token,omitempty"`
+	MfaRequired  bool       `json:"mfa_required,omitempty"`
+	MfaToken     string     `json:"mfa_token,omitempty"`
+	Code         string     `json:"code,omitempty"`
+	User         *LoginUser `json:"user,omitempty"`
+}
+
+// Client is safe for concurrent use once logged in.
+type Client struct {
+	// BaseURL is the server root, e.g. https://api.example.com.
+	BaseURL    string
+	HTTPClient *http.Client
+	// RefreshBefore refreshes the session token this long before it expires.
+	RefreshBefore time.Duration
+	// Encrypt sends and accepts application/jose+json for users and roles.
+	Encrypt bool
+
+	mu           sync.Mutex
+	email        string
+	token        string
+	refreshToken string
+	expiresAt    time.Time
+	mfaToken     string
+	shared       []byte
+	user         *LoginUser
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:       strings.TrimSuffix(baseURL, "/"),
+		HTTPClient:    http.DefaultClient,
+		RefreshBefore: 30 * time.Second,
+	}
+}
+
+// Login runs the ECDH handshake and the signed password login. With a
+// second factor enrolled it returns ErrMfaRequired.
+func (c *Client) Login(ctx context.Context, email, password string) error {
+	priv, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	pub, err := util.EncodePubKey(priv.PublicKey())
+	if err != nil {
+		return err
+	}
+	var hs loginObject
+	if err := c.send(ctx, http.MethodPut, "/api/v1/auth", loginObject{Email: email, PublicKey: pub}, &hs, nil, false); err != nil {
+		return err
+	}
+	spub, err := util.DecodePubKey(hs.PublicKey)
+	if err != nil {
+		return fmt.Errorf("client: invalid server key: %w", err)
+	}
+	shared, err := priv.ECDH(spub)
+	if err != nil {
+		return err
+	}
+	var res loginObject
+	err = c.send(ctx, http.MethodPut, "/api/v1/auth", loginObject{
+		Email:     email,
+		PublicKey: pub,
+		Password:  password,
+		Kid:       hs.Kid,
+	}, &res, shared, false)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.email = email
+	c.shared = shared
+	if res.MfaRequired {
+		c.mfaToken = res.MfaToken
+		return ErrMfaRequired
+	}
+	c.setSession(res)
+	return nil
+}
+
+// VerifyMfa completes a login that returned ErrMfaRequired with a TOTP or
+// recovery code.
+func (c *Client) VerifyMfa(ctx context.Context, code string) error {
+	c.mu.Lock()
+	email, mfaToken, shared := c.email, c.mfaToken, c.shared
+	c.mu.Unlock()
+	if mfaToken == "" {
+		return ErrNotLoggedIn
+	}
+	var res loginObject
+	err := c.send(ctx, http.MethodPut, "/api/v1/auth/mfa", loginObject{
+		Email:    email,
+		MfaToken: mfaToken,
+		Code:     code,
+	}, &res, shared, false)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mfaToken = ""
+	c.setSession(res)
+	return nil
+}
+
+// Refresh exchanges the refresh token for a new session token.
+func (c *Client) Refresh(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refresh(ctx)
+}
+
+func (c *Client) refresh(ctx context.Context) error {
+	if c.refreshToken == "" {
+		return ErrNotLoggedIn
+	}
+	var res loginObject
+	err := c.send(ctx, http.MethodPost, "/api/v1/auth", loginObject{
+		Email:        c.email,
+		RefreshToken: c.refreshToken,
+	}, &res, c.shared, false)
+	if err != nil {
+		return err
+	}
+	c.setSession(res)
+	return nil
+}
+
+// Logout ends the session on the server and forgets it locally.
+func (c *Client) Logout(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == "" {
+		return ErrNotLoggedIn
+	}
+	err := c.send(ctx, http.MethodDelete, "/api/v1/auth", loginObject{Email: c.email, Token: c.token}, nil, nil, false)
+	c.token, c.refreshToken, c.shared, c.user = "", "", nil, nil
+	c.expiresAt = time.Time{}
+	return err
+}
+
+// Token returns the current session token.
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// User returns the user of the current session.
+func (c *Client) User() *LoginUser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user
+}
+
+func (c *Client) setSession(res loginObject) {
+	c.token = res.Token
+	c.refreshToken = res.RefreshToken
+	c.expiresAt = tokenExpiry(res.Token)
+	if res.User != nil {
+		c.user = res.User
+	}
+}
+
+// session returns a valid token and the shared secret, refreshing first when
+// the token is about to expire.
+func (c *Client) session(ctx context.Context) (string, []byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == "" {
+		return "", nil, ErrNotLoggedIn
+	}
+	if !c.expiresAt.IsZero() && time.Until(c.expiresAt) < c.RefreshBefore {
+		if err := c.refresh(ctx); err != nil {
+			return "", nil, err
+		}
+	}
+	return c.token, c.shared, nil
+}
+
+// Do sends in as JSON to the API path with the session token, signs it and
+// decodes the response into out. encrypt uses application/jose+json for
+// both directions.
+func (c *Client) Do(ctx context.Context, method, path string, in, out any, encrypt bool) error {
+	token, shared, err := c.session(ctx)
+	if err != nil {
+		return err
+	}
+	return c.sendToken(ctx, method, path, in, out, shared, encrypt, token)
+}
+
+func (c *Client) send(ctx context.Context, method, path string, in, out any, shared []byte, encrypt bool) error {
+	return c.sendToken(ctx, method, path, in, out, shared, encrypt, "")
+}
+
+func (c *Client) sendToken(ctx context.Context, method, path string, in, out any, shared []byte, encrypt bool, token string) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	contentType := "application/json"
+	if encrypt {
+		if body != nil {
+			var err error
+			if body, err = util.EncryptJOSE(shared, body); err != nil {
+				return err
+			}
+		}
+		contentType = util.ContentTypeJOSE
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if encrypt {
+		req.Header.Set("Accept", util.ContentTypeJOSE)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if len(shared) > 0 {
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	bb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt == util.ContentTypeJOSE {
+		if bb, err = util.DecryptJOSE(shared, bb); err != nil {
+			return fmt.Errorf("client: decrypt response: %w", err)
+		}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := &Error{Status: resp.StatusCode}
+		if json.Unmarshal(bb, e) != nil || e.Code == "" {
+			e.Code = http.StatusText(resp.StatusCode)
+			e.Msg = strings.TrimSpace(string(bb))
+		}
+		return e
+	}
+	if out == nil || len(bb) == 0 {
+		return nil
+	}
+	return json.Unmarshal(bb, out)
+}
+
+// tokenExpiry reads the exp claim without verifying the token; the server
+// verifies it on every request.
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(raw, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"example.com/app-api/model"
+)
+
+// Resource mirrors the CRUD routes the handler package registers for an
+// entity T with its filter F, sorting S and field names D.
+type Resource[T, F, S any, D ~string] struct {
+	c       *Client
+	path    string
+	encrypt bool
+}
+
+// Users are the /api/v1/user routes.
+func (c *Client) Users() *Resource[model.User, model.UserFilter, model.UserSorting, model.UserField] {
+	return &Resource[model.User, model.UserFilter, model.UserSorting, model.UserField]{c: c, path: "/api/v1/user", encrypt: c.Encrypt}
+}
+
+// Roles are the /api/v1/role routes.
+func (c *Client) Roles() *Resource[model.Role, model.RoleFilter, model.RoleSorting, model.RoleField] {
+	return &Resource[model.Role, model.RoleFilter, model.RoleSorting, model.RoleField]{c: c, path: "/api/v1/role", encrypt: c.Encrypt}
+}
+
+// Params are the /api/v1/param routes.
+func (c *Client) Params() *Resource[model.Param, model.ParamFilter, model.ParamSorting, model.ParamField] {
+	return &Resource[model.Param, model.ParamFilter, model.ParamSorting, model.ParamField]{c: c, path: "/api/v1/param"}
+}
+
+func (r *Resource[T, F, S, D]) idPath(id int64) string {
+	return r.path + "/" + strconv.FormatInt(id, 10)
+}
+
+func (r *Resource[T, F, S, D]) Get(ctx context.Context, id int64) (*T, error) {
+	var obj T
+	if err := r.c.Do(ctx, http.MethodGet, r.idPath(id), nil, &obj, r.encrypt); err != nil {
+		return nil, err
+	}
+	return &obj, nil
+}
+
+// Find returns a page of the matching objects and the total count.
+func (r *Resource[T, F, S, D]) Find(ctx context.Context, filter []F, sorting []S, limit int, offset int64) ([]T, int64, error) {
+	in := struct {
+		Limit   int   `json:"limit"`
+		Offset  int64 `json:"offset"`
+		Filter  []F   `json:"filter"`
+		Sorting []S   `json:"sorting"`
+	}{limit, offset, filter, sorting}
+	var out struct {
+		List  []T   `json:"list"`
+		Total int64 `json:"total"`
+	}
+	if err := r.c.Do(ctx, http.MethodPost, r.path, in, &out, r.encrypt); err != nil {
+		return nil, 0, err
+	}
+	return out.List, out.Total, nil
+}
+
+func (r *Resource[T, F, S, D]) Create(ctx context.Context, obj T) (*T, error) {
+	var res T
+	if err := r.c.Do(ctx, http.MethodPut, r.path, obj, &res, r.encrypt); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Update writes the given fields of obj to the object id.
+func (r *Resource[T, F, S, D]) Update(ctx context.Context, id int64, obj T, fields ...D) (*T, error) {
+	in := struct {
+		Value  T   `json:"value"`
+		Fields []D `json:"fields"`
+	}{obj, fields}
+	var res T
+	if err := r.c.Do(ctx, http.MethodPatch, r.idPath(id), in, &res, r.encrypt); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (r *Resource[T, F, S, D]) Delete(ctx context.Context, id int64) error {
+	return r.c.Do(ctx, http.MethodDelete, r.idPath(id), nil, nil, r.encrypt)
+}
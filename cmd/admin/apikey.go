@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"strconv"
+	"time"
+
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+)
+
+type apiKeyRow struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Privileges string     `json:"privileges"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// Key is only set when the key is created, it cannot be shown again.
+	Key string `json:"key,omitempty"`
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func printAPIKeys(out *output, keys []model.APIKey, key string) error {
+	rows := make([]apiKeyRow, 0, len(keys))
+	table := make([][]string, 0, len(keys))
+	header := []string{"ID", "NAME", "PREFIX", "PRIVILEGES", "EXPIRES", "LAST USED"}
+	if key != "" {
+		header = append(header, "KEY")
+	}
+	for _, k := range keys {
+		row := apiKeyRow{
+			ID:         k.ID,
+			Name:       k.Name,
+			Prefix:     k.Prefix,
+			Privileges: k.Privileges,
+			ExpiresAt:  nullTime(k.ExpiresAt),
+			LastUsedAt: nullTime(k.LastUsedAt),
+			Key:        key,
+		}
+		rows = append(rows, row)
+		line := []string{
+			strconv.FormatInt(row.ID, 10), row.Name, row.Prefix, row.Privileges,
+			formatTime(row.ExpiresAt), formatTime(row.LastUsedAt),
+		}
+		if key != "" {
+			line = append(line, key)
+		}
+		table = append(table, line)
+	}
+	return out.print(rows, header, table)
+}
+
+func getAPIKey(ctx context.Context, store model.AppStore, prefix string) (*model.APIKey, error) {
+	k, err := store.APIKey().GetByPrefix(ctx, prefix)
+	if isNotFound(err) || (err == nil && k == nil) {
+		return nil, notFound("api key %s not found", prefix)
+	}
+	return k, err
+}
+
+// newAPIKey fills obj with a fresh secret and returns the key to hand out.
+func newAPIKey(obj *model.APIKey) (string, error) {
+	key, prefix, hash, err := util.NewAPIKey()
+	if err != nil {
+		return "", err
+	}
+	obj.Prefix = prefix
+	obj.SecretHash = hash
+	obj.CreatedAt = time.Now()
+	return key, nil
+}
+
+// createAPIKey stores a new key and prints it; the secret cannot be recovered later.
+func createAPIKey(ctx context.Context, store model.AppStore, out *output, obj model.APIKey) error {
+	key, err := newAPIKey(&obj)
+	if err != nil {
+		return err
+	}
+	res, err := store.APIKey().Create(ctx, obj)
+	if err != nil {
+		return err
+	}
+	return printAPIKeys(out, []model.APIKey{*res}, key)
+}
+
+func apiKeyCreate(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	fs := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+	email := fs.String("user", "", "email of the service account")
+	name := fs.String("name", "", "name of the key")
+	privileges := fs.String("privileges", "", `privileges as JSON, e.g. {"param":{"read":true}}; all privileges of the user when empty`)
+	expires := fs.Duration("expires", 0, "validity of the key, e.g. 2160h; never expires when 0")
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if *email == "" || *name == "" {
+		return usageError("-user and -name are required")
+	}
+	if *expires < 0 {
+		return usageError("-expires must not be negative")
+	}
+	user, err := getUserByEmail(ctx, store, *email)
+	if err != nil {
+		return err
+	}
+	obj := model.APIKey{UserID: user.ID, Name: *name, Privileges: *privileges}
+	if err := validateAPIKeyPrivileges(ctx, store, obj); err != nil {
+		if cause := errors.Unwrap(err); cause != nil {
+			return usageError("invalid -privileges: %v", cause)
+		}
+		return err
+	}
+	if *expires > 0 {
+		obj.ExpiresAt = sql.NullTime{Time: time.Now().Add(*expires), Valid: true}
+	}
+	return createAPIKey(ctx, store, out, obj)
+}
+
+func apiKeyList(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	fs := flag.NewFlagSet("apikey list", flag.ContinueOnError)
+	pos, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	user, err := getUserByEmail(ctx, store, pos[0])
+	if err != nil {
+		return err
+	}
+	keys, err := store.APIKey().ListByUser(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	return printAPIKeys(out, keys, "")
+}
+
+// apiKeyRotate issues a new key with the name, privileges and expiry of the
+// old one. The old key stays valid for the grace period so the clients can
+// switch without downtime. The new key is stored before the old one is
+// shortened, so a failed rotation leaves the old key as it was.
+func apiKeyRotate(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	fs := flag.NewFlagSet("apikey rotate", flag.ContinueOnError)
+	grace := fs.Duration("grace", 0, "validity of the old key after the rotation")
+	pos, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if *grace < 0 {
+		return usageError("-grace must not be negative")
+	}
+	old, err := getAPIKey(ctx, store, pos[0])
+	if err != nil {
+		return err
+	}
+	obj := model.APIKey{UserID: old.UserID, Name: old.Name, Privileges: old.Privileges}
+	if old.ExpiresAt.Valid && old.ExpiresAt.Time.After(old.CreatedAt) {
+		obj.ExpiresAt = sql.NullTime{Time: time.Now().Add(old.ExpiresAt.Time.Sub(old.CreatedAt)), Valid: true}
+	}
+	if err := validateAPIKeyPrivileges(ctx, store, obj); err != nil {
+		if cause := errors.Unwrap(err); cause != nil {
+			// the roles of the user no longer grant the privileges of the key
+			return conflict("key %s cannot be rotated: %v", old.Prefix, cause)
+		}
+		return err
+	}
+	key, err := newAPIKey(&obj)
+	if err != nil {
+		return err
+	}
+	res, err := store.APIKey().Rotate(ctx, old.ID, time.Now().Add(*grace), obj)
+	if err != nil {
+		return err
+	}
+	return printAPIKeys(out, []model.APIKey{*res}, key)
+}
+
+func apiKeyRevoke(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	fs := flag.NewFlagSet("apikey revoke", flag.ContinueOnError)
+	pos, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	k, err := getAPIKey(ctx, store, pos[0])
+	if err != nil {
+		return err
+	}
+	if err := store.APIKey().Expire(ctx, k.ID, time.Now()); err != nil {
+		return err
+	}
+	if k, err = getAPIKey(ctx, store, pos[0]); err != nil {
+		return err
+	}
+	return printAPIKeys(out, []model.APIKey{*k}, "")
+}
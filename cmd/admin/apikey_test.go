@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"example.com/app-api/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeyCreate(t *testing.T) {
+	ctx := context.Background()
+	store := model.GetAppStore()
+	out := &output{json: true}
+
+	err := roleCreate(ctx, store, out, []string{"-name", "CliService", "-privileges", `{"param":{"read":true}}`})
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = userCreate(ctx, store, out, []string{"-email", "cli-service@example.com", "-service", "-role", "CliService"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	user, err := store.User().GetByEmail(ctx, "cli-service@example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	t.Run("Unknown privilege", func(t *testing.T) {
+		err := apiKeyCreate(ctx, store, out, []string{"-user", user.Email, "-name", "cli", "-privileges", `{"audit":{"read":true}}`})
+		assert.Equal(t, exitUsage, exitCode(err), err)
+		assert.ErrorContains(t, err, "unknown privilege audit:read")
+
+		keys, err := store.APIKey().ListByUser(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, keys, "key must not be created")
+	})
+
+	t.Run("Unknown scope", func(t *testing.T) {
+		err := apiKeyCreate(ctx, store, out, []string{"-user", user.Email, "-name", "cli", "-privileges", `{"app_user":{"read":{"groups":["cli"]}}}`})
+		assert.Equal(t, exitUsage, exitCode(err), err)
+	})
+
+	t.Run("Privilege the user lacks", func(t *testing.T) {
+		err := apiKeyCreate(ctx, store, out, []string{"-user", user.Email, "-name", "cli", "-privileges", `{"param":{"*":true}}`})
+		assert.Equal(t, exitUsage, exitCode(err), err)
+		assert.ErrorContains(t, err, "not granted")
+	})
+
+	t.Run("Registered privileges", func(t *testing.T) {
+		err := apiKeyCreate(ctx, store, out, []string{"-user", user.Email, "-name", "cli", "-privileges", `{"param":{"read":{"groups":["cli"]}}}`})
+		assert.NoError(t, err)
+
+		keys, err := store.APIKey().ListByUser(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Len(t, keys, 1)
+	})
+
+	t.Run("Unknown user", func(t *testing.T) {
+		err := apiKeyCreate(ctx, store, out, []string{"-user", "nobody@example.com", "-name", "cli"})
+		assert.Equal(t, exitNotFound, exitCode(err), err)
+	})
+}
+
+func TestAPIKeyRotate(t *testing.T) {
+	ctx := context.Background()
+	store := model.GetAppStore()
+	out := &output{json: true}
+
+	err := userCreate(ctx, store, out, []string{"-email", "cli-rotate@example.com", "-service"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	user, err := store.User().GetByEmail(ctx, "cli-rotate@example.com")
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = apiKeyCreate(ctx, store, out, []string{"-user", user.Email, "-name", "rotate", "-expires", "24h"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	keys, err := store.APIKey().ListByUser(ctx, user.ID)
+	if !assert.NoError(t, err) || !assert.Len(t, keys, 1) {
+		return
+	}
+	old := keys[0]
+
+	t.Run("Failed insert keeps the old key", func(t *testing.T) {
+		obj := model.APIKey{UserID: user.ID, Name: "rotate", Prefix: old.Prefix, SecretHash: "x", CreatedAt: time.Now()}
+		_, err := store.APIKey().Rotate(ctx, old.ID, time.Now(), obj)
+		assert.Error(t, err)
+
+		k, err := store.APIKey().GetByPrefix(ctx, old.Prefix)
+		if assert.NoError(t, err) {
+			assert.Equal(t, old.ExpiresAt, k.ExpiresAt)
+		}
+	})
+
+	t.Run("Rotate with grace", func(t *testing.T) {
+		err := apiKeyRotate(ctx, store, out, []string{"-grace", "1h", old.Prefix})
+		assert.NoError(t, err)
+
+		keys, err := store.APIKey().ListByUser(ctx, user.ID)
+		if !assert.NoError(t, err) || !assert.Len(t, keys, 2) {
+			return
+		}
+		assert.NotEqual(t, old.Prefix, keys[0].Prefix)
+		assert.Equal(t, "rotate", keys[0].Name)
+		assert.True(t, keys[0].ExpiresAt.Valid)
+		k, err := store.APIKey().GetByPrefix(ctx, old.Prefix)
+		if assert.NoError(t, err) {
+			assert.WithinDuration(t, time.Now().Add(time.Hour), k.ExpiresAt.Time, time.Minute)
+		}
+	})
+
+	t.Run("Rotate without grace", func(t *testing.T) {
+		keys, err := store.APIKey().ListByUser(ctx, user.ID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		err = apiKeyRotate(ctx, store, out, []string{keys[0].Prefix})
+		assert.NoError(t, err)
+
+		k, err := store.APIKey().GetByPrefix(ctx, keys[0].Prefix)
+		if assert.NoError(t, err) {
+			assert.False(t, k.ExpiresAt.Time.After(time.Now()), "old key must be expired")
+		}
+		keys, err = store.APIKey().ListByUser(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Len(t, keys, 3)
+	})
+
+	t.Run("Unknown key", func(t *testing.T) {
+		err := apiKeyRotate(ctx, store, out, []string{"nokey"})
+		assert.Equal(t, exitNotFound, exitCode(err), err)
+	})
+}
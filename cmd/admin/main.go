@@ -0,0 +1,220 @@
+// Command admin bootstraps and operates the system directly on the database:
+// it creates the first administrator, manages roles, parameters, sessions and
+// the API keys of service accounts.
+//
+//	admin [-o table|json] <group> <command> [flags] [args]
+//
+// Exit codes: 0 success, 1 error, 2 usage, 3 not found, 4 already exists.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+)
+
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
+	exitConflict = 4
+)
+
+// cliError carries the exit code of a failed command.
+type cliError struct {
+	code int
+	msg  string
+}
+
+func (e *cliError) Error() string { return e.msg }
+
+func usageError(format string, args ...any) error {
+	return &cliError{code: exitUsage, msg: fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...any) error {
+	return &cliError{code: exitNotFound, msg: fmt.Sprintf(format, args...)}
+}
+
+func conflict(format string, args ...any) error {
+	return &cliError{code: exitConflict, msg: fmt.Sprintf(format, args...)}
+}
+
+// isNotFound matches the NOT_FOUND error of the stores.
+func isNotFound(err error) bool {
+	return err != nil && err.Error() == "NOT_FOUND"
+}
+
+var registerCatalog sync.Once
+
+// validatePrivileges checks privileges against the catalog of the server. The
+// hand-written handlers register their privileges with their routes, so the
+// routes of main.go are registered on a mux that is never served.
+func validatePrivileges(store model.AppStore, privileges string) error {
+	registerPrivileges(store)
+	return handler.ValidatePrivileges(privileges)
+}
+
+// validateAPIKeyPrivileges is validatePrivileges for the privileges of a key,
+// which must also be granted to its user.
+func validateAPIKeyPrivileges(ctx context.Context, store model.AppStore, ak model.APIKey) error {
+	registerPrivileges(store)
+	return handler.ValidateAPIKeyPrivileges(ctx, store, ak)
+}
+
+func registerPrivileges(store model.AppStore) {
+	registerCatalog.Do(func() {
+		api := http.NewServeMux()
+		apiStore := handler.APIStore(store)
+		handler.UserHandlerRegister(api, "/api/v1", apiStore, handler.BasicAuthenticate)
+		handler.UserStatusHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
+		handler.UserRoleHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
+		handler.RoleHandlerRegister(api, "/api/v1", apiStore, handler.BasicAuthenticate)
+		handler.RolePolicyHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
+		handler.ParamHandlerRegister(api, "/api/v1", apiStore, handler.BasicAuthenticate)
+		handler.ChangeRequestHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
+		handler.AuthHandlerRegister(api, store)
+		handler.MeHandlerRegister(api, "/api/v1", store)
+	})
+}
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, store model.AppStore, out *output, args []string) error
+}
+
+var commands = map[string]map[string]command{
+	"user": {
+		"create":       {"-email EMAIL [-name NAME] [-password PW | -password-stdin | -service] [-role ROLE,...]", userCreate},
+		"list":         {"[-email PATTERN] [-limit N] [-offset N]", userList},
+		"disable":      {"[-lock] [-reason TEXT] EMAIL", userDisable},
+		"enable":       {"[-reason TEXT] EMAIL", userEnable},
+		"set-password": {"[-password PW | -password-stdin] EMAIL", userSetPassword},
+	},
+	"role": {
+		"create":  {"-name NAME [-description TEXT] [-privileges JSON] [-mfa] [-parents ROLE,...]", roleCreate},
+		"list":    {"", roleList},
+		"parents": {"ROLE [PARENT...]", roleParents},
+		"exclude": {"ROLE [OTHER...]", roleExclude},
+		"grant":   {"[-from TIME] [-until TIME|DURATION] EMAIL ROLE", roleGrant},
+		"revoke":  {"EMAIL ROLE", roleRevoke},
+	},
+	"param": {
+		"get":  {"GROUP CODE", paramGet},
+		"set":  {"[-description TEXT] GROUP CODE VALUE", paramSet},
+		"list": {"[-group GROUP]", paramList},
+	},
+	"session": {
+		"revoke": {"EMAIL", sessionRevoke},
+	},
+	"apikey": {
+		"create": {"-user EMAIL -name NAME [-privileges JSON] [-expires DURATION]", apiKeyCreate},
+		"list":   {"EMAIL", apiKeyList},
+		"rotate": {"[-grace DURATION] PREFIX", apiKeyRotate},
+		"revoke": {"PREFIX", apiKeyRevoke},
+	},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: admin [-o table|json] <group> <command> [flags] [args]")
+	for _, group := range []string{"user", "role", "param", "session", "apikey"} {
+		for _, name := range slices.Sorted(maps.Keys(commands[group])) {
+			fmt.Fprintf(os.Stderr, "  %s %s %s\n", group, name, commands[group][name].usage)
+		}
+	}
+}
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	format := flag.String("o", "table", "output format: table or json")
+	timeout := flag.Duration("timeout", time.Minute, "timeout of the command")
+	flag.Usage = usage
+	flag.Parse()
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "invalid output format %q\n", *format)
+		return exitUsage
+	}
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+		return exitUsage
+	}
+	cmd, ok := commands[args[0]][args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", strings.Join(args[:2], " "))
+		usage()
+		return exitUsage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	store := model.GetAppStore()
+	out := &output{json: *format == "json"}
+	err := cmd.run(ctx, store, out, args[2:])
+	if err == nil {
+		return exitOK
+	}
+	code := exitError
+	var cerr *cliError
+	if errors.As(err, &cerr) {
+		code = cerr.code
+	}
+	if out.json {
+		_ = json.NewEncoder(os.Stderr).Encode(map[string]any{"error": err.Error(), "exit_code": code})
+	} else {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	}
+	if code == exitUsage {
+		fmt.Fprintf(os.Stderr, "usage: admin %s %s %s\n", args[0], args[1], cmd.usage)
+	}
+	return code
+}
+
+// output writes either one JSON document or a tab aligned table to stdout.
+type output struct {
+	json bool
+}
+
+func (o *output) print(v any, header []string, rows [][]string) error {
+	if o.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// parse parses the flags of a sub command and checks the number of
+// positional arguments.
+func parse(fs *flag.FlagSet, args []string, nargs int) ([]string, error) {
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return nil, usageError("%v", err)
+	}
+	if fs.NArg() != nargs {
+		return nil, usageError("expected %d arguments, got %d", nargs, fs.NArg())
+	}
+	return fs.Args(), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"strconv"
+	"time"
+
+	"example.com/app-api/model"
+	"example.com/app-api/util/jsql"
+)
+
+func printParams(out *output, params []model.Param) error {
+	table := make([][]string, 0, len(params))
+	for _, p := range params {
+		table = append(table, []string{
+			strconv.FormatInt(p.ID, 10), p.Group, p.Code, p.Value.String, p.Description.String,
+		})
+	}
+	if params == nil {
+		params = []model.Param{}
+	}
+	return out.print(params, []string{"ID", "GROUP", "CODE", "VALUE", "DESCRIPTION"}, table)
+}
+
+func getParam(ctx context.Context, store model.AppStore, group, code string) (*model.Param, error) {
+	p, err := store.Param().GetByPARAM_UNIQUE(ctx, code, group)
+	if isNotFound(err) || (err == nil && p == nil) {
+		return nil, notFound("param %s/%s not found", group, code)
+	}
+	return p, err
+}
+
+func paramGet(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	fs := flag.NewFlagSet("param get", flag.ContinueOnError)
+	pos, err := parse(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	p, err := getParam(ctx, store, pos[0], pos[1])
+	if err != nil {
+		return err
+	}
+	return printParams(out, []model.Param{*p})
+}
+
+// paramSet creates the parameter or updates its value.
+func paramSet(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	fs := flag.NewFlagSet("param set", flag.ContinueOnError)
+	description := fs.String("description", "", "description, kept when empty")
+	pos, err := parse(fs, args, 3)
+	if err != nil {
+		return err
+	}
+	p, err := store.Param().GetByPARAM_UNIQUE(ctx, pos[1], pos[0])
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	if p == nil || isNotFound(err) {
+		p = &model.Param{
+			Group:       pos[0],
+			Code:        pos[1],
+			Value:       jsql.NullStringValue(pos[2]),
+			Description: jsql.NullStringValue(*description),
+			UpdatedBy:   "admin-cli",
+			UpdatedAt:   time.Now(),
+		}
+		if p, err = store.Param().Create(ctx, *p); err != nil {
+			return err
+		}
+		return printParams(out, []model.Param{*p})
+	}
+	p.Value = jsql.NullStringValue(pos[2])
+	p.UpdatedBy = "admin-cli"
+	p.UpdatedAt = time.Now()
+	fields := []model.ParamField{model.ParamField_Value, model.ParamField_UpdatedBy, model.ParamField_UpdatedAt}
+	if *description != "" {
+		p.Description = jsql.NullStringValue(*description)
+		fields = append(fields, model.ParamField_Description)
+	}
+	if err := store.Param().Update(ctx, *p, fields); err != nil {
+		return err
+	}
+	return printParams(out, []model.Param{*p})
+}
+
+func paramList(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	fs := flag.NewFlagSet("param list", flag.ContinueOnError)
+	group := fs.String("group", "", "only parameters of the group")
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	var filter []model.ParamFilter
+	if *group != "" {
+		value, _ := json.Marshal(*group)
+		filter = append(filter, model.ParamFilter{Field: model.ParamField_Group, Op: model.FilterOp_EQ, Value: value})
+	}
+	params, _, err := store.Param().Find(ctx, filter, []model.ParamSorting{
+		{Field: model.ParamField_Group, Dir: model.SortDir_ASC},
+		{Field: model.ParamField_Code, Dir: model.SortDir_ASC},
+	}, 1000, 0)
+	if err != nil {
+		return err
+	}
+	return printParams(out, params)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/app-api/model"
+	"example.com/app-api/util/jsql"
+)
+
+// roleRow is a role with its policy.
+type roleRow struct {
+	model.Role
+	Parents     []int64 `json:"parents"`
+	MfaRequired bool    `json:"mfa_required"`
+}
+
+func printRoles(ctx context.Context, store model.AppStore, out *output, roles []model.Role) error {
+	// the closure of the roles has the policies of all of them in one query
+	ids := make([]int64, 0, len(roles))
+	for _, r := range roles {
+		ids = append(ids, r.ID)
+	}
+	closure, err := store.RolePolicy().Closure(ctx, ids)
+	if err != nil {
+		return err
+	}
+	nodes := make(map[int64]model.RoleNode, len(closure))
+	for _, node := range closure {
+		nodes[node.ID] = node
+	}
+	rows := make([]roleRow, 0, len(roles))
+	table := make([][]string, 0, len(roles))
+	for _, r := range roles {
+		node := nodes[r.ID]
+		row := roleRow{Role: r, Parents: node.Parents, MfaRequired: node.MfaRequired}
+		rows = append(rows, row)
+		names := make([]string, 0, len(row.Parents))
+		for _, id := range row.Parents {
+			names = append(names, strconv.FormatInt(id, 10))
+		}
+		table = append(table, []string{
+			strconv.FormatInt(r.ID, 10), r.Name, r.Description.String,
+			strconv.FormatBool(row.MfaRequired), strings.Join(names, ","), r.Privileges,
+		})
+	}
+	return out.print(rows, []string{"ID", "NAME", "DESCRIPTION", "MFA", "PARENTS", "PRIVILEGES"}, table)
+}
+
+func roleCreate(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	fs := flag.NewFlagSet("role create", flag.ContinueOnError)
+	name := fs.String("name", "", "name of the role")
+	description := fs.String("description", "", "description")
+	privileges := fs.String("privileges", "{}", `privileges as JSON, e.g. {"param":{"read":true,"delete":"deny"}}`)
+	mfa := fs.Bool("mfa", false, "require a second factor for users of the role")
+	parents := fs.String("parents", "", "comma separated names of the roles it includes")
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if *name == "" {
+		return usageError("-name is required")
+	}
+	if err := validatePrivileges(store, *privileges); err != nil {
+		return usageError("invalid -privileges: %v", err)
+	}
+	_, err := store.Role().GetByName(ctx, *name)
+	if err == nil {
+		return conflict("role %s already exists", *name)
+	} else if !isNotFound(err) {
+		return err
+	}
+	role := model.Role{
+		Name:       *name,
+		Privileges: *privileges,
+		UpdatedBy:  "admin-cli",
+		UpdatedAt:  time.Now(),
+	}
+	if *description != "" {
+		role.Description = jsql.NullStringValue(*description)
+	}
+	parentIDs, err := getRoleIDs(ctx, store, strings.Split(*parents, ","))
+	if err != nil {
+		return err
+	}
+	res, err := store.Role().Create(ctx, role)
+	if err != nil {
+		return err
+	}
+	if len(parentIDs) > 0 || *mfa {
+		err = updateRolePolicy(ctx, store, res.ID, func(p *model.RolePolicy) {
+			p.Parents = parentIDs
+			p.MfaRequired = *mfa
+		}, model.RolePolicyField_Parents, model.RolePolicyField_MfaRequired)
+		if err != nil {
+			return roleError(err, res.Name)
+		}
+	}
+	return printRoles(ctx, store, out, []model.Role{*res})
+}
+
+// updateRolePolicy applies set to the current policy of the role and stores
+// the fields.
+func updateRolePolicy(ctx context.Context, store model.AppStore, id int64, set func(p *model.RolePolicy), fields ...model.RolePolicyField) error {
+	policy, err := store.RolePolicy().Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	set(policy)
+	return store.RolePolicy().Update(ctx, *policy, fields)
+}
+
+func roleList(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	fs := flag.NewFlagSet("role list", flag.ContinueOnError)
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	roles, _, err := store.Role().Find(ctx, nil, []model.RoleSorting{{Field: model.RoleField_ID, Dir: model.SortDir_ASC}}, 1000, 0)
+	if err != nil {
+		return err
+	}
+	return printRoles(ctx, store, out, roles)
+}
+
+// getRoleIDs looks up the IDs of the named roles, skipping empty names.
+func getRoleIDs(ctx context.Context, store model.AppStore, names []string) ([]int64, error) {
+	ids := []int64{}
+	for _, rn := range names {
+		if rn = strings.TrimSpace(rn); rn == "" {
+			continue
+		}
+		role, err := getRoleByName(ctx, store, rn)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, role.ID)
+	}
+	return ids, nil
+}
+
+// roleParents replaces the roles a role includes; without parents the role
+// includes none.
+func roleParents(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	return setRoleLinks(ctx, store, out, "role parents", "PARENT", args, func(role *model.Role, ids []int64) error {
+		return updateRolePolicy(ctx, store, role.ID, func(p *model.RolePolicy) {
+			p.Parents = ids
+		}, model.RolePolicyField_Parents)
+	})
+}
+
+// roleExclude replaces the roles a user must not hold together with a role;
+// without roles the role excludes none.
+func roleExclude(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	return setRoleLinks(ctx, store, out, "role exclude", "OTHER", args, func(role *model.Role, ids []int64) error {
+		return updateRolePolicy(ctx, store, role.ID, func(p *model.RolePolicy) {
+			p.Excludes = ids
+		}, model.RolePolicyField_Excludes)
+	})
+}
+
+// setRoleLinks replaces the roles linked to the role of the first argument
+// by the roles of the other arguments with set.
+func setRoleLinks(ctx context.Context, store model.AppStore, out *output, name, arg string, args []string, set func(role *model.Role, ids []int64) error) error {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil {
+		return usageError("%v", err)
+	}
+	if fs.NArg() < 1 {
+		return usageError("%s: expected ROLE [%s...]", name, arg)
+	}
+	role, err := getRoleByName(ctx, store, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	ids, err := getRoleIDs(ctx, store, fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+	if err := set(role, ids); err != nil {
+		return roleError(err, role.Name)
+	}
+	if role, err = getRoleByName(ctx, store, role.Name); err != nil {
+		return err
+	}
+	return printRoles(ctx, store, out, []model.Role{*role})
+}
+
+// roleError explains the store errors of role changes.
+func roleError(err error, role string) error {
+	switch rc := model.AsRoleConflictError(err); {
+	case rc != nil:
+		return conflict("user %s would hold the exclusive roles %s", rc.Email, strings.Join(rc.Roles, " and "))
+	case err.Error() == "ROLE_CYCLE":
+		return conflict("role %s would include itself", role)
+	case err.Error() == "ROLE_EXCLUDES_ITSELF":
+		return usageError("role %s cannot exclude itself", role)
+	}
+	return err
+}
+
+func roleGrant(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	return changeUserRole(ctx, store, out, "role grant", args, true)
+}
+
+func roleRevoke(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	return changeUserRole(ctx, store, out, "role revoke", args, false)
+}
+
+func changeUserRole(ctx context.Context, store model.AppStore, out *output, name string, args []string, grant bool) error {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	var from, until *string
+	if grant {
+		from = fs.String("from", "", "start of the assignment, RFC 3339; immediately when empty")
+		until = fs.String("until", "", "end of the assignment, RFC 3339 or a duration such as 72h; unbounded when empty")
+	}
+	pos, err := parse(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	user, err := getUserByEmail(ctx, store, pos[0])
+	if err != nil {
+		return err
+	}
+	role, err := getRoleByName(ctx, store, pos[1])
+	if err != nil {
+		return err
+	}
+	if grant {
+		now := time.Now()
+		assignment := model.UserRole{UserID: user.ID, RoleID: role.ID}
+		if assignment.ValidFrom, err = parseValidity(*from, now); err != nil {
+			return usageError("invalid -from: %v", err)
+		}
+		if assignment.ValidUntil, err = parseValidity(*until, now); err != nil {
+			return usageError("invalid -until: %v", err)
+		}
+		if assignment.ValidFrom != nil && assignment.ValidUntil != nil && !assignment.ValidFrom.Before(*assignment.ValidUntil) {
+			return usageError("-from must be before -until")
+		}
+		// granting again replaces the validity window
+		if err := store.UserRole().Assign(ctx, assignment); err != nil {
+			return roleError(err, role.Name)
+		}
+	} else {
+		// a role not assigned is nothing to change; scripts may rerun the
+		// command
+		if err := store.UserRole().Remove(ctx, user.ID, role.ID); err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	if user, err = getUserByEmail(ctx, store, pos[0]); err != nil {
+		return err
+	}
+	return printUsers(ctx, store, out, []model.User{*user})
+}
+
+// parseValidity parses an RFC 3339 time or a duration from now; empty is nil.
+func parseValidity(s string, now time.Time) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		t := now.Add(d)
+		return &t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"example.com/app-api/model"
+	"github.com/stretchr/testify/assert"
+)
+
+// exitCode returns the exit code run reports for err.
+func exitCode(err error) int {
+	var cerr *cliError
+	if errors.As(err, &cerr) {
+		return cerr.code
+	}
+	if err != nil {
+		return exitError
+	}
+	return exitOK
+}
+
+func TestRoleCreate(t *testing.T) {
+	ctx := context.Background()
+	store := model.GetAppStore()
+	out := &output{json: true}
+
+	t.Run("Unknown privilege", func(t *testing.T) {
+		err := roleCreate(ctx, store, out, []string{"-name", "CliUnknown", "-privileges", `{"audit":{"read":true}}`})
+		assert.Equal(t, exitUsage, exitCode(err), err)
+		assert.ErrorContains(t, err, "unknown privilege audit:read")
+
+		_, err = store.Role().GetByName(ctx, "CliUnknown")
+		assert.True(t, isNotFound(err), "role must not be created")
+	})
+
+	t.Run("Unknown scope", func(t *testing.T) {
+		err := roleCreate(ctx, store, out, []string{"-name", "CliUnknown", "-privileges", `{"param":{"read":{"code":["a"]}}}`})
+		assert.Equal(t, exitUsage, exitCode(err), err)
+		assert.ErrorContains(t, err, "unknown scope param:read:code")
+	})
+
+	t.Run("Invalid value", func(t *testing.T) {
+		err := roleCreate(ctx, store, out, []string{"-name", "CliUnknown", "-privileges", `{"param":{"read":"yes"}}`})
+		assert.Equal(t, exitUsage, exitCode(err), err)
+	})
+
+	t.Run("Privileges of the hand-written handlers", func(t *testing.T) {
+		err := roleCreate(ctx, store, out, []string{"-name", "CliOperator", "-privileges",
+			`{"app_user":{"read":true,"impersonate":true},"param":{"read":{"groups":["cli"]},"approve":true}}`})
+		assert.NoError(t, err)
+
+		role, err := store.Role().GetByName(ctx, "CliOperator")
+		if assert.NoError(t, err) {
+			assert.Contains(t, role.Privileges, "impersonate")
+		}
+	})
+
+	t.Run("Existing role", func(t *testing.T) {
+		err := roleCreate(ctx, store, out, []string{"-name", "CliOperator"})
+		assert.Equal(t, exitConflict, exitCode(err), err)
+	})
+}
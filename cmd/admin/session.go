@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"example.com/app-api/model"
+	"example.com/app-api/util/jsql"
+)
+
+// sessionRevoke clears the refresh token and the shared secret of the user:
+// the session cannot be refreshed and signed requests fail right away.
+func sessionRevoke(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	fs := flag.NewFlagSet("session revoke", flag.ContinueOnError)
+	pos, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	user, err := getUserByEmail(ctx, store, pos[0])
+	if err != nil {
+		return err
+	}
+	user.Token = jsql.SecretValueNull()
+	user.Secret = jsql.SecretValueNull()
+	user.UpdatedAt = time.Now()
+	err = store.User().Update(ctx, *user, []model.UserField{
+		model.UserField_Token, model.UserField_Secret, model.UserField_UpdatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	user.Version++
+	return printUsers(ctx, store, out, []model.User{*user})
+}
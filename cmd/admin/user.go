@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/app-api/model"
+	"example.com/app-api/util/jsql"
+)
+
+type userRow struct {
+	ID        int64     `json:"id"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	Roles     []string  `json:"roles"`
+	Status    string    `json:"status"`
+	Session   bool      `json:"session"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func toUserRow(u model.User, status string) userRow {
+	row := userRow{
+		ID:        u.ID,
+		Email:     u.Email,
+		Name:      u.Name,
+		Roles:     []string{},
+		Status:    status,
+		Session:   u.Token.Valid && u.Token.String != "",
+		UpdatedAt: u.UpdatedAt,
+	}
+	for _, r := range u.Roles {
+		row.Roles = append(row.Roles, r.Name)
+	}
+	return row
+}
+
+func printUsers(ctx context.Context, store model.AppStore, out *output, users []model.User) error {
+	// the statuses of all users in one query
+	ids := make([]int64, 0, len(users))
+	for _, u := range users {
+		ids = append(ids, u.ID)
+	}
+	list, err := store.UserStatus().Find(ctx, ids)
+	if err != nil {
+		return err
+	}
+	statuses := make(map[int64]string, len(list))
+	for _, st := range list {
+		statuses[st.UserID] = st.Status
+	}
+	rows := make([]userRow, 0, len(users))
+	table := make([][]string, 0, len(users))
+	for _, u := range users {
+		row := toUserRow(u, statuses[u.ID])
+		rows = append(rows, row)
+		table = append(table, []string{
+			strconv.FormatInt(row.ID, 10), row.Email, row.Name,
+			strings.Join(row.Roles, ","), row.Status, strconv.FormatBool(row.Session),
+		})
+	}
+	return out.print(rows, []string{"ID", "EMAIL", "NAME", "ROLES", "STATUS", "SESSION"}, table)
+}
+
+// readPassword returns the -password flag or the first line of stdin.
+func readPassword(password string, stdin bool) (string, error) {
+	if stdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("read password from stdin: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		return "", usageError("a password is required (-password or -password-stdin)")
+	}
+	return password, nil
+}
+
+func getUserByEmail(ctx context.Context, store model.AppStore, email string) (*model.User, error) {
+	user, err := store.User().GetByEmail(ctx, email)
+	if isNotFound(err) || (err == nil && user == nil) {
+		return nil, notFound("user %s not found", email)
+	}
+	return user, err
+}
+
+func getRoleByName(ctx context.Context, store model.AppStore, name string) (*model.Role, error) {
+	role, err := store.Role().GetByName(ctx, name)
+	if isNotFound(err) || (err == nil && role == nil) {
+		return nil, notFound("role %s not found", name)
+	}
+	return role, err
+}
+
+func userCreate(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	fs := flag.NewFlagSet("user create", flag.ContinueOnError)
+	email := fs.String("email", "", "email of the user")
+	name := fs.String("name", "", "display name")
+	password := fs.String("password", "", "password; prefer -password-stdin")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin")
+	service := fs.Bool("service", false, "service account without an interactive login, see apikey create")
+	roles := fs.String("role", "", "comma separated role names")
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	if *email == "" {
+		return usageError("-email is required")
+	}
+	pw := rand.Text() + rand.Text()
+	if !*service {
+		var err error
+		if pw, err = readPassword(*password, *passwordStdin); err != nil {
+			return err
+		}
+	}
+	if _, err := store.User().GetByEmail(ctx, *email); err == nil {
+		return conflict("user %s already exists", *email)
+	} else if !isNotFound(err) {
+		return err
+	}
+	user := model.User{
+		Email:     *email,
+		Name:      *name,
+		Password:  jsql.SecretValue(pw),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	if user.Name == "" {
+		user.Name = *email
+	}
+	for _, rn := range strings.Split(*roles, ",") {
+		if rn = strings.TrimSpace(rn); rn == "" {
+			continue
+		}
+		role, err := getRoleByName(ctx, store, rn)
+		if err != nil {
+			return err
+		}
+		user.Roles = append(user.Roles, *role)
+	}
+	if err := store.UserRole().Conflicts(ctx, user); err != nil {
+		return roleError(err, "")
+	}
+	res, err := store.User().Create(ctx, user)
+	if err != nil {
+		return roleError(err, "")
+	}
+	res.Roles = user.Roles
+	return printUsers(ctx, store, out, []model.User{*res})
+}
+
+func userList(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	fs := flag.NewFlagSet("user list", flag.ContinueOnError)
+	email := fs.String("email", "", "email pattern, % matches any text")
+	limit := fs.Int("limit", 100, "maximum number of users")
+	offset := fs.Int64("offset", 0, "number of users to skip")
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+	var filter []model.UserFilter
+	if *email != "" {
+		value, _ := json.Marshal(*email)
+		filter = append(filter, model.UserFilter{Field: model.UserField_Email, Op: model.FilterOp_ILike, Value: value})
+	}
+	users, _, err := store.User().Find(ctx, filter, []model.UserSorting{{Field: model.UserField_ID, Dir: model.SortDir_ASC}}, *limit, *offset)
+	if err != nil {
+		return err
+	}
+	for i := range users {
+		// Find does not load the roles
+		if users[i].Roles == nil {
+			if u, err := store.User().Get(ctx, users[i].ID); err == nil {
+				users[i].Roles = u.Roles
+			}
+		}
+	}
+	return printUsers(ctx, store, out, users)
+}
+
+// userDisable disables or locks the user, which revokes its sessions and
+// refuses any later login. The user keeps its roles for when it is enabled.
+func userDisable(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	fs := flag.NewFlagSet("user disable", flag.ContinueOnError)
+	reason := fs.String("reason", "", "reason recorded with the status")
+	lock := fs.Bool("lock", false, "set the status to locked instead of disabled")
+	pos, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	status := model.UserStatusDisabled
+	if *lock {
+		status = model.UserStatusLocked
+	}
+	return userSetStatus(ctx, store, out, pos[0], status, *reason)
+}
+
+// userEnable makes a disabled or locked user active again.
+func userEnable(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	fs := flag.NewFlagSet("user enable", flag.ContinueOnError)
+	reason := fs.String("reason", "", "reason recorded with the status")
+	pos, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	return userSetStatus(ctx, store, out, pos[0], model.UserStatusActive, *reason)
+}
+
+func userSetStatus(ctx context.Context, store model.AppStore, out *output, email, status, reason string) error {
+	user, err := getUserByEmail(ctx, store, email)
+	if err != nil {
+		return err
+	}
+	err = store.UserStatus().Set(ctx, user.ID, status, reason, model.AuditActorSystem, time.Now())
+	if isNotFound(err) {
+		return notFound("user %s not found", email)
+	}
+	if err != nil {
+		return err
+	}
+	user, err = store.User().Get(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	return printUsers(ctx, store, out, []model.User{*user})
+}
+
+func userSetPassword(ctx context.Context, store model.AppStore, out *output, args []string) error {
+	fs := flag.NewFlagSet("user set-password", flag.ContinueOnError)
+	password := fs.String("password", "", "new password; prefer -password-stdin")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin")
+	pos, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	pw, err := readPassword(*password, *passwordStdin)
+	if err != nil {
+		return err
+	}
+	user, err := getUserByEmail(ctx, store, pos[0])
+	if err != nil {
+		return err
+	}
+	err = store.User().UpdatePassword(ctx, user.ID, user.Version, pw)
+	if err != nil && err.Error() == "NO_ROWS_AFFECTED" {
+		return errors.New("user was modified concurrently, retry")
+	}
+	if err != nil {
+		return err
+	}
+	return printUsers(ctx, store, out, []model.User{*user})
+}
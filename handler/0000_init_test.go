@@ -27,17 +27,29 @@ var (
 )
 
 func TestSetup(t *testing.T) {
-	store := model.GetStore()
+	store := model.GetAppStore()
 
 	api := http.NewServeMux()
+	apiStore := handler.APIStore(store)
 
-	handler.UserHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
-	handler.RoleHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
-	handler.ParamHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
+	handler.UserHandlerRegister(api, "/api/v1", apiStore, handler.BasicAuthenticate)
+	handler.UserStatusHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
+	handler.UserRoleHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
+	handler.RoleHandlerRegister(api, "/api/v1", apiStore, handler.BasicAuthenticate)
+	handler.RolePolicyHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
+	handler.ParamHandlerRegister(api, "/api/v1", apiStore, handler.BasicAuthenticate)
+	handler.ChangeRequestHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
 	handler.AuthHandlerRegister(api, store)
+	handler.MeHandlerRegister(api, "/api/v1", store)
+	// the resources of the fixtures, which the application checks outside
+	// of the handler package
+	for _, resource := range []string{"audit", "identity", "tcpgwAccess", "tcpgwAccessIP", "kaltimtara"} {
+		handler.RegisterPrivileges(resource, "create", "read", "update", "delete")
+	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/api/v1/", handler.Secure(store, api))
+	mux.Handle("/api/v1/", handler.Secure(store, handler.E2EEncryption(api)))
+	handler.WellKnownHandlerRegister(mux)
 
 	httpLog := handler.HTTPLogger(slog.Default(), handler.LoggerOptions{
 		LogRequestBody:  true,
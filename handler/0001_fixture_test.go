@@ -0,0 +1,102 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+	"example.com/app-api/util/jsql"
+	"github.com/stretchr/testify/assert"
+)
+
+// fixture creates the roles and users of a test under names unique to the
+// run, so the tests can share one database.
+type fixture struct {
+	t      *testing.T
+	ctx    context.Context
+	store  model.AppStore
+	suffix string
+}
+
+func newFixture(t *testing.T) *fixture {
+	return &fixture{
+		t:      t,
+		ctx:    context.Background(),
+		store:  model.GetAppStore(),
+		suffix: time.Now().Format("20060102150405.000"),
+	}
+}
+
+// name makes name unique to the run.
+func (f *fixture) name(name string) string {
+	return name + "-" + f.suffix
+}
+
+func (f *fixture) role(name, privileges string) model.Role {
+	role, err := f.store.Role().Create(f.ctx, model.Role{
+		Name:       f.name(name),
+		Privileges: privileges,
+		UpdatedBy:  "test",
+		UpdatedAt:  time.Now(),
+	})
+	if !assert.NoError(f.t, err) {
+		return model.Role{}
+	}
+	return *role
+}
+
+// user creates a user created by the admin, with the password secret123 and
+// an email made unique from name.
+func (f *fixture) user(name string, roles ...model.Role) model.User {
+	user, err := f.store.User().Create(f.ctx, model.User{
+		Email:     f.name(name) + "@demo.com",
+		Name:      name,
+		Password:  jsql.SecretValue("secret123"),
+		Roles:     roles,
+		CreatedBy: &model.UserRef{ID: 1},
+		CreatedAt: time.Now(),
+		UpdatedBy: &model.UserRef{ID: 1},
+		UpdatedAt: time.Now(),
+	})
+	if !assert.NoError(f.t, err) {
+		return model.User{}
+	}
+	return *user
+}
+
+// userWith creates a user holding a role of the same name with privileges.
+func (f *fixture) userWith(name, privileges string) model.User {
+	return f.user(name, f.role(name, privileges))
+}
+
+// send makes a request with the session of the last login, signed with its
+// shared secret, and returns the status and the body of the response. A
+// body other than nil or []byte is sent as JSON.
+func (f *fixture) send(method, url string, body any) (int, []byte) {
+	var bb []byte
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		bb = b
+	default:
+		bb, _ = json.Marshal(b)
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(bb))
+	assert.NoError(f.t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	util.SetSignedHMAC(req, bb, shared, "Content-Type")
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(f.t, err) {
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	bb, _ = io.ReadAll(resp.Body)
+	return resp.StatusCode, bb
+}
@@ -192,6 +192,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, nil, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -252,6 +253,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, nil, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -294,9 +296,8 @@ func TestUserCrudApi(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPut, "http://localhost:8080/api/v1/role", bytes.NewReader(body))
 		assert.NoError(t, err)
-		util.SetHMAC(req, body, shared)
-
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -330,9 +331,8 @@ func TestUserCrudApi(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPut, "http://localhost:8080/api/v1/role", bytes.NewReader(body))
 		assert.NoError(t, err)
-		util.SetHMAC(req, body, shared)
-
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -354,6 +354,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, nil, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -395,9 +396,8 @@ func TestUserCrudApi(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPatch, "http://localhost:8080/api/v1/user/1", bytes.NewReader(body))
 		assert.NoError(t, err)
-		util.SetHMAC(req, body, shared)
-
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -420,6 +420,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, nil, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -443,6 +444,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, nil, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -479,9 +481,8 @@ func TestUserCrudApi(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPut, "http://localhost:8080/api/v1/user", bytes.NewReader(body))
 		assert.NoError(t, err)
-		util.SetHMAC(req, body, shared)
-
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -502,6 +503,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, nil, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -622,6 +624,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -661,6 +664,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -701,6 +705,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -751,6 +756,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -796,6 +802,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -845,6 +852,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -894,6 +902,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -943,6 +952,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -994,6 +1004,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -1047,6 +1058,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
@@ -1105,6 +1117,7 @@ func TestUserCrudApi(t *testing.T) {
 		assert.NoError(t, err)
 
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 		resp, err := http.DefaultClient.Do(req)
 		assert.NoError(t, err)
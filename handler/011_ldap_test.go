@@ -0,0 +1,299 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+	"example.com/app-api/util/jsql"
+	"github.com/jimlambrt/gldap"
+	"github.com/stretchr/testify/assert"
+)
+
+type ldapEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// ldapDirectory is a minimal in-process LDAP server answering simple binds and
+// equality searches on a single attribute.
+type ldapDirectory struct {
+	mu      sync.Mutex
+	entries []*ldapEntry
+}
+
+var ldapFilterRe = regexp.MustCompile(`^\(([A-Za-z]+)=([^()*]*)\)$`)
+
+func (d *ldapDirectory) entry(dn string) *ldapEntry {
+	for _, e := range d.entries {
+		if strings.EqualFold(e.dn, dn) {
+			return e
+		}
+	}
+	return nil
+}
+
+func (d *ldapDirectory) bind(w *gldap.ResponseWriter, r *gldap.Request) {
+	resp := r.NewBindResponse(gldap.WithResponseCode(gldap.ResultInvalidCredentials))
+	defer func() { _ = w.Write(resp) }()
+	m, err := r.GetSimpleBindMessage()
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e := d.entry(m.UserName); e != nil && m.Password != "" && string(m.Password) == e.password {
+		resp.SetResultCode(gldap.ResultSuccess)
+	}
+}
+
+func (d *ldapDirectory) search(w *gldap.ResponseWriter, r *gldap.Request) {
+	resp := r.NewSearchDoneResponse(gldap.WithResponseCode(gldap.ResultNoSuchObject))
+	defer func() { _ = w.Write(resp) }()
+	m, err := r.GetSearchMessage()
+	if err != nil {
+		return
+	}
+	match := ldapFilterRe.FindStringSubmatch(m.Filter)
+	if match == nil {
+		resp.SetResultCode(gldap.ResultUnwillingToPerform)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range d.entries {
+		if !strings.HasSuffix(strings.ToLower(e.dn), strings.ToLower(m.BaseDN)) {
+			continue
+		}
+		for _, v := range e.attrs[match[1]] {
+			if strings.EqualFold(v, match[2]) {
+				_ = w.Write(r.NewSearchResponseEntry(e.dn, gldap.WithAttributes(e.attrs)))
+				break
+			}
+		}
+	}
+	resp.SetResultCode(gldap.ResultSuccess)
+}
+
+func TestLdap(t *testing.T) {
+	store := model.GetAppStore()
+	ctx := context.Background()
+
+	alice := &ldapEntry{
+		dn:       "uid=alice,ou=people,dc=example,dc=org",
+		password: "alice-ldap-pass",
+		attrs: map[string][]string{
+			"mail":     {"alice@example.org"},
+			"cn":       {"Alice Ldap"},
+			"memberOf": {"cn=admins,ou=groups,dc=example,dc=org"},
+		},
+	}
+	dir := &ldapDirectory{entries: []*ldapEntry{
+		{dn: "cn=service,dc=example,dc=org", password: "service-pass"},
+		alice,
+		{
+			dn:       "uid=bob,ou=people,dc=example,dc=org",
+			password: "bob-ldap-pass",
+			attrs: map[string][]string{
+				"mail": {"bob@example.org"},
+				"cn":   {"Bob Ldap"},
+			},
+		},
+		{
+			dn:       "uid=admin,ou=people,dc=example,dc=org",
+			password: "admin-ldap-pass",
+			attrs: map[string][]string{
+				"mail": {"admin@demo.com"},
+				"cn":   {"Admin Ldap"},
+			},
+		},
+	}}
+
+	srv, err := gldap.NewServer()
+	assert.NoError(t, err)
+	mux, err := gldap.NewMux()
+	assert.NoError(t, err)
+	assert.NoError(t, mux.Bind(dir.bind))
+	assert.NoError(t, mux.Search(dir.search))
+	assert.NoError(t, srv.Router(mux))
+	go func() { _ = srv.Run("127.0.0.1:10389") }()
+	defer srv.Stop()
+	for i := 0; i < 50 && !srv.Ready(); i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	handler.SetAuthenticators(handler.LocalAuthenticator{}, &handler.LDAPAuthenticator{
+		URL:          "ldap://127.0.0.1:10389",
+		BindDN:       "cn=service,dc=example,dc=org",
+		BindPassword: "service-pass",
+		BaseDN:       "ou=people,dc=example,dc=org",
+		UserFilter:   "(mail=%s)",
+		Timeout:      5 * time.Second,
+		Rules: []handler.LDAPRoleRule{
+			{Group: "^cn=admins,ou=groups,", Role: "Admin"},
+			{Group: "^cn=staff,ou=groups,", Role: "Staf"},
+		},
+	})
+	defer handler.SetAuthenticators(handler.LocalAuthenticator{})
+
+	roleNames := func(user *model.User) []string {
+		names := []string{}
+		for _, r := range user.Roles {
+			names = append(names, r.Name)
+		}
+		return names
+	}
+
+	t.Run("Invalid ldap password", func(t *testing.T) {
+		status, _ := authLoginStatus(t, "alice@example.org", "wrong")
+		assert.Equal(t, http.StatusBadRequest, status)
+
+		_, err := store.User().GetByEmail(ctx, "alice@example.org")
+		assert.Error(t, err, "user must not be provisioned on failed login")
+	})
+
+	t.Run("Unknown user", func(t *testing.T) {
+		status, _ := authLoginStatus(t, "nobody@example.org", "alice-ldap-pass")
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("First login provisions user", func(t *testing.T) {
+		status, res := authLoginStatus(t, "alice@example.org", "alice-ldap-pass")
+		assert.Equal(t, http.StatusOK, status)
+		assert.NotEmpty(t, res.Token)
+		token = res.Token
+
+		user, err := store.User().GetByEmail(ctx, "alice@example.org")
+		assert.NoError(t, err)
+		assert.Equal(t, "Alice Ldap", user.Name)
+		assert.Equal(t, []string{"Admin"}, roleNames(user))
+
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:8080/api/v1/role/1", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Local password is not set", func(t *testing.T) {
+		handler.SetAuthenticators(handler.LocalAuthenticator{})
+		status, _ := authLoginStatus(t, "alice@example.org", "alice-ldap-pass")
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("Group change syncs managed roles only", func(t *testing.T) {
+		handler.SetAuthenticators(handler.LocalAuthenticator{}, &handler.LDAPAuthenticator{
+			URL:        "ldap://127.0.0.1:10389",
+			BaseDN:     "ou=people,dc=example,dc=org",
+			UserFilter: "(mail=%s)",
+			Timeout:    5 * time.Second,
+			Rules: []handler.LDAPRoleRule{
+				{Group: "^cn=admins,ou=groups,", Role: "Admin"},
+				{Group: "^cn=staff,ou=groups,", Role: "Staf"},
+			},
+		})
+
+		user, err := store.User().GetByEmail(ctx, "alice@example.org")
+		assert.NoError(t, err)
+		opr, err := store.Role().GetByName(ctx, "Opr")
+		assert.NoError(t, err)
+		user.Roles = append(user.Roles, *opr)
+		assert.NoError(t, store.User().Update(ctx, *user, []model.UserField{model.UserField_Roles}))
+
+		dir.mu.Lock()
+		alice.attrs["memberOf"] = []string{"cn=staff,ou=groups,dc=example,dc=org"}
+		dir.mu.Unlock()
+
+		status, _ := authLoginStatus(t, "alice@example.org", "alice-ldap-pass")
+		assert.Equal(t, http.StatusOK, status)
+
+		user, err = store.User().GetByEmail(ctx, "alice@example.org")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"Opr", "Staf"}, roleNames(user))
+	})
+
+	t.Run("Local user is not taken over by ldap", func(t *testing.T) {
+		status, _ := authLoginStatus(t, "admin@demo.com", "admin-ldap-pass")
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("User of another source is not taken over by ldap", func(t *testing.T) {
+		now := time.Now()
+		bob, err := store.User().Create(ctx, model.User{
+			Email:     "bob@example.org",
+			Name:      "Bob Oidc",
+			Password:  jsql.SecretValueNull(),
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, store.UserSource().Set(ctx, bob.ID, model.UserSourceOIDC))
+
+		status, _ := authLoginStatus(t, "bob@example.org", "bob-ldap-pass")
+		assert.Equal(t, http.StatusBadRequest, status)
+
+		assert.NoError(t, store.UserSource().Set(ctx, bob.ID, model.UserSourceLDAP))
+		status, _ = authLoginStatus(t, "bob@example.org", "bob-ldap-pass")
+		assert.Equal(t, http.StatusOK, status, "a user linked to the directory binds")
+	})
+
+	t.Run("Local user still authenticates", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+	})
+}
+
+func authLoginStatus(t *testing.T, email, password string) (int, handler.LoginObject) {
+	lreq := handler.LoginObject{
+		Email:     email,
+		PublicKey: pubKey,
+	}
+	body, _ := json.Marshal(lreq)
+	req, err := http.NewRequest(http.MethodPut, "http://localhost:8080/api/v1/auth", bytes.NewReader(body))
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	bb, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(bb, &lreq), string(bb))
+
+	spub, err := util.DecodePubKey(lreq.PublicKey)
+	assert.NoError(t, err)
+	lshared, err := sPriv.ECDH(spub)
+	assert.NoError(t, err)
+
+	lreq = handler.LoginObject{
+		Email:     email,
+		PublicKey: pubKey,
+		Password:  password,
+	}
+	body, _ = json.Marshal(lreq)
+	req, err = http.NewRequest(http.MethodPut, "http://localhost:8080/api/v1/auth", bytes.NewReader(body))
+	assert.NoError(t, err)
+	util.SetHMAC(req, body, lshared)
+	resp2, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp2.Body.Close()
+	bb, err = io.ReadAll(resp2.Body)
+	assert.NoError(t, err)
+
+	var res handler.LoginObject
+	if resp2.StatusCode == http.StatusOK {
+		assert.NoError(t, json.Unmarshal(bb, &res), string(bb))
+		shared = lshared
+	}
+	return resp2.StatusCode, res
+}
@@ -0,0 +1,176 @@
+package handler_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSMTP is a minimal in-process SMTP server that captures every message.
+type fakeSMTP struct {
+	ln   net.Listener
+	msgs chan string
+}
+
+func startFakeSMTP(t *testing.T) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	f := &fakeSMTP{ln: ln, msgs: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	fmt.Fprint(conn, "220 localhost fake smtp\r\n")
+	for {
+		ln, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(ln))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			fmt.Fprint(conn, "250 localhost\r\n")
+		case strings.HasPrefix(cmd, "DATA"):
+			fmt.Fprint(conn, "354 end with .\r\n")
+			var data strings.Builder
+			for {
+				dl, err := rd.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dl == ".\r\n" {
+					break
+				}
+				data.WriteString(dl)
+			}
+			f.msgs <- data.String()
+			fmt.Fprint(conn, "250 ok\r\n")
+		case strings.HasPrefix(cmd, "QUIT"):
+			fmt.Fprint(conn, "221 bye\r\n")
+			return
+		default:
+			fmt.Fprint(conn, "250 ok\r\n")
+		}
+	}
+}
+
+func (f *fakeSMTP) wait(t *testing.T) string {
+	select {
+	case msg := <-f.msgs:
+		return msg
+	case <-time.After(10 * time.Second):
+		t.Fatal("no mail received")
+	}
+	return ""
+}
+
+func TestPasswordReset(t *testing.T) {
+	smtpd := startFakeSMTP(t)
+	defer smtpd.ln.Close()
+	handler.SetMailer(&util.SMTPMailer{Addr: smtpd.ln.Addr().String(), From: "no-reply@demo.com"})
+
+	post := func(method string, body any) (int, string) {
+		bb, _ := json.Marshal(body)
+		req, err := http.NewRequest(method, "http://localhost:8080/api/v1/auth/reset", bytes.NewReader(bb))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		rb, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, string(rb)
+	}
+
+	var resetToken string
+
+	t.Run("Request reset unknown email", func(t *testing.T) {
+		status, body := post(http.MethodPost, handler.PasswordResetRequest{Email: "nobody@demo.com"})
+		assert.Equal(t, http.StatusOK, status, body)
+		select {
+		case <-smtpd.msgs:
+			t.Fatal("no mail must be sent for unknown email")
+		case <-time.After(1 * time.Second):
+		}
+	})
+
+	t.Run("Request reset", func(t *testing.T) {
+		status, body := post(http.MethodPost, handler.PasswordResetRequest{Email: "opr1@demo.com"})
+		assert.Equal(t, http.StatusOK, status, body)
+		msg := smtpd.wait(t)
+		assert.Contains(t, msg, "To: opr1@demo.com")
+		m := regexp.MustCompile(`token=([^\s]+)`).FindStringSubmatch(msg)
+		if assert.Len(t, m, 2) {
+			resetToken, _ = url.QueryUnescape(m[1])
+		}
+	})
+
+	t.Run("Confirm reset wrong token", func(t *testing.T) {
+		status, body := post(http.MethodPut, handler.PasswordResetConfirm{Token: "wrong", Password: "opr1pass"})
+		assert.Equal(t, http.StatusBadRequest, status, body)
+		assert.Contains(t, body, "invalid_token")
+	})
+
+	t.Run("Confirm reset", func(t *testing.T) {
+		status, body := post(http.MethodPut, handler.PasswordResetConfirm{Token: resetToken, Password: "opr1pass"})
+		assert.Equal(t, http.StatusOK, status, body)
+	})
+
+	t.Run("Confirm reset token reuse", func(t *testing.T) {
+		status, body := post(http.MethodPut, handler.PasswordResetConfirm{Token: resetToken, Password: "other"})
+		assert.Equal(t, http.StatusBadRequest, status, body)
+	})
+
+	t.Run("Login with new password", func(t *testing.T) {
+		lreq := authLogin(t, "opr1@demo.com", "opr1pass")
+		assert.NotEmpty(t, lreq.Token)
+		authLogin(t, "admin@demo.com", "admin123")
+	})
+
+	t.Run("Request reset throttled per email", func(t *testing.T) {
+		max := handler.RESET_MAX_PER_EMAIL
+		handler.RESET_MAX_PER_EMAIL = 1
+		defer func() { handler.RESET_MAX_PER_EMAIL = max }()
+		// the token of "Request reset" is within the window
+		status, body := post(http.MethodPost, handler.PasswordResetRequest{Email: "opr1@demo.com"})
+		assert.Equal(t, http.StatusOK, status, body)
+		select {
+		case <-smtpd.msgs:
+			t.Fatal("no mail must be sent beyond RESET_MAX_PER_EMAIL")
+		case <-time.After(1 * time.Second):
+		}
+	})
+
+	t.Run("Request reset throttled per client", func(t *testing.T) {
+		max := handler.RESET_MAX_PER_IP
+		handler.RESET_MAX_PER_IP = 0
+		defer func() { handler.RESET_MAX_PER_IP = max }()
+		status, body := post(http.MethodPost, handler.PasswordResetRequest{Email: "nobody@demo.com"})
+		assert.Equal(t, http.StatusTooManyRequests, status, body)
+		assert.Contains(t, body, "too_many_requests")
+	})
+}
@@ -0,0 +1,251 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMfa(t *testing.T) {
+	var secret string
+	var recoveryCodes []string
+	var mfaToken string
+
+	call := func(t *testing.T, method, url string, body any, sign bool) (int, []byte) {
+		var bb []byte
+		if body != nil {
+			bb, _ = json.Marshal(body)
+		}
+		req, err := http.NewRequest(method, url, bytes.NewReader(bb))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if sign {
+			util.SetSignedHMAC(req, bb, shared, "Content-Type")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		rb, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp.StatusCode, rb
+	}
+
+	t.Run("Require mfa for role Opr", func(t *testing.T) {
+		setRoleMfa(t, 2, true)
+
+		status, body := call(t, http.MethodGet, "http://localhost:8080/api/v1/user/1", nil, false)
+		assert.Equal(t, http.StatusForbidden, status, string(body))
+		assert.Contains(t, string(body), "mfa_required")
+	})
+
+	t.Run("Require mfa for the auth endpoints but enrollment", func(t *testing.T) {
+		for _, path := range []string{"/auth", "/auth/privileges", "/auth/explain?resource=app_user&action=read"} {
+			status, body := call(t, http.MethodGet, "http://localhost:8080/api/v1"+path, nil, false)
+			assert.Equal(t, http.StatusForbidden, status, path, string(body))
+			assert.Contains(t, string(body), "mfa_required", path)
+		}
+	})
+
+	t.Run("Enroll totp unsigned", func(t *testing.T) {
+		status, body := call(t, http.MethodPost, "http://localhost:8080/api/v1/auth/totp", nil, false)
+		assert.Equal(t, http.StatusForbidden, status, string(body))
+	})
+
+	t.Run("Enroll totp", func(t *testing.T) {
+		status, body := call(t, http.MethodPost, "http://localhost:8080/api/v1/auth/totp", nil, true)
+		assert.Equal(t, http.StatusOK, status, string(body))
+
+		var res handler.TotpEnrollment
+		assert.NoError(t, json.Unmarshal(body, &res))
+		assert.NotEmpty(t, res.Secret)
+		assert.True(t, strings.HasPrefix(res.OtpauthURI, "otpauth://totp/"), res.OtpauthURI)
+		secret = res.Secret
+	})
+
+	t.Run("Confirm totp wrong code", func(t *testing.T) {
+		status, body := call(t, http.MethodPut, "http://localhost:8080/api/v1/auth/totp", handler.TotpCode{Code: "000000"}, true)
+		assert.Equal(t, http.StatusBadRequest, status, string(body))
+	})
+
+	t.Run("Confirm totp", func(t *testing.T) {
+		code, err := util.TOTPCode(secret, util.TOTPStep(time.Now()))
+		assert.NoError(t, err)
+		status, body := call(t, http.MethodPut, "http://localhost:8080/api/v1/auth/totp", handler.TotpCode{Code: code}, true)
+		assert.Equal(t, http.StatusOK, status, string(body))
+
+		var res handler.TotpRecoveryCodes
+		assert.NoError(t, json.Unmarshal(body, &res))
+		assert.Len(t, res.RecoveryCodes, 10)
+		recoveryCodes = res.RecoveryCodes
+	})
+
+	t.Run("Enroll totp over a confirmed secret", func(t *testing.T) {
+		status, body := call(t, http.MethodPost, "http://localhost:8080/api/v1/auth/totp", nil, true)
+		assert.Equal(t, http.StatusBadRequest, status, string(body))
+		assert.Contains(t, string(body), "mfa_already_enabled")
+	})
+
+	t.Run("Login requires second step", func(t *testing.T) {
+		lreq := authLoginStep1(t, "admin@demo.com", "admin123")
+		assert.True(t, lreq.MfaRequired)
+		assert.Empty(t, lreq.Token)
+		assert.NotEmpty(t, lreq.MfaToken)
+		mfaToken = lreq.MfaToken
+
+		_, err := handler.ParseToken(mfaToken)
+		assert.Error(t, err, "mfa token must not be accepted as session token")
+	})
+
+	mfaStep := func(t *testing.T, code string) (int, handler.LoginObject) {
+		lreq := handler.LoginObject{Email: "admin@demo.com", MfaToken: mfaToken, Code: code}
+		body, _ := json.Marshal(lreq)
+		req, err := http.NewRequest(http.MethodPut, "http://localhost:8080/api/v1/auth/mfa", bytes.NewReader(body))
+		assert.NoError(t, err)
+		util.SetHMAC(req, body, shared)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		bb, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		var res handler.LoginObject
+		if resp.StatusCode == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(bb, &res), string(bb))
+		}
+		return resp.StatusCode, res
+	}
+
+	t.Run("Second step wrong code", func(t *testing.T) {
+		status, _ := mfaStep(t, "123456")
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("Second step recovery code", func(t *testing.T) {
+		status, res := mfaStep(t, recoveryCodes[0])
+		assert.Equal(t, http.StatusOK, status)
+		assert.NotEmpty(t, res.Token)
+		token = res.Token
+		refreshToken = res.RefreshToken
+
+		status, body := call(t, http.MethodGet, "http://localhost:8080/api/v1/user/1", nil, true)
+		assert.Equal(t, http.StatusOK, status, string(body))
+	})
+
+	t.Run("Second step recovery code reuse", func(t *testing.T) {
+		status, _ := mfaStep(t, recoveryCodes[0])
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("Second step locked after failed attempts", func(t *testing.T) {
+		ctx := context.Background()
+		store := model.GetAppStore()
+		user, err := store.User().GetByEmail(ctx, "admin@demo.com")
+		if !assert.NoError(t, err) {
+			return
+		}
+		for i := 0; i < handler.MFA_MAX_ATTEMPTS; i++ {
+			status, _ := mfaStep(t, "123456")
+			assert.Equal(t, http.StatusBadRequest, status)
+		}
+		mfa, err := store.UserMfa().Get(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, handler.MFA_MAX_ATTEMPTS, mfa.FailedAttempts)
+
+		status, _ := mfaStep(t, recoveryCodes[2])
+		assert.Equal(t, http.StatusBadRequest, status, "valid code must be rejected while locked")
+
+		assert.NoError(t, store.UserMfa().ResetAttempts(ctx, user.ID))
+		status, res := mfaStep(t, recoveryCodes[2])
+		assert.Equal(t, http.StatusOK, status)
+		token = res.Token
+		refreshToken = res.RefreshToken
+	})
+
+	t.Run("Disable totp while required", func(t *testing.T) {
+		status, body := call(t, http.MethodDelete, "http://localhost:8080/api/v1/auth/totp", handler.TotpCode{Code: recoveryCodes[1]}, true)
+		assert.Equal(t, http.StatusBadRequest, status, string(body))
+	})
+
+	t.Run("Disable totp", func(t *testing.T) {
+		setRoleMfa(t, 2, false)
+
+		status, body := call(t, http.MethodDelete, "http://localhost:8080/api/v1/auth/totp", handler.TotpCode{Code: recoveryCodes[1]}, true)
+		assert.Equal(t, http.StatusOK, status, string(body))
+
+		authLogin(t, "admin@demo.com", "admin123")
+	})
+}
+
+func setRoleMfa(t *testing.T, roleID int64, required bool) {
+	ctx := context.Background()
+	store := model.GetAppStore()
+	policy, err := store.RolePolicy().Get(ctx, roleID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	policy.MfaRequired = required
+	err = store.RolePolicy().Update(ctx, *policy, []model.RolePolicyField{model.RolePolicyField_MfaRequired})
+	assert.NoError(t, err)
+}
+
+func authLoginStep1(t *testing.T, email, password string) handler.LoginObject {
+	lreq := handler.LoginObject{
+		Email:     email,
+		PublicKey: pubKey,
+	}
+	body, _ := json.Marshal(lreq)
+
+	req, err := http.NewRequest(http.MethodPut, "http://localhost:8080/api/v1/auth", bytes.NewReader(body))
+	assert.NoError(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	bb, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, fmt.Sprintf("Invalid response: %s", string(bb)))
+
+	err = json.Unmarshal(bb, &lreq)
+	assert.NoError(t, err, fmt.Sprintf("Invalid response: %s", string(bb)))
+
+	spub, err := util.DecodePubKey(lreq.PublicKey)
+	assert.NoError(t, err)
+
+	shared, err = sPriv.ECDH(spub)
+	assert.NoError(t, err)
+
+	lreq = handler.LoginObject{
+		Email:     email,
+		PublicKey: pubKey,
+		Password:  password,
+	}
+	body, _ = json.Marshal(lreq)
+
+	req, err = http.NewRequest(http.MethodPut, "http://localhost:8080/api/v1/auth", bytes.NewReader(body))
+	assert.NoError(t, err)
+	util.SetHMAC(req, body, shared)
+
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	bb, err = io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, fmt.Sprintf("Invalid response: %s", string(bb)))
+
+	err = json.Unmarshal(bb, &lreq)
+	assert.NoError(t, err, fmt.Sprintf("Invalid response: %s", string(bb)))
+	return lreq
+}
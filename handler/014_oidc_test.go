@@ -0,0 +1,368 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockAuthCode struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+}
+
+// mockIdP is an OpenID Connect provider that authorizes the configured
+// identity without user interaction.
+type mockIdP struct {
+	srv          *httptest.Server
+	key          *ecdsa.PrivateKey
+	clientID     string
+	clientSecret string
+
+	mu            sync.Mutex
+	codes         map[string]mockAuthCode
+	email         string
+	emailVerified any // nil leaves the claim out
+	name          string
+	groups        []string
+	audience      string
+}
+
+func newMockIdP(t *testing.T, clientID, clientSecret string) *mockIdP {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	idp := &mockIdP{
+		key:          key,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		codes:        map[string]mockAuthCode{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("GET /authorize", idp.authorize)
+	mux.HandleFunc("POST /token", idp.token)
+	mux.HandleFunc("GET /jwks", idp.jwks)
+	idp.srv = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *mockIdP) identity(email, name string, verified any, groups ...string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.email, idp.name, idp.emailVerified, idp.groups = email, name, verified, groups
+	idp.audience = ""
+}
+
+func (idp *mockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 idp.srv.URL,
+		"authorization_endpoint": idp.srv.URL + "/authorize",
+		"token_endpoint":         idp.srv.URL + "/token",
+		"jwks_uri":               idp.srv.URL + "/jwks",
+	})
+}
+
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != idp.clientID ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	code := rand.Text()
+	idp.mu.Lock()
+	idp.codes[code] = mockAuthCode{
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		redirectURI: q.Get("redirect_uri"),
+	}
+	idp.mu.Unlock()
+	redirect, _ := url.Parse(q.Get("redirect_uri"))
+	rq := redirect.Query()
+	rq.Set("code", code)
+	rq.Set("state", q.Get("state"))
+	redirect.RawQuery = rq.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+	if id, secret, ok := r.BasicAuth(); !ok || id != idp.clientID || secret != idp.clientSecret {
+		tokenError("invalid_client")
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError("invalid_request")
+		return
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	ac, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	if !ok || ac.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError("invalid_grant")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != ac.challenge {
+		tokenError("invalid_grant")
+		return
+	}
+	aud := idp.clientID
+	if idp.audience != "" {
+		aud = idp.audience
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":    idp.srv.URL,
+		"sub":    "sub-" + idp.email,
+		"aud":    aud,
+		"iat":    now.Unix(),
+		"exp":    now.Add(5 * time.Minute).Unix(),
+		"nonce":  ac.nonce,
+		"email":  idp.email,
+		"name":   idp.name,
+		"groups": idp.groups,
+	}
+	if idp.emailVerified != nil {
+		claims["email_verified"] = idp.emailVerified
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	tok.Header["kid"] = "mock-1"
+	idToken, err := tok.SignedString(idp.key)
+	if err != nil {
+		tokenError("server_error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"access_token": rand.Text(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (idp *mockIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	pub, _ := idp.key.PublicKey.ECDH()
+	point := pub.Bytes()
+	_ = json.NewEncoder(w).Encode(util.JWKSet{Keys: []util.JWK{{
+		Kty: "EC",
+		Kid: "mock-1",
+		Use: "sig",
+		Alg: "ES256",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(point[1:33]),
+		Y:   base64.RawURLEncoding.EncodeToString(point[33:]),
+	}}})
+}
+
+func TestOidc(t *testing.T) {
+	store := model.GetAppStore()
+	ctx := context.Background()
+
+	idp := newMockIdP(t, "app-api", "app-secret")
+	defer idp.srv.Close()
+
+	browser := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	start := func(t *testing.T) (int, handler.OidcAuthorization, []byte) {
+		body, _ := json.Marshal(handler.OidcLoginRequest{PublicKey: pubKey})
+		resp, err := http.Post("http://localhost:8080/api/v1/auth/oidc", "application/json", bytes.NewReader(body))
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		var res handler.OidcAuthorization
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, res, nil
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		spub, err := util.DecodePubKey(res.PublicKey)
+		assert.NoError(t, err)
+		oshared, err := sPriv.ECDH(spub)
+		assert.NoError(t, err)
+		return resp.StatusCode, res, oshared
+	}
+
+	authorize := func(t *testing.T, authURL string) (string, string) {
+		resp, err := browser.Get(authURL)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+		loc, err := url.Parse(resp.Header.Get("Location"))
+		assert.NoError(t, err)
+		assert.Equal(t, "/oidc/callback", loc.Path)
+		return loc.Query().Get("state"), loc.Query().Get("code")
+	}
+
+	finish := func(t *testing.T, oshared []byte, state, code string) (int, handler.LoginObject, string) {
+		body, _ := json.Marshal(handler.OidcLoginRequest{State: state, Code: code})
+		req, err := http.NewRequest(http.MethodPut, "http://localhost:8080/api/v1/auth/oidc", bytes.NewReader(body))
+		assert.NoError(t, err)
+		util.SetHMAC(req, body, oshared)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		bb, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		var res handler.LoginObject
+		if resp.StatusCode == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(bb, &res), string(bb))
+		}
+		return resp.StatusCode, res, string(bb)
+	}
+
+	t.Run("Disabled without provider", func(t *testing.T) {
+		status, _, _ := start(t)
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	handler.SetOIDCProvider(&handler.OIDCProvider{
+		Issuer:       idp.srv.URL,
+		ClientID:     "app-api",
+		ClientSecret: "app-secret",
+		RedirectURL:  "http://localhost:3000/oidc/callback",
+		RoleClaim:    "groups",
+		Rules: []handler.OIDCRoleRule{
+			{Value: "^app-admins$", Role: "Admin"},
+		},
+		Provision: true,
+	})
+	defer handler.SetOIDCProvider(nil)
+
+	var lastState, lastCode string
+	var lastShared []byte
+
+	t.Run("First login provisions user", func(t *testing.T) {
+		idp.identity("dave@example.org", "Dave Sso", true, "app-admins", "everyone")
+		status, authz, oshared := start(t)
+		assert.Equal(t, http.StatusOK, status)
+		u, err := url.Parse(authz.AuthorizationURL)
+		assert.NoError(t, err)
+		assert.Equal(t, "S256", u.Query().Get("code_challenge_method"))
+		assert.NotEmpty(t, u.Query().Get("nonce"))
+
+		state, code := authorize(t, authz.AuthorizationURL)
+		assert.Equal(t, authz.State, state)
+
+		status, res, body := finish(t, oshared, state, code)
+		assert.Equal(t, http.StatusOK, status, body)
+		assert.NotEmpty(t, res.Token)
+		assert.NotEmpty(t, res.RefreshToken)
+		lastState, lastCode, lastShared = state, code, oshared
+
+		claim, err := handler.ParseToken(res.Token)
+		assert.NoError(t, err)
+		assert.Equal(t, "dave@example.org", claim.Subject)
+
+		user, err := store.User().GetByEmail(ctx, "dave@example.org")
+		assert.NoError(t, err)
+		assert.Equal(t, "Dave Sso", user.Name)
+		assert.Len(t, user.Roles, 1)
+		assert.Equal(t, "Admin", user.Roles[0].Name)
+
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:8080/api/v1/role/1", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+res.Token)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("State cannot be replayed", func(t *testing.T) {
+		status, _, body := finish(t, lastShared, lastState, lastCode)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Contains(t, body, "invalid_state")
+	})
+
+	t.Run("Request must be signed with the login key", func(t *testing.T) {
+		status, authz, _ := start(t)
+		assert.Equal(t, http.StatusOK, status)
+		state, code := authorize(t, authz.AuthorizationURL)
+		status, _, _ = finish(t, []byte("not-the-shared-secret"), state, code)
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("Wrong audience is rejected", func(t *testing.T) {
+		idp.identity("dave@example.org", "Dave Sso", true, "app-admins")
+		idp.mu.Lock()
+		idp.audience = "another-client"
+		idp.mu.Unlock()
+		status, authz, oshared := start(t)
+		assert.Equal(t, http.StatusOK, status)
+		state, code := authorize(t, authz.AuthorizationURL)
+		status, _, body := finish(t, oshared, state, code)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Contains(t, body, "invalid_id_token")
+	})
+
+	t.Run("Unverified email is rejected", func(t *testing.T) {
+		idp.identity("eve@example.org", "Eve", false)
+		status, authz, oshared := start(t)
+		assert.Equal(t, http.StatusOK, status)
+		state, code := authorize(t, authz.AuthorizationURL)
+		status, _, body := finish(t, oshared, state, code)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Contains(t, body, "email_not_verified")
+
+		_, err := store.User().GetByEmail(ctx, "eve@example.org")
+		assert.Error(t, err)
+	})
+
+	t.Run("Missing email_verified is rejected", func(t *testing.T) {
+		idp.identity("staff@demo.com", "Staff", nil)
+		status, authz, oshared := start(t)
+		assert.Equal(t, http.StatusOK, status)
+		state, code := authorize(t, authz.AuthorizationURL)
+		status, _, body := finish(t, oshared, state, code)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Contains(t, body, "email_not_verified")
+	})
+
+	t.Run("Existing user is linked by email", func(t *testing.T) {
+		before, err := store.User().GetByEmail(ctx, "staff@demo.com")
+		assert.NoError(t, err)
+
+		idp.identity("Staff@Demo.com", "Someone Else", true)
+		status, authz, oshared := start(t)
+		assert.Equal(t, http.StatusOK, status)
+		state, code := authorize(t, authz.AuthorizationURL)
+		status, res, body := finish(t, oshared, state, code)
+		assert.Equal(t, http.StatusOK, status, body)
+		assert.Equal(t, before.ID, res.User.User.ID)
+
+		after, err := store.User().GetByEmail(ctx, "staff@demo.com")
+		assert.NoError(t, err)
+		assert.Equal(t, before.Name, after.Name)
+		assert.Equal(t, len(before.Roles), len(after.Roles))
+	})
+
+	t.Run("Local login still works", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+	})
+}
@@ -0,0 +1,141 @@
+package handler_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/util"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeKeyFile(t *testing.T, key any) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	f, err := os.CreateTemp(t.TempDir(), "jwt-*.pem")
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.NoError(t, pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	return f.Name()
+}
+
+func writePublicKeyFile(t *testing.T, key any) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwt-pub.pem")
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+	return path
+}
+
+func TestJwtKeys(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	es256, err := handler.LoadJWTKeyFile(writeKeyFile(t, ecKey))
+	assert.NoError(t, err)
+	eddsa, err := handler.LoadJWTKeyFile(writeKeyFile(t, edKey))
+	assert.NoError(t, err)
+	es256Pub, err := handler.LoadJWTKeyFile(writePublicKeyFile(t, &ecKey.PublicKey))
+	assert.NoError(t, err)
+	assert.Equal(t, es256.Kid, es256Pub.Kid, "kid must not depend on the key file")
+
+	hsToken := token
+	var esToken string
+
+	getRole := func(t *testing.T, tok string) int {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:8080/api/v1/role/1", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	getJWKS := func(t *testing.T) util.JWKSet {
+		resp, err := http.Get("http://localhost:8080/.well-known/jwks.json")
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var set util.JWKSet
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&set))
+		return set
+	}
+
+	t.Run("Empty jwks with HS256", func(t *testing.T) {
+		assert.Empty(t, getJWKS(t).Keys)
+	})
+
+	t.Run("Sign with ES256", func(t *testing.T) {
+		handler.SetJWTKeys(es256)
+		authLogin(t, "admin@demo.com", "admin123")
+		esToken = token
+
+		tok, _, err := jwt.NewParser().ParseUnverified(esToken, &handler.JwtClaims{})
+		assert.NoError(t, err)
+		assert.Equal(t, "ES256", tok.Method.Alg())
+		assert.Equal(t, es256.Kid, tok.Header["kid"])
+		assert.Equal(t, http.StatusOK, getRole(t, esToken))
+	})
+
+	t.Run("Jwks verifies token", func(t *testing.T) {
+		set := getJWKS(t)
+		assert.Len(t, set.Keys, 1)
+		assert.Equal(t, es256.Kid, set.Keys[0].Kid)
+		assert.Equal(t, "ES256", set.Keys[0].Alg)
+		assert.Empty(t, set.Keys[0].N+set.Keys[0].E, "no private or foreign material")
+
+		_, err := jwt.Parse(esToken, func(tok *jwt.Token) (any, error) {
+			return set.Keys[0].PublicKey()
+		}, jwt.WithValidMethods([]string{"ES256"}))
+		assert.NoError(t, err)
+	})
+
+	t.Run("HS256 accepted during migration", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, getRole(t, hsToken))
+	})
+
+	t.Run("Rotate to EdDSA", func(t *testing.T) {
+		handler.SetJWTKeys(eddsa, es256Pub)
+		assert.Len(t, getJWKS(t).Keys, 2)
+		assert.Equal(t, http.StatusOK, getRole(t, esToken), "previous key still verifies")
+
+		authLogin(t, "admin@demo.com", "admin123")
+		tok, _, err := jwt.NewParser().ParseUnverified(token, &handler.JwtClaims{})
+		assert.NoError(t, err)
+		assert.Equal(t, "EdDSA", tok.Method.Alg())
+		assert.Equal(t, eddsa.Kid, tok.Header["kid"])
+		assert.Equal(t, http.StatusOK, getRole(t, token))
+	})
+
+	t.Run("Retired key is rejected", func(t *testing.T) {
+		handler.SetJWTKeys(eddsa)
+		assert.Equal(t, http.StatusUnauthorized, getRole(t, esToken))
+	})
+
+	t.Run("HS256 rejected after migration", func(t *testing.T) {
+		handler.SetJWTAcceptHS256(false)
+		assert.Equal(t, http.StatusUnauthorized, getRole(t, hsToken))
+		handler.SetJWTAcceptHS256(true)
+	})
+
+	t.Run("Back to HS256", func(t *testing.T) {
+		handler.SetJWTKeys(nil)
+		authLogin(t, "admin@demo.com", "admin123")
+		tok, _, err := jwt.NewParser().ParseUnverified(token, &handler.JwtClaims{})
+		assert.NoError(t, err)
+		assert.Equal(t, "HS256", tok.Method.Alg())
+	})
+}
@@ -0,0 +1,142 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+	"github.com/stretchr/testify/assert"
+)
+
+// handshake is the first, unsigned step of the login returning the server key.
+func handshake(t *testing.T) handler.LoginObject {
+	body, _ := json.Marshal(handler.LoginObject{PublicKey: pubKey})
+	req, err := http.NewRequest(http.MethodPut, "http://localhost:8080/api/v1/auth", bytes.NewReader(body))
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var res handler.LoginObject
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	return res
+}
+
+// loginWithKey is the signed second step of the login for the server key hs.
+func loginWithKey(t *testing.T, hs handler.LoginObject, email, password string) (int, string) {
+	spub, err := util.DecodePubKey(hs.PublicKey)
+	assert.NoError(t, err)
+	kshared, err := sPriv.ECDH(spub)
+	assert.NoError(t, err)
+	body, _ := json.Marshal(handler.LoginObject{
+		Email:     email,
+		PublicKey: pubKey,
+		Password:  password,
+		Kid:       hs.Kid,
+	})
+	req, err := http.NewRequest(http.MethodPut, "http://localhost:8080/api/v1/auth", bytes.NewReader(body))
+	assert.NoError(t, err)
+	util.SetHMAC(req, body, kshared)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	bb, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return resp.StatusCode, string(bb)
+}
+
+func TestServerKey(t *testing.T) {
+	store := model.GetAppStore()
+	ctx := context.Background()
+
+	var first handler.LoginObject
+
+	t.Run("Handshake returns kid", func(t *testing.T) {
+		first = handshake(t)
+		assert.NotEmpty(t, first.PublicKey)
+		assert.NotEmpty(t, first.Kid)
+
+		status, body := loginWithKey(t, first, "admin@demo.com", "admin123")
+		assert.Equal(t, http.StatusOK, status, body)
+	})
+
+	t.Run("Key file", func(t *testing.T) {
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		path := writeKeyFile(t, ecKey)
+		k1, err := handler.LoadServerKeyFile(path)
+		assert.NoError(t, err)
+		k2, err := handler.LoadServerKeyFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, k1.Kid, k2.Kid, "instances loading the same file share the key")
+		assert.Equal(t, k1.PublicKey, k2.PublicKey)
+
+		handler.SetServerKeys(k1)
+		hs := handshake(t)
+		assert.Equal(t, k1.Kid, hs.Kid)
+		assert.Equal(t, k1.PublicKey, hs.PublicKey)
+
+		status, body := loginWithKey(t, first, "admin@demo.com", "admin123")
+		assert.Equal(t, http.StatusBadRequest, status, "previous ephemeral key is gone")
+		assert.Contains(t, body, "invalid_kid")
+
+		status, body = loginWithKey(t, hs, "admin@demo.com", "admin123")
+		assert.Equal(t, http.StatusOK, status, body)
+	})
+
+	var dbKey handler.LoginObject
+
+	t.Run("Key in db", func(t *testing.T) {
+		handler.UseDBServerKeys(time.Hour, 10*time.Minute)
+		dbKey = handshake(t)
+
+		keys, err := store.ServerKey().List(ctx, time.Now())
+		assert.NoError(t, err)
+		assert.NotEmpty(t, keys)
+		assert.Equal(t, dbKey.Kid, keys[0].Kid)
+		assert.NotContains(t, keys[0].PrivateKey.String, dbKey.PublicKey)
+
+		// a restarted instance loads the same key
+		handler.UseDBServerKeys(time.Hour, 10*time.Minute)
+		hs := handshake(t)
+		assert.Equal(t, dbKey.Kid, hs.Kid)
+		assert.Equal(t, dbKey.PublicKey, hs.PublicKey)
+	})
+
+	t.Run("Rotation keeps previous key during overlap", func(t *testing.T) {
+		k, err := handler.RotateServerKeys(ctx, store)
+		assert.NoError(t, err)
+		assert.NotEqual(t, dbKey.Kid, k.Kid)
+
+		hs := handshake(t)
+		assert.Equal(t, k.Kid, hs.Kid)
+
+		status, body := loginWithKey(t, dbKey, "admin@demo.com", "admin123")
+		assert.Equal(t, http.StatusOK, status, body)
+	})
+
+	t.Run("Unknown kid", func(t *testing.T) {
+		hs := handshake(t)
+		hs.Kid = "unknown"
+		status, body := loginWithKey(t, hs, "admin@demo.com", "admin123")
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Contains(t, body, "invalid_kid")
+	})
+
+	t.Run("Back to ephemeral key", func(t *testing.T) {
+		k, err := handler.NewServerKey(nil)
+		assert.NoError(t, err)
+		handler.SetServerKeys(k)
+		authLogin(t, "admin@demo.com", "admin123")
+	})
+}
@@ -0,0 +1,118 @@
+package handler_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNonce(t *testing.T) {
+	store := model.GetAppStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	testStore := func(t *testing.T, s handler.NonceStore) {
+		key := time.Now().Format(time.RFC3339Nano) + "-nonce"
+		ok, err := s.Add(ctx, key, time.Now().Add(time.Minute))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = s.Add(ctx, key, time.Now().Add(time.Minute))
+		assert.NoError(t, err)
+		assert.False(t, ok, "replay must be detected")
+
+		expired := key + "-expired"
+		ok, err = s.Add(ctx, expired, time.Now().Add(-time.Second))
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = s.Add(ctx, expired, time.Now().Add(time.Minute))
+		assert.NoError(t, err)
+		assert.True(t, ok, "expired nonce is not a replay")
+
+		var added atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if ok, err := s.Add(ctx, key+"-concurrent", time.Now().Add(time.Minute)); err == nil && ok {
+					added.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), added.Load())
+	}
+
+	t.Run("Memory store", func(t *testing.T) {
+		testStore(t, handler.NewMemoryNonceStore(4, 1000))
+	})
+
+	t.Run("Memory store is capped", func(t *testing.T) {
+		s := handler.NewMemoryNonceStore(1, 2)
+		expires := time.Now().Add(time.Minute)
+		for _, key := range []string{"first", "second", "third"} {
+			ok, err := s.Add(ctx, key, expires)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		}
+		ok, err := s.Add(ctx, "third", expires)
+		assert.NoError(t, err)
+		assert.False(t, ok, "replay must be detected")
+		ok, err = s.Add(ctx, "first", expires)
+		assert.NoError(t, err)
+		assert.True(t, ok, "the oldest nonce is evicted")
+	})
+
+	t.Run("DB store", func(t *testing.T) {
+		testStore(t, handler.NewDBNonceStore(ctx, store, time.Minute))
+
+		_, err := store.Nonce().Add(ctx, "expired-nonce", time.Now().Add(-time.Minute), time.Now())
+		assert.NoError(t, err)
+		n, err := store.Nonce().DeleteExpired(ctx, time.Now())
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, n, int64(1))
+	})
+
+	t.Run("Replay across instances", func(t *testing.T) {
+		body, _ := json.Marshal(map[string]any{
+			"value":  map[string]any{"email": "admin@demo.com"},
+			"fields": []string{"email"},
+		})
+		signed, err := http.NewRequest(http.MethodPatch, "http://localhost:8080/api/v1/user/1", bytes.NewReader(body))
+		assert.NoError(t, err)
+		signed.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(signed, body, shared, "Content-Type")
+		send := func() int {
+			req, err := http.NewRequest(http.MethodPatch, signed.URL.String(), bytes.NewReader(body))
+			assert.NoError(t, err)
+			req.Header = signed.Header.Clone()
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			defer resp.Body.Close()
+			return resp.StatusCode
+		}
+
+		handler.SetNonceStore(handler.NewDBNonceStore(ctx, store, time.Minute))
+		assert.Equal(t, http.StatusOK, send())
+
+		// another instance shares the table but not the memory of the first one
+		handler.SetNonceStore(handler.NewDBNonceStore(ctx, store, time.Minute))
+		assert.NotEqual(t, http.StatusOK, send(), "replayed request must be rejected")
+	})
+
+	t.Run("Back to memory store", func(t *testing.T) {
+		handler.SetNonceStore(handler.NewMemoryNonceStore(64, 100000))
+		authLogin(t, "admin@demo.com", "admin123")
+	})
+}
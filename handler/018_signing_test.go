@@ -0,0 +1,178 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigningPolicy(t *testing.T) {
+	patchBody, _ := json.Marshal(map[string]any{
+		"value":  map[string]any{"email": "admin@demo.com"},
+		"fields": []string{"email"},
+	})
+
+	do := func(t *testing.T, req *http.Request) (int, handler.HttpResult) {
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		var res handler.HttpResult
+		_ = json.NewDecoder(resp.Body).Decode(&res)
+		return resp.StatusCode, res
+	}
+	getUser := func(t *testing.T, sign bool) (int, handler.HttpResult) {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:8080/api/v1/user/1", nil)
+		assert.NoError(t, err)
+		if sign {
+			util.SetHMAC(req, nil, shared)
+		}
+		return do(t, req)
+	}
+	patchUser := func(t *testing.T) *http.Request {
+		req, err := http.NewRequest(http.MethodPatch, "http://localhost:8080/api/v1/user/1", bytes.NewReader(patchBody))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+
+	t.Run("Parse rules", func(t *testing.T) {
+		rules, err := handler.ParseSigningRules("app_user:read=required, param:*:get=off")
+		assert.NoError(t, err)
+		assert.Equal(t, []handler.SigningRule{
+			{Resource: "app_user", Action: "read", Policy: handler.SignRequired},
+			{Resource: "param", Action: "*", Method: http.MethodGet, Policy: handler.SignOff},
+		}, rules)
+
+		_, err = handler.ParseSigningRules("app_user:read=always")
+		assert.Error(t, err)
+		_, err = handler.ParseSigningRules("app_user=required")
+		assert.Error(t, err)
+	})
+
+	t.Run("Reads are optional by default", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:8080/api/v1/role/1", nil)
+		assert.NoError(t, err)
+		status, _ := do(t, req)
+		assert.Equal(t, http.StatusOK, status)
+
+		req, err = http.NewRequest(http.MethodGet, "http://localhost:8080/api/v1/role/1", nil)
+		assert.NoError(t, err)
+		util.SetHMAC(req, nil, []byte("wrong secret"))
+		status, res := do(t, req)
+		assert.Equal(t, http.StatusForbidden, status, "a present signature is verified")
+		assert.Equal(t, handler.SignatureMismatch, res.Code)
+	})
+
+	t.Run("Required for user reads and finds by default", func(t *testing.T) {
+		status, res := getUser(t, false)
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, handler.SignatureMissing, res.Code)
+
+		status, _ = getUser(t, true)
+		assert.Equal(t, http.StatusOK, status)
+
+		body, _ := json.Marshal(map[string]any{"limit": 1})
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:8080/api/v1/role", bytes.NewReader(body))
+		assert.NoError(t, err)
+		status, res = do(t, req)
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, handler.SignatureMissing, res.Code)
+	})
+
+	t.Run("Off for user reads", func(t *testing.T) {
+		handler.SetSigningRules(handler.SigningRule{Resource: "app_user", Action: "read", Policy: handler.SignOff})
+		defer handler.SetSigningRules()
+
+		status, _ := getUser(t, false)
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("Off for user updates", func(t *testing.T) {
+		handler.SetSigningRules(handler.SigningRule{Resource: "app_user", Action: "update", Policy: handler.SignOff})
+		status, res := do(t, patchUser(t))
+		assert.Equal(t, http.StatusOK, status, res.Code)
+		handler.SetSigningRules()
+
+		status, res = do(t, patchUser(t))
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, handler.SignatureMissing, res.Code)
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		req := patchUser(t)
+		util.SetSignedHMAC(req, patchBody, shared, "Content-Type")
+		headers := req.Header.Clone()
+		status, res := do(t, req)
+		assert.Equal(t, http.StatusOK, status, res.Code)
+
+		req = patchUser(t)
+		req.Header = headers
+		status, res = do(t, req)
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, handler.SignatureNonceReplay, res.Code)
+	})
+
+	t.Run("Clock skew", func(t *testing.T) {
+		handler.SetHMACClockSkew(time.Second)
+		defer handler.SetHMACClockSkew(time.Minute)
+		req := patchUser(t)
+		util.SetSignedHMAC(req, patchBody, shared, "Content-Type")
+		time.Sleep(3 * time.Second)
+		status, res := do(t, req)
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, handler.SignatureTimestampSkew, res.Code)
+	})
+
+	t.Run("Content-Type is signed by default", func(t *testing.T) {
+		req := patchUser(t)
+		util.SetHMAC(req, patchBody, shared)
+		status, res := do(t, req)
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, handler.SignatureHeaderUnsigned, res.Code)
+
+		req = patchUser(t)
+		util.SetSignedHMAC(req, patchBody, shared, "Content-Type")
+		status, res = do(t, req)
+		assert.Equal(t, http.StatusOK, status, res.Code)
+
+		req = patchUser(t)
+		util.SetSignedHMAC(req, patchBody, shared, "Content-Type")
+		req.Header.Set("Content-Type", "text/plain")
+		status, res = do(t, req)
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, handler.SignatureMismatch, res.Code)
+	})
+
+	t.Run("Signed headers", func(t *testing.T) {
+		handler.SetHMACSignedHeaders()
+		defer handler.SetHMACSignedHeaders("Content-Type")
+
+		req := patchUser(t)
+		util.SetHMAC(req, patchBody, shared)
+		status, res := do(t, req)
+		assert.Equal(t, http.StatusOK, status, res.Code)
+	})
+
+	t.Run("Login reports reason", func(t *testing.T) {
+		hs := handshake(t)
+		body, _ := json.Marshal(handler.LoginObject{Email: "admin@demo.com", PublicKey: pubKey, Password: "admin123", Kid: hs.Kid})
+		req, err := http.NewRequest(http.MethodPut, "http://localhost:8080/api/v1/auth", bytes.NewReader(body))
+		assert.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		var res handler.HttpResult
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, handler.SignatureMissing, res.Code)
+
+		authLogin(t, "admin@demo.com", "admin123")
+	})
+}
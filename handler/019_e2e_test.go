@@ -0,0 +1,116 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestE2EEncryption(t *testing.T) {
+	do := func(t *testing.T, req *http.Request) (*http.Response, []byte) {
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		bb, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, bb
+	}
+
+	t.Run("Encrypted response", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:8080/api/v1/user/1", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Accept", util.ContentTypeJOSE)
+		util.SetHMAC(req, nil, shared)
+		resp, bb := do(t, req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, string(bb))
+		assert.Equal(t, util.ContentTypeJOSE, resp.Header.Get("Content-Type"))
+		assert.NotContains(t, string(bb), "admin@demo.com")
+
+		plain, err := util.DecryptJOSE(shared, bb)
+		assert.NoError(t, err)
+		var user model.User
+		assert.NoError(t, json.Unmarshal(plain, &user))
+		assert.Equal(t, "admin@demo.com", user.Email)
+	})
+
+	t.Run("Encrypted signed request", func(t *testing.T) {
+		body, _ := json.Marshal(map[string]any{
+			"value":  map[string]any{"email": "admin@demo.com"},
+			"fields": []string{"email"},
+		})
+		sealed, err := util.EncryptJOSE(shared, body)
+		assert.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPatch, "http://localhost:8080/api/v1/user/1", bytes.NewReader(sealed))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", util.ContentTypeJOSE)
+		util.SetSignedHMAC(req, sealed, shared, "Content-Type")
+		resp, bb := do(t, req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, string(bb))
+		assert.Equal(t, util.ContentTypeJOSE, resp.Header.Get("Content-Type"))
+
+		plain, err := util.DecryptJOSE(shared, bb)
+		assert.NoError(t, err)
+		var user model.User
+		assert.NoError(t, json.Unmarshal(plain, &user))
+		assert.Equal(t, "admin@demo.com", user.Email)
+	})
+
+	t.Run("Wrong key", func(t *testing.T) {
+		sealed, err := util.EncryptJOSE([]byte("another secret"), []byte(`{"limit":10}`))
+		assert.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:8080/api/v1/user", bytes.NewReader(sealed))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", util.ContentTypeJOSE)
+		resp, bb := do(t, req)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, string(bb), "invalid_jwe")
+	})
+
+	t.Run("Unencrypted resources", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:8080/api/v1/param/1", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Accept", util.ContentTypeJOSE)
+		resp, _ := do(t, req)
+		assert.NotEqual(t, util.ContentTypeJOSE, resp.Header.Get("Content-Type"))
+	})
+
+	t.Run("Required", func(t *testing.T) {
+		handler.SetE2EEncryption(handler.E2ERequired)
+		defer handler.SetE2EEncryption(handler.E2EOptional)
+
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:8080/api/v1/role/1", nil)
+		assert.NoError(t, err)
+		resp, bb := do(t, req)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, string(bb), "encryption_required")
+
+		req, err = http.NewRequest(http.MethodGet, "http://localhost:8080/api/v1/role/1", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Accept", util.ContentTypeJOSE)
+		resp, bb = do(t, req)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		plain, err := util.DecryptJOSE(shared, bb)
+		assert.NoError(t, err)
+		var role model.Role
+		assert.NoError(t, json.Unmarshal(plain, &role))
+		assert.Equal(t, int64(1), role.ID)
+
+		// the length of a chunked body is unknown to the server
+		body := io.MultiReader(strings.NewReader(`{"filter":[]}`))
+		req, err = http.NewRequest(http.MethodPost, "http://localhost:8080/api/v1/param", body)
+		assert.NoError(t, err)
+		req.Header.Set("Accept", util.ContentTypeJOSE)
+		resp, bb = do(t, req)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, string(bb), "encryption_required")
+	})
+}
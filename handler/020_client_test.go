@@ -0,0 +1,100 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"example.com/app-api/client"
+	"example.com/app-api/model"
+	"example.com/app-api/util/jsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c := client.New("http://localhost:8080")
+
+	t.Run("Not logged in", func(t *testing.T) {
+		_, err := c.Users().Get(ctx, 1)
+		assert.ErrorIs(t, err, client.ErrNotLoggedIn)
+	})
+
+	t.Run("Invalid password", func(t *testing.T) {
+		err := c.Login(ctx, "admin@demo.com", "wrong")
+		var cerr *client.Error
+		assert.True(t, errors.As(err, &cerr), "%v", err)
+		assert.Equal(t, http.StatusBadRequest, cerr.Status)
+	})
+
+	t.Run("Login", func(t *testing.T) {
+		assert.NoError(t, c.Login(ctx, "admin@demo.com", "admin123"))
+		assert.NotEmpty(t, c.Token())
+		assert.Equal(t, "admin@demo.com", c.User().Email)
+	})
+
+	t.Run("Users", func(t *testing.T) {
+		user, err := c.Users().Get(ctx, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, "admin@demo.com", user.Email)
+
+		value, _ := json.Marshal("admin@demo.com")
+		list, total, err := c.Users().Find(ctx, []model.UserFilter{
+			{Field: model.UserField_Email, Op: model.FilterOp_EQ, Value: value},
+		}, []model.UserSorting{{Field: model.UserField_ID, Dir: model.SortDir_ASC}}, 10, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), total)
+		if assert.Len(t, list, 1) {
+			assert.Equal(t, int64(1), list[0].ID)
+		}
+	})
+
+	t.Run("Params", func(t *testing.T) {
+		p, err := c.Params().Create(ctx, model.Param{
+			Group:       "SDK",
+			Code:        "sdk_param",
+			Value:       jsql.NullStringValue("v1"),
+			Description: jsql.NullStringValue("created by the client sdk"),
+		})
+		assert.NoError(t, err)
+
+		_, err = c.Params().Update(ctx, p.ID, model.Param{Value: jsql.NullStringValue("v2")}, model.ParamField_Value)
+		assert.NoError(t, err)
+		p, err = c.Params().Get(ctx, p.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "v2", p.Value.String)
+
+		assert.NoError(t, c.Params().Delete(ctx, p.ID))
+		_, err = c.Params().Get(ctx, p.ID)
+		assert.Error(t, err)
+	})
+
+	t.Run("Encrypted roles", func(t *testing.T) {
+		c.Encrypt = true
+		defer func() { c.Encrypt = false }()
+		role, err := c.Roles().Get(ctx, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), role.ID)
+	})
+
+	t.Run("Refresh before expiry", func(t *testing.T) {
+		before := c.Token()
+		time.Sleep(1100 * time.Millisecond) // tokens of the same second are equal
+		c.RefreshBefore = time.Hour
+		_, err := c.Roles().Get(ctx, 1)
+		assert.NoError(t, err)
+		c.RefreshBefore = 30 * time.Second
+		assert.NotEqual(t, before, c.Token())
+	})
+
+	t.Run("Logout", func(t *testing.T) {
+		assert.NoError(t, c.Logout(ctx))
+		_, err := c.Roles().Get(ctx, 1)
+		assert.ErrorIs(t, err, client.ErrNotLoggedIn)
+
+		authLogin(t, "admin@demo.com", "admin123")
+	})
+}
@@ -0,0 +1,103 @@
+package handler_test
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+	"example.com/app-api/util/jsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKey(t *testing.T) {
+	f := newFixture(t)
+	store, ctx := f.store, f.ctx
+	user := f.user("svc", f.role("svc-param", `{"param":{"read":true,"update":true}}`))
+	param, err := store.Param().Create(ctx, model.Param{
+		Group:     "APIKEY",
+		Code:      "key_" + f.suffix,
+		Value:     jsql.NullStringValue("v1"),
+		UpdatedBy: "test",
+		UpdatedAt: time.Now(),
+	})
+	assert.NoError(t, err)
+
+	newKey := func(privileges string, expires sql.NullTime) (string, *model.APIKey) {
+		key, prefix, hash, err := util.NewAPIKey()
+		assert.NoError(t, err)
+		k, err := store.APIKey().Create(ctx, model.APIKey{
+			UserID:     user.ID,
+			Name:       "test",
+			Prefix:     prefix,
+			SecretHash: hash,
+			Privileges: privileges,
+			ExpiresAt:  expires,
+			CreatedAt:  time.Now(),
+		})
+		assert.NoError(t, err)
+		return key, k
+	}
+	send := func(method, url, key string, body []byte) int {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("X-API-Key", key)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	paramURL := fmt.Sprintf("http://localhost:8080/api/v1/param/%d", param.ID)
+	patch := []byte(`{"value":{"value":"v2"},"fields":["value"]}`)
+
+	t.Run("Scoped key", func(t *testing.T) {
+		key, k := newKey(`{"param":{"read":true}}`, sql.NullTime{})
+		assert.Equal(t, http.StatusOK, send(http.MethodGet, paramURL, key, nil))
+		assert.Equal(t, http.StatusForbidden, send(http.MethodPatch, paramURL, key, patch), "update is outside the scope")
+		assert.Equal(t, http.StatusForbidden, send(http.MethodGet, "http://localhost:8080/api/v1/user/1", key, nil))
+
+		k, err := store.APIKey().GetByPrefix(ctx, k.Prefix)
+		assert.NoError(t, err)
+		assert.True(t, k.LastUsedAt.Valid, "last use is tracked")
+	})
+
+	t.Run("Unscoped key has the privileges of the user", func(t *testing.T) {
+		key, _ := newKey("", sql.NullTime{})
+		assert.Equal(t, http.StatusOK, send(http.MethodPatch, paramURL, key, patch), "no signature is required")
+		assert.Equal(t, http.StatusForbidden, send(http.MethodGet, "http://localhost:8080/api/v1/user/1", key, nil))
+	})
+
+	t.Run("Invalid keys", func(t *testing.T) {
+		key, k := newKey("", sql.NullTime{})
+		assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, paramURL, key+"x", nil))
+		assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, paramURL, "ak_"+k.Prefix, nil))
+		assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, paramURL, "ak_unknown_secret", nil))
+
+		expired, _ := newKey("", sql.NullTime{Time: time.Now().Add(-time.Second), Valid: true})
+		assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, paramURL, expired, nil))
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		key, k := newKey("", sql.NullTime{})
+		assert.NoError(t, store.APIKey().Expire(ctx, k.ID, time.Now().Add(time.Hour)))
+		assert.Equal(t, http.StatusOK, send(http.MethodGet, paramURL, key, nil), "valid during the grace period")
+		assert.NoError(t, store.APIKey().Expire(ctx, k.ID, time.Now()))
+		assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, paramURL, key, nil))
+		// a later expiry never extends a revoked key
+		assert.NoError(t, store.APIKey().Expire(ctx, k.ID, time.Now().Add(time.Hour)))
+		assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, paramURL, key, nil))
+
+		keys, err := store.APIKey().ListByUser(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Len(t, keys, 5)
+	})
+
+	authLogin(t, "admin@demo.com", "admin123")
+}
@@ -0,0 +1,133 @@
+package handler_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionCookie(t *testing.T) {
+	handler.SetSessionCookie(handler.SessionCookieOptions{Enabled: true, Insecure: true})
+	defer handler.SetSessionCookie(handler.SessionCookieOptions{})
+
+	// cookies mimics the cookie jar of the browser
+	cookies := map[string]*http.Cookie{}
+	send := func(method, url string, body []byte, csrf string, sign bool) (*http.Response, string) {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		assert.NoError(t, err)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		if csrf != "" {
+			req.Header.Set("X-CSRF-Token", csrf)
+		}
+		if sign {
+			util.SetHMAC(req, body, shared)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		defer resp.Body.Close()
+		bb, _ := io.ReadAll(resp.Body)
+		for _, c := range resp.Cookies() {
+			if c.MaxAge < 0 {
+				delete(cookies, c.Name)
+			} else {
+				cookies[c.Name] = c
+			}
+		}
+		return resp, string(bb)
+	}
+
+	hs := handshake(t)
+	spub, err := util.DecodePubKey(hs.PublicKey)
+	assert.NoError(t, err)
+	shared, err = sPriv.ECDH(spub)
+	assert.NoError(t, err)
+	body, _ := json.Marshal(handler.LoginObject{
+		Email:     "admin@demo.com",
+		PublicKey: pubKey,
+		Password:  "admin123",
+		Kid:       hs.Kid,
+		Cookie:    true,
+	})
+	resp, bb := send(http.MethodPut, "http://localhost:8080/api/v1/auth", body, "", true)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, bb)
+	var login handler.LoginObject
+	assert.NoError(t, json.Unmarshal([]byte(bb), &login))
+	assert.Empty(t, login.Token, "tokens stay in the cookies")
+	assert.Empty(t, login.RefreshToken, "tokens stay in the cookies")
+	assert.NotEmpty(t, login.CsrfToken)
+	if assert.Contains(t, cookies, "session") && assert.Contains(t, cookies, "csrf_token") {
+		assert.True(t, cookies["session"].HttpOnly)
+		assert.Equal(t, http.SameSiteStrictMode, cookies["session"].SameSite)
+		assert.False(t, cookies["csrf_token"].HttpOnly, "the script echoes the csrf token")
+		assert.Equal(t, login.CsrfToken, cookies["csrf_token"].Value)
+	}
+	assert.Equal(t, "/api/v1", cookies["session_refresh"].Path)
+
+	patch := []byte(`{"value":{"email":"admin@demo.com"},"fields":["email"]}`)
+	t.Run("Cookie authenticates", func(t *testing.T) {
+		resp, bb := send(http.MethodGet, "http://localhost:8080/api/v1/role/1", nil, "", false)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, bb)
+	})
+
+	t.Run("CSRF token required", func(t *testing.T) {
+		resp, bb := send(http.MethodPatch, "http://localhost:8080/api/v1/user/1", patch, "", true)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, bb)
+		assert.Contains(t, bb, "csrf_invalid")
+		resp, bb = send(http.MethodPatch, "http://localhost:8080/api/v1/user/1", patch, "wrong", true)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, bb)
+		resp, bb = send(http.MethodPatch, "http://localhost:8080/api/v1/user/1", patch, login.CsrfToken, true)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, bb)
+	})
+
+	t.Run("Session cookie without the mode", func(t *testing.T) {
+		// clients of the plain session cookie keep working, without CSRF token
+		handler.SetSessionCookie(handler.SessionCookieOptions{})
+		defer handler.SetSessionCookie(handler.SessionCookieOptions{Enabled: true, Insecure: true})
+		resp, bb := send(http.MethodGet, "http://localhost:8080/api/v1/role/1", nil, "", false)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, bb)
+		resp, bb = send(http.MethodPatch, "http://localhost:8080/api/v1/user/1", patch, "", true)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, bb)
+	})
+
+	t.Run("Transparent refresh", func(t *testing.T) {
+		delete(cookies, "session")
+		resp, bb := send(http.MethodGet, "http://localhost:8080/api/v1/role/1", nil, "", false)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, bb)
+		assert.Contains(t, cookies, "session", "a new session cookie is issued")
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
+		resp, bb := send(http.MethodPost, "http://localhost:8080/api/v1/auth", []byte(`{}`), login.CsrfToken, true)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, bb)
+		var res handler.LoginObject
+		assert.NoError(t, json.Unmarshal([]byte(bb), &res))
+		assert.Empty(t, res.RefreshToken)
+		assert.NotEmpty(t, res.CsrfToken)
+		assert.NotEqual(t, login.CsrfToken, res.CsrfToken)
+		login = res
+	})
+
+	t.Run("Logout clears the cookies", func(t *testing.T) {
+		refresh := cookies["session_refresh"]
+		resp, bb := send(http.MethodDelete, "http://localhost:8080/api/v1/auth", []byte(`{}`), login.CsrfToken, false)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, bb)
+		assert.Empty(t, cookies)
+
+		// the refresh token is revoked on the server as well
+		cookies["session_refresh"] = refresh
+		resp, bb = send(http.MethodGet, "http://localhost:8080/api/v1/role/1", nil, "", false)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, bb)
+	})
+
+	authLogin(t, "admin@demo.com", "admin123")
+}
@@ -0,0 +1,109 @@
+package handler_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+	"example.com/app-api/util/jsql"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+func TestPasswordHash(t *testing.T) {
+	store := model.GetAppStore()
+	db := util.GetPostgresConn("DB")
+	ctx := context.Background()
+	email := "hash-" + time.Now().Format("20060102150405.000") + "@demo.com"
+
+	user, err := store.User().Create(ctx, model.User{
+		Email:     email,
+		Name:      "hash",
+		Password:  jsql.SecretValue("secret123"),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	})
+	assert.NoError(t, err)
+	storedHash := func() string {
+		u, err := store.User().Get(ctx, user.ID)
+		assert.NoError(t, err)
+		return u.Password.String
+	}
+	setHash := func(hash string) {
+		_, err := db.ExecContext(ctx, "UPDATE app_user SET password = $1 WHERE id = $2", hash, user.ID)
+		assert.NoError(t, err)
+	}
+
+	t.Run("Rehash on changed parameters", func(t *testing.T) {
+		// a hash made before the parameters changed
+		p := util.HashParams()
+		salt := []byte("0123456789abcdef")
+		key := argon2.IDKey([]byte("secret123"), salt, p.Iterations+1, p.Memory, p.Parallelism, p.KeyLen)
+		before := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+			p.Memory, p.Iterations+1, p.Parallelism,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+		setHash(before)
+
+		status, _ := authLoginStatus(t, email, "secret123")
+		assert.Equal(t, http.StatusOK, status)
+		after := storedHash()
+		assert.NotEqual(t, before, after)
+		assert.Contains(t, after, fmt.Sprintf(",t=%d,", p.Iterations))
+
+		status, _ = authLoginStatus(t, email, "secret123")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, after, storedHash(), "current hashes are kept")
+	})
+
+	t.Run("Imported bcrypt hash", func(t *testing.T) {
+		hash, err := bcrypt.GenerateFromPassword([]byte("secret123"), bcrypt.MinCost)
+		assert.NoError(t, err)
+		setHash(string(hash))
+		status, _ := authLoginStatus(t, email, "wrong")
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, string(hash), storedHash())
+
+		status, _ = authLoginStatus(t, email, "secret123")
+		assert.Equal(t, http.StatusOK, status)
+		assert.True(t, strings.HasPrefix(storedHash(), "$argon2id$"), "migrated to argon2id")
+	})
+
+	t.Run("Imported scrypt hash", func(t *testing.T) {
+		salt := []byte("0123456789abcdef")
+		key, err := scrypt.Key([]byte("secret123"), salt, 1<<10, 8, 1, 32)
+		assert.NoError(t, err)
+		setHash("$scrypt$ln=10,r=8,p=1$" + base64.RawStdEncoding.EncodeToString(salt) + "$" +
+			base64.RawStdEncoding.EncodeToString(key))
+		status, _ := authLoginStatus(t, email, "secret123")
+		assert.Equal(t, http.StatusOK, status)
+		assert.True(t, strings.HasPrefix(storedHash(), "$argon2id$"), "migrated to argon2id")
+	})
+
+	assert.Error(t, util.ValidHashParams(util.Params{Memory: 1, Iterations: 1, Parallelism: 4, SaltLen: 16, KeyLen: 32}))
+	assert.NoError(t, util.ValidHashParams(util.HashParams()))
+
+	t.Run("Imported hash parameters are bounded", func(t *testing.T) {
+		hash := "$" + base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef")) +
+			"$" + base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+		for _, params := range []string{
+			"$argon2i$v=19$m=65536,t=0,p=1",
+			"$argon2i$v=19$m=8388608,t=1,p=1",
+			"$scrypt$ln=30,r=8,p=1",
+			"$scrypt$ln=10,r=1024,p=1024",
+		} {
+			ok, err := util.CheckPassword("secret123", jsql.SecretValue(params+hash))
+			assert.False(t, ok, params)
+			assert.Error(t, err, params)
+		}
+	})
+
+	authLogin(t, "admin@demo.com", "admin123")
+}
@@ -0,0 +1,96 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"example.com/app-api/util/jsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPermission(t *testing.T) {
+	f := newFixture(t)
+	store, ctx := f.store, f.ctx
+	reader := f.role("reader", `{"*":{"read":true},"param":{"*":true}}`)
+	nodelete := f.role("nodelete", `{"param":{"delete":"deny"}}`)
+	user := f.user("perm", reader, nodelete)
+	param, err := store.Param().Create(ctx, model.Param{
+		Group:     "PERM",
+		Code:      "perm_" + f.suffix,
+		Value:     jsql.NullStringValue("v1"),
+		UpdatedBy: "test",
+		UpdatedAt: time.Now(),
+	})
+	assert.NoError(t, err)
+
+	authLogin(t, user.Email, "secret123")
+	explain := func(query string) handler.Decision {
+		status, bb := f.send(http.MethodGet, "http://localhost:8080/api/v1/auth/explain?"+query, nil)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var d handler.Decision
+		assert.NoError(t, json.Unmarshal(bb, &d), string(bb))
+		return d
+	}
+	paramURL := fmt.Sprintf("http://localhost:8080/api/v1/param/%d", param.ID)
+
+	t.Run("Wildcards grant", func(t *testing.T) {
+		status, bb := f.send(http.MethodGet, paramURL, nil)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		status, bb = f.send(http.MethodGet, "http://localhost:8080/api/v1/role/1", nil)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+
+		d := explain("resource=app_role&action=read")
+		assert.True(t, d.Allowed)
+		assert.Equal(t, reader.Name, d.Role)
+		assert.Equal(t, "*:read", d.Rule)
+	})
+
+	t.Run("Deny beats allow", func(t *testing.T) {
+		status, bb := f.send(http.MethodDelete, paramURL, nil)
+		assert.Equal(t, http.StatusForbidden, status, string(bb))
+
+		d := explain("resource=param&action=delete")
+		assert.False(t, d.Allowed)
+		assert.Equal(t, handler.EffectDeny, d.Effect)
+		assert.Equal(t, nodelete.Name, d.Role)
+		assert.Len(t, d.Matches, 2, "both roles match")
+	})
+
+	t.Run("Nothing granted", func(t *testing.T) {
+		d := explain("resource=app_role&action=create")
+		assert.False(t, d.Allowed)
+		assert.Equal(t, handler.EffectNone, d.Effect)
+		assert.Empty(t, d.Role)
+	})
+
+	t.Run("Explain another user", func(t *testing.T) {
+		d := explain("resource=app_role&action=create&email=admin@demo.com")
+		assert.Equal(t, "admin@demo.com", d.Email)
+		assert.True(t, d.Allowed)
+	})
+
+	t.Run("Invalid request", func(t *testing.T) {
+		status, _ := f.send(http.MethodGet, "http://localhost:8080/api/v1/auth/explain?resource=param", nil)
+		assert.Equal(t, http.StatusBadRequest, status)
+	})
+
+	t.Run("Deny beats allow within a role", func(t *testing.T) {
+		readonly := f.role("readonly", `{"param":{"*":"deny","read":true}}`)
+		authLogin(t, f.user("readonly", readonly).Email, "secret123")
+
+		status, bb := f.send(http.MethodGet, paramURL, nil)
+		assert.Equal(t, http.StatusForbidden, status, string(bb))
+
+		d := explain("resource=param&action=read")
+		assert.False(t, d.Allowed)
+		assert.Equal(t, handler.EffectDeny, d.Effect)
+		assert.Equal(t, "param:*", d.Rule, "the wildcard deny is not lifted by the grant of the action")
+	})
+
+	authLogin(t, "admin@demo.com", "admin123")
+}
@@ -0,0 +1,88 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrivilegeRegistry(t *testing.T) {
+	f := newFixture(t)
+	authLogin(t, "admin@demo.com", "admin123")
+	createRole := func(privileges string) (int, []byte) {
+		body, _ := json.Marshal(model.Role{
+			Name:       "registry-" + time.Now().Format("20060102150405.000000"),
+			Privileges: privileges,
+		})
+		return f.send(http.MethodPut, "http://localhost:8080/api/v1/role", body)
+	}
+
+	t.Run("Catalog", func(t *testing.T) {
+		status, bb := f.send(http.MethodGet, "http://localhost:8080/api/v1/auth/privileges", nil)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var catalog []handler.PrivilegeResource
+		assert.NoError(t, json.Unmarshal(bb, &catalog))
+		resources := map[string][]string{}
+		for _, r := range catalog {
+			resources[r.Resource] = r.Actions
+		}
+		assert.ElementsMatch(t, []string{"create", "read", "update", "delete", "impersonate"}, resources["app_user"])
+		for _, resource := range []string{"app_role", "param"} {
+			assert.ElementsMatch(t, []string{"create", "read", "update", "delete", "approve"}, resources[resource], resource)
+		}
+	})
+
+	t.Run("Unknown privileges are rejected", func(t *testing.T) {
+		for _, privileges := range []string{
+			`{"gl_account":{"read":true}}`,
+			`{"param":{"publish":true}}`,
+			`{"*":{"publish":true}}`,
+			`{"param":{"read":"yes"}}`,
+			`not json`,
+		} {
+			status, bb := createRole(privileges)
+			assert.Equal(t, http.StatusUnprocessableEntity, status, privileges)
+			var res handler.HttpResult
+			assert.NoError(t, json.Unmarshal(bb, &res), string(bb))
+			assert.Equal(t, "invalid_privileges", res.Code, privileges)
+		}
+	})
+
+	t.Run("Unknown resource is rejected with 422", func(t *testing.T) {
+		name := f.name("gl-account")
+		body, _ := json.Marshal(model.Role{Name: name, Privileges: `{"gl_account":{"read":true}}`})
+		status, bb := f.send(http.MethodPut, "http://localhost:8080/api/v1/role", body)
+		assert.Equal(t, http.StatusUnprocessableEntity, status, string(bb))
+		var res handler.HttpResult
+		assert.NoError(t, json.Unmarshal(bb, &res), string(bb))
+		assert.Equal(t, "invalid_privileges", res.Code)
+		assert.Contains(t, res.Error, "gl_account")
+
+		_, err := f.store.Role().GetByName(f.ctx, name)
+		assert.Error(t, err, "role must not be created")
+	})
+
+	t.Run("Known privileges", func(t *testing.T) {
+		status, bb := createRole(`{"param":{"*":true,"delete":"deny"},"*":{"read":true},"app_user":{"update":false}}`)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var role model.Role
+		assert.NoError(t, json.Unmarshal(bb, &role))
+
+		update := func(privileges string) int {
+			body, _ := json.Marshal(map[string]any{
+				"value":  map[string]any{"privileges": privileges},
+				"fields": []string{"privileges"},
+			})
+			status, _ := f.send(http.MethodPatch, "http://localhost:8080/api/v1/role/"+strconv.FormatInt(role.ID, 10), body)
+			return status
+		}
+		assert.Equal(t, http.StatusUnprocessableEntity, update(`{"gl_account":{"read":true}}`))
+		assert.Equal(t, http.StatusOK, update(`{"param":{"read":true}}`))
+	})
+}
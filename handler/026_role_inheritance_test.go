@@ -0,0 +1,133 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleInheritance(t *testing.T) {
+	f := newFixture(t)
+	store, ctx := f.store, f.ctx
+	createRole := func(name, privileges string, parents ...int64) *model.Role {
+		role := f.role(name, privileges)
+		if len(parents) > 0 {
+			policy, err := store.RolePolicy().Get(ctx, role.ID)
+			assert.NoError(t, err)
+			policy.Parents = parents
+			assert.NoError(t, store.RolePolicy().Update(ctx, *policy, []model.RolePolicyField{model.RolePolicyField_Parents}))
+		}
+		return &role
+	}
+	base := createRole("base", `{"param":{"read":true,"delete":"deny"}}`)
+	editor := createRole("editor", `{"param":{"update":true}}`, base.ID)
+	lead := createRole("lead", `{"param":{"create":true}}`, editor.ID)
+	user := f.user("inherit", *lead)
+
+	explain := func(action string) handler.Decision {
+		status, bb := f.send(http.MethodGet, "http://localhost:8080/api/v1/auth/explain?resource=param&action="+action, nil)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var d handler.Decision
+		assert.NoError(t, json.Unmarshal(bb, &d), string(bb))
+		return d
+	}
+	getPolicy := func(role *model.Role) *model.RolePolicy {
+		policy, err := store.RolePolicy().Get(ctx, role.ID)
+		assert.NoError(t, err)
+		return policy
+	}
+	setParentsVersion := func(role *model.Role, version int64, parents ...int64) (int, handler.HttpResult) {
+		body, _ := json.Marshal(map[string]any{
+			"value":  map[string]any{"version": version, "parents": parents},
+			"fields": []string{"parents"},
+		})
+		status, bb := f.send(http.MethodPatch, "http://localhost:8080/api/v1/role/"+strconv.FormatInt(role.ID, 10)+"/policy", body)
+		var res handler.HttpResult
+		_ = json.Unmarshal(bb, &res)
+		return status, res
+	}
+	setParents := func(role *model.Role, parents ...int64) (int, handler.HttpResult) {
+		return setParentsVersion(role, getPolicy(role).Version, parents...)
+	}
+
+	t.Run("Transitive privileges", func(t *testing.T) {
+		authLogin(t, user.Email, "secret123")
+		for _, action := range []string{"create", "update", "read"} {
+			assert.True(t, explain(action).Allowed, action)
+		}
+		d := explain("read")
+		assert.Equal(t, base.Name, d.Role)
+		assert.Equal(t, []handler.DecisionMatch{{Role: base.Name, Via: lead.Name, Rule: "param:read", Effect: handler.EffectAllow}}, d.Matches)
+
+		d = explain("delete")
+		assert.False(t, d.Allowed)
+		assert.Equal(t, handler.EffectDeny, d.Effect, "inherited deny")
+	})
+
+	t.Run("Cycles are rejected", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+		status, res := setParents(base, lead.ID)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "role_cycle", res.Code)
+		status, res = setParents(base, base.ID)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "role_cycle", res.Code)
+		status, res = setParents(base, 1<<40)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Equal(t, "role_parent_not_found", res.Code)
+
+		assert.Empty(t, getPolicy(base).Parents)
+	})
+
+	t.Run("Stale versions are rejected", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+		version := getPolicy(base).Version
+		status, _ := setParents(base)
+		assert.Equal(t, http.StatusOK, status)
+		status, res := setParentsVersion(base, version, editor.ID)
+		assert.Equal(t, http.StatusConflict, status)
+		assert.Equal(t, "conflict", res.Code)
+		assert.Empty(t, getPolicy(base).Parents)
+	})
+
+	t.Run("Renames bump the version", func(t *testing.T) {
+		authLogin(t, user.Email, "secret123")
+		assert.Equal(t, base.Name, explain("read").Role)
+
+		before := getPolicy(lead)
+		base.Name = "base-renamed-" + f.suffix
+		assert.NoError(t, store.Role().Update(ctx, *base, []model.RoleField{model.RoleField_Name}))
+		assert.Greater(t, getPolicy(lead).Version, before.Version)
+
+		// the cached name of the old version must not be used
+		authLogin(t, user.Email, "secret123")
+		assert.Equal(t, base.Name, explain("read").Role)
+	})
+
+	t.Run("Parent changes bump the version", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+		before := getPolicy(lead)
+		assert.Equal(t, []int64{editor.ID}, before.Parents)
+
+		base.Privileges = `{"param":{"read":true}}`
+		assert.NoError(t, store.Role().Update(ctx, *base, []model.RoleField{model.RoleField_Privileges}))
+		assert.Greater(t, getPolicy(lead).Version, before.Version)
+
+		// the cached privileges of the old version must not be used
+		authLogin(t, user.Email, "secret123")
+		assert.Equal(t, handler.EffectNone, explain("delete").Effect)
+
+		status, _ := setParents(lead)
+		assert.Equal(t, http.StatusOK, status)
+		authLogin(t, user.Email, "secret123")
+		assert.False(t, explain("read").Allowed)
+		assert.True(t, explain("create").Allowed)
+	})
+
+	authLogin(t, "admin@demo.com", "admin123")
+}
@@ -0,0 +1,123 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleValidity(t *testing.T) {
+	f := newFixture(t)
+	store, ctx := f.store, f.ctx
+	now := time.Now()
+	past, soon, later := now.Add(-time.Hour), now.Add(time.Hour), now.Add(24*time.Hour)
+
+	expired := f.role("expired", `{"param":{"delete":true}}`)
+	future := f.role("future", `{"param":{"create":true}}`)
+	current := f.role("current", `{"param":{"read":true}}`)
+	user := f.user("validity", expired, future, current)
+
+	rolesURL := "http://localhost:8080/api/v1/user/" + strconv.FormatInt(user.ID, 10) + "/role"
+	allowed := func(action string) bool {
+		_, bb := f.send(http.MethodGet, "http://localhost:8080/api/v1/auth/explain?resource=param&action="+action, nil)
+		var d handler.Decision
+		assert.NoError(t, json.Unmarshal(bb, &d), string(bb))
+		return d.Allowed
+	}
+
+	t.Run("Assign validity windows", func(t *testing.T) {
+		for _, a := range []struct {
+			role model.Role
+			body handler.UserRoleParam
+		}{
+			{expired, handler.UserRoleParam{ValidUntil: &past}},
+			{future, handler.UserRoleParam{ValidFrom: &soon}},
+			{current, handler.UserRoleParam{ValidFrom: &past, ValidUntil: &later}},
+		} {
+			bb, _ := json.Marshal(a.body)
+			status, bb := f.send(http.MethodPut, rolesURL+"/"+strconv.FormatInt(a.role.ID, 10), bb)
+			assert.Equal(t, http.StatusOK, status, string(bb))
+		}
+
+		bb, _ := json.Marshal(handler.UserRoleParam{ValidFrom: &later, ValidUntil: &soon})
+		status, bb := f.send(http.MethodPut, rolesURL+"/"+strconv.FormatInt(current.ID, 10), bb)
+		assert.Equal(t, http.StatusBadRequest, status, string(bb))
+
+		status, bb = f.send(http.MethodGet, rolesURL, nil)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var list []model.UserRole
+		assert.NoError(t, json.Unmarshal(bb, &list), string(bb))
+		if assert.Len(t, list, 3) {
+			assert.Equal(t, current.ID, list[2].RoleID)
+			assert.WithinDuration(t, later, *list[2].ValidUntil, time.Second)
+		}
+	})
+
+	t.Run("Users show the roles in effect", func(t *testing.T) {
+		userURL := "http://localhost:8080/api/v1/user/" + strconv.FormatInt(user.ID, 10)
+		status, bb := f.send(http.MethodGet, userURL, nil)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var loaded model.User
+		assert.NoError(t, json.Unmarshal(bb, &loaded), string(bb))
+		if assert.Len(t, loaded.Roles, 1) {
+			assert.Equal(t, current.ID, loaded.Roles[0].ID)
+		}
+
+		// writing back the roles shown keeps the others
+		body, _ := json.Marshal(map[string]any{
+			"value":  map[string]any{"version": loaded.Version, "roles": loaded.Roles},
+			"fields": []string{"roles"},
+		})
+		status, bb = f.send(http.MethodPatch, userURL, body)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		held, err := store.UserRole().Find(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Len(t, held, 3)
+	})
+
+	t.Run("Only assignments in their window count", func(t *testing.T) {
+		authLogin(t, user.Email, "secret123")
+		assert.True(t, allowed("read"))
+		assert.False(t, allowed("delete"), "expired")
+		assert.False(t, allowed("create"), "not yet valid")
+	})
+
+	t.Run("Updates keep pending assignments", func(t *testing.T) {
+		loaded, err := store.User().Get(ctx, user.ID)
+		assert.NoError(t, err)
+		loaded.Name = "validity updated"
+		assert.NoError(t, store.User().Update(ctx, *loaded, []model.UserField{model.UserField_Name}))
+
+		var n int
+		err = util.GetPostgresConn("DB").QueryRowContext(ctx,
+			`SELECT COUNT(*) FROM app_user_role WHERE app_user = $1`, user.ID).Scan(&n)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+	})
+
+	t.Run("Expirations are audited once", func(t *testing.T) {
+		_, err := store.UserRole().RecordExpiredRoles(ctx, time.Now())
+		assert.NoError(t, err)
+		_, err = store.UserRole().RecordExpiredRoles(ctx, time.Now())
+		assert.NoError(t, err)
+
+		logs, err := store.AuditLog().ListByResource(ctx, "app_user", strconv.FormatInt(user.ID, 10), 10)
+		assert.NoError(t, err)
+		if assert.Len(t, logs, 1) {
+			assert.Equal(t, model.AuditActionRoleExpired, logs[0].Action)
+			assert.Equal(t, model.AuditActorSystem, logs[0].Actor)
+			var detail map[string]any
+			assert.NoError(t, json.Unmarshal([]byte(logs[0].Detail), &detail))
+			assert.Equal(t, expired.Name, detail["role"])
+		}
+	})
+
+	authLogin(t, "admin@demo.com", "admin123")
+}
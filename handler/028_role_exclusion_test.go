@@ -0,0 +1,134 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleExclusion(t *testing.T) {
+	authLogin(t, "admin@demo.com", "admin123")
+	f := newFixture(t)
+	store, ctx := f.store, f.ctx
+	setPolicy := func(role model.Role, set func(p *model.RolePolicy), fields ...model.RolePolicyField) {
+		policy, err := store.RolePolicy().Get(ctx, role.ID)
+		assert.NoError(t, err)
+		set(policy)
+		assert.NoError(t, store.RolePolicy().Update(ctx, *policy, fields))
+	}
+	createRole := func(name string, parents ...int64) model.Role {
+		role := f.role(name, `{}`)
+		if len(parents) > 0 {
+			setPolicy(role, func(p *model.RolePolicy) { p.Parents = parents }, model.RolePolicyField_Parents)
+		}
+		return role
+	}
+	maker := createRole("maker")
+	checker := createRole("checker")
+	supervisor := createRole("supervisor", checker.ID)
+	approver := createRole("approver")
+	setPolicy(approver, func(p *model.RolePolicy) { p.Excludes = []int64{maker.ID} }, model.RolePolicyField_Excludes)
+
+	patchPolicy := func(role model.Role, field string, ids []int64) (int, []byte) {
+		policy, err := store.RolePolicy().Get(ctx, role.ID)
+		assert.NoError(t, err)
+		return f.send(http.MethodPatch, "http://localhost:8080/api/v1/role/"+strconv.FormatInt(role.ID, 10)+"/policy", map[string]any{
+			"value":  map[string]any{"version": policy.Version, field: ids},
+			"fields": []string{field},
+		})
+	}
+	assertConflict := func(status int, bb []byte, email string, roles ...string) {
+		assert.Equal(t, http.StatusUnprocessableEntity, status, string(bb))
+		var res handler.RoleConflict
+		assert.NoError(t, json.Unmarshal(bb, &res), string(bb))
+		assert.Equal(t, "role_conflict", res.Code)
+		assert.Equal(t, email, res.Email)
+		assert.ElementsMatch(t, roles, res.Roles)
+	}
+
+	status, bb := patchPolicy(maker, "excludes", []int64{checker.ID})
+	assert.Equal(t, http.StatusOK, status, string(bb))
+	policy, err := store.RolePolicy().Get(ctx, checker.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{maker.ID}, policy.Excludes, "exclusions are symmetric")
+
+	email := f.name("sod") + "@demo.com"
+	var user model.User
+
+	t.Run("Create with exclusive roles", func(t *testing.T) {
+		status, bb := f.send(http.MethodPut, "http://localhost:8080/api/v1/user", map[string]any{
+			"email":    email,
+			"name":     "sod",
+			"password": "secret123",
+			"roles":    []model.Role{{ID: maker.ID}, {ID: checker.ID}},
+		})
+		assertConflict(status, bb, email, maker.Name, checker.Name)
+
+		status, bb = f.send(http.MethodPut, "http://localhost:8080/api/v1/user", map[string]any{
+			"email":    email,
+			"name":     "sod",
+			"password": "secret123",
+			"roles":    []model.Role{{ID: maker.ID}},
+		})
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		assert.NoError(t, json.Unmarshal(bb, &user))
+	})
+
+	t.Run("Inherited roles conflict", func(t *testing.T) {
+		loaded, err := store.User().Get(ctx, user.ID)
+		assert.NoError(t, err)
+		status, bb := f.send(http.MethodPatch, "http://localhost:8080/api/v1/user/"+strconv.FormatInt(user.ID, 10), map[string]any{
+			"value": map[string]any{
+				"version": loaded.Version,
+				"roles":   []model.Role{{ID: maker.ID}, {ID: supervisor.ID}},
+			},
+			"fields": []string{"roles"},
+		})
+		assertConflict(status, bb, email, maker.Name, checker.Name)
+	})
+
+	t.Run("Windows that do not overlap", func(t *testing.T) {
+		until, from := time.Now().Add(time.Hour), time.Now().Add(2*time.Hour)
+		assert.NoError(t, store.UserRole().Assign(ctx, model.UserRole{UserID: user.ID, RoleID: maker.ID, ValidUntil: &until}))
+		assert.NoError(t, store.UserRole().Assign(ctx, model.UserRole{UserID: user.ID, RoleID: checker.ID, ValidFrom: &from}))
+		status, bb := f.send(http.MethodPut, "http://localhost:8080/api/v1/user/"+strconv.FormatInt(user.ID, 10)+"/role/"+strconv.FormatInt(checker.ID, 10), nil)
+		assertConflict(status, bb, email, maker.Name, checker.Name)
+	})
+
+	t.Run("Role edits that would cause a conflict", func(t *testing.T) {
+		other := createRole("other")
+		loaded, err := store.User().Get(ctx, user.ID)
+		assert.NoError(t, err)
+		loaded.Roles = append(loaded.Roles, other)
+		assert.NoError(t, store.User().Update(ctx, *loaded, []model.UserField{model.UserField_Roles}))
+
+		status, bb := patchPolicy(other, "parents", []int64{checker.ID})
+		assertConflict(status, bb, email, maker.Name, checker.Name)
+		status, bb = patchPolicy(other, "excludes", []int64{maker.ID})
+		assertConflict(status, bb, email, maker.Name, other.Name)
+	})
+
+	t.Run("Writes that skip the API check", func(t *testing.T) {
+		skipped := f.user("skipped", approver)
+		loaded, err := store.User().Get(ctx, skipped.ID)
+		assert.NoError(t, err)
+		loaded.Roles = append(loaded.Roles, maker)
+		err = store.User().Update(ctx, *loaded, []model.UserField{model.UserField_Roles})
+		conflict := model.AsRoleConflictError(err)
+		if assert.NotNil(t, conflict, "%v", err) {
+			assert.Equal(t, skipped.Email, conflict.Email)
+			assert.ElementsMatch(t, []string{approver.Name, maker.Name}, conflict.Roles)
+		}
+		roles, err := store.UserRole().Find(ctx, skipped.ID)
+		assert.NoError(t, err)
+		assert.Len(t, roles, 1, "the assignment is rolled back")
+	})
+
+	authLogin(t, "admin@demo.com", "admin123")
+}
@@ -0,0 +1,299 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"example.com/app-api/util/jsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeRequest(t *testing.T) {
+	f := newFixture(t)
+	store, ctx := f.store, f.ctx
+	group := f.name("approval")
+	handler.SetApprovalOptions(handler.ApprovalOptions{RolePrivileges: true, ParamGroups: []string{group}})
+	defer handler.SetApprovalOptions(handler.ApprovalOptions{})
+
+	role := f.role("guarded", `{"param":{"read":true}}`)
+	checker := f.role("checker", `{"app_role":{"read":true,"approve":true},"app_user":{"read":true,"approve":true},"param":{"read":true,"approve":true}}`)
+	email := f.user("checker", checker).Email
+	param, err := store.Param().Create(ctx, model.Param{
+		Group:     group,
+		Code:      "limit",
+		Value:     jsql.NullStringValue("10"),
+		UpdatedBy: "test",
+		UpdatedAt: time.Now(),
+	})
+	assert.NoError(t, err)
+
+	request := func(url string, body any) model.ChangeRequest {
+		status, bb := f.send(http.MethodPatch, url, body)
+		assert.Equal(t, http.StatusAccepted, status, string(bb))
+		var cr model.ChangeRequest
+		assert.NoError(t, json.Unmarshal(bb, &cr), string(bb))
+		assert.Equal(t, model.ChangeStatusPending, cr.Status)
+		return cr
+	}
+	requested := func(method, url string, body any) model.ChangeRequest {
+		status, bb := f.send(method, url, body)
+		assert.Equal(t, http.StatusAccepted, status, string(bb))
+		var cr model.ChangeRequest
+		assert.NoError(t, json.Unmarshal(bb, &cr), string(bb))
+		return cr
+	}
+	decide := func(cr model.ChangeRequest, decision string) (int, []byte) {
+		return f.send(http.MethodPost, "http://localhost:8080/api/v1/change_request/"+strconv.FormatInt(cr.ID, 10)+"/"+decision,
+			handler.ChangeRequestDecision{Comment: decision + " by test"})
+	}
+	roleURL := "http://localhost:8080/api/v1/role/" + strconv.FormatInt(role.ID, 10)
+
+	t.Run("Role privileges wait for approval", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+		cr := request(roleURL, map[string]any{
+			"value":  map[string]any{"privileges": `{"param":{"read":true,"update":true}}`},
+			"fields": []string{"privileges"},
+		})
+		loaded, err := store.Role().Get(ctx, role.ID)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"param":{"read":true}}`, loaded.Privileges, "not applied yet")
+
+		status, bb := decide(cr, "approve")
+		assert.Equal(t, http.StatusForbidden, status, string(bb))
+		var res handler.HttpResult
+		assert.NoError(t, json.Unmarshal(bb, &res))
+		assert.Equal(t, "own_change", res.Code)
+
+		authLogin(t, email, "secret123")
+		status, bb = decide(cr, "approve")
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var decided model.ChangeRequest
+		assert.NoError(t, json.Unmarshal(bb, &decided))
+		assert.Equal(t, model.ChangeStatusApproved, decided.Status)
+		assert.Equal(t, "approve by test", decided.Comment)
+		loaded, err = store.Role().Get(ctx, role.ID)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"param":{"read":true,"update":true}}`, loaded.Privileges)
+
+		status, _ = decide(cr, "reject")
+		assert.Equal(t, http.StatusConflict, status, "decided already")
+
+		logs, err := store.AuditLog().ListByResource(ctx, "app_role", strconv.FormatInt(role.ID, 10), 10)
+		assert.NoError(t, err)
+		if assert.Len(t, logs, 2) {
+			assert.Equal(t, model.AuditActionChangeApproved, logs[0].Action)
+			assert.Equal(t, email, logs[0].Actor)
+			assert.Equal(t, model.AuditActionChangeRequested, logs[1].Action)
+		}
+	})
+
+	t.Run("Other role fields are applied at once", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+		status, bb := f.send(http.MethodPatch, roleURL, map[string]any{
+			"value":  map[string]any{"name": role.Name + "-renamed"},
+			"fields": []string{"name"},
+		})
+		assert.Equal(t, http.StatusOK, status, string(bb))
+	})
+
+	t.Run("Rejected param changes are not applied", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+		cr := request("http://localhost:8080/api/v1/param/"+strconv.FormatInt(param.ID, 10), map[string]any{
+			"value":  map[string]any{"value": "1000"},
+			"fields": []string{"value"},
+		})
+
+		authLogin(t, email, "secret123")
+		status, bb := f.send(http.MethodPost, "http://localhost:8080/api/v1/change_request", handler.ChangeRequestFindParam{
+			Filter: model.ChangeRequestFilter{Status: model.ChangeStatusPending, ResourceID: param.ID, Resources: []string{"param"}},
+		})
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var pending []model.ChangeRequest
+		assert.NoError(t, json.Unmarshal(bb, &pending))
+		if assert.Len(t, pending, 1) {
+			assert.Equal(t, cr.ID, pending[0].ID)
+		}
+
+		status, bb = decide(cr, "reject")
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		loaded, err := store.Param().Get(ctx, param.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "10", loaded.Value.String)
+	})
+
+	t.Run("Changes of an updated resource fail", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+		cr := request("http://localhost:8080/api/v1/param/"+strconv.FormatInt(param.ID, 10), map[string]any{
+			"value":  map[string]any{"value": "1000"},
+			"fields": []string{"value"},
+		})
+		err := store.Param().Update(ctx, model.Param{
+			ID:        param.ID,
+			Value:     jsql.NullStringValue("20"),
+			UpdatedAt: time.Now(),
+		}, []model.ParamField{model.ParamField_Value, model.ParamField_UpdatedAt})
+		assert.NoError(t, err)
+
+		authLogin(t, email, "secret123")
+		status, bb := f.send(http.MethodPost, "http://localhost:8080/api/v1/change_request/"+strconv.FormatInt(cr.ID, 10)+"/approve", "approve")
+		assert.Equal(t, http.StatusBadRequest, status, string(bb))
+		assert.Contains(t, string(bb), "invalid_body")
+
+		status, bb = decide(cr, "approve")
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var decided model.ChangeRequest
+		assert.NoError(t, json.Unmarshal(bb, &decided))
+		assert.Equal(t, model.ChangeStatusFailed, decided.Status)
+		assert.Equal(t, "CHANGED_SINCE_REQUEST", decided.Error)
+		loaded, err := store.Param().Get(ctx, param.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "20", loaded.Value.String, "the later update is kept")
+	})
+
+	t.Run("Role creation waits for approval", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+		name := f.name("created")
+		cr := requested(http.MethodPut, "http://localhost:8080/api/v1/role", map[string]any{
+			"name":       name,
+			"privileges": `{"app_role":{"read":true,"update":true}}`,
+		})
+		byName := []model.RoleFilter{{Field: model.RoleField_Name, Op: model.FilterOp_EQ, Value: json.RawMessage(strconv.Quote(name))}}
+		_, total, err := store.Role().Find(ctx, byName, nil, 10, 0)
+		assert.NoError(t, err)
+		assert.Zero(t, total, "not created yet")
+
+		authLogin(t, email, "secret123")
+		status, bb := decide(cr, "approve")
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		_, total, err = store.Role().Find(ctx, byName, nil, 10, 0)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 1, total)
+	})
+
+	t.Run("Role assignment waits for approval", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+		user := f.user("maker")
+		userURL := "http://localhost:8080/api/v1/user/" + strconv.FormatInt(user.ID, 10)
+		assign := requested(http.MethodPut, userURL+"/role/"+strconv.FormatInt(role.ID, 10), handler.UserRoleParam{})
+		requested(http.MethodPatch, userURL, map[string]any{
+			"value":  map[string]any{"version": user.Version, "roles": []map[string]any{{"id": role.ID}}},
+			"fields": []string{"roles"},
+		})
+		held, err := store.UserRole().Find(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, held, "not assigned yet")
+
+		authLogin(t, email, "secret123")
+		status, bb := decide(assign, "approve")
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		held, err = store.UserRole().Find(ctx, user.ID)
+		assert.NoError(t, err)
+		if assert.Len(t, held, 1) {
+			assert.Equal(t, role.ID, held[0].RoleID)
+		}
+
+		// removing roles is applied at once
+		authLogin(t, "admin@demo.com", "admin123")
+		loaded, err := store.User().Get(ctx, user.ID)
+		assert.NoError(t, err)
+		status, bb = f.send(http.MethodPatch, userURL, map[string]any{
+			"value":  map[string]any{"version": loaded.Version, "roles": []map[string]any{}},
+			"fields": []string{"roles"},
+		})
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		held, err = store.UserRole().Find(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, held)
+	})
+
+	t.Run("Roles of a created user wait for approval", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+		cr := requested(http.MethodPut, "http://localhost:8080/api/v1/user", map[string]any{
+			"email":    f.name("created") + "@demo.com",
+			"name":     "created",
+			"password": "secret123",
+			"roles":    []map[string]any{{"id": role.ID}},
+		})
+		assert.NotZero(t, cr.ResourceID, "the user is created")
+		held, err := store.UserRole().Find(ctx, cr.ResourceID)
+		assert.NoError(t, err)
+		assert.Empty(t, held, "without its roles")
+
+		authLogin(t, email, "secret123")
+		status, bb := decide(cr, "approve")
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		held, err = store.UserRole().Find(ctx, cr.ResourceID)
+		assert.NoError(t, err)
+		assert.Len(t, held, 1)
+	})
+
+	t.Run("Param creation and deletion wait for approval", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+		byCode := []model.ParamFilter{
+			{Field: model.ParamField_Group, Op: model.FilterOp_EQ, Value: json.RawMessage(strconv.Quote(group))},
+			{Field: model.ParamField_Code, Op: model.FilterOp_EQ, Value: json.RawMessage(`"created"`)},
+		}
+		create := requested(http.MethodPut, "http://localhost:8080/api/v1/param", map[string]any{
+			"group_name": group,
+			"code":       "created",
+			"value":      "1",
+		})
+		_, total, err := store.Param().Find(ctx, byCode, nil, 10, 0)
+		assert.NoError(t, err)
+		assert.Zero(t, total, "not created yet")
+		remove := requested(http.MethodDelete, "http://localhost:8080/api/v1/param/"+strconv.FormatInt(param.ID, 10), nil)
+		_, err = store.Param().Get(ctx, param.ID)
+		assert.NoError(t, err, "not deleted yet")
+
+		authLogin(t, email, "secret123")
+		status, bb := decide(create, "approve")
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		_, total, err = store.Param().Find(ctx, byCode, nil, 10, 0)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 1, total)
+		status, bb = decide(remove, "approve")
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		_, err = store.Param().Get(ctx, param.ID)
+		if assert.Error(t, err) {
+			assert.Equal(t, "NOT_FOUND", err.Error())
+		}
+	})
+
+	t.Run("Param approvals stay in the scope of the approver", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+		scoped := f.userWith("scoped-checker", `{"param":{"read":true,"approve":{"groups":["`+f.name("other")+`"]}}}`)
+		guarded, err := store.Param().Create(ctx, model.Param{
+			Group:     group,
+			Code:      "scoped",
+			Value:     jsql.NullStringValue("1"),
+			UpdatedBy: "test",
+			UpdatedAt: time.Now(),
+		})
+		assert.NoError(t, err)
+		cr := request("http://localhost:8080/api/v1/param/"+strconv.FormatInt(guarded.ID, 10), map[string]any{
+			"value":  map[string]any{"value": "2"},
+			"fields": []string{"value"},
+		})
+
+		authLogin(t, scoped.Email, "secret123")
+		status, bb := decide(cr, "approve")
+		assert.Equal(t, http.StatusForbidden, status, string(bb))
+		var res handler.HttpResult
+		assert.NoError(t, json.Unmarshal(bb, &res), string(bb))
+		assert.Equal(t, "out_of_scope", res.Code)
+		pending, err := store.ChangeRequest().Get(ctx, cr.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, model.ChangeStatusPending, pending.Status)
+
+		authLogin(t, email, "secret123")
+		status, bb = decide(cr, "approve")
+		assert.Equal(t, http.StatusOK, status, string(bb))
+	})
+
+	authLogin(t, "admin@demo.com", "admin123")
+}
@@ -0,0 +1,133 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"example.com/app-api/util/jsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParamScope(t *testing.T) {
+	f := newFixture(t)
+	store, ctx := f.store, f.ctx
+	gl, fee := f.name("scope-gl"), f.name("scope-fee")
+	user := f.userWith("scoped", `{"param":{"read":{"groups":["`+gl+`"]},"update":{"groups":["`+gl+`"]}}}`)
+	createParam := func(group string) model.Param {
+		param, err := store.Param().Create(ctx, model.Param{
+			Group:     group,
+			Code:      "rate",
+			Value:     jsql.NullStringValue("1"),
+			UpdatedBy: "test",
+			UpdatedAt: time.Now(),
+		})
+		assert.NoError(t, err)
+		return *param
+	}
+	inScope, outOfScope := createParam(gl), createParam(fee)
+
+	paramURL := func(p model.Param) string {
+		return "http://localhost:8080/api/v1/param/" + strconv.FormatInt(p.ID, 10)
+	}
+	assertOutOfScope := func(status int, bb []byte) {
+		assert.Equal(t, http.StatusForbidden, status, string(bb))
+		var res handler.HttpResult
+		assert.NoError(t, json.Unmarshal(bb, &res), string(bb))
+		assert.Equal(t, "out_of_scope", res.Code)
+	}
+	authLogin(t, user.Email, "secret123")
+
+	t.Run("Find returns the rows in scope", func(t *testing.T) {
+		status, bb := f.send(http.MethodPost, "http://localhost:8080/api/v1/param", handler.ParamFindParam{
+			Limit:  10,
+			Filter: []model.ParamFilter{{Field: model.ParamField_Group, Op: model.FilterOp_Like, Value: json.RawMessage(`"scope-%-` + f.suffix + `"`)}},
+		})
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var res struct {
+			List  []model.Param `json:"list"`
+			Total int64         `json:"total"`
+		}
+		assert.NoError(t, json.Unmarshal(bb, &res))
+		assert.Equal(t, int64(1), res.Total)
+		if assert.Len(t, res.List, 1) {
+			assert.Equal(t, inScope.ID, res.List[0].ID)
+		}
+	})
+
+	t.Run("Get rejects rows out of scope", func(t *testing.T) {
+		status, bb := f.send(http.MethodGet, paramURL(inScope), nil)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		status, bb = f.send(http.MethodGet, paramURL(outOfScope), nil)
+		assertOutOfScope(status, bb)
+	})
+
+	t.Run("Update stays in scope", func(t *testing.T) {
+		status, bb := f.send(http.MethodPatch, paramURL(inScope), map[string]any{
+			"value":  map[string]any{"value": "2"},
+			"fields": []string{"value"},
+		})
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		status, bb = f.send(http.MethodPatch, paramURL(outOfScope), map[string]any{
+			"value":  map[string]any{"value": "2"},
+			"fields": []string{"value"},
+		})
+		assertOutOfScope(status, bb)
+		status, bb = f.send(http.MethodPatch, paramURL(inScope), map[string]any{
+			"value":  map[string]any{"group_name": fee},
+			"fields": []string{"group_name"},
+		})
+		assertOutOfScope(status, bb)
+
+		loaded, err := store.Param().Get(ctx, outOfScope.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "1", loaded.Value.String)
+	})
+
+	t.Run("Explain shows the scope", func(t *testing.T) {
+		status, bb := f.send(http.MethodGet, "http://localhost:8080/api/v1/auth/explain?resource=param&action=read", nil)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var d handler.Decision
+		assert.NoError(t, json.Unmarshal(bb, &d))
+		assert.True(t, d.Allowed)
+		assert.Equal(t, model.PrivilegeScope{"groups": {gl}}, d.Scope)
+	})
+
+	t.Run("Find and Get agree on a scope without groups", func(t *testing.T) {
+		open := f.userWith("unscoped", `{"param":{"read":{}}}`)
+		authLogin(t, open.Email, "secret123")
+
+		status, bb := f.send(http.MethodPost, "http://localhost:8080/api/v1/param", handler.ParamFindParam{
+			Limit:  10,
+			Filter: []model.ParamFilter{{Field: model.ParamField_Group, Op: model.FilterOp_Like, Value: json.RawMessage(`"scope-%-` + f.suffix + `"`)}},
+		})
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var res struct {
+			List  []model.Param `json:"list"`
+			Total int64         `json:"total"`
+		}
+		assert.NoError(t, json.Unmarshal(bb, &res))
+		assert.Equal(t, int64(2), res.Total)
+		assert.Len(t, res.List, 2)
+
+		for _, p := range []model.Param{inScope, outOfScope} {
+			status, bb = f.send(http.MethodGet, paramURL(p), nil)
+			assert.Equal(t, http.StatusOK, status, string(bb))
+		}
+	})
+
+	t.Run("Scopes name registered attributes", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+		status, bb := f.send(http.MethodPut, "http://localhost:8080/api/v1/role", model.Role{
+			Name:       f.name("bad-scope"),
+			Privileges: `{"param":{"read":{"codes":["rate"]}}}`,
+		})
+		assert.Equal(t, http.StatusUnprocessableEntity, status, string(bb))
+	})
+
+	authLogin(t, "admin@demo.com", "admin123")
+}
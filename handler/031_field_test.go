@@ -0,0 +1,88 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFieldPrivileges(t *testing.T) {
+	f := newFixture(t)
+	store, ctx := f.store, f.ctx
+	clerk := f.userWith("clerk", `{"app_user":{"read":true,"update":true}}`)
+	auditor := f.userWith("auditor", `{"app_user":{"read":true},"app_user.created_by":{"read":true},"app_user.email":{"read":"deny"}}`)
+
+	userURL := "http://localhost:8080/api/v1/user/" + strconv.FormatInt(clerk.ID, 10)
+	getUser := func() model.User {
+		status, bb := f.send(http.MethodGet, userURL, nil)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var user model.User
+		assert.NoError(t, json.Unmarshal(bb, &user), string(bb))
+		return user
+	}
+
+	t.Run("References are masked", func(t *testing.T) {
+		authLogin(t, clerk.Email, "secret123")
+		user := getUser()
+		assert.Equal(t, clerk.Email, user.Email)
+		if assert.NotNil(t, user.CreatedBy) {
+			assert.Equal(t, int64(1), user.CreatedBy.ID)
+			assert.Empty(t, user.CreatedBy.Email)
+		}
+		if assert.NotNil(t, user.UpdatedBy) {
+			assert.Empty(t, user.UpdatedBy.Email)
+		}
+	})
+
+	t.Run("Granted and denied fields", func(t *testing.T) {
+		authLogin(t, auditor.Email, "secret123")
+		user := getUser()
+		assert.Empty(t, user.Email, "denied")
+		if assert.NotNil(t, user.CreatedBy) {
+			assert.NotEmpty(t, user.CreatedBy.Email, "granted")
+		}
+		if assert.NotNil(t, user.UpdatedBy) {
+			assert.Empty(t, user.UpdatedBy.Email)
+		}
+	})
+
+	t.Run("Server fields are not writable", func(t *testing.T) {
+		authLogin(t, clerk.Email, "secret123")
+		loaded, err := store.User().Get(ctx, clerk.ID)
+		assert.NoError(t, err)
+		status, bb := f.send(http.MethodPatch, userURL, map[string]any{
+			"value": map[string]any{
+				"version":    loaded.Version,
+				"name":       "clerk updated",
+				"created_at": time.Now().Add(-24 * time.Hour),
+				"created_by": map[string]any{"id": clerk.ID},
+			},
+			"fields": []string{"name", "created_at", "created_by"},
+		})
+		assert.Equal(t, http.StatusForbidden, status, string(bb))
+		var res handler.FieldForbidden
+		assert.NoError(t, json.Unmarshal(bb, &res), string(bb))
+		assert.Equal(t, "field_forbidden", res.Code)
+		assert.Equal(t, []string{"created_at", "created_by"}, res.Fields)
+
+		status, bb = f.send(http.MethodPatch, userURL, map[string]any{
+			"value":  map[string]any{"version": loaded.Version, "name": "clerk updated"},
+			"fields": []string{"name"},
+		})
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		loaded, err = store.User().Get(ctx, clerk.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "clerk updated", loaded.Name)
+		if assert.NotNil(t, loaded.CreatedBy) {
+			assert.Equal(t, int64(1), loaded.CreatedBy.ID)
+		}
+	})
+
+	authLogin(t, "admin@demo.com", "admin123")
+}
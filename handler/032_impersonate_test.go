@@ -0,0 +1,113 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"example.com/app-api/util/jsql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImpersonate(t *testing.T) {
+	f := newFixture(t)
+	store, ctx := f.store, f.ctx
+	support := f.userWith("support", `{"app_user":{"read":true,"impersonate":true}}`)
+	other := f.userWith("support2", `{"app_user":{"impersonate":true}}`)
+	target := f.userWith("target", `{"param":{"read":true,"update":true,"delete":true}}`)
+	param, err := store.Param().Create(ctx, model.Param{
+		Group:     f.name("impersonate"),
+		Code:      "limit",
+		Value:     jsql.NullStringValue("1"),
+		UpdatedBy: "test",
+		UpdatedAt: time.Now(),
+	})
+	assert.NoError(t, err)
+
+	impersonate := func(id int64) (int, handler.LoginObject, handler.HttpResult) {
+		status, bb := f.send(http.MethodPost, "http://localhost:8080/api/v1/auth/impersonate/"+strconv.FormatInt(id, 10), nil)
+		var obj handler.LoginObject
+		var res handler.HttpResult
+		_ = json.Unmarshal(bb, &obj)
+		_ = json.Unmarshal(bb, &res)
+		return status, obj, res
+	}
+	paramURL := "http://localhost:8080/api/v1/param/" + strconv.FormatInt(param.ID, 10)
+
+	t.Run("Requires the privilege", func(t *testing.T) {
+		authLogin(t, target.Email, "secret123")
+		status, _, _ := impersonate(support.ID)
+		assert.Equal(t, http.StatusForbidden, status)
+	})
+
+	t.Run("Requires the second factor of the actor", func(t *testing.T) {
+		role := support.Roles[0]
+		setRoleMfa(t, role.ID, true)
+		defer setRoleMfa(t, role.ID, false)
+		authLogin(t, support.Email, "secret123")
+		status, _, res := impersonate(target.ID)
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, "mfa_required", res.Code)
+	})
+
+	t.Run("Act as the user", func(t *testing.T) {
+		authLogin(t, support.Email, "secret123")
+		status, _, res := impersonate(other.ID)
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, "impersonate_privileged", res.Code)
+
+		status, obj, _ := impersonate(target.ID)
+		assert.Equal(t, http.StatusOK, status)
+		if assert.NotNil(t, obj.User) {
+			assert.Equal(t, target.Email, obj.User.Email)
+			assert.Equal(t, support.Email, obj.User.Impersonator)
+		}
+		token = obj.Token
+
+		status, bb := f.send(http.MethodGet, "http://localhost:8080/api/v1/auth/explain?resource=param&action=update", nil)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var d handler.Decision
+		assert.NoError(t, json.Unmarshal(bb, &d))
+		assert.Equal(t, target.Email, d.Email)
+		assert.True(t, d.Allowed)
+
+		status, bb = f.send(http.MethodGet, "http://localhost:8080/api/v1/user/"+strconv.FormatInt(support.ID, 10), nil)
+		assert.Equal(t, http.StatusForbidden, status, "privileges of the subject: %s", bb)
+
+		status, bb = f.send(http.MethodPatch, paramURL, map[string]any{
+			"value":  map[string]any{"value": "2"},
+			"fields": []string{"value"},
+		})
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		status, _ = f.send(http.MethodDelete, paramURL, nil)
+		assert.Equal(t, http.StatusForbidden, status, "blocked while impersonating")
+		_, err := store.Param().Get(ctx, param.ID)
+		assert.NoError(t, err)
+
+		status, _, res = impersonate(other.ID)
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, "impersonation_nested", res.Code)
+
+		status, bb = f.send(http.MethodDelete, "http://localhost:8080/api/v1/auth", handler.LoginObject{Email: target.Email, Token: obj.Token})
+		assert.Equal(t, http.StatusBadRequest, status, "the actor cannot log out the subject: %s", bb)
+		status, bb = f.send(http.MethodDelete, "http://localhost:8080/api/v1/auth", map[string]any{})
+		assert.Equal(t, http.StatusBadRequest, status, "the actor cannot log out the subject: %s", bb)
+	})
+
+	t.Run("Audit keeps the actor", func(t *testing.T) {
+		logs, err := store.AuditLog().ListByResource(ctx, "app_user", strconv.FormatInt(target.ID, 10), 10)
+		assert.NoError(t, err)
+		actions := map[string]string{}
+		for _, l := range logs {
+			actions[l.Action] = l.Actor
+		}
+		assert.Equal(t, support.Email, actions[handler.AuditActionImpersonationStarted])
+		assert.Equal(t, support.Email, actions[handler.AuditActionImpersonatedRequest])
+	})
+
+	authLogin(t, "admin@demo.com", "admin123")
+}
@@ -0,0 +1,102 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"example.com/app-api/handler"
+	"example.com/app-api/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserStatus(t *testing.T) {
+	f := newFixture(t)
+	store, ctx := f.store, f.ctx
+	user := f.userWith("status", `{"param":{"read":true}}`)
+	created, err := store.UserStatus().Get(ctx, user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, model.UserStatusActive, created.Status)
+	assert.Nil(t, created.ChangedAt)
+
+	userURL := "http://localhost:8080/api/v1/user/" + strconv.FormatInt(user.ID, 10)
+
+	authLogin(t, user.Email, "secret123")
+	userToken, userShared := token, shared
+
+	t.Run("Disable", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+		status, bb := f.send(http.MethodPost, userURL+"/disable", handler.UserStatusParam{Status: "active"})
+		assert.Equal(t, http.StatusBadRequest, status, string(bb))
+
+		status, bb = f.send(http.MethodPost, userURL+"/disable", handler.UserStatusParam{Reason: "left the company"})
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var res model.UserStatus
+		assert.NoError(t, json.Unmarshal(bb, &res), string(bb))
+		assert.Equal(t, user.ID, res.UserID)
+		assert.Equal(t, model.UserStatusDisabled, res.Status)
+		assert.Equal(t, "left the company", res.Reason)
+		assert.NotNil(t, res.ChangedAt)
+
+		loaded, err := store.User().Get(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.False(t, loaded.Token.Valid, "sessions are revoked")
+		assert.False(t, loaded.Secret.Valid)
+	})
+
+	t.Run("Disabled user is refused", func(t *testing.T) {
+		token, shared = userToken, userShared
+		status, _ := f.send(http.MethodGet, userURL, nil)
+		assert.Equal(t, http.StatusUnauthorized, status, "existing session")
+
+		status, _ = authLoginStatus(t, user.Email, "secret123")
+		assert.NotEqual(t, http.StatusOK, status, "login")
+	})
+
+	t.Run("Get status", func(t *testing.T) {
+		authLogin(t, "admin@demo.com", "admin123")
+		status, bb := f.send(http.MethodGet, userURL+"/status", nil)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var res model.UserStatus
+		assert.NoError(t, json.Unmarshal(bb, &res), string(bb))
+		assert.Equal(t, model.UserStatusDisabled, res.Status)
+
+		status, bb = f.send(http.MethodGet, "http://localhost:8080/api/v1/user/0/status", nil)
+		assert.Equal(t, http.StatusNotFound, status, string(bb))
+
+		admin, err := store.User().GetByEmail(ctx, "admin@demo.com")
+		assert.NoError(t, err)
+		status, bb = f.send(http.MethodPost, "http://localhost:8080/api/v1/user/"+strconv.FormatInt(admin.ID, 10)+"/disable", nil)
+		assert.Equal(t, http.StatusBadRequest, status, string(bb))
+	})
+
+	t.Run("Lock and enable", func(t *testing.T) {
+		status, bb := f.send(http.MethodPost, userURL+"/disable", handler.UserStatusParam{Status: model.UserStatusLocked})
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		loaded, err := store.UserStatus().Get(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, model.UserStatusLocked, loaded.Status)
+
+		status, bb = f.send(http.MethodPost, userURL+"/enable", nil)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		authLogin(t, user.Email, "secret123")
+		status, _ = f.send(http.MethodGet, "http://localhost:8080/api/v1/param/0", nil)
+		assert.NotEqual(t, http.StatusUnauthorized, status)
+	})
+
+	t.Run("Changes are audited", func(t *testing.T) {
+		logs, err := store.AuditLog().ListByResource(ctx, "app_user", strconv.FormatInt(user.ID, 10), 10)
+		assert.NoError(t, err)
+		count := 0
+		for _, l := range logs {
+			if l.Action == model.AuditActionUserStatusChanged {
+				assert.Equal(t, "admin@demo.com", l.Actor)
+				count++
+			}
+		}
+		assert.Equal(t, 3, count)
+	})
+
+	authLogin(t, "admin@demo.com", "admin123")
+}
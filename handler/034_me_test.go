@@ -0,0 +1,90 @@
+package handler_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"example.com/app-api/handler"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMe(t *testing.T) {
+	f := newFixture(t)
+	store, ctx := f.store, f.ctx
+	role := f.role("me", `{"param":{"read":true}}`)
+	user := f.user("me", role)
+
+	meURL := "http://localhost:8080/api/v1/me"
+	getMe := func() handler.Me {
+		status, bb := f.send(http.MethodGet, meURL, nil)
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		var me handler.Me
+		assert.NoError(t, json.Unmarshal(bb, &me), string(bb))
+		return me
+	}
+
+	authLogin(t, user.Email, "secret123")
+
+	t.Run("Get without a body", func(t *testing.T) {
+		me := getMe()
+		assert.Equal(t, user.ID, me.ID)
+		assert.Equal(t, user.Email, me.Email)
+		assert.Equal(t, []string{role.Name}, me.Roles)
+		assert.Contains(t, me.Privileges, "param")
+		assert.JSONEq(t, `{}`, string(me.Preferences))
+	})
+
+	t.Run("Update name and preferences", func(t *testing.T) {
+		status, bb := f.send(http.MethodPatch, meURL, map[string]any{
+			"name":        "me updated",
+			"preferences": map[string]any{"theme": "dark", "page_size": 50},
+		})
+		assert.Equal(t, http.StatusOK, status, string(bb))
+		me := getMe()
+		assert.Equal(t, "me updated", me.Name)
+		assert.JSONEq(t, `{"theme":"dark","page_size":50}`, string(me.Preferences))
+
+		loaded, err := store.User().Get(ctx, user.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "me updated", loaded.Name)
+		assert.Len(t, loaded.Roles, 1, "roles are kept")
+
+		status, _ = f.send(http.MethodPatch, meURL, map[string]any{"preferences": map[string]any{"theme": "light"}})
+		assert.Equal(t, http.StatusOK, status)
+		me = getMe()
+		assert.Equal(t, "me updated", me.Name, "name is kept")
+		assert.JSONEq(t, `{"theme":"light"}`, string(me.Preferences))
+	})
+
+	t.Run("Invalid updates", func(t *testing.T) {
+		var res handler.HttpResult
+		status, bb := f.send(http.MethodPatch, meURL, map[string]any{"name": "  "})
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.NoError(t, json.Unmarshal(bb, &res), string(bb))
+		assert.Equal(t, "name_required", res.Code)
+
+		status, bb = f.send(http.MethodPatch, meURL, map[string]any{"preferences": []string{"dark"}})
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.NoError(t, json.Unmarshal(bb, &res), string(bb))
+		assert.Equal(t, "invalid_preferences", res.Code)
+
+		status, bb = f.send(http.MethodPatch, meURL, map[string]any{"preferences": map[string]string{"note": strings.Repeat("x", 32<<10)}})
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.NoError(t, json.Unmarshal(bb, &res), string(bb))
+		assert.Equal(t, "preferences_too_large", res.Code)
+	})
+
+	t.Run("Requires a session", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:8080/api/v1/me", nil)
+		assert.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		}
+	})
+
+	authLogin(t, "admin@demo.com", "admin123")
+}
@@ -47,9 +47,8 @@ func TestParamCrudApi(t *testing.T) {
 
 		req, err := http.NewRequest(http.MethodPut, "http://localhost:8080/api/v1/param", bytes.NewReader(body))
 		assert.NoError(t, err)
-		util.SetHMAC(req, body, shared)
-
 		req.Header.Set("Content-Type", "application/json")
+		util.SetSignedHMAC(req, body, shared, "Content-Type")
 		req.AddCookie(&http.Cookie{Name: "session", Value: token})
 
 		resp, err := http.DefaultClient.Do(req)
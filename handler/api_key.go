@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+)
+
+// apiKeyTouchInterval limits the last_used_at writes to one per key and interval.
+const apiKeyTouchInterval = time.Minute
+
+var errInvalidAPIKey = errors.New("invalid api key")
+
+// apiKeyUser resolves the service account of key. The privileges are those of
+// the roles of the user, narrowed to the scope of the key if it has any.
+func apiKeyUser(ctx context.Context, store model.AppStore, key string) (*LoginUser, error) {
+	prefix, secret, ok := util.ParseAPIKey(key)
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+	ak, err := store.APIKey().GetByPrefix(ctx, prefix)
+	if err != nil {
+		if err.Error() == "NOT_FOUND" {
+			return nil, errInvalidAPIKey
+		}
+		return nil, err
+	}
+	hash := util.HashAPIKeySecret(secret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(ak.SecretHash)) != 1 {
+		return nil, errInvalidAPIKey
+	}
+	now := time.Now()
+	if ak.ExpiresAt.Valid && !now.Before(ak.ExpiresAt.Time) {
+		slog.Warn("api key expired", "prefix", prefix, "expires_at", ak.ExpiresAt.Time)
+		return nil, errInvalidAPIKey
+	}
+	user, err := store.User().Get(ctx, ak.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errInvalidAPIKey
+	}
+	if active, err := userActive(ctx, store, user); err != nil {
+		return nil, err
+	} else if !active {
+		return nil, errInvalidAPIKey
+	}
+	luser, err := toLoginUser(ctx, store, user)
+	if err != nil {
+		return nil, err
+	}
+	if ak.Privileges != "" {
+		scope := map[string]any{}
+		if err := json.Unmarshal([]byte(ak.Privileges), &scope); err != nil {
+			// a broken scope must not widen the key to all privileges of the user
+			slog.Error("failed to unmarshal api key privileges", "prefix", prefix, "err", err)
+			return nil, errInvalidAPIKey
+		}
+		luser.scope = scope
+	}
+	luser.APIKey = prefix
+	if !ak.LastUsedAt.Valid || now.Sub(ak.LastUsedAt.Time) > apiKeyTouchInterval {
+		if err := store.APIKey().Touch(ctx, ak.ID, now); err != nil {
+			slog.Warn("failed to update api key last use", "prefix", prefix, "err", err)
+		}
+	}
+	return luser, nil
+}
+
+// ValidateAPIKeyPrivileges checks the privileges of ak like those of a role
+// and that they grant nothing the user of the key is not granted itself. It
+// returns an *httpError answered with 422 otherwise. Rotations check the
+// privileges again, since the roles of the user may have changed since.
+func ValidateAPIKeyPrivileges(ctx context.Context, store model.AppStore, ak model.APIKey) error {
+	if ak.Privileges == "" {
+		return nil
+	}
+	if err := ValidatePrivileges(ak.Privileges); err != nil {
+		return unprocessableError("invalid_privileges", err)
+	}
+	scope := map[string]any{}
+	if err := json.Unmarshal([]byte(ak.Privileges), &scope); err != nil {
+		return unprocessableError("invalid_privileges", err)
+	}
+	user, err := store.User().Get(ctx, ak.UserID)
+	if err != nil {
+		return err
+	}
+	luser, err := toLoginUser(ctx, store, user)
+	if err != nil {
+		return err
+	}
+	// the catalog expands the wildcards of the key
+	for _, p := range PrivilegeCatalog() {
+		for _, action := range p.Actions {
+			if effect, _, _ := privilegeEffect(scope, p.Resource, action); effect != EffectAllow {
+				continue
+			}
+			if !luser.decide(p.Resource, action).Allowed {
+				return unprocessableError("invalid_privileges",
+					fmt.Errorf("privilege %s:%s not granted to %s", p.Resource, action, user.Email))
+			}
+		}
+	}
+	return nil
+}
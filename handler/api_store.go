@@ -0,0 +1,284 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"example.com/app-api/model"
+)
+
+// The generated handlers only call the store. APIStore wraps the store they
+// are registered with and applies the rules of this package to those calls;
+// a rejected call returns an *httpError, which writeInternalError answers.
+// The hand-written handlers apply the rules themselves and take the plain
+// store.
+
+// APIStore returns store with the checks of the generated handlers and
+// registers the privileges they check: the CRUD actions of their resource.
+func APIStore(store model.AppStore) model.AppStore {
+	RegisterPrivileges("app_user", "create", "read", "update", "delete")
+	RegisterFields("app_user", userFieldRules)
+	RegisterPrivileges("app_role", "create", "read", "update", "delete")
+	RegisterPrivileges("param", "create", "read", "update", "delete")
+	RegisterScope("param", "groups")
+	return &apiStore{AppStore: store}
+}
+
+type apiStore struct {
+	model.AppStore
+}
+
+func (s *apiStore) Role() model.RoleStore {
+	return &apiRoleStore{RoleStore: s.AppStore.Role(), store: s.AppStore}
+}
+
+func (s *apiStore) Param() model.ParamStore {
+	return &apiParamStore{ParamStore: s.AppStore.Param(), store: s.AppStore}
+}
+
+func (s *apiStore) User() model.UserStore {
+	return &apiUserStore{UserStore: s.AppStore.User(), store: s.AppStore}
+}
+
+// apiRoleStore only stores privileges naming registered resources and
+// actions, and keeps the changes that need approval as change requests.
+type apiRoleStore struct {
+	model.RoleStore
+	store model.AppStore
+}
+
+func validRolePrivileges(privileges string) error {
+	if err := ValidatePrivileges(privileges); err != nil {
+		slog.Warn("invalid role privileges", "err", err)
+		return unprocessableError("invalid_privileges", err)
+	}
+	return nil
+}
+
+func (s *apiRoleStore) Create(ctx context.Context, obj model.Role) (*model.Role, error) {
+	if err := validRolePrivileges(obj.Privileges); err != nil {
+		return nil, err
+	}
+	if roleCreateNeedsApproval(obj) {
+		// the role has no ID before it is created
+		return nil, changeRequested(ctx, s.store, "app_role", 0, roleChange{Create: &obj})
+	}
+	return s.RoleStore.Create(ctx, obj)
+}
+
+func (s *apiRoleStore) Update(ctx context.Context, obj model.Role, fields []model.RoleField) error {
+	if slices.Contains(fields, model.RoleField_Privileges) {
+		if err := validRolePrivileges(obj.Privileges); err != nil {
+			return err
+		}
+	}
+	change := RoleUpdateParam{Value: obj, Fields: fields}
+	if roleChangeNeedsApproval(change) {
+		return changeRequested(ctx, s.store, "app_role", obj.ID, change)
+	}
+	return s.RoleStore.Update(ctx, obj, fields)
+}
+
+// apiParamStore keeps the params to the scope of the login user and the
+// changes that need approval as change requests.
+type apiParamStore struct {
+	model.ParamStore
+	store model.AppStore
+}
+
+func (s *apiParamStore) Create(ctx context.Context, obj model.Param) (*model.Param, error) {
+	if !paramInScope(ctx, "create", obj) {
+		return nil, outOfScopeError()
+	}
+	if paramGroupNeedsApproval(obj.Group) {
+		// the param has no ID before it is created
+		return nil, changeRequested(ctx, s.store, "param", 0, paramChange{Create: &obj})
+	}
+	return s.ParamStore.Create(ctx, obj)
+}
+
+func (s *apiParamStore) Get(ctx context.Context, id int64) (*model.Param, error) {
+	obj, err := s.ParamStore.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !paramInScope(ctx, "read", *obj) {
+		return nil, outOfScopeError()
+	}
+	return obj, nil
+}
+
+func (s *apiParamStore) Find(ctx context.Context, filter []model.ParamFilter, sorting []model.ParamSorting, limit int, offset int64) ([]model.Param, int64, error) {
+	store := s.ParamStore
+	// like inScope, a scope without groups does not narrow the groups
+	if groups, ok := scopeOf(ctx, "param", "read")["groups"]; ok {
+		store = s.store.ParamInGroups(groups)
+	}
+	return store.Find(ctx, filter, sorting, limit, offset)
+}
+
+func (s *apiParamStore) Update(ctx context.Context, obj model.Param, fields []model.ParamField) error {
+	if err := paramStoredInScope(ctx, s.ParamStore, "update", obj.ID); err != nil {
+		return err
+	}
+	if slices.Contains(fields, model.ParamField_Group) && !paramInScope(ctx, "update", obj) {
+		slog.Warn("param moved out of scope", "id", obj.ID, "group", obj.Group)
+		return outOfScopeError()
+	}
+	change := ParamUpdateParam{Value: obj, Fields: fields}
+	if ok, err := paramChangeNeedsApproval(ctx, s.store, change); err != nil {
+		return err
+	} else if ok {
+		return changeRequested(ctx, s.store, "param", obj.ID, paramChange{ParamUpdateParam: &change})
+	}
+	return s.ParamStore.Update(ctx, obj, fields)
+}
+
+func (s *apiParamStore) Delete(ctx context.Context, id int64) error {
+	if err := paramStoredInScope(ctx, s.ParamStore, "delete", id); err != nil {
+		return err
+	}
+	// without fields only the stored group of the param is checked
+	if ok, err := paramChangeNeedsApproval(ctx, s.store, ParamUpdateParam{Value: model.Param{ID: id}}); err != nil {
+		return err
+	} else if ok {
+		return changeRequested(ctx, s.store, "param", id, paramChange{Delete: true})
+	}
+	return s.ParamStore.Delete(ctx, id)
+}
+
+// apiUserStore masks the fields the login user may not read, rejects
+// updates of the fields it may not write and roles a user must not hold
+// together, records the impersonator as the author of the changes and keeps
+// the role assignments that need approval as change requests.
+type apiUserStore struct {
+	model.UserStore
+	store model.AppStore
+}
+
+// rolesInEffect drops the roles of user assigned outside their validity
+// window; /user/{id}/role lists them all.
+func (s *apiUserStore) rolesInEffect(ctx context.Context, user *model.User) error {
+	if len(user.Roles) == 0 {
+		return nil
+	}
+	held, err := s.store.UserRole().Find(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	user.Roles = slices.DeleteFunc(user.Roles, func(role model.Role) bool {
+		return !slices.ContainsFunc(held, func(ur model.UserRole) bool {
+			return ur.RoleID == role.ID && ur.InEffect(now)
+		})
+	})
+	return nil
+}
+
+func (s *apiUserStore) Get(ctx context.Context, id int64) (*model.User, error) {
+	obj, err := s.UserStore.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.rolesInEffect(ctx, obj); err != nil {
+		return nil, err
+	}
+	maskUser(obj, unreadableFields(ctx, "app_user"))
+	return obj, nil
+}
+
+func (s *apiUserStore) Find(ctx context.Context, filter []model.UserFilter, sorting []model.UserSorting, limit int, offset int64) ([]model.User, int64, error) {
+	list, total, err := s.UserStore.Find(ctx, filter, sorting, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	hidden := unreadableFields(ctx, "app_user")
+	for i := range list {
+		if err := s.rolesInEffect(ctx, &list[i]); err != nil {
+			return nil, 0, err
+		}
+		maskUser(&list[i], hidden)
+	}
+	return list, total, nil
+}
+
+// actorRef is the user behind the request of ctx; the generated handlers
+// name the login user, who is the subject while impersonating.
+func actorRef(ctx context.Context, ref *model.UserRef) *model.UserRef {
+	luser, ok := ctx.Value(HandlerCtxKeyUser).(*LoginUser)
+	if !ok || luser.User == nil {
+		return ref
+	}
+	return &model.UserRef{ID: luser.actorID()}
+}
+
+func (s *apiUserStore) Create(ctx context.Context, obj model.User) (*model.User, error) {
+	obj.CreatedBy = actorRef(ctx, obj.CreatedBy)
+	obj.UpdatedBy = actorRef(ctx, obj.UpdatedBy)
+	if len(obj.Roles) > 0 {
+		if err := s.store.UserRole().Conflicts(ctx, obj); err != nil {
+			return nil, err
+		}
+	}
+	roles := obj.Roles
+	approval := approvalOptions().RolePrivileges && len(roles) > 0
+	if approval {
+		// the user is created without roles, their assignment waits
+		obj.Roles = nil
+	}
+	res, err := s.UserStore.Create(ctx, obj)
+	if err != nil {
+		return nil, err
+	}
+	if approval {
+		change := UserUpdateParam{
+			Value:  model.User{ID: res.ID, Version: res.Version, Roles: roles},
+			Fields: []model.UserField{model.UserField_Roles},
+		}
+		return nil, changeRequested(ctx, s.store, "app_user", res.ID, userChange{UserUpdateParam: &change})
+	}
+	maskUser(res, unreadableFields(ctx, "app_user"))
+	return res, nil
+}
+
+func (s *apiUserStore) Update(ctx context.Context, obj model.User, fields []model.UserField) error {
+	// the generated handler adds updated_by and updated_at to the fields of
+	// the request and sets them itself
+	requested := slices.DeleteFunc(slices.Clone(fields), func(f model.UserField) bool {
+		return f == model.UserField_UpdatedBy || f == model.UserField_UpdatedAt
+	})
+	if err := fieldForbiddenError("app_user", unwritableFields(ctx, "app_user", requested)); err != nil {
+		return err
+	}
+	if slices.Contains(fields, model.UserField_Roles) {
+		// the roles outside their window are not shown, so they are not
+		// removed either
+		held, err := s.store.UserRole().Find(ctx, obj.ID)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, ur := range held {
+			if !ur.InEffect(now) && !slices.ContainsFunc(obj.Roles, func(role model.Role) bool { return role.ID == ur.RoleID }) {
+				obj.Roles = append(obj.Roles, model.Role{ID: ur.RoleID, Name: ur.RoleName})
+			}
+		}
+		if err := s.store.UserRole().Conflicts(ctx, obj); err != nil {
+			return err
+		}
+	}
+	if slices.Contains(fields, model.UserField_UpdatedBy) {
+		obj.UpdatedBy = actorRef(ctx, obj.UpdatedBy)
+	}
+	if slices.Contains(fields, model.UserField_Roles) {
+		if ok, err := userRolesNeedApproval(ctx, s.store, obj.ID, obj.Roles); err != nil {
+			return err
+		} else if ok {
+			change := UserUpdateParam{Value: obj, Fields: fields}
+			return changeRequested(ctx, s.store, "app_user", obj.ID, userChange{UserUpdateParam: &change})
+		}
+	}
+	return s.UserStore.Update(ctx, obj, fields)
+}
@@ -3,22 +3,24 @@ package handler
 import (
 	"context"
 	"crypto/ecdh"
-	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"time"
 
 	"example.com/app-api/model"
 	"example.com/app-api/util"
 	"example.com/app-api/util/jsql"
+	"github.com/golang-jwt/jwt/v5"
 )
 
-func AuthHandlerRegister(mux *http.ServeMux, store model.Store) {
+func AuthHandlerRegister(mux *http.ServeMux, store model.AppStore) {
+	RegisterPrivileges("app_user", "impersonate")
 	mux.HandleFunc("PUT /api/v1/auth", func(w http.ResponseWriter, r *http.Request) {
 		if err := AuthLogin(r.Context(), store, w, r); err != nil {
 			writeInternalError(w, err)
@@ -39,6 +41,61 @@ func AuthHandlerRegister(mux *http.ServeMux, store model.Store) {
 			writeInternalError(w, err)
 		}
 	})
+	mux.HandleFunc("PUT /api/v1/auth/mfa", func(w http.ResponseWriter, r *http.Request) {
+		if err := AuthMfaVerify(r.Context(), store, w, r); err != nil {
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("POST /api/v1/auth/totp", func(w http.ResponseWriter, r *http.Request) {
+		if err := AuthTotpEnroll(r.Context(), store, w, r); err != nil {
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("PUT /api/v1/auth/totp", func(w http.ResponseWriter, r *http.Request) {
+		if err := AuthTotpConfirm(r.Context(), store, w, r); err != nil {
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("DELETE /api/v1/auth/totp", func(w http.ResponseWriter, r *http.Request) {
+		if err := AuthTotpDisable(r.Context(), store, w, r); err != nil {
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("POST /api/v1/auth/reset", func(w http.ResponseWriter, r *http.Request) {
+		if err := AuthResetRequest(r.Context(), store, w, r); err != nil {
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("PUT /api/v1/auth/reset", func(w http.ResponseWriter, r *http.Request) {
+		if err := AuthResetConfirm(r.Context(), store, w, r); err != nil {
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("POST /api/v1/auth/oidc", func(w http.ResponseWriter, r *http.Request) {
+		if err := AuthOidcStart(r.Context(), store, w, r); err != nil {
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("PUT /api/v1/auth/oidc", func(w http.ResponseWriter, r *http.Request) {
+		if err := AuthOidcLogin(r.Context(), store, w, r); err != nil {
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("GET /api/v1/auth/explain", func(w http.ResponseWriter, r *http.Request) {
+		if err := AuthExplain(r.Context(), store, w, r); err != nil {
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("GET /api/v1/auth/privileges", func(w http.ResponseWriter, r *http.Request) {
+		if err := AuthPrivileges(r.Context(), store, w, r); err != nil {
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("POST /api/v1/auth/impersonate/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := AuthImpersonate(r.Context(), store, w, r); err != nil {
+			writeInternalError(w, err)
+		}
+	})
 	mux.HandleFunc("GET /api/v1/auth/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status": "ok"}`))
@@ -48,18 +105,28 @@ func AuthHandlerRegister(mux *http.ServeMux, store model.Store) {
 // swagger: model LoginObjectaRequest
 type LoginObjectRequest struct {
 	PublicKey string `json:"public_key,omitempty"`
+	Kid       string `json:"kid,omitempty"`
 	Email     string `json:"email"`
 	Password  string `json:"password,omitempty"`
+	// Cookie asks for the cookie session mode, see SessionCookieOptions.
+	Cookie bool `json:"cookie,omitempty"`
 }
 
 // swagger: model LoginObject
 type LoginObject struct {
 	PublicKey    string     `json:"public_key,omitempty"`
+	Kid          string     `json:"kid,omitempty"`
 	Email        string     `json:"email"`
 	Password     string     `json:"password,omitempty"`
 	Token        string     `json:"token,omitempty"`
 	RefreshToken string     `json:"refresh_token,omitempty"`
+	MfaRequired  bool       `json:"mfa_required,omitempty"`
+	MfaToken     string     `json:"mfa_token,omitempty"`
+	Code         string     `json:"code,omitempty"`
 	User         *LoginUser `json:"user,omitempty"`
+	Cookie       bool       `json:"cookie,omitempty"`
+	// CsrfToken replaces the tokens in the cookie session mode.
+	CsrfToken string `json:"csrf_token,omitempty"`
 }
 
 var (
@@ -67,9 +134,6 @@ var (
 	TOKEN_EXPIRY         = 5 * time.Minute
 	REFRESH_TOKEN_EXPIRY = 60 * time.Minute
 	curve                = ecdh.P256()
-	sPriv, _             = curve.GenerateKey(rand.Reader)
-	sPub                 = sPriv.PublicKey()
-	sPubXY, _            = util.EncodePubKey(sPub)
 )
 
 func init() {
@@ -95,7 +159,7 @@ func init() {
 	}
 }
 
-func getUser(ctx context.Context, store model.Store, obj *LoginObject) *model.User {
+func getUser(ctx context.Context, store model.AppStore, obj *LoginObject) *model.User {
 	if obj.Email == "" {
 		slog.Warn("email is empty")
 		return nil
@@ -105,12 +169,22 @@ func getUser(ctx context.Context, store model.Store, obj *LoginObject) *model.Us
 		slog.Warn("failed to get user by email", "email", obj.Email, "err", err)
 		return nil
 	}
+	if user == nil && obj.Token == "" && obj.RefreshToken == "" && obj.Password != "" {
+		// unknown locally, an external authenticator may provision the user
+		return authenticatePassword(ctx, store, obj, nil)
+	}
 	if user == nil {
 		slog.Warn("user not found", "email", obj.Email)
 		return nil
 	}
+	if active, err := userActive(ctx, store, user); err != nil {
+		slog.Warn("failed to get user status", "email", obj.Email, "err", err)
+		return nil
+	} else if !active {
+		return nil
+	}
 	if obj.Token != "" {
-		claim, err := ParseHS256(obj.Token)
+		claim, err := ParseToken(obj.Token)
 		if err != nil {
 			slog.Warn("invalid token", "email", obj.Email, "err", err)
 			return nil
@@ -119,10 +193,15 @@ func getUser(ctx context.Context, store model.Store, obj *LoginObject) *model.Us
 			slog.Warn("email mismatch", "email", obj.Email, "token_email", claim.Subject)
 			return nil
 		}
+		if claim.Actor != nil {
+			// the actor must not end or renew the sessions of the subject
+			slog.Warn("impersonation token rejected", "email", obj.Email, "actor", claim.Actor.Subject)
+			return nil
+		}
 		return user
 	}
 	if obj.RefreshToken != "" {
-		claim, err := ParseHS256(obj.RefreshToken)
+		claim, err := ParseToken(obj.RefreshToken)
 		if err != nil {
 			slog.Warn("invalid token", "email", obj.Email, "err", err)
 			return nil
@@ -138,31 +217,49 @@ func getUser(ctx context.Context, store model.Store, obj *LoginObject) *model.Us
 		return user
 	}
 	if obj.Password != "" {
-		if ok, err := util.VerifyPassword(obj.Password, user.Password); err != nil {
-			slog.Warn("failed to verify password", "email", obj.Email, "err", err)
-			return nil
-		} else if !ok {
-			slog.Warn("invalid password", "email", obj.Email)
-			return nil
-		}
-		user.Password = jsql.SecretValueNull()
-		user.Token = jsql.SecretValueNull()
-		return user
+		return authenticatePassword(ctx, store, obj, user)
 	}
 	bb, _ := json.MarshalIndent(obj, "", "  ")
 	slog.Warn("no authentication method provided", "email", obj.Email, "login_object", string(bb))
 	return nil
 }
 
+func authenticatePassword(ctx context.Context, store model.AppStore, obj *LoginObject, user *model.User) *model.User {
+	user = authenticate(ctx, store, obj.Email, obj.Password, user)
+	if user == nil {
+		slog.Warn("invalid password", "email", obj.Email)
+		return nil
+	}
+	user.Password = jsql.SecretValueNull()
+	user.Token = jsql.SecretValueNull()
+	return user
+}
+
+// mergeMap merges the privileges of source into target: a deny wins over a
+// grant, a grant over a scoped grant and that over anything else. The values
+// of scopes add up.
 func mergeMap(target map[string]any, source map[string]any) map[string]any {
 	for k, sv := range source {
 		if tv, ok := target[k]; ok {
 			if svm, ok := sv.(map[string]any); ok {
 				if tvm, ok := tv.(map[string]any); ok {
 					target[k] = mergeMap(tvm, svm)
+				} else if tv != privilegeDeny && tv != true {
+					target[k] = sv
+				}
+			} else if sva, ok := sv.([]any); ok {
+				if tva, ok := tv.([]any); ok {
+					for _, v := range sva {
+						if !slices.Contains(tva, v) {
+							tva = append(tva, v)
+						}
+					}
+					target[k] = tva
 				} else {
 					target[k] = sv
 				}
+			} else if tv == privilegeDeny {
+				continue
 			} else if svb, ok := sv.(bool); ok {
 				if svb {
 					target[k] = sv
@@ -177,28 +274,65 @@ func mergeMap(target map[string]any, source map[string]any) map[string]any {
 	return target
 }
 
-func toLoginUser(user *model.User) *LoginUser {
+// toLoginUser resolves the privileges of the user roles in effect, including
+// the roles they inherit.
+func toLoginUser(ctx context.Context, store model.AppStore, user *model.User) (*LoginUser, error) {
+	assigned, err := store.UserRole().Find(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	inEffect := make(map[int64]bool, len(assigned))
+	for _, a := range assigned {
+		inEffect[a.RoleID] = a.InEffect(now)
+	}
+	active := make([]model.Role, 0, len(user.Roles))
+	ids := make([]int64, 0, len(user.Roles))
+	for _, role := range user.Roles {
+		if inEffect[role.ID] {
+			active = append(active, role)
+			ids = append(ids, role.ID)
+		}
+	}
+	effective, err := resolveRoles(ctx, store, ids)
+	if err != nil {
+		return nil, err
+	}
 	roles := []string{}
 	mprivs := map[string]any{}
-	for _, role := range user.Roles {
+	mfaRequired := false
+	rprivs := make([]rolePrivileges, 0, len(active))
+	for _, role := range active {
 		roles = append(roles, role.Name)
-		p := map[string]any{}
-		err := json.Unmarshal([]byte(role.Privileges), &p)
-		if err != nil {
-			slog.Warn("failed to unmarshal role privileges", "role", role.Name, "privileges", role.Privileges, "err", err)
+		e, ok := effective[role.ID]
+		if !ok {
+			continue
+		}
+		mfaRequired = mfaRequired || e.mfaRequired
+		for i, inherited := range e.roles {
+			rp := rolePrivileges{role: inherited.name, privileges: inherited.parsed}
+			if i > 0 {
+				rp.via = role.Name
+			}
+			rprivs = append(rprivs, rp)
+			// mergeMap shares the nested maps of its source, merge a copy
+			merged := map[string]any{}
+			_ = json.Unmarshal([]byte(inherited.privileges), &merged)
+			mprivs = mergeMap(mprivs, merged)
 		}
-		mprivs = mergeMap(mprivs, p)
 	}
 	cuser := *user
 	cuser.Password = jsql.SecretValueNull()
 	cuser.Token = jsql.SecretValueNull()
 	return &LoginUser{
-		Name:       user.Name,
-		Email:      user.Email,
-		Privileges: mprivs,
-		Roles:      roles,
-		User:       &cuser,
-	}
+		Name:        user.Name,
+		Email:       user.Email,
+		Privileges:  mprivs,
+		Roles:       roles,
+		MfaRequired: mfaRequired,
+		User:        &cuser,
+		roles:       rprivs,
+	}, nil
 }
 
 // ShowUser   godoc
@@ -213,10 +347,15 @@ func toLoginUser(user *model.User) *LoginUser {
 // @Failure      404  {object}  HttpResult
 // @Failure      500  {object}  HttpResult
 // @Router       /auth [put]
-func AuthLogin(ctx context.Context, store model.Store, w http.ResponseWriter, r *http.Request) error {
+func AuthLogin(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
 	var obj LoginObject
 	if r.Header.Get("X-Req-Signature") == "" {
-		obj.PublicKey = sPubXY
+		skey, err := serverKeys.get(ctx, store, "")
+		if err != nil {
+			return err
+		}
+		obj.PublicKey = skey.PublicKey
+		obj.Kid = skey.Kid
 		_ = json.NewEncoder(w).Encode(obj)
 		return nil
 	}
@@ -242,13 +381,19 @@ func AuthLogin(ctx context.Context, store model.Store, w http.ResponseWriter, r
 		return nil
 	}
 
-	shared, err := sPriv.ECDH(cpub)
+	skey, err := serverKeys.get(ctx, store, obj.Kid)
+	if err != nil {
+		slog.Warn("invalid server key", "kid", obj.Kid, "err", err)
+		writeBadRequest(w, "invalid_kid")
+		return nil
+	}
+	shared, err := skey.Private.ECDH(cpub)
 	slog.Debug("computed shared secret", "email", obj.Email, "shared_len", base64.RawStdEncoding.EncodeToString(shared))
 	if err != nil {
 		slog.Warn("failed to compute shared secret", "err", err)
 	}
-	if !BasicHMAC(r, "auth", "login", shared) {
-		w.WriteHeader(http.StatusBadRequest)
+	if reason := VerifyHMAC(r, shared); reason != "" {
+		writeBadRequest(w, reason)
 		return nil
 	}
 
@@ -262,12 +407,44 @@ func AuthLogin(ctx context.Context, store model.Store, w http.ResponseWriter, r
 		w.WriteHeader(http.StatusBadRequest)
 		return nil
 	}
-	obj.Token, err = SignHS256(user.Email, TOKEN_EXPIRY)
+	return loginSession(ctx, store, w, &obj, user, shared)
+}
+
+// loginSession completes an authenticated login: it either starts the second
+// factor step or issues the session tokens bound to the ECDH shared secret.
+func loginSession(ctx context.Context, store model.AppStore, w http.ResponseWriter, obj *LoginObject, user *model.User, shared []byte) error {
+	mfa, err := store.UserMfa().Get(ctx, user.ID)
+	if err != nil && err.Error() != "NOT_FOUND" {
+		slog.Error("failed to get user mfa", "email", obj.Email, "err", err)
+		return fmt.Errorf("login failed")
+	}
+	if mfa != nil && mfa.Enabled {
+		// keep the shared secret for signing the second step, but issue no session yet
+		user.Secret = jsql.SecretValue(base64.RawStdEncoding.EncodeToString(shared))
+		err = store.User().Update(ctx, *user, []model.UserField{model.UserField_Secret})
+		if err != nil {
+			slog.Error("failed to update user secret", "err", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return nil
+		}
+		obj.MfaRequired = true
+		obj.MfaToken, err = SignTokenClaims(JwtClaims{
+			Scope:            "mfa",
+			RegisteredClaims: jwt.RegisteredClaims{Subject: user.Email},
+		}, MFA_TOKEN_EXPIRY)
+		if err != nil {
+			slog.Error("failed to sign mfa token", "err", err)
+			return fmt.Errorf("login failed")
+		}
+		_ = json.NewEncoder(w).Encode(obj)
+		return nil
+	}
+	obj.Token, err = SignToken(user.Email, TOKEN_EXPIRY)
 	if err != nil {
 		slog.Error("failed to sign token", "err", err)
 		return fmt.Errorf("login failed")
 	}
-	obj.RefreshToken, err = SignHS256(user.Email, REFRESH_TOKEN_EXPIRY)
+	obj.RefreshToken, err = SignToken(user.Email, REFRESH_TOKEN_EXPIRY)
 	if err != nil {
 		slog.Error("failed to sign refresh token", "err", err)
 		w.WriteHeader(http.StatusBadRequest)
@@ -283,16 +460,19 @@ func AuthLogin(ctx context.Context, store model.Store, w http.ResponseWriter, r
 		w.WriteHeader(http.StatusBadRequest)
 		return nil
 	}
-	obj.User = toLoginUser(user)
+	if obj.Cookie {
+		obj.Cookie = setSessionCookies(w, obj)
+	}
+	obj.User, err = toLoginUser(ctx, store, user)
+	if err != nil {
+		slog.Error("failed to resolve user roles", "email", user.Email, "err", err)
+		return fmt.Errorf("login failed")
+	}
 	_ = json.NewEncoder(w).Encode(obj)
 	return nil
 }
 
-func AuthRefresh(ctx context.Context, store model.Store, w http.ResponseWriter, r *http.Request) error {
-	if !BasicHMAC(r, "auth", "refresh", nil) {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil
-	}
+func AuthRefresh(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
 	var obj LoginObject
 	err := json.NewDecoder(r.Body).Decode(&obj)
 	if err != nil {
@@ -301,6 +481,20 @@ func AuthRefresh(ctx context.Context, store model.Store, w http.ResponseWriter,
 	}
 	obj.Password = ""
 	obj.Token = ""
+	if obj.RefreshToken == "" {
+		// cookie session mode: the script cannot read the refresh token
+		if c, _ := r.Cookie(refreshCookieName); c != nil && c.Value != "" {
+			obj.RefreshToken = c.Value
+			obj.Cookie = true
+		}
+	}
+	mfa := false
+	if claim, err := ParseToken(obj.RefreshToken); err == nil {
+		mfa = claim.Mfa
+		if obj.Email == "" {
+			obj.Email = claim.Subject
+		}
+	}
 	var user *model.User
 	user = getUser(ctx, store, &obj)
 	obj.RefreshToken = ""
@@ -321,18 +515,18 @@ func AuthRefresh(ctx context.Context, store model.Store, w http.ResponseWriter,
 		w.WriteHeader(http.StatusBadRequest)
 		return nil
 	}
-	if !BasicHMAC(r, "auth", "refresh", shared) {
-		slog.Warn("invalid hmac for refresh", "email", obj.Email)
-		w.WriteHeader(http.StatusBadRequest)
+	if reason := VerifyHMAC(r, shared); reason != "" {
+		slog.Warn("invalid hmac for refresh", "email", obj.Email, "reason", reason)
+		writeBadRequest(w, reason)
 		return nil
 	}
 
-	obj.Token, err = SignHS256(user.Email, TOKEN_EXPIRY)
+	obj.Token, err = signSessionToken(user.Email, mfa, TOKEN_EXPIRY)
 	if err != nil {
 		slog.Error("failed to sign token", "err", err)
 		return fmt.Errorf("login failed")
 	}
-	obj.RefreshToken, err = SignHS256(user.Email, REFRESH_TOKEN_EXPIRY)
+	obj.RefreshToken, err = signSessionToken(user.Email, mfa, REFRESH_TOKEN_EXPIRY)
 	if err != nil {
 		slog.Error("failed to sign refresh token", "err", err)
 		return fmt.Errorf("login failed")
@@ -346,12 +540,19 @@ func AuthRefresh(ctx context.Context, store model.Store, w http.ResponseWriter,
 		slog.Error("failed to update user token", "err", err)
 		return fmt.Errorf("refresh token failed")
 	}
-	obj.User = toLoginUser(user)
+	if obj.Cookie {
+		obj.Cookie = setSessionCookies(w, &obj)
+	}
+	obj.User, err = toLoginUser(ctx, store, user)
+	if err != nil {
+		slog.Error("failed to resolve user roles", "email", user.Email, "err", err)
+		return fmt.Errorf("refresh token failed")
+	}
 	_ = json.NewEncoder(w).Encode(obj)
 	return nil
 }
 
-func AuthLogout(ctx context.Context, store model.Store, w http.ResponseWriter, r *http.Request) error {
+func AuthLogout(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
 	var obj LoginObject
 	err := json.NewDecoder(r.Body).Decode(&obj)
 	if err != nil {
@@ -361,8 +562,19 @@ func AuthLogout(ctx context.Context, store model.Store, w http.ResponseWriter, r
 	obj.Password = ""
 	obj.RefreshToken = ""
 	var user *model.User
-	user = getUser(ctx, store, &obj)
+	luser, _ := ctx.Value(HandlerCtxKeyUser).(*LoginUser)
+	if obj.Token == "" && luser != nil && luser.APIKey == "" && luser.Impersonator == "" {
+		// cookie session mode: Secure has authenticated the session cookie
+		user, err = store.User().GetByEmail(ctx, luser.Email)
+		if err != nil {
+			slog.Warn("failed to get user by email", "email", luser.Email, "err", err)
+			user = nil
+		}
+	} else {
+		user = getUser(ctx, store, &obj)
+	}
 	obj.Token = ""
+	clearSessionCookies(w)
 	if user == nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return nil
@@ -382,7 +594,9 @@ func AuthLogout(ctx context.Context, store model.Store, w http.ResponseWriter, r
 	return nil
 }
 
-func AuthGet(ctx context.Context, store model.Store, w http.ResponseWriter, r *http.Request) error {
+// AuthGet returns the user of the login object in the body. Clients that
+// cannot send a body on a GET use MeGet, which relies on the session.
+func AuthGet(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
 	var obj LoginObject
 	err := json.NewDecoder(r.Body).Decode(&obj)
 	if err != nil {
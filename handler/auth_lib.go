@@ -8,30 +8,13 @@ import (
 	"encoding/base64"
 	"log/slog"
 	"net/http"
+	"slices"
 	"strings"
-	"sync"
 	"time"
 
 	"example.com/app-api/model"
-	lru "github.com/hashicorp/golang-lru/v2"
 )
 
-type Params struct {
-	Memory      uint32 // in KiB
-	Iterations  uint32
-	Parallelism uint8
-	SaltLen     uint32
-	KeyLen      uint32
-}
-
-var hashParam = &Params{
-	Memory:      64 * 1024, // 64 MiB
-	Iterations:  3,
-	Parallelism: 2,
-	SaltLen:     16,
-	KeyLen:      32,
-}
-
 // swagger: model LoginUser
 type LoginUser struct {
 	Email      string         `json:"email"`
@@ -39,23 +22,47 @@ type LoginUser struct {
 	User       *model.User    `json:"user,omitempty"`
 	Roles      []string       `json:"roles,omitempty"`
 	Privileges map[string]any `json:"privileges,omitempty"`
-}
+	// MfaRequired is set when any role of the user, or a role it includes,
+	// requires a second factor.
+	MfaRequired bool `json:"mfa_required,omitempty"`
+	// APIKey is the prefix of the API key the request authenticated with.
+	APIKey string `json:"api_key,omitempty"`
+	// Impersonator is the email of the user acting as this one.
+	Impersonator string `json:"impersonator,omitempty"`
 
-var (
-	nonces, _  = lru.New[string, struct{}](100000)
-	noncesLock sync.Mutex
-)
+	// roles keeps the privileges per role to explain decisions, see decide.
+	roles []rolePrivileges
+	// scope narrows the privileges of an API key; nil for other logins.
+	scope map[string]any
+	// impersonatorID is the user ID of Impersonator.
+	impersonatorID int64
+	// mfa is set when the session token was issued after a second factor.
+	mfa bool
+}
 
 type Authenticate func(r *http.Request, resourece, action string) bool
 
-func Secure(store model.Store, next http.Handler) http.Handler {
+func Secure(store model.AppStore, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w, r = withSignatureStatus(w, r)
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			luser, err := apiKeyUser(r.Context(), store, key)
+			if err != nil {
+				slog.Warn("api key rejected", "path", r.URL.Path, "error", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("unauthorized"))
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(),
+				HandlerCtxKeyUser, luser)))
+			return
+		}
 		var claim *JwtClaims
 		var err error
 		auth := r.Header.Get("Authorization")
 		if strings.HasPrefix(auth, "Bearer ") {
 			token := auth[7:]
-			claim, err = ParseHS256(token)
+			claim, err = ParseToken(token)
 			if err != nil {
 				w.WriteHeader(http.StatusUnauthorized)
 				w.Write([]byte("unauthorized"))
@@ -63,14 +70,20 @@ func Secure(store model.Store, next http.Handler) http.Handler {
 			}
 		}
 		if claim == nil {
-			session, _ := r.Cookie("session")
-			if session != nil {
-				claim, err = ParseHS256(session.Value)
-				if err != nil {
+			claim, err = sessionFromCookies(r.Context(), store, w, r)
+			if err != nil {
+				slog.Warn("invalid session cookie", "path", r.URL.Path, "error", err)
+				clearSessionCookies(w)
+				// a stale cookie must not lock the user out of the login
+				if !sessionlessRoute(r) {
 					w.WriteHeader(http.StatusUnauthorized)
 					w.Write([]byte("unauthorized"))
 					return
 				}
+			} else if claim != nil && sessionCookieOptions().Enabled && !validCSRF(r) {
+				slog.Warn("invalid csrf token", "path", r.URL.Path, "method", r.Method)
+				writeForbidenCode(w, "csrf_invalid")
+				return
 			}
 		}
 		if claim != nil {
@@ -99,120 +112,228 @@ func Secure(store model.Store, next http.Handler) http.Handler {
 				w.Write([]byte("unauthorized"))
 				return
 			}
+			if active, err := userActive(r.Context(), store, user); err != nil || !active {
+				if err != nil {
+					slog.Error("get user status", "email", user.Email, "error", err)
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("unauthorized"))
+				return
+			}
+			luser, err := toLoginUser(r.Context(), store, user)
+			if err != nil {
+				slog.Error("resolve user roles", "email", user.Email, "error", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("unauthorized"))
+				return
+			}
+			luser.mfa = claim.Mfa
+			if claim.Actor != nil {
+				if err := impersonate(r, store, luser, claim.Actor.Subject); err != nil {
+					slog.Warn("impersonation rejected", "actor", claim.Actor.Subject, "subject", user.Email, "error", err)
+					w.WriteHeader(http.StatusUnauthorized)
+					w.Write([]byte("unauthorized"))
+					return
+				}
+			}
+			if luser.MfaRequired && !claim.Mfa && !mfaExemptRoute(r) {
+				slog.Warn("second factor required", "email", user.Email, "path", r.URL.Path)
+				writeForbidenCode(w, "mfa_required")
+				return
+			}
 			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(),
-				HandlerCtxKeyUser, toLoginUser(user))))
+				HandlerCtxKeyUser, luser)))
 		} else {
 			next.ServeHTTP(w, r)
 		}
 	})
 }
 
+// sessionlessRoute reports whether r logs in or out, or resets the password:
+// the routes that need no session.
+func sessionlessRoute(r *http.Request) bool {
+	switch r.Method + " " + r.URL.Path {
+	case "PUT /api/v1/auth", "DELETE /api/v1/auth", "PUT /api/v1/auth/mfa",
+		"POST /api/v1/auth/oidc", "PUT /api/v1/auth/oidc",
+		"POST /api/v1/auth/reset", "PUT /api/v1/auth/reset":
+		return true
+	}
+	return false
+}
+
+// mfaExemptRoute reports whether r is one of the routes a user whose role
+// requires a second factor reaches without it: to enroll the second factor,
+// to use it and to log out.
+func mfaExemptRoute(r *http.Request) bool {
+	switch r.Method + " " + r.URL.Path {
+	case "POST /api/v1/auth/totp", "PUT /api/v1/auth/totp", "PUT /api/v1/auth/mfa", "DELETE /api/v1/auth":
+		return true
+	}
+	return false
+}
+
+// BasicHMAC reports whether the request is signed with shared.
 func BasicHMAC(r *http.Request, resource, action string, shared []byte) bool {
+	return VerifyHMAC(r, shared) == ""
+}
+
+// VerifyHMAC checks the X-Req-* signature headers of the request against
+// shared and returns the reason code of a rejection, "" for a valid signature.
+// Headers listed in X-Req-Signed-Headers are covered by the signature.
+func VerifyHMAC(r *http.Request, shared []byte) string {
 	var hmacSignature, nonce, reqTime string
 	if hmacSignature = r.Header.Get("X-Req-Signature"); hmacSignature == "" {
 		slog.Warn("missing X-Req-Signature header", "url", r.URL.String(), "method", r.Method)
-		return false
+		return SignatureMissing
 	}
 	if nonce = r.Header.Get("X-Req-Nonce"); nonce == "" {
 		slog.Warn("missing X-Nonce header", "url", r.URL.String(), "method", r.Method)
-		return false
+		return SignatureNonceMissing
 	}
 	if len(nonce) < 20 {
 		slog.Warn("X-Req-Nonce header too short", "url", r.URL.String(), "method", r.Method, "nonce", nonce)
-		return false
+		return SignatureNonceMissing
 	}
 	if reqTime = r.Header.Get("X-Req-Timestamp"); reqTime == "" {
 		slog.Warn("missing X-Req-Timestamp header", "url", r.URL.String(), "method", r.Method)
-		return false
+		return SignatureTimestampError
 	}
-	if rt, err := time.Parse(time.RFC3339, reqTime); err != nil {
+	skew := hmacClockSkew()
+	rt, err := time.Parse(time.RFC3339, reqTime)
+	if err != nil {
 		slog.Warn("invalid X-Req-Timestamp header", "url", r.URL.String(), "method", r.Method, "reqTime", reqTime, "error", err)
-		return false
-	} else if time.Since(rt) > 1*time.Minute || time.Until(rt) > 1*time.Minute {
+		return SignatureTimestampError
+	} else if time.Since(rt) > skew || time.Until(rt) > skew {
 		slog.Warn("X-Req-Timestamp header out of range", "url", r.URL.String(), "method", r.Method, "reqTime", reqTime)
-		return false
+		return SignatureTimestampSkew
 	}
-	if len(shared) > 0 {
-		bodyHash := r.Header.Get("X-Body-Hash")
-		var buf bytes.Buffer
-		var ok bool
-		if buf, ok = r.Context().Value(HandlerCtxKeyBody).(bytes.Buffer); !ok {
-			slog.Warn("missing body in context", "url", r.URL.String(), "method", r.Method)
-		}
-		mac := hmac.New(sha256.New, []byte(nonce))
-		mac.Write(buf.Bytes())
-		rawBodyHash := mac.Sum(nil)
-		calcBodyHash := base64.RawStdEncoding.EncodeToString(rawBodyHash)
-		if bodyHash != calcBodyHash {
-			slog.Warn("X-Body-Hash header does not match request body", "url", r.URL.String(), "method", r.Method,
-				"body_hash", bodyHash, "calc_body_hash", calcBodyHash)
-			return false
+	if len(shared) == 0 {
+		slog.Warn("missing shared secret for signature", "url", r.URL.String(), "method", r.Method)
+		return SignatureSecretMissing
+	}
+	var signedHeaders []string
+	for _, h := range strings.Split(r.Header.Get("X-Req-Signed-Headers"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			signedHeaders = append(signedHeaders, http.CanonicalHeaderKey(h))
 		}
-		{
-			noncesLock.Lock()
-			defer noncesLock.Unlock()
-			nkey := reqTime + "-" + nonce
-
-			if _, exists := nonces.Get(nkey); exists {
-				slog.Warn("nonce replay attack detected", "url", r.URL.String(), "method", r.Method, "nonce", nonce)
-				return false
-			}
-			nonces.Add(nkey, struct{}{})
+	}
+	for _, h := range hmacSignedHeaders() {
+		if r.Header.Get(h) != "" && !slices.Contains(signedHeaders, h) {
+			slog.Warn("header not covered by signature", "url", r.URL.String(), "method", r.Method, "header", h)
+			return SignatureHeaderUnsigned
 		}
-		mac = hmac.New(sha256.New, shared)
-		mac.Write([]byte(nonce))
-		mac.Write([]byte(";"))
-		mac.Write([]byte(reqTime))
-		mac.Write([]byte(";"))
-		mac.Write([]byte(r.Method))
-		mac.Write([]byte(";"))
-		mac.Write([]byte(r.URL.RequestURI()))
+	}
+	bodyHash := r.Header.Get("X-Body-Hash")
+	var buf bytes.Buffer
+	var ok bool
+	if buf, ok = r.Context().Value(HandlerCtxKeyBody).(bytes.Buffer); !ok {
+		slog.Warn("missing body in context", "url", r.URL.String(), "method", r.Method)
+	}
+	mac := hmac.New(sha256.New, []byte(nonce))
+	mac.Write(buf.Bytes())
+	rawBodyHash := mac.Sum(nil)
+	calcBodyHash := base64.RawStdEncoding.EncodeToString(rawBodyHash)
+	if bodyHash != calcBodyHash {
+		slog.Warn("X-Body-Hash header does not match request body", "url", r.URL.String(), "method", r.Method,
+			"body_hash", bodyHash, "calc_body_hash", calcBodyHash)
+		return SignatureBodyMismatch
+	}
+	mac = hmac.New(sha256.New, shared)
+	mac.Write([]byte(nonce))
+	mac.Write([]byte(";"))
+	mac.Write([]byte(reqTime))
+	mac.Write([]byte(";"))
+	mac.Write([]byte(r.Method))
+	mac.Write([]byte(";"))
+	mac.Write([]byte(r.URL.RequestURI()))
+	mac.Write([]byte(";"))
+	mac.Write([]byte(calcBodyHash))
+	for _, h := range signedHeaders {
 		mac.Write([]byte(";"))
-		mac.Write([]byte(calcBodyHash))
-		calcSignature := base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
-		if hmacSignature != calcSignature {
-			slog.Warn("X-Req-Signature header does not match", "url", r.URL.String(),
-				"nonce", nonce, "method", r.Method, "RequestURI", r.URL.RequestURI(),
-				"calc_body_hash", calcBodyHash, "hmacSignature", hmacSignature,
-				"calc_signature", calcSignature,
-			)
-			return false
-		}
+		mac.Write([]byte(strings.ToLower(h) + ":" + strings.TrimSpace(r.Header.Get(h))))
+	}
+	calcSignature := base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+	if hmacSignature != calcSignature {
+		slog.Warn("X-Req-Signature header does not match", "url", r.URL.String(),
+			"nonce", nonce, "method", r.Method, "RequestURI", r.URL.RequestURI(),
+			"calc_body_hash", calcBodyHash, "hmacSignature", hmacSignature,
+			"calc_signature", calcSignature,
+		)
+		return SignatureMismatch
+	}
+	// only signed requests are recorded, so unauthenticated clients cannot fill the cache;
+	// after rt+skew the timestamp check rejects the request anyway
+	fresh, err := nonceStore.Add(r.Context(), reqTime+"-"+nonce, rt.Add(skew+time.Second))
+	if err != nil {
+		slog.Error("failed to record nonce", "url", r.URL.String(), "method", r.Method, "error", err)
+		return SignatureNonceError
+	}
+	if !fresh {
+		slog.Warn("nonce replay attack detected", "url", r.URL.String(), "method", r.Method, "nonce", nonce)
+		return SignatureNonceReplay
+	}
+	return ""
+}
+
+// UserHMAC verifies the request signature with the shared secret of the login user.
+func UserHMAC(r *http.Request, luser *LoginUser, resource, action string) bool {
+	if luser.User.Secret.Valid == false || luser.User.Secret.String == "" {
+		slog.Warn("missing user secret for action", "user", luser.Email, "resource", resource, "action", action)
+		setSignatureError(r, SignatureSecretMissing)
+		return false
+	}
+	shared, err := base64.RawStdEncoding.DecodeString(luser.User.Secret.String)
+	if err != nil {
+		slog.Warn("invalid user secret for action", "user", luser.Email, "resource", resource, "action", action, "error", err)
+		setSignatureError(r, SignatureSecretMissing)
+		return false
+	}
+	if reason := VerifyHMAC(r, shared); reason != "" {
+		setSignatureError(r, reason)
+		return false
 	}
 	return true
 }
 
 func BasicAuthenticate(r *http.Request, resource, action string) bool {
-	if luser, ok := r.Context().Value(HandlerCtxKeyUser).(*LoginUser); !ok {
+	luser, ok := r.Context().Value(HandlerCtxKeyUser).(*LoginUser)
+	if !ok {
 		slog.Warn("missing login user in context")
+		return false
 	} else if luser == nil {
 		slog.Warn("nil login user in context")
-	} else if pm, ok := luser.Privileges[resource].(map[string]any); ok {
-		if b, ok := pm[action].(bool); ok {
-			if b {
-				method := r.Method
-				if method == http.MethodPatch || method == http.MethodPut || method == http.MethodDelete {
-					if luser.User.Secret.Valid == false || luser.User.Secret.String == "" {
-						slog.Warn("missing user secret for action", "user", luser.Email, "resource", resource, "action", action)
-						return false
-					}
-					shared, err := base64.RawStdEncoding.DecodeString(luser.User.Secret.String)
-					if err != nil {
-						slog.Warn("invalid user secret for action", "user", luser.Email, "resource", resource, "action", action, "error", err)
-						return false
-					}
-					if !BasicHMAC(r, resource, action, shared) {
-						return false
-					}
-				}
-				return true
-			}
-			slog.Warn("missing privilege for action", "resource", resource, "action", action, "user", luser.Email, "res.privileges", pm)
-		} else {
-			slog.Warn("missing privilege for action", "resource", resource, "action", action, "user", luser.Email, "res.privileges", pm)
+		return false
+	}
+	d := luser.decide(resource, action)
+	if !d.Allowed {
+		slog.Warn("permission denied", "resource", resource, "action", action, "user", luser.Email,
+			"effect", d.Effect, "role", d.Role, "rule", d.Rule)
+		return false
+	}
+	if luser.Impersonator != "" && impersonationBlocked(action) {
+		slog.Warn("action blocked while impersonating", "resource", resource, "action", action,
+			"user", luser.Email, "impersonator", luser.Impersonator)
+		return false
+	}
+	return signedAsRequired(r, luser, resource, action)
+}
+
+// signedAsRequired applies the signing policy of resource and action to the
+// request of luser.
+func signedAsRequired(r *http.Request, luser *LoginUser, resource, action string) bool {
+	if luser.APIKey != "" {
+		// the key itself is the credential; there is no shared secret to sign with
+		return true
+	}
+	switch signingPolicy(resource, action, r.Method) {
+	case SignRequired:
+		if !UserHMAC(r, luser, resource, action) {
+			return false
+		}
+	case SignOptional:
+		if r.Header.Get("X-Req-Signature") != "" && !UserHMAC(r, luser, resource, action) {
+			return false
 		}
-	} else {
-		slog.Warn("missing privilege for resource", "resource", resource, "user", luser.Email, "privileges", luser.Privileges)
 	}
-	return false
+	return true
 }
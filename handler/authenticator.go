@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+	"example.com/app-api/util/jsql"
+)
+
+// Authenticator verifies the password of email. user is the local app_user
+// row, nil when none exists yet. It returns the authenticated user, or nil
+// without error to pass the login on to the next authenticator of the chain.
+type Authenticator interface {
+	Name() string
+	Authenticate(ctx context.Context, store model.AppStore, email, password string, user *model.User) (*model.User, error)
+}
+
+var authenticators []Authenticator
+
+func init() {
+	chain := os.Getenv("AUTH_CHAIN")
+	if chain == "" {
+		chain = "local"
+		if os.Getenv("LDAP_URL") != "" {
+			chain = "local,ldap"
+		}
+	}
+	for _, name := range strings.Split(chain, ",") {
+		switch strings.TrimSpace(name) {
+		case "local":
+			authenticators = append(authenticators, LocalAuthenticator{})
+		case "ldap":
+			a, err := NewLDAPAuthenticator("LDAP")
+			if err != nil {
+				slog.Error("invalid LDAP configuration, authenticator disabled", "err", err)
+				continue
+			}
+			authenticators = append(authenticators, a)
+		case "":
+		default:
+			slog.Warn("unknown authenticator in AUTH_CHAIN env var", "name", name)
+		}
+	}
+}
+
+// SetAuthenticators replaces the authenticator chain used for password logins.
+func SetAuthenticators(a ...Authenticator) {
+	authenticators = a
+}
+
+func authenticate(ctx context.Context, store model.AppStore, email, password string, user *model.User) *model.User {
+	for _, a := range authenticators {
+		u, err := a.Authenticate(ctx, store, email, password, user)
+		if err != nil {
+			slog.Warn("authenticator failed", "authenticator", a.Name(), "email", email, "err", err)
+			continue
+		}
+		if u != nil {
+			slog.Debug("authenticated", "authenticator", a.Name(), "email", email)
+			return u
+		}
+	}
+	return nil
+}
+
+// LocalAuthenticator verifies the password hash stored in app_user.
+type LocalAuthenticator struct{}
+
+func (LocalAuthenticator) Name() string {
+	return "local"
+}
+
+func (LocalAuthenticator) Authenticate(ctx context.Context, store model.AppStore, email, password string, user *model.User) (*model.User, error) {
+	if user == nil {
+		return nil, nil
+	}
+	ok, err := util.CheckPassword(password, user.Password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	if util.NeedsRehash(user.Password) {
+		// the plain password is only known now; a failure keeps the old hash valid
+		if err := store.User().UpdatePassword(ctx, user.ID, user.Version, password); err != nil {
+			slog.Warn("failed to rehash password", "email", email, "err", err)
+		} else {
+			slog.Info("password rehashed", "email", email)
+		}
+	}
+	return user, nil
+}
+
+// roleRule grants role to externally authenticated users having a group or
+// claim value matching pattern (case insensitive).
+type roleRule struct {
+	pattern string
+	role    string
+}
+
+// provisionUser creates the app_user row of an externally authenticated user
+// when user is nil, recording source as its provisioning source, otherwise it
+// synchronizes the roles named in rules with values. Roles not named in any
+// rule are left untouched. The user is returned freshly loaded when it was
+// changed.
+func provisionUser(ctx context.Context, store model.AppStore, source, email, name string, values []string, rules []roleRule, user *model.User) (*model.User, error) {
+	managed := map[int64]bool{}
+	granted := map[int64]model.Role{}
+	for _, rule := range rules {
+		role, err := store.Role().GetByName(ctx, rule.role)
+		if err != nil {
+			if err.Error() == "NOT_FOUND" {
+				slog.Warn("role map refers to unknown role", "role", rule.role)
+				continue
+			}
+			return nil, err
+		}
+		managed[role.ID] = true
+		re, err := regexp.Compile("(?i)" + rule.pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			if re.MatchString(v) {
+				granted[role.ID] = model.Role{ID: role.ID}
+				break
+			}
+		}
+	}
+	now := time.Now()
+	if user == nil {
+		if name == "" {
+			name = email
+		}
+		obj := model.User{
+			Email:     email,
+			Name:      name,
+			Password:  jsql.SecretValueNull(),
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		for _, role := range granted {
+			obj.Roles = append(obj.Roles, role)
+		}
+		if err := store.UserRole().Conflicts(ctx, obj); err != nil {
+			return nil, err
+		}
+		created, err := store.User().Create(ctx, obj)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.UserSource().Set(ctx, created.ID, source); err != nil {
+			return nil, err
+		}
+		slog.Info("provisioned external user", "email", created.Email, "id", created.ID)
+		return store.User().Get(ctx, created.ID)
+	}
+	roles := []model.Role{}
+	changed := false
+	for _, role := range user.Roles {
+		if managed[role.ID] {
+			if _, ok := granted[role.ID]; !ok {
+				changed = true
+				continue
+			}
+			delete(granted, role.ID)
+		}
+		roles = append(roles, role)
+	}
+	for _, role := range granted {
+		roles = append(roles, role)
+		changed = true
+	}
+	if !changed {
+		return user, nil
+	}
+	user.Roles = roles
+	user.UpdatedAt = now
+	if err := store.UserRole().Conflicts(ctx, *user); err != nil {
+		return nil, err
+	}
+	err := store.User().Update(ctx, *user, []model.UserField{model.UserField_Roles, model.UserField_UpdatedAt})
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("synchronized external user roles", "email", user.Email, "id", user.ID)
+	return store.User().Get(ctx, user.ID)
+}
@@ -0,0 +1,613 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/app-api/model"
+)
+
+// Changes that need approval are not applied by PATCH. They are kept as a
+// change request until another user with the approve privilege of the
+// resource approves or rejects them; only then the update runs.
+
+// ApprovalOptions selects the changes that need a second person.
+type ApprovalOptions struct {
+	// RolePrivileges holds changes to the privileges and parents of roles,
+	// the creation of roles with privileges and the assignment of roles to
+	// users.
+	RolePrivileges bool
+	// ParamGroups holds the creation, changes and deletion of the params of
+	// these groups, moving a param into one of them too.
+	ParamGroups []string
+}
+
+var approvals = struct {
+	mu  sync.RWMutex
+	opt ApprovalOptions
+}{}
+
+func init() {
+	opt := ApprovalOptions{
+		RolePrivileges: os.Getenv("APPROVAL_ROLE_PRIVILEGES") == "true",
+	}
+	for _, group := range strings.Split(os.Getenv("APPROVAL_PARAM_GROUPS"), ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			opt.ParamGroups = append(opt.ParamGroups, group)
+		}
+	}
+	SetApprovalOptions(opt)
+}
+
+// SetApprovalOptions replaces the changes that need approval.
+func SetApprovalOptions(opt ApprovalOptions) {
+	approvals.mu.Lock()
+	defer approvals.mu.Unlock()
+	approvals.opt = opt
+}
+
+func approvalOptions() ApprovalOptions {
+	approvals.mu.RLock()
+	defer approvals.mu.RUnlock()
+	return approvals.opt
+}
+
+// changeAppliers run the update of an approved change per resource.
+var changeAppliers = map[string]func(ctx context.Context, store model.AppStore, cr *model.ChangeRequest) error{
+	"app_role": applyRoleChange,
+	"app_user": applyUserChange,
+	"param":    applyParamChange,
+}
+
+// roleChange is the change of an app_role change request: an update of the
+// role, or of its policy, or the creation of a role.
+type roleChange struct {
+	*RoleUpdateParam
+	Policy *RolePolicyUpdateParam `json:"policy,omitempty"`
+	Create *model.Role            `json:"create,omitempty"`
+}
+
+// userChange is the change of an app_user change request: an update of the
+// user changing its roles, or the assignment of a role.
+type userChange struct {
+	*UserUpdateParam
+	Assign *userRoleAssignment `json:"assign,omitempty"`
+}
+
+// userRoleAssignment is the assignment of a role held by a change request.
+type userRoleAssignment struct {
+	RoleID int64 `json:"role_id"`
+	UserRoleParam
+}
+
+// paramChange is the change of a param change request: an update, the
+// creation or the deletion of the param.
+type paramChange struct {
+	*ParamUpdateParam
+	Create *model.Param `json:"create,omitempty"`
+	Delete bool         `json:"delete,omitempty"`
+}
+
+func roleChangeNeedsApproval(obj RoleUpdateParam) bool {
+	return approvalOptions().RolePrivileges && slices.Contains(obj.Fields, model.RoleField_Privileges)
+}
+
+// roleCreateNeedsApproval holds roles created with any privilege.
+func roleCreateNeedsApproval(obj model.Role) bool {
+	if !approvalOptions().RolePrivileges {
+		return false
+	}
+	privileges, err := model.ParsePrivileges(obj.Privileges)
+	return err != nil || len(privileges) > 0
+}
+
+// userRolesNeedApproval holds role changes giving the user a role it does
+// not hold yet; removing roles is applied at once.
+func userRolesNeedApproval(ctx context.Context, store model.AppStore, userID int64, roles []model.Role) (bool, error) {
+	if !approvalOptions().RolePrivileges || len(roles) == 0 {
+		return false, nil
+	}
+	current, err := store.UserRole().Find(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roles {
+		if !slices.ContainsFunc(current, func(ur model.UserRole) bool { return ur.RoleID == role.ID }) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// userRoleAssignNeedsApproval holds every assignment, a new validity window
+// may extend the privileges of the user too.
+func userRoleAssignNeedsApproval() bool {
+	return approvalOptions().RolePrivileges
+}
+
+// paramGroupNeedsApproval holds the creation of the params of the approval
+// groups.
+func paramGroupNeedsApproval(group string) bool {
+	return slices.Contains(approvalOptions().ParamGroups, group)
+}
+
+func rolePolicyChangeNeedsApproval(obj RolePolicyUpdateParam) bool {
+	return approvalOptions().RolePrivileges && slices.Contains(obj.Fields, model.RolePolicyField_Parents)
+}
+
+func paramChangeNeedsApproval(ctx context.Context, store model.AppStore, obj ParamUpdateParam) (bool, error) {
+	groups := approvalOptions().ParamGroups
+	if len(groups) == 0 {
+		return false, nil
+	}
+	if slices.Contains(obj.Fields, model.ParamField_Group) && slices.Contains(groups, obj.Value.Group) {
+		return true, nil
+	}
+	current, err := store.Param().Get(ctx, obj.Value.ID)
+	if err != nil {
+		if err.Error() == "NOT_FOUND" {
+			// the update fails on its own
+			return false, nil
+		}
+		return false, err
+	}
+	return slices.Contains(groups, current.Group), nil
+}
+
+// errChangedSinceRequest fails an approved change of a resource updated after
+// the request, which would silently overwrite that update.
+var errChangedSinceRequest = errors.New("CHANGED_SINCE_REQUEST")
+
+func applyRoleChange(ctx context.Context, store model.AppStore, cr *model.ChangeRequest) error {
+	var change roleChange
+	if err := json.Unmarshal(cr.Change, &change); err != nil {
+		return err
+	}
+	if change.Policy != nil {
+		return applyRolePolicyChange(ctx, store, cr, *change.Policy)
+	}
+	if change.Create != nil {
+		return applyRoleCreate(ctx, store, *change.Create)
+	}
+	if change.RoleUpdateParam == nil {
+		return fmt.Errorf("empty change")
+	}
+	obj := *change.RoleUpdateParam
+	current, err := store.Role().Get(ctx, cr.ResourceID)
+	if err != nil {
+		return err
+	}
+	if current.UpdatedAt.After(cr.RequestedAt) {
+		return errChangedSinceRequest
+	}
+	// the catalog may have changed since the request
+	if slices.Contains(obj.Fields, model.RoleField_Privileges) {
+		if err := ValidatePrivileges(obj.Value.Privileges); err != nil {
+			return err
+		}
+	}
+	obj.Value.ID = cr.ResourceID
+	obj.Value.UpdatedAt = time.Now()
+	if !slices.Contains(obj.Fields, model.RoleField_UpdatedAt) {
+		obj.Fields = append(obj.Fields, model.RoleField_UpdatedAt)
+	}
+	return store.Role().Update(ctx, obj.Value, obj.Fields)
+}
+
+func applyRoleCreate(ctx context.Context, store model.AppStore, obj model.Role) error {
+	// the catalog may have changed since the request
+	if err := ValidatePrivileges(obj.Privileges); err != nil {
+		return err
+	}
+	obj.UpdatedAt = time.Now()
+	_, err := store.Role().Create(ctx, obj)
+	return err
+}
+
+// applyRolePolicyChange updates the policy with the version of the request,
+// which fails when the policy changed since.
+func applyRolePolicyChange(ctx context.Context, store model.AppStore, cr *model.ChangeRequest, obj RolePolicyUpdateParam) error {
+	obj.Value.RoleID = cr.ResourceID
+	err := store.RolePolicy().Update(ctx, obj.Value, obj.Fields)
+	if err != nil && err.Error() == "NO_ROWS_AFFECTED" {
+		return errChangedSinceRequest
+	}
+	return err
+}
+
+func applyUserChange(ctx context.Context, store model.AppStore, cr *model.ChangeRequest) error {
+	var change userChange
+	if err := json.Unmarshal(cr.Change, &change); err != nil {
+		return err
+	}
+	if change.Assign != nil {
+		return store.UserRole().Assign(ctx, model.UserRole{
+			UserID:     cr.ResourceID,
+			RoleID:     change.Assign.RoleID,
+			ValidFrom:  change.Assign.ValidFrom,
+			ValidUntil: change.Assign.ValidUntil,
+		})
+	}
+	if change.UserUpdateParam == nil {
+		return fmt.Errorf("empty change")
+	}
+	obj := *change.UserUpdateParam
+	obj.Value.ID = cr.ResourceID
+	// the exclusions may have changed since the request
+	if err := store.UserRole().Conflicts(ctx, obj.Value); err != nil {
+		return err
+	}
+	obj.Value.UpdatedAt = time.Now()
+	if !slices.Contains(obj.Fields, model.UserField_UpdatedAt) {
+		obj.Fields = append(obj.Fields, model.UserField_UpdatedAt)
+	}
+	// the version of the request fails the update of a user changed since
+	err := store.User().Update(ctx, obj.Value, obj.Fields)
+	if err != nil && err.Error() == "NO_ROWS_AFFECTED" {
+		return errChangedSinceRequest
+	}
+	return err
+}
+
+func applyParamChange(ctx context.Context, store model.AppStore, cr *model.ChangeRequest) error {
+	var change paramChange
+	if err := json.Unmarshal(cr.Change, &change); err != nil {
+		return err
+	}
+	if change.Create != nil {
+		obj := *change.Create
+		obj.UpdatedAt = time.Now()
+		_, err := store.Param().Create(ctx, obj)
+		return err
+	}
+	current, err := store.Param().Get(ctx, cr.ResourceID)
+	if err != nil {
+		return err
+	}
+	if current.UpdatedAt.After(cr.RequestedAt) {
+		return errChangedSinceRequest
+	}
+	if change.Delete {
+		return store.Param().Delete(ctx, cr.ResourceID)
+	}
+	if change.ParamUpdateParam == nil {
+		return fmt.Errorf("empty change")
+	}
+	obj := *change.ParamUpdateParam
+	obj.Value.ID = cr.ResourceID
+	obj.Value.UpdatedAt = time.Now()
+	if !slices.Contains(obj.Fields, model.ParamField_UpdatedAt) {
+		obj.Fields = append(obj.Fields, model.ParamField_UpdatedAt)
+	}
+	return store.Param().Update(ctx, obj.Value, obj.Fields)
+}
+
+// paramChangeInScope checks the params a param change request writes, the
+// stored one and the one it would write, against the approve scope of the
+// login user.
+func paramChangeInScope(ctx context.Context, store model.AppStore, cr *model.ChangeRequest) error {
+	scope := scopeOf(ctx, "param", "approve")
+	if scope == nil {
+		return nil
+	}
+	var change paramChange
+	if err := json.Unmarshal(cr.Change, &change); err != nil {
+		return err
+	}
+	if change.Create != nil {
+		if !inScope(scope, paramAttribute(*change.Create)) {
+			slog.Warn("param change out of scope", "id", cr.ID, "group", change.Create.Group, "scope", scope)
+			return outOfScopeError()
+		}
+		return nil
+	}
+	if err := paramStoredInScope(ctx, store.Param(), "approve", cr.ResourceID); err != nil {
+		return err
+	}
+	if change.ParamUpdateParam != nil && slices.Contains(change.Fields, model.ParamField_Group) &&
+		!inScope(scope, paramAttribute(change.Value)) {
+		slog.Warn("param change out of scope", "id", cr.ID, "group", change.Value.Group, "scope", scope)
+		return outOfScopeError()
+	}
+	return nil
+}
+
+// requestChange keeps the update obj of a resource as a pending change
+// request and answers 202 with it.
+func requestChange(ctx context.Context, store model.AppStore, w http.ResponseWriter, resource string, id int64, obj any) error {
+	cr, err := createChangeRequest(ctx, store, resource, id, obj)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	return json.NewEncoder(w).Encode(cr)
+}
+
+// changeRequested is requestChange for the API store: the *httpError
+// answers the update with the change request.
+func changeRequested(ctx context.Context, store model.AppStore, resource string, id int64, obj any) error {
+	cr, err := createChangeRequest(ctx, store, resource, id, obj)
+	if err != nil {
+		return err
+	}
+	return &httpError{status: http.StatusAccepted, code: "change_requested", body: cr}
+}
+
+func createChangeRequest(ctx context.Context, store model.AppStore, resource string, id int64, obj any) (*model.ChangeRequest, error) {
+	luser, ok := ctx.Value(HandlerCtxKeyUser).(*LoginUser)
+	if !ok || luser == nil || luser.User == nil {
+		return nil, fmt.Errorf("missing user in context")
+	}
+	change, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	cr, err := store.ChangeRequest().Create(ctx, model.ChangeRequest{
+		Resource:    resource,
+		ResourceID:  id,
+		Change:      change,
+		Status:      model.ChangeStatusPending,
+		RequestedBy: luser.actorID(),
+		RequestedAt: time.Now(),
+	})
+	if err != nil {
+		slog.Warn("error create ChangeRequest", "resource", resource, "id", id, "err", err)
+		return nil, err
+	}
+	slog.Info("change request created", "id", cr.ID, "resource", resource, "resource_id", id, "by", luser.Email)
+	auditChangeRequest(ctx, store, luser.auditActor(), model.AuditActionChangeRequested, cr)
+	return cr, nil
+}
+
+func auditChangeRequest(ctx context.Context, store model.AppStore, actor, action string, cr *model.ChangeRequest) {
+	detail, _ := json.Marshal(map[string]any{
+		"change_request": cr.ID,
+		"status":         cr.Status,
+		"comment":        cr.Comment,
+		"error":          cr.Error,
+	})
+	_, err := store.AuditLog().Create(ctx, model.AuditLog{
+		CreatedAt:  time.Now(),
+		Actor:      actor,
+		Action:     action,
+		Resource:   cr.Resource,
+		ResourceID: strconv.FormatInt(cr.ResourceID, 10),
+		Detail:     string(detail),
+	})
+	if err != nil {
+		slog.Error("failed to audit change request", "id", cr.ID, "action", action, "err", err)
+	}
+}
+
+// swagger: model ChangeRequestFindParam
+type ChangeRequestFindParam struct {
+	Limit  int                       `json:"limit"`
+	Offset int64                     `json:"offset"`
+	Filter model.ChangeRequestFilter `json:"filter"`
+}
+
+// swagger: model ChangeRequestDecision
+type ChangeRequestDecision struct {
+	Comment string `json:"comment"`
+}
+
+func ChangeRequestHandlerRegister(mux *http.ServeMux, base string, store model.AppStore, authenticate Authenticate) {
+	for resource := range changeAppliers {
+		RegisterPrivileges(resource, "approve")
+	}
+	mux.HandleFunc("POST "+base+"/change_request", func(w http.ResponseWriter, r *http.Request) {
+		if err := ChangeRequestFind(r.Context(), store, w, r); err != nil {
+			slog.Warn("error in ChangeRequestFind", "err", err)
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("GET "+base+"/change_request/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := ChangeRequestGet(r.Context(), store, authenticate, w, r); err != nil {
+			slog.Warn("error in ChangeRequestGet", "err", err)
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("POST "+base+"/change_request/{id}/approve", func(w http.ResponseWriter, r *http.Request) {
+		if err := ChangeRequestDecide(r.Context(), store, authenticate, w, r, model.ChangeStatusApproved); err != nil {
+			slog.Warn("error in ChangeRequestDecide", "err", err)
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("POST "+base+"/change_request/{id}/reject", func(w http.ResponseWriter, r *http.Request) {
+		if err := ChangeRequestDecide(r.Context(), store, authenticate, w, r, model.ChangeStatusRejected); err != nil {
+			slog.Warn("error in ChangeRequestDecide", "err", err)
+			writeInternalError(w, err)
+		}
+	})
+}
+
+// loadChangeRequest returns the change request of the id path value, nil
+// after writing the response when there is none.
+func loadChangeRequest(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) (*model.ChangeRequest, error) {
+	pid := r.PathValue("id")
+	id, err := strconv.ParseInt(pid, 10, 64)
+	if err != nil {
+		slog.Warn("invalid id", "id", pid, "err", err)
+		writeBadRequest(w, "invalid_id")
+		return nil, nil
+	}
+	cr, err := store.ChangeRequest().Get(ctx, id)
+	if err != nil {
+		if err.Error() == "NOT_FOUND" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(HttpResult{Code: "not_found"})
+			return nil, nil
+		}
+		return nil, err
+	}
+	return cr, nil
+}
+
+// FindChangeRequest   godoc
+// @Summary      Find change requests
+// @Description  Change requests of the resources the login user may read, newest first
+// @Tags         change_request
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        param  body    ChangeRequestFindParam  true  "filter"
+// @Success      200  {array}   model.ChangeRequest
+// @Failure      400  {object}  HttpResult
+// @Failure      500  {object}  HttpResult
+// @Router       /change_request [post]
+func ChangeRequestFind(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	luser, ok := ctx.Value(HandlerCtxKeyUser).(*LoginUser)
+	if !ok || luser == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return nil
+	}
+	var obj ChangeRequestFindParam
+	if err := json.NewDecoder(r.Body).Decode(&obj); err != nil {
+		slog.Warn("invalid body", "err", err)
+		return fmt.Errorf("invalid body")
+	}
+	var readable []string
+	for resource := range changeAppliers {
+		if len(obj.Filter.Resources) > 0 && !slices.Contains(obj.Filter.Resources, resource) {
+			continue
+		}
+		if luser.decide(resource, "read").Allowed {
+			readable = append(readable, resource)
+		}
+	}
+	res := []model.ChangeRequest{}
+	if len(readable) > 0 {
+		if obj.Limit <= 0 {
+			obj.Limit = 100
+		}
+		obj.Filter.Resources = readable
+		var err error
+		res, err = store.ChangeRequest().Find(ctx, obj.Filter, obj.Limit, obj.Offset)
+		if err != nil {
+			slog.Warn("error find ChangeRequest", "filter", obj.Filter, "err", err)
+			return err
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res)
+}
+
+// ShowChangeRequest   godoc
+// @Summary      Get change request
+// @Description  Get a change request; requires read on its resource
+// @Tags         change_request
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      integer  true  "Change request ID"
+// @Success      200  {object}  model.ChangeRequest
+// @Failure      403  {object}  HttpResult
+// @Failure      404  {object}  HttpResult
+// @Failure      500  {object}  HttpResult
+// @Router       /change_request/{id} [get]
+func ChangeRequestGet(ctx context.Context, store model.AppStore, authenticate Authenticate, w http.ResponseWriter, r *http.Request) error {
+	cr, err := loadChangeRequest(ctx, store, w, r)
+	if err != nil || cr == nil {
+		return err
+	}
+	if !authenticate(r, cr.Resource, "read") {
+		writeForbiden(w)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(cr)
+}
+
+// ApproveChangeRequest   godoc
+// @Summary      Approve or reject a change request
+// @Description  Decide a pending change request; requires approve on its resource, and on the params of a param change within the scope of the grant. The author of a change cannot decide it. An approved change is applied at once, its status turns failed when the update fails or the resource was updated after the request.
+// @Tags         change_request
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      integer  true  "Change request ID"
+// @Param        param  body    ChangeRequestDecision  false  "comment"
+// @Success      200  {object}  model.ChangeRequest
+// @Failure      400  {object}  HttpResult
+// @Failure      403  {object}  HttpResult
+// @Failure      404  {object}  HttpResult
+// @Failure      409  {object}  HttpResult
+// @Failure      500  {object}  HttpResult
+// @Router       /change_request/{id}/approve [post]
+// @Router       /change_request/{id}/reject [post]
+func ChangeRequestDecide(ctx context.Context, store model.AppStore, authenticate Authenticate, w http.ResponseWriter, r *http.Request, status string) error {
+	luser, ok := ctx.Value(HandlerCtxKeyUser).(*LoginUser)
+	if !ok || luser == nil || luser.User == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return nil
+	}
+	var obj ChangeRequestDecision
+	if err := json.NewDecoder(r.Body).Decode(&obj); err != nil && !errors.Is(err, io.EOF) {
+		slog.Warn("invalid body", "err", err)
+		writeBadRequest(w, "invalid_body")
+		return nil
+	}
+	cr, err := loadChangeRequest(ctx, store, w, r)
+	if err != nil || cr == nil {
+		return err
+	}
+	if !authenticate(r, cr.Resource, "approve") {
+		writeForbiden(w)
+		return nil
+	}
+	if cr.RequestedBy == luser.actorID() {
+		slog.Warn("own change request", "id", cr.ID, "user", luser.Email)
+		writeForbidenCode(w, "own_change")
+		return nil
+	}
+	if cr.Resource == "param" {
+		if err := paramChangeInScope(ctx, store, cr); err != nil {
+			return err
+		}
+	}
+	// deciding first keeps a second approval from applying the change again
+	if err := store.ChangeRequest().Decide(ctx, cr.ID, status, luser.actorID(), obj.Comment, time.Now()); err != nil {
+		if err.Error() == "NOT_PENDING" {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(HttpResult{Code: "not_pending"})
+			return nil
+		}
+		return err
+	}
+	action := model.AuditActionChangeRejected
+	if status == model.ChangeStatusApproved {
+		action = model.AuditActionChangeApproved
+		apply, ok := changeAppliers[cr.Resource]
+		if !ok {
+			err = fmt.Errorf("unknown resource %s", cr.Resource)
+		} else {
+			err = apply(ctx, store, cr)
+		}
+		if err != nil {
+			slog.Warn("approved change failed", "id", cr.ID, "resource", cr.Resource, "resource_id", cr.ResourceID, "err", err)
+			if err := store.ChangeRequest().Fail(ctx, cr.ID, err.Error()); err != nil {
+				return err
+			}
+		}
+	}
+	if cr, err = store.ChangeRequest().Get(ctx, cr.ID); err != nil {
+		return err
+	}
+	slog.Info("change request decided", "id", cr.ID, "status", cr.Status, "by", luser.Email)
+	auditChangeRequest(ctx, store, luser.auditActor(), action, cr)
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(cr)
+}
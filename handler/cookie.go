@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"example.com/app-api/model"
+)
+
+// Cookie names of the cookie session mode. A login with "cookie": true keeps
+// the tokens in HttpOnly cookies out of reach of scripts; the CSRF token is
+// readable and must be echoed in the X-CSRF-Token header (double submit).
+const (
+	sessionCookieName = "session"
+	refreshCookieName = "session_refresh"
+	csrfCookieName    = "csrf_token"
+	csrfHeader        = "X-CSRF-Token"
+)
+
+// SessionCookieOptions configures the cookie session mode.
+type SessionCookieOptions struct {
+	Enabled bool
+	// Insecure drops the Secure attribute, for development over plain http only.
+	Insecure bool
+	// SameSite defaults to http.SameSiteStrictMode.
+	SameSite http.SameSite
+	Domain   string
+}
+
+var sessionCookies = struct {
+	mu  sync.RWMutex
+	opt SessionCookieOptions
+}{}
+
+func init() {
+	opt := SessionCookieOptions{
+		Enabled:  os.Getenv("SESSION_COOKIE") == "true",
+		Insecure: os.Getenv("SESSION_COOKIE_INSECURE") == "true",
+		Domain:   os.Getenv("SESSION_COOKIE_DOMAIN"),
+	}
+	switch str := strings.ToLower(os.Getenv("SESSION_COOKIE_SAMESITE")); str {
+	case "", "strict":
+		opt.SameSite = http.SameSiteStrictMode
+	case "lax":
+		opt.SameSite = http.SameSiteLaxMode
+	case "none":
+		opt.SameSite = http.SameSiteNoneMode
+	default:
+		slog.Warn("invalid SESSION_COOKIE_SAMESITE env var, using strict", "value", str)
+		opt.SameSite = http.SameSiteStrictMode
+	}
+	SetSessionCookie(opt)
+}
+
+// SetSessionCookie replaces the options of the cookie session mode.
+func SetSessionCookie(opt SessionCookieOptions) {
+	if opt.SameSite == 0 {
+		opt.SameSite = http.SameSiteStrictMode
+	}
+	sessionCookies.mu.Lock()
+	defer sessionCookies.mu.Unlock()
+	sessionCookies.opt = opt
+}
+
+func sessionCookieOptions() SessionCookieOptions {
+	sessionCookies.mu.RLock()
+	defer sessionCookies.mu.RUnlock()
+	return sessionCookies.opt
+}
+
+func newCookie(opt SessionCookieOptions, name, value, path string, maxAge int, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   opt.Domain,
+		MaxAge:   maxAge,
+		Secure:   !opt.Insecure,
+		HttpOnly: httpOnly,
+		SameSite: opt.SameSite,
+	}
+}
+
+// setSessionCookies moves the tokens of obj into cookies and sets a new CSRF
+// token; obj keeps only the CSRF token. It reports false when the cookie
+// session mode is disabled.
+func setSessionCookies(w http.ResponseWriter, obj *LoginObject) bool {
+	opt := sessionCookieOptions()
+	if !opt.Enabled {
+		return false
+	}
+	csrf := rand.Text()
+	http.SetCookie(w, newCookie(opt, sessionCookieName, obj.Token, "/", int(TOKEN_EXPIRY.Seconds()), true))
+	// the refresh token is only sent to the API
+	http.SetCookie(w, newCookie(opt, refreshCookieName, obj.RefreshToken, "/api/v1", int(REFRESH_TOKEN_EXPIRY.Seconds()), true))
+	http.SetCookie(w, newCookie(opt, csrfCookieName, csrf, "/", int(REFRESH_TOKEN_EXPIRY.Seconds()), false))
+	obj.Token = ""
+	obj.RefreshToken = ""
+	obj.CsrfToken = csrf
+	return true
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	opt := sessionCookieOptions()
+	http.SetCookie(w, newCookie(opt, sessionCookieName, "", "/", -1, true))
+	http.SetCookie(w, newCookie(opt, refreshCookieName, "", "/api/v1", -1, true))
+	http.SetCookie(w, newCookie(opt, csrfCookieName, "", "/", -1, false))
+}
+
+// sessionFromCookies returns the claims of the session cookie. An expired
+// session is renewed from the refresh cookie without rotating the refresh
+// token, so concurrent requests of the page do not invalidate each other.
+// It returns nil claims and no error without session cookies. While the
+// cookie session mode is disabled only the plain session cookie is read, as
+// before the mode existed.
+func sessionFromCookies(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) (*JwtClaims, error) {
+	opt := sessionCookieOptions()
+	session, _ := r.Cookie(sessionCookieName)
+	refresh, _ := r.Cookie(refreshCookieName)
+	var err error
+	if session != nil && session.Value != "" {
+		var claim *JwtClaims
+		if claim, err = ParseToken(session.Value); err == nil {
+			return claim, nil
+		}
+	}
+	if !opt.Enabled || refresh == nil || refresh.Value == "" {
+		return nil, err
+	}
+	claim, err := ParseToken(refresh.Value)
+	if err != nil {
+		return nil, err
+	}
+	user, err := store.User().GetByEmail(ctx, claim.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || user.Token.String != refresh.Value {
+		// logged out or refreshed by another login
+		return nil, errors.New("refresh token mismatch")
+	}
+	token, err := signSessionToken(user.Email, claim.Mfa, TOKEN_EXPIRY)
+	if err != nil {
+		return nil, err
+	}
+	http.SetCookie(w, newCookie(opt, sessionCookieName, token, "/", int(TOKEN_EXPIRY.Seconds()), true))
+	slog.Debug("session cookie renewed", "email", user.Email)
+	return ParseToken(token)
+}
+
+// validCSRF checks the double submitted CSRF token of a state changing request.
+// It is enforced for cookie sessions once the cookie session mode is enabled;
+// before, the session cookie is only accepted for compatibility.
+func validCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	cookie, _ := r.Cookie(csrfCookieName)
+	header := r.Header.Get(csrfHeader)
+	if cookie == nil || cookie.Value == "" || header == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) == 1
+}
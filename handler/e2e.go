@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"example.com/app-api/util"
+)
+
+// E2EMode controls the encryption of request and response bodies with the
+// ECDH secret of the login.
+type E2EMode string
+
+const (
+	// E2EOff passes bodies through unchanged.
+	E2EOff E2EMode = "off"
+	// E2EOptional encrypts when the client sends or accepts application/jose+json.
+	E2EOptional E2EMode = "optional"
+	// E2ERequired rejects plaintext requests and responses.
+	E2ERequired E2EMode = "required"
+)
+
+var e2e = struct {
+	mu    sync.RWMutex
+	mode  E2EMode
+	paths []string
+}{}
+
+func init() {
+	mode := E2EMode(os.Getenv("E2E_ENCRYPTION"))
+	switch mode {
+	case "":
+		mode = E2EOptional
+	case E2EOff, E2EOptional, E2ERequired:
+	default:
+		slog.Error("invalid E2E_ENCRYPTION env var", "value", mode)
+		os.Exit(1)
+	}
+	var paths []string
+	if str := os.Getenv("E2E_PATHS"); str != "" {
+		for _, p := range strings.Split(str, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				paths = append(paths, p)
+			}
+		}
+	}
+	SetE2EEncryption(mode, paths...)
+}
+
+// SetE2EEncryption applies mode to the requests below paths; without paths
+// the user and role resources are covered.
+func SetE2EEncryption(mode E2EMode, paths ...string) {
+	if len(paths) == 0 {
+		paths = []string{"/api/v1/user", "/api/v1/role"}
+	}
+	e2e.mu.Lock()
+	defer e2e.mu.Unlock()
+	e2e.mode = mode
+	e2e.paths = paths
+}
+
+func e2eMode(path string) E2EMode {
+	e2e.mu.RLock()
+	defer e2e.mu.RUnlock()
+	for _, p := range e2e.paths {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return e2e.mode
+		}
+	}
+	return E2EOff
+}
+
+func isJOSE(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mt == util.ContentTypeJOSE
+}
+
+func acceptsJOSE(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		if isJOSE(strings.TrimSpace(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// E2EEncryption decrypts application/jose+json request bodies and encrypts
+// the response for clients that send or accept that type. It runs inside
+// Secure, which provides the login user and its shared secret, so the
+// HTTPLogger around the chain only ever sees ciphertext. Request signatures
+// cover the encrypted body as sent on the wire.
+func E2EEncryption(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode := e2eMode(r.URL.Path)
+		if mode == E2EOff {
+			next.ServeHTTP(w, r)
+			return
+		}
+		encReq := isJOSE(r.Header.Get("Content-Type"))
+		encResp := encReq || acceptsJOSE(r)
+		// ContentLength is -1 for chunked bodies; r.Body may have been replaced
+		// by the request logger, so it cannot be compared to http.NoBody
+		if mode == E2ERequired && (!encResp || (r.ContentLength != 0 && !encReq)) {
+			slog.Warn("plaintext request to encrypted resource", "url", r.URL.String(), "method", r.Method)
+			writeBadRequest(w, "encryption_required")
+			return
+		}
+		if !encResp {
+			next.ServeHTTP(w, r)
+			return
+		}
+		luser, ok := r.Context().Value(HandlerCtxKeyUser).(*LoginUser)
+		if !ok || luser == nil || luser.User == nil || !luser.User.Secret.Valid {
+			slog.Warn("encrypted request without login secret", "url", r.URL.String(), "method", r.Method)
+			writeBadRequest(w, "encryption_unavailable")
+			return
+		}
+		shared, err := base64.RawStdEncoding.DecodeString(luser.User.Secret.String)
+		if err != nil {
+			slog.Warn("invalid user secret for encryption", "user", luser.Email, "error", err)
+			writeBadRequest(w, "encryption_unavailable")
+			return
+		}
+		if encReq {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeBadRequest(w, "invalid_body")
+				return
+			}
+			plain, err := util.DecryptJOSE(shared, body)
+			if err != nil {
+				slog.Warn("failed to decrypt request body", "user", luser.Email, "url", r.URL.String(), "error", err)
+				writeBadRequest(w, "invalid_jwe")
+				return
+			}
+			r = r.Clone(r.Context())
+			r.Body = io.NopCloser(bytes.NewReader(plain))
+			r.ContentLength = int64(len(plain))
+			r.Header.Set("Content-Type", "application/json")
+		}
+		ew := &e2eWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(ew, r)
+		ew.seal(shared)
+	})
+}
+
+// e2eWriter buffers the response so it can be encrypted as a whole.
+type e2eWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buf         bytes.Buffer
+}
+
+func (w *e2eWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+}
+
+func (w *e2eWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.buf.Write(b)
+}
+
+func (w *e2eWriter) seal(shared []byte) {
+	if w.buf.Len() == 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+		return
+	}
+	sealed, err := util.EncryptJOSE(shared, w.buf.Bytes())
+	if err != nil {
+		slog.Error("failed to encrypt response body", "error", err)
+		writeInternalError(w.ResponseWriter, err)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", util.ContentTypeJOSE)
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(sealed)
+}
@@ -2,10 +2,69 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+
+	"example.com/app-api/model"
 )
 
+// RoleConflict is the body of a 422 response to a change that would let a
+// user hold two mutually exclusive roles.
+// swagger: model RoleConflict
+type RoleConflict struct {
+	Code  string   `json:"code"`
+	Email string   `json:"email"`
+	Roles []string `json:"roles"`
+}
+
+// httpError answers a request with status and body instead of a 500. The
+// API store returns it from the checks the generated handlers do not make,
+// see APIStore.
+type httpError struct {
+	status int
+	code   string
+	body   any
+	// err is the cause of a rejected value, for the callers outside of HTTP.
+	err error
+}
+
+func (e *httpError) Error() string {
+	return e.code
+}
+
+func (e *httpError) Unwrap() error {
+	return e.err
+}
+
+func badRequestError(code string, err error) *httpError {
+	return &httpError{
+		status: http.StatusBadRequest,
+		code:   code,
+		body:   HttpResult{Code: code, Error: err.Error()},
+		err:    err,
+	}
+}
+
+func unprocessableError(code string, err error) *httpError {
+	return &httpError{
+		status: http.StatusUnprocessableEntity,
+		code:   code,
+		body:   HttpResult{Code: code, Error: err.Error()},
+		err:    err,
+	}
+}
+
 func writeInternalError(w http.ResponseWriter, err error) {
+	var herr *httpError
+	if errors.As(err, &herr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(herr.status)
+		json.NewEncoder(w).Encode(herr.body)
+		return
+	}
+	if writeRoleConflict(w, err) {
+		return
+	}
 	w.WriteHeader(http.StatusInternalServerError)
 	merr := HttpResult{
 		Code:  "system_error",
@@ -21,3 +80,67 @@ func writeForbiden(w http.ResponseWriter) {
 	}
 	json.NewEncoder(w).Encode(merr)
 }
+
+func writeForbidenCode(w http.ResponseWriter, code string) {
+	w.WriteHeader(http.StatusForbidden)
+	merr := HttpResult{
+		Code: code,
+	}
+	json.NewEncoder(w).Encode(merr)
+}
+
+func writeNotFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(HttpResult{Code: "not_found"})
+}
+
+func writeBadRequest(w http.ResponseWriter, code string) {
+	w.WriteHeader(http.StatusBadRequest)
+	merr := HttpResult{
+		Code: code,
+	}
+	json.NewEncoder(w).Encode(merr)
+}
+
+func writeBadRequestError(w http.ResponseWriter, code string, err error) {
+	w.WriteHeader(http.StatusBadRequest)
+	merr := HttpResult{
+		Code:  code,
+		Error: err.Error(),
+	}
+	json.NewEncoder(w).Encode(merr)
+}
+
+// writeRoleConflict writes a role conflict, see model.AsRoleConflictError,
+// as 422 and reports whether err was one.
+func writeRoleConflict(w http.ResponseWriter, err error) bool {
+	conflict := model.AsRoleConflictError(err)
+	if conflict == nil {
+		return false
+	}
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(RoleConflict{
+		Code:  "role_conflict",
+		Email: conflict.Email,
+		Roles: conflict.Roles,
+	})
+	return true
+}
+
+// writeRoleError writes the rejected parents or exclusions of a role as
+// bad request, or 422 for the conflicts they would cause.
+func writeRoleError(w http.ResponseWriter, err error) bool {
+	switch err.Error() {
+	case "ROLE_CYCLE":
+		writeBadRequest(w, "role_cycle")
+	case "ROLE_PARENT_NOT_FOUND":
+		writeBadRequest(w, "role_parent_not_found")
+	case "ROLE_NOT_FOUND":
+		writeBadRequest(w, "role_not_found")
+	case "ROLE_EXCLUDES_ITSELF":
+		writeBadRequest(w, "role_excludes_itself")
+	default:
+		return writeRoleConflict(w, err)
+	}
+	return true
+}
@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"example.com/app-api/model"
+)
+
+// Field privileges use the resource "<resource>.<field>" with the actions
+// read and update, e.g. {"app_user.email": {"read": "deny"}}. Without an
+// entry the FieldRule of the field decides.
+
+// FieldAccess is the default access to a field.
+type FieldAccess int
+
+const (
+	// FieldOpen allows the field unless a role denies it.
+	FieldOpen FieldAccess = iota
+	// FieldGranted needs a role granting the field.
+	FieldGranted
+	// FieldNever is kept by the server; no role can grant it.
+	FieldNever
+)
+
+// FieldRule is the default read and write access to a field.
+type FieldRule struct {
+	Read  FieldAccess
+	Write FieldAccess
+}
+
+// FieldForbidden is the body of a 403 response to an update of fields the
+// login user may not write.
+// swagger: model FieldForbidden
+type FieldForbidden struct {
+	Code   string   `json:"code"`
+	Fields []string `json:"fields"`
+}
+
+var fieldRegistry = struct {
+	mu    sync.RWMutex
+	rules map[string]map[string]FieldRule
+}{rules: map[string]map[string]FieldRule{}}
+
+// RegisterFields sets the field rules of resource and adds the field
+// privileges to the catalog. Fields without a rule are open.
+func RegisterFields(resource string, rules map[string]FieldRule) {
+	fieldRegistry.mu.Lock()
+	defer fieldRegistry.mu.Unlock()
+	fieldRegistry.rules[resource] = rules
+	for field := range rules {
+		RegisterPrivileges(resource+"."+field, "read", "update")
+	}
+}
+
+func fieldRule(resource, field string) FieldRule {
+	fieldRegistry.mu.RLock()
+	defer fieldRegistry.mu.RUnlock()
+	return fieldRegistry.rules[resource][field]
+}
+
+// fieldAllowed reports whether the login user may read or update the field.
+func fieldAllowed(ctx context.Context, resource, field, action string) bool {
+	rule := fieldRule(resource, field)
+	access := rule.Read
+	if action == "update" {
+		access = rule.Write
+	}
+	if access == FieldNever {
+		return false
+	}
+	luser, ok := ctx.Value(HandlerCtxKeyUser).(*LoginUser)
+	if !ok || luser == nil {
+		return access == FieldOpen
+	}
+	switch luser.decide(resource+"."+field, action).Effect {
+	case EffectAllow:
+		return true
+	case EffectDeny:
+		return false
+	}
+	return access == FieldOpen
+}
+
+// unwritableFields returns the fields of an update the login user may not
+// write.
+func unwritableFields[F ~string](ctx context.Context, resource string, fields []F) []string {
+	denied := []string{}
+	for _, field := range fields {
+		if !fieldAllowed(ctx, resource, string(field), "update") {
+			denied = append(denied, string(field))
+		}
+	}
+	return denied
+}
+
+// writeFieldForbidden rejects an update of the fields denied with 403 and
+// reports whether there were any.
+func writeFieldForbidden(w http.ResponseWriter, resource string, denied []string) bool {
+	err := fieldForbiddenError(resource, denied)
+	if err == nil {
+		return false
+	}
+	writeInternalError(w, err)
+	return true
+}
+
+// fieldForbiddenError is writeFieldForbidden for the API store; nil when no
+// field is denied.
+func fieldForbiddenError(resource string, denied []string) error {
+	if len(denied) == 0 {
+		return nil
+	}
+	slog.Warn("fields not writable", "resource", resource, "fields", denied)
+	return &httpError{
+		status: http.StatusForbidden,
+		code:   "field_forbidden",
+		body:   FieldForbidden{Code: "field_forbidden", Fields: denied},
+	}
+}
+
+// userFieldRules keep the audit fields to the server and show
+// who created or updated a user by ID only, unless a role grants the field.
+var userFieldRules = map[string]FieldRule{
+	string(model.UserField_ID):        {Write: FieldNever},
+	string(model.UserField_Email):     {},
+	string(model.UserField_Version):   {},
+	string(model.UserField_Name):      {},
+	string(model.UserField_Password):  {},
+	string(model.UserField_Token):     {Write: FieldNever},
+	string(model.UserField_Secret):    {Write: FieldNever},
+	string(model.UserField_Roles):     {},
+	string(model.UserField_CreatedBy): {Read: FieldGranted, Write: FieldNever},
+	string(model.UserField_CreatedAt): {Write: FieldNever},
+	string(model.UserField_UpdatedBy): {Read: FieldGranted, Write: FieldNever},
+	string(model.UserField_UpdatedAt): {Write: FieldNever},
+}
+
+// maskUserRef keeps the ID of a user reference only.
+func maskUserRef(ref *model.UserRef) *model.UserRef {
+	if ref == nil {
+		return nil
+	}
+	return &model.UserRef{ID: ref.ID}
+}
+
+// unreadableFields returns the fields of resource the login user may not
+// read.
+func unreadableFields(ctx context.Context, resource string) []string {
+	fieldRegistry.mu.RLock()
+	rules := fieldRegistry.rules[resource]
+	fieldRegistry.mu.RUnlock()
+	hidden := []string{}
+	for field := range rules {
+		if !fieldAllowed(ctx, resource, field, "read") {
+			hidden = append(hidden, field)
+		}
+	}
+	return hidden
+}
+
+// maskUser clears the hidden fields of user; user references keep their ID.
+func maskUser(user *model.User, hidden []string) {
+	for _, field := range hidden {
+		switch model.UserField(field) {
+		case model.UserField_Email:
+			user.Email = ""
+		case model.UserField_Version:
+			user.Version = 0
+		case model.UserField_Name:
+			user.Name = ""
+		case model.UserField_Roles:
+			user.Roles = nil
+		case model.UserField_CreatedBy:
+			user.CreatedBy = maskUserRef(user.CreatedBy)
+		case model.UserField_CreatedAt:
+			user.CreatedAt = time.Time{}
+		case model.UserField_UpdatedBy:
+			user.UpdatedBy = maskUserRef(user.UpdatedBy)
+		case model.UserField_UpdatedAt:
+			user.UpdatedAt = time.Time{}
+		}
+	}
+}
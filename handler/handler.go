@@ -15,6 +15,8 @@ const (
 	HandlerCtxKeyUser HandlerCtxKey = "user"
 	HandlerCtxKeyPath HandlerCtxKey = "path"
 	HandlerCtxKeyBody HandlerCtxKey = "body"
+
+	HandlerCtxKeySignature HandlerCtxKey = "signature"
 )
 
 // swagger: model HttpResult
@@ -29,38 +31,64 @@ var jwtSecret = os.Getenv("JWT_SECRET")
 
 type JwtClaims struct {
 	Privileges map[string]any `json:"privileges,omitempty"`
+	// Scope restricts a token to one purpose (e.g. "mfa"); session tokens have none.
+	Scope string `json:"scope,omitempty"`
+	// Mfa is set when the session was established with a second factor.
+	Mfa bool `json:"mfa,omitempty"`
+	// Actor is the real user of an impersonation token, see AuthImpersonate.
+	Actor *ActorClaim `json:"act,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func SignHS256(subject string, ttl time.Duration) (string, error) {
+func SignToken(subject string, ttl time.Duration) (string, error) {
+	return SignTokenClaims(JwtClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: subject},
+	}, ttl)
+}
+
+// SignTokenClaims signs claims after filling in issuer, audience and validity.
+// The token is signed with the asymmetric key configured by SetJWTKeys, if
+// any; HS256 with JWT_SECRET is the fallback.
+func SignTokenClaims(claims JwtClaims, ttl time.Duration) (string, error) {
 	now := time.Now()
-	claims := JwtClaims{
-		RegisteredClaims: jwt.RegisteredClaims{
-			Subject:   subject,
-			Issuer:    "mwui",
-			Audience:  []string{"mwui-clients"},
-			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
-			IssuedAt:  jwt.NewNumericDate(now),
-			NotBefore: jwt.NewNumericDate(now.Add(-30 * time.Second)),
-		},
-	}
-	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return tok.SignedString([]byte(jwtSecret))
+	claims.Issuer = "mwui"
+	claims.Audience = []string{"mwui-clients"}
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.NotBefore = jwt.NewNumericDate(now.Add(-30 * time.Second))
+	return jwtKeys.sign(claims)
+}
+
+// ParseToken parses a session token; scoped tokens are rejected.
+func ParseToken(tokenStr string) (*JwtClaims, error) {
+	return ParseTokenScope(tokenStr, "")
 }
 
+// Deprecated: use SignToken.
+func SignHS256(subject string, ttl time.Duration) (string, error) {
+	return SignToken(subject, ttl)
+}
+
+// Deprecated: use ParseToken.
 func ParseHS256(tokenStr string) (*JwtClaims, error) {
+	return ParseToken(tokenStr)
+}
+
+var jwtParserOptions = []jwt.ParserOption{
+	jwt.WithValidMethods([]string{
+		jwt.SigningMethodHS256.Alg(),
+		jwt.SigningMethodES256.Alg(),
+		jwt.SigningMethodEdDSA.Alg(),
+	}),
+	jwt.WithLeeway(30 * time.Second),
+	jwt.WithIssuedAt(),
+	jwt.WithIssuer("mwui"),
+	jwt.WithAudience("mwui-clients"),
+}
+
+func ParseTokenScope(tokenStr string, scope string) (*JwtClaims, error) {
 	var claims JwtClaims
-	tok, err := jwt.ParseWithClaims(tokenStr, &claims, func(t *jwt.Token) (any, error) {
-		if t.Method != jwt.SigningMethodHS256 {
-			return nil, errors.New("unexpected alg")
-		}
-		return []byte(jwtSecret), nil
-	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}),
-		jwt.WithLeeway(30*time.Second),
-		jwt.WithIssuedAt(),
-		jwt.WithIssuer("mwui"),
-		jwt.WithAudience("mwui-clients"),
-	)
+	tok, err := jwt.ParseWithClaims(tokenStr, &claims, jwtKeys.keyFunc, jwtParserOptions...)
 	if err != nil {
 		slog.Debug("token parse error", "err", err)
 		return nil, err
@@ -69,5 +97,9 @@ func ParseHS256(tokenStr string) (*JwtClaims, error) {
 		slog.Debug("invalid token")
 		return nil, errors.New("invalid token")
 	}
+	if claims.Scope != scope {
+		slog.Debug("unexpected token scope", "scope", claims.Scope, "expected", scope)
+		return nil, errors.New("unexpected token scope")
+	}
 	return &claims, nil
 }
@@ -47,7 +47,13 @@ func HTTPLogger(log *slog.Logger, opt LoggerOptions) func(http.Handler) http.Han
 
 			reqHeaders := map[string]string{}
 			for k, v := range r.Header {
-				reqHeaders[k] = strings.Join(v, ", ")
+				switch k {
+				case "Authorization", "Cookie", "X-Api-Key", "X-Csrf-Token":
+					// credentials of the session
+					reqHeaders[k] = "***SECRET***"
+				default:
+					reqHeaders[k] = strings.Join(v, ", ")
+				}
 			}
 
 			// Print to console
@@ -85,7 +91,7 @@ func HTTPLogger(log *slog.Logger, opt LoggerOptions) func(http.Handler) http.Han
 			}
 			if opt.LogResponseBody {
 				if r.Header.Get("Content-Type") == "application/json" {
-					fields = append(fields, slog.String("resp.body", rw.preview()))
+					fields = append(fields, slog.String("resp.body", string(maskSensitiveJSON([]byte(rw.preview())))))
 				}
 			}
 
@@ -139,22 +145,19 @@ func truncate(s string, max int) string {
 	return s
 }
 
-// GetUserFromRequest extracts user info (claims) from session cookie in request headers.
+// GetUserFromRequest extracts user info (claims) from the session cookie of the request.
 func GetUserFromRequest(r *http.Request) jwt.MapClaims {
-	cookie := r.Header.Get("Cookie")
-	if !strings.Contains(cookie, "session=") {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
 		return nil
 	}
-
-	// Extract token string safely
-	tokenString := strings.Split(strings.Split(cookie, "session=")[1], ";")[0]
-
-	// Parse the JWT
-	token, _ := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
+	// same keys and checks as ParseToken
+	token, err := jwt.Parse(cookie.Value, jwtKeys.keyFunc, jwtParserOptions...)
+	if err != nil {
+		slog.Debug("invalid session cookie", "err", err)
+		return nil
+	}
+	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid && claims["scope"] == nil {
 		return claims
 	}
 	return nil
@@ -200,7 +203,8 @@ func maskRecursive(v *interface{}) {
 
 // Helper to detect sensitive field names
 func isSensitiveKey(k string) bool {
-	sensitiveKeys := []string{"password", "secret", "token", "apikey", "key"}
+	sensitiveKeys := []string{"password", "secret", "token", "apikey", "key",
+		"refresh_token", "mfa_token", "csrf_token", "otpauth_uri", "recovery_codes"}
 	for _, s := range sensitiveKeys {
 		if bytes.EqualFold([]byte(k), []byte(s)) {
 			return true
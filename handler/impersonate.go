@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/app-api/model"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// An impersonation token is a session token of the subject with the real
+// user in the act claim (RFC 8693). Secure resolves the privileges of the
+// subject but keeps the actor for audit records, and signs and encrypts with
+// the login secret of the actor, who holds it.
+
+// Audit log actions of impersonation.
+const (
+	AuditActionImpersonationStarted = "impersonation_started"
+	AuditActionImpersonatedRequest  = "impersonated_request"
+)
+
+// ActorClaim names the user acting on behalf of the subject of a token.
+type ActorClaim struct {
+	Subject string `json:"sub"`
+}
+
+// ImpersonationOptions configures impersonation.
+type ImpersonationOptions struct {
+	// TTL of an impersonation token; there is no refresh.
+	TTL time.Duration
+	// BlockedActions are denied while impersonating.
+	BlockedActions []string
+}
+
+var impersonation = struct {
+	mu  sync.RWMutex
+	opt ImpersonationOptions
+}{}
+
+func init() {
+	opt := ImpersonationOptions{
+		TTL:            15 * time.Minute,
+		BlockedActions: []string{"delete", "approve"},
+	}
+	if str := os.Getenv("IMPERSONATION_TTL"); str != "" {
+		if v, err := strconv.Atoi(str); err == nil {
+			opt.TTL = time.Duration(v) * time.Minute
+		} else {
+			slog.Warn("invalid IMPERSONATION_TTL env var, using default", "err", err, "value", str)
+		}
+	}
+	if str, ok := os.LookupEnv("IMPERSONATION_BLOCKED_ACTIONS"); ok {
+		opt.BlockedActions = nil
+		for _, action := range strings.Split(str, ",") {
+			if action = strings.TrimSpace(action); action != "" {
+				opt.BlockedActions = append(opt.BlockedActions, action)
+			}
+		}
+	}
+	SetImpersonation(opt)
+}
+
+// SetImpersonation replaces the impersonation options.
+func SetImpersonation(opt ImpersonationOptions) {
+	if opt.TTL <= 0 {
+		opt.TTL = 15 * time.Minute
+	}
+	impersonation.mu.Lock()
+	defer impersonation.mu.Unlock()
+	impersonation.opt = opt
+}
+
+func impersonationOptions() ImpersonationOptions {
+	impersonation.mu.RLock()
+	defer impersonation.mu.RUnlock()
+	return impersonation.opt
+}
+
+// impersonationBlocked reports whether action is denied while impersonating.
+func impersonationBlocked(action string) bool {
+	blocked := impersonationOptions().BlockedActions
+	return slices.Contains(blocked, action) || slices.Contains(blocked, privilegeWildcard)
+}
+
+// auditActor is the user audit records name for the requests of luser.
+func (luser *LoginUser) auditActor() string {
+	if luser.Impersonator != "" {
+		return luser.Impersonator
+	}
+	return luser.Email
+}
+
+// actorID is the ID of the user behind the requests of luser.
+func (luser *LoginUser) actorID() int64 {
+	if luser.impersonatorID != 0 {
+		return luser.impersonatorID
+	}
+	return luser.User.ID
+}
+
+var errImpersonationRevoked = errors.New("impersonation revoked")
+
+// impersonate turns the login user of an impersonation token into the
+// subject as seen by actor. The actor must still hold app_user:impersonate.
+func impersonate(r *http.Request, store model.AppStore, luser *LoginUser, actor string) error {
+	ctx := r.Context()
+	user, err := store.User().GetByEmail(ctx, actor)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return errImpersonationRevoked
+	}
+	if active, err := userActive(ctx, store, user); err != nil {
+		return err
+	} else if !active {
+		return errImpersonationRevoked
+	}
+	actorUser, err := toLoginUser(ctx, store, user)
+	if err != nil {
+		return err
+	}
+	if !actorUser.decide("app_user", "impersonate").Allowed {
+		return errImpersonationRevoked
+	}
+	luser.Impersonator = user.Email
+	luser.impersonatorID = user.ID
+	luser.User.Secret = user.Secret
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		auditImpersonation(ctx, store, luser, AuditActionImpersonatedRequest, map[string]any{
+			"subject": luser.Email,
+			"method":  r.Method,
+			"path":    r.URL.Path,
+		})
+	}
+	return nil
+}
+
+func auditImpersonation(ctx context.Context, store model.AppStore, luser *LoginUser, action string, detail map[string]any) {
+	bb, _ := json.Marshal(detail)
+	_, err := store.AuditLog().Create(ctx, model.AuditLog{
+		CreatedAt:  time.Now(),
+		Actor:      luser.auditActor(),
+		Action:     action,
+		Resource:   "app_user",
+		ResourceID: strconv.FormatInt(luser.User.ID, 10),
+		Detail:     string(bb),
+	})
+	if err != nil {
+		slog.Error("failed to audit impersonation", "actor", luser.auditActor(), "subject", luser.Email, "err", err)
+	}
+}
+
+// Impersonate   godoc
+// @Summary      Impersonate a user
+// @Description  Issue a short-lived token acting as the user; requires app_user:impersonate and, when the roles of the actor require it, a session with a second factor. Users holding that privilege cannot be impersonated.
+// @Tags         auth
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      integer  true  "User ID"
+// @Success      200  {object}  LoginObject
+// @Failure      400  {object}  HttpResult
+// @Failure      403  {object}  HttpResult
+// @Failure      404  {object}  HttpResult
+// @Router       /auth/impersonate/{id} [post]
+func AuthImpersonate(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	luser, ok := ctx.Value(HandlerCtxKeyUser).(*LoginUser)
+	if !ok || luser == nil || luser.User == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return nil
+	}
+	if luser.Impersonator != "" {
+		writeForbidenCode(w, "impersonation_nested")
+		return nil
+	}
+	if luser.APIKey != "" || !luser.decide("app_user", "impersonate").Allowed {
+		slog.Warn("impersonation denied", "user", luser.Email)
+		writeForbiden(w)
+		return nil
+	}
+	pid := r.PathValue("id")
+	id, err := strconv.ParseInt(pid, 10, 64)
+	if err != nil {
+		writeBadRequest(w, "invalid_id")
+		return nil
+	}
+	if id == luser.User.ID {
+		writeBadRequest(w, "impersonate_self")
+		return nil
+	}
+	user, err := store.User().Get(ctx, id)
+	if err != nil {
+		if err.Error() == "NOT_FOUND" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(HttpResult{Code: "not_found"})
+			return nil
+		}
+		return err
+	}
+	subject, err := toLoginUser(ctx, store, user)
+	if err != nil {
+		return err
+	}
+	if subject.decide("app_user", "impersonate").Allowed {
+		slog.Warn("impersonation of privileged user denied", "user", luser.Email, "subject", user.Email)
+		writeForbidenCode(w, "impersonate_privileged")
+		return nil
+	}
+	ttl := impersonationOptions().TTL
+	// the second factor, if any, is the one of the session of the actor
+	token, err := SignTokenClaims(JwtClaims{
+		Mfa:              luser.mfa,
+		Actor:            &ActorClaim{Subject: luser.Email},
+		RegisteredClaims: jwt.RegisteredClaims{Subject: user.Email},
+	}, ttl)
+	if err != nil {
+		slog.Error("failed to sign impersonation token", "err", err)
+		return err
+	}
+	subject.Impersonator = luser.Email
+	subject.impersonatorID = luser.User.ID
+	slog.Info("impersonation started", "actor", luser.Email, "subject", user.Email, "ttl", ttl)
+	auditImpersonation(ctx, store, subject, AuditActionImpersonationStarted, map[string]any{
+		"subject":    user.Email,
+		"expires_at": time.Now().Add(ttl),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(LoginObject{
+		Email: user.Email,
+		Token: token,
+		User:  subject,
+	})
+}
@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"example.com/app-api/util"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTKey is an asymmetric key for session tokens. Private is nil for keys
+// that only verify tokens, e.g. the previous key after a rotation.
+type JWTKey struct {
+	Kid     string
+	Alg     string
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// NewJWTKey wraps a P-256 ECDSA (ES256) or Ed25519 (EdDSA) private or public
+// key. The kid is the RFC 7638 thumbprint, so replicas loading the same key
+// file agree on it.
+func NewJWTKey(key any) (*JWTKey, error) {
+	k := &JWTKey{}
+	switch v := key.(type) {
+	case *ecdsa.PrivateKey:
+		k.Private, k.Public = v, &v.PublicKey
+	case ed25519.PrivateKey:
+		k.Private, k.Public = v, v.Public()
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		k.Public = v
+	default:
+		return nil, fmt.Errorf("unsupported jwt key type %T", key)
+	}
+	switch pub := k.Public.(type) {
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, errors.New("ecdsa jwt key must use P-256")
+		}
+		k.Alg = jwt.SigningMethodES256.Alg()
+	case ed25519.PublicKey:
+		k.Alg = jwt.SigningMethodEdDSA.Alg()
+	}
+	jwk, err := util.NewJWK(k.Public)
+	if err != nil {
+		return nil, err
+	}
+	k.Kid = jwk.Thumbprint()
+	return k, nil
+}
+
+// LoadJWTKeyFile reads a PEM encoded PKCS#8 or SEC 1 private key or a PKIX
+// public key.
+func LoadJWTKeyFile(path string) (*JWTKey, error) {
+	bb, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(bb)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", path)
+	}
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	k, err := NewJWTKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+type jwtKeyring struct {
+	mu          sync.RWMutex
+	signing     *JWTKey
+	verify      map[string]*JWTKey
+	acceptHS256 bool
+}
+
+var jwtKeys = &jwtKeyring{verify: map[string]*JWTKey{}, acceptHS256: true}
+
+func init() {
+	var signing *JWTKey
+	var verify []*JWTKey
+	if path := os.Getenv("JWT_SIGNING_KEY_FILE"); path != "" {
+		k, err := LoadJWTKeyFile(path)
+		if err != nil {
+			slog.Error("failed to load JWT_SIGNING_KEY_FILE", "err", err)
+			os.Exit(1)
+		}
+		signing = k
+	}
+	for _, path := range strings.Split(os.Getenv("JWT_VERIFY_KEY_FILES"), ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		k, err := LoadJWTKeyFile(path)
+		if err != nil {
+			slog.Error("failed to load JWT_VERIFY_KEY_FILES", "err", err)
+			os.Exit(1)
+		}
+		verify = append(verify, k)
+	}
+	if str := os.Getenv("JWT_ACCEPT_HS256"); str != "" {
+		if v, err := strconv.ParseBool(str); err == nil {
+			SetJWTAcceptHS256(v)
+		} else {
+			slog.Warn("invalid JWT_ACCEPT_HS256 env var, using default", "err", err, "value", str)
+		}
+	}
+	SetJWTKeys(signing, verify...)
+	if signing != nil {
+		slog.Info("signing tokens with asymmetric key", "alg", signing.Alg, "kid", signing.Kid)
+	}
+}
+
+// SetJWTKeys makes signing the key for new tokens and accepts tokens of
+// signing and verify. With a nil signing key tokens are signed with HS256 and
+// JWT_SECRET.
+func SetJWTKeys(signing *JWTKey, verify ...*JWTKey) {
+	m := map[string]*JWTKey{}
+	for _, k := range verify {
+		m[k.Kid] = k
+	}
+	if signing != nil {
+		m[signing.Kid] = signing
+	}
+	jwtKeys.mu.Lock()
+	defer jwtKeys.mu.Unlock()
+	jwtKeys.signing = signing
+	jwtKeys.verify = m
+}
+
+// SetJWTAcceptHS256 controls whether HS256 tokens are still accepted once an
+// asymmetric signing key is configured. Disable it when all HS256 tokens
+// issued before the migration have expired.
+func SetJWTAcceptHS256(accept bool) {
+	jwtKeys.mu.Lock()
+	defer jwtKeys.mu.Unlock()
+	jwtKeys.acceptHS256 = accept
+}
+
+func (r *jwtKeyring) sign(claims JwtClaims) (string, error) {
+	r.mu.RLock()
+	signing := r.signing
+	r.mu.RUnlock()
+	if signing == nil {
+		tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return tok.SignedString([]byte(jwtSecret))
+	}
+	if signing.Private == nil {
+		return "", errors.New("jwt signing key has no private key")
+	}
+	tok := jwt.NewWithClaims(jwt.GetSigningMethod(signing.Alg), claims)
+	tok.Header["kid"] = signing.Kid
+	return tok.SignedString(signing.Private)
+}
+
+func (r *jwtKeyring) keyFunc(t *jwt.Token) (any, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	alg := t.Method.Alg()
+	if alg == jwt.SigningMethodHS256.Alg() {
+		if r.signing != nil && !r.acceptHS256 {
+			return nil, errors.New("HS256 tokens are no longer accepted")
+		}
+		return []byte(jwtSecret), nil
+	}
+	kid, _ := t.Header["kid"].(string)
+	k, ok := r.verify[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if k.Alg != alg {
+		return nil, fmt.Errorf("alg %s does not match key %q", alg, kid)
+	}
+	return k.Public, nil
+}
+
+// JWKS returns the public keys that verify session tokens.
+func JWKS() util.JWKSet {
+	jwtKeys.mu.RLock()
+	defer jwtKeys.mu.RUnlock()
+	set := util.JWKSet{Keys: []util.JWK{}}
+	for _, k := range jwtKeys.verify {
+		jwk, err := util.NewJWK(k.Public)
+		if err != nil {
+			slog.Error("failed to encode jwk", "kid", k.Kid, "err", err)
+			continue
+		}
+		jwk.Kid = k.Kid
+		jwk.Alg = k.Alg
+		jwk.Use = "sig"
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+func WellKnownHandlerRegister(mux *http.ServeMux) {
+	mux.HandleFunc("GET /.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		_ = json.NewEncoder(w).Encode(JWKS())
+	})
+}
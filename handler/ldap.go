@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"example.com/app-api/model"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPRoleRule grants the app_role named Role to users that are member of a
+// group whose DN matches the regular expression Group (case insensitive).
+type LDAPRoleRule struct {
+	Group string `json:"group"`
+	Role  string `json:"role"`
+}
+
+// LDAPAuthenticator verifies passwords with a bind against an LDAP or Active
+// Directory server. The user entry is looked up with the service account
+// BindDN, then bound with the given password. On success the app_user row is
+// created when missing and the roles named in Rules are synchronized with the
+// LDAP groups of the user. Roles not named in any rule are left untouched.
+type LDAPAuthenticator struct {
+	URL                string
+	BindDN             string
+	BindPassword       string
+	BaseDN             string
+	UserFilter         string // %s is replaced by the escaped email
+	NameAttr           string
+	GroupAttr          string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	Timeout            time.Duration
+	Rules              []LDAPRoleRule
+}
+
+// NewLDAPAuthenticator reads the configuration from the env vars <prefix>_URL,
+// _BIND_DN, _BIND_PASSWORD, _BASE_DN, _USER_FILTER, _NAME_ATTR, _GROUP_ATTR,
+// _STARTTLS, _INSECURE_SKIP_VERIFY, _TIMEOUT (seconds) and _ROLE_MAP, a JSON
+// list of LDAPRoleRule.
+func NewLDAPAuthenticator(prefix string) (*LDAPAuthenticator, error) {
+	a := &LDAPAuthenticator{
+		URL:          os.Getenv(prefix + "_URL"),
+		BindDN:       os.Getenv(prefix + "_BIND_DN"),
+		BindPassword: os.Getenv(prefix + "_BIND_PASSWORD"),
+		BaseDN:       os.Getenv(prefix + "_BASE_DN"),
+		UserFilter:   os.Getenv(prefix + "_USER_FILTER"),
+		NameAttr:     os.Getenv(prefix + "_NAME_ATTR"),
+		GroupAttr:    os.Getenv(prefix + "_GROUP_ATTR"),
+		Timeout:      10 * time.Second,
+	}
+	if a.URL == "" {
+		return nil, fmt.Errorf("%s_URL is empty", prefix)
+	}
+	if a.BaseDN == "" {
+		return nil, fmt.Errorf("%s_BASE_DN is empty", prefix)
+	}
+	a.StartTLS, _ = strconv.ParseBool(os.Getenv(prefix + "_STARTTLS"))
+	a.InsecureSkipVerify, _ = strconv.ParseBool(os.Getenv(prefix + "_INSECURE_SKIP_VERIFY"))
+	if str := os.Getenv(prefix + "_TIMEOUT"); str != "" {
+		if v, err := strconv.Atoi(str); err == nil {
+			a.Timeout = time.Duration(v) * time.Second
+		} else {
+			slog.Warn("invalid "+prefix+"_TIMEOUT env var, using default", "err", err, "value", str)
+		}
+	}
+	if str := os.Getenv(prefix + "_ROLE_MAP"); str != "" {
+		if err := json.Unmarshal([]byte(str), &a.Rules); err != nil {
+			return nil, fmt.Errorf("invalid %s_ROLE_MAP: %w", prefix, err)
+		}
+	}
+	for _, rule := range a.Rules {
+		if _, err := regexp.Compile(rule.Group); err != nil {
+			return nil, fmt.Errorf("invalid %s_ROLE_MAP group %q: %w", prefix, rule.Group, err)
+		}
+	}
+	return a, nil
+}
+
+func (a *LDAPAuthenticator) Name() string {
+	return "ldap"
+}
+
+func (a *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.InsecureSkipVerify}
+	conn, err := ldap.DialURL(a.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.Timeout}),
+		ldap.DialWithTLSConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.Timeout)
+	if a.StartTLS {
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (a *LDAPAuthenticator) Authenticate(ctx context.Context, store model.AppStore, email, password string, user *model.User) (*model.User, error) {
+	// an empty password would be an unauthenticated bind, which servers accept
+	if password == "" {
+		return nil, nil
+	}
+	// an account must not be taken over by a directory entry of the same
+	// email: only users provisioned here or linked to the directory bind
+	if user != nil {
+		if user.Password.Valid {
+			return nil, nil
+		}
+		source, err := store.UserSource().Get(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		if source != model.UserSourceLDAP {
+			return nil, nil
+		}
+	}
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if a.BindDN != "" {
+		if err = conn.Bind(a.BindDN, a.BindPassword); err != nil {
+			return nil, fmt.Errorf("service bind: %w", err)
+		}
+	}
+	filter := a.UserFilter
+	if filter == "" {
+		filter = "(mail=%s)"
+	}
+	nameAttr := a.NameAttr
+	if nameAttr == "" {
+		nameAttr = "cn"
+	}
+	groupAttr := a.GroupAttr
+	if groupAttr == "" {
+		groupAttr = "memberOf"
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(a.Timeout.Seconds()), false,
+		fmt.Sprintf(filter, ldap.EscapeFilter(email)),
+		[]string{nameAttr, groupAttr},
+		nil,
+	))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("user search: %w", err)
+	}
+	if len(res.Entries) != 1 {
+		if len(res.Entries) > 1 {
+			slog.Warn("ldap user search is ambiguous", "email", email, "entries", len(res.Entries))
+		}
+		return nil, nil
+	}
+	entry := res.Entries[0]
+	if err = conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			slog.Warn("invalid ldap password", "email", email, "dn", entry.DN)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("user bind: %w", err)
+	}
+	rules := make([]roleRule, 0, len(a.Rules))
+	for _, rule := range a.Rules {
+		rules = append(rules, roleRule{pattern: rule.Group, role: rule.Role})
+	}
+	return provisionUser(ctx, store, model.UserSourceLDAP, email, entry.GetAttributeValue(nameAttr), entry.GetAttributeValues(groupAttr), rules, user)
+}
@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/app-api/model"
+)
+
+// maxPreferencesSize limits the preferences document of a user.
+const maxPreferencesSize = 16 << 10
+
+// Me is the profile of the login user with its effective privileges.
+// swagger: model Me
+type Me struct {
+	ID          int64          `json:"id"`
+	Email       string         `json:"email"`
+	Name        string         `json:"name"`
+	Status      string         `json:"status"`
+	Roles       []string       `json:"roles"`
+	Privileges  map[string]any `json:"privileges"`
+	MfaRequired bool           `json:"mfa_required,omitempty"`
+	// APIKey is the prefix of the API key of the request; Scope narrows the
+	// privileges to the ones of the key.
+	APIKey       string          `json:"api_key,omitempty"`
+	Scope        map[string]any  `json:"scope,omitempty"`
+	Impersonator string          `json:"impersonator,omitempty"`
+	Preferences  json.RawMessage `json:"preferences"`
+}
+
+// MeUpdate is the body of a profile update. Fields left out are kept; the
+// preferences are replaced as a whole.
+// swagger: model MeUpdate
+type MeUpdate struct {
+	Name        *string         `json:"name"`
+	Preferences json.RawMessage `json:"preferences"`
+}
+
+// MeHandlerRegister adds the profile endpoints of the login user. They need
+// no privilege, only the session Secure resolves.
+func MeHandlerRegister(mux *http.ServeMux, base string, store model.AppStore) {
+	mux.HandleFunc("GET "+base+"/me", func(w http.ResponseWriter, r *http.Request) {
+		if err := MeGet(r.Context(), store, w, r); err != nil {
+			slog.Warn("error in MeGet", "err", err)
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("PATCH "+base+"/me", func(w http.ResponseWriter, r *http.Request) {
+		if err := MeUpdateProfile(r.Context(), store, w, r); err != nil {
+			slog.Warn("error in MeUpdateProfile", "err", err)
+			writeInternalError(w, err)
+		}
+	})
+}
+
+// meUser returns the login user of the request, nil after writing a 401.
+func meUser(ctx context.Context, w http.ResponseWriter) *LoginUser {
+	luser, ok := ctx.Value(HandlerCtxKeyUser).(*LoginUser)
+	if !ok || luser == nil || luser.User == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return nil
+	}
+	return luser
+}
+
+func writeMe(ctx context.Context, store model.AppStore, w http.ResponseWriter, luser *LoginUser) error {
+	me := Me{
+		ID:           luser.User.ID,
+		Email:        luser.Email,
+		Name:         luser.Name,
+		Roles:        luser.Roles,
+		Privileges:   luser.Privileges,
+		MfaRequired:  luser.MfaRequired,
+		APIKey:       luser.APIKey,
+		Scope:        luser.scope,
+		Impersonator: luser.Impersonator,
+		Preferences:  json.RawMessage("{}"),
+	}
+	status, err := store.UserStatus().Get(ctx, luser.User.ID)
+	if err != nil {
+		return err
+	}
+	me.Status = status.Status
+	pref, err := store.UserPreference().Get(ctx, luser.User.ID)
+	if err != nil && err.Error() != "NOT_FOUND" {
+		return err
+	}
+	if pref != nil {
+		me.Preferences = json.RawMessage(pref.Preferences)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(me)
+}
+
+// MeGet   godoc
+// @Summary      Get the profile of the login user
+// @Description  Identity, roles, effective privileges and preferences of the login user.
+// @Tags         me
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {object}  Me
+// @Failure      401  {string}  string
+// @Router       /me [get]
+func MeGet(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	luser := meUser(ctx, w)
+	if luser == nil {
+		return nil
+	}
+	return writeMe(ctx, store, w, luser)
+}
+
+// MeUpdateProfile   godoc
+// @Summary      Update the profile of the login user
+// @Description  Update the name and the preferences of the login user; nothing else of the user can be changed here.
+// @Tags         me
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        param  body    MeUpdate  true  "Profile fields"
+// @Success      200  {object}  Me
+// @Failure      400  {object}  HttpResult
+// @Failure      401  {string}  string
+// @Failure      403  {object}  HttpResult
+// @Failure      409  {object}  HttpResult
+// @Router       /me [patch]
+func MeUpdateProfile(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	luser := meUser(ctx, w)
+	if luser == nil {
+		return nil
+	}
+	if luser.APIKey != "" {
+		// a key acts for its user but does not own the profile
+		writeForbiden(w)
+		return nil
+	}
+	if !signedAsRequired(r, luser, "me", "update") {
+		writeForbiden(w)
+		return nil
+	}
+	var obj MeUpdate
+	// reject oversized bodies before they are decoded into memory
+	r.Body = http.MaxBytesReader(w, r.Body, maxPreferencesSize+1024)
+	if err := json.NewDecoder(r.Body).Decode(&obj); err != nil && !errors.Is(err, io.EOF) {
+		var merr *http.MaxBytesError
+		if errors.As(err, &merr) {
+			writeBadRequest(w, "preferences_too_large")
+			return nil
+		}
+		slog.Warn("invalid body", "err", err)
+		writeBadRequest(w, "invalid_body")
+		return nil
+	}
+	var prefs bytes.Buffer
+	if len(obj.Preferences) > 0 && string(obj.Preferences) != "null" {
+		var m map[string]any
+		if err := json.Unmarshal(obj.Preferences, &m); err != nil {
+			writeBadRequest(w, "invalid_preferences")
+			return nil
+		}
+		if err := json.Compact(&prefs, obj.Preferences); err != nil {
+			writeBadRequest(w, "invalid_preferences")
+			return nil
+		}
+		if prefs.Len() > maxPreferencesSize {
+			writeBadRequest(w, "preferences_too_large")
+			return nil
+		}
+	}
+	now := time.Now()
+	if obj.Name != nil {
+		name := strings.TrimSpace(*obj.Name)
+		if name == "" {
+			writeBadRequest(w, "name_required")
+			return nil
+		}
+		user := *luser.User
+		user.Name = name
+		user.UpdatedBy = &model.UserRef{ID: luser.actorID()}
+		user.UpdatedAt = now
+		err := store.User().Update(ctx, user, []model.UserField{
+			model.UserField_Name, model.UserField_UpdatedBy, model.UserField_UpdatedAt,
+		})
+		if err != nil {
+			if err.Error() == "NO_ROWS_AFFECTED" {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(HttpResult{Code: "conflict"})
+				return nil
+			}
+			return err
+		}
+		luser.Name = name
+		luser.User.Name = name
+	}
+	if prefs.Len() > 0 {
+		err := store.UserPreference().Save(ctx, model.UserPreference{
+			UserID:      luser.User.ID,
+			Preferences: prefs.String(),
+			UpdatedAt:   now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return writeMe(ctx, store, w, luser)
+}
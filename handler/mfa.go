@@ -0,0 +1,419 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+	"example.com/app-api/util/jsql"
+)
+
+// swagger: model TotpEnrollment
+type TotpEnrollment struct {
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauth_uri"`
+}
+
+// swagger: model TotpCode
+type TotpCode struct {
+	Code string `json:"code"`
+}
+
+// swagger: model TotpRecoveryCodes
+type TotpRecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+var (
+	MFA_ISSUER          = "app-api"
+	MFA_TOKEN_EXPIRY    = 5 * time.Minute
+	MFA_RECOVERY_CODES  = 10
+	MFA_MAX_ATTEMPTS    = 5
+	MFA_LOCK_TIME       = 15 * time.Minute
+	mfaKey              []byte
+	recoveryCodeEncoder = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+func init() {
+	if str := os.Getenv("MFA_ISSUER"); str != "" {
+		MFA_ISSUER = str
+	}
+	if str := os.Getenv("MFA_MAX_ATTEMPTS"); str != "" {
+		if v, err := strconv.Atoi(str); err == nil && v > 0 {
+			MFA_MAX_ATTEMPTS = v
+		} else {
+			slog.Warn("invalid MFA_MAX_ATTEMPTS env var, using default", "err", err, "value", str)
+		}
+	}
+	if str := os.Getenv("MFA_LOCK_TIME"); str != "" {
+		if v, err := strconv.Atoi(str); err == nil {
+			MFA_LOCK_TIME = time.Duration(v) * time.Minute
+		} else {
+			slog.Warn("invalid MFA_LOCK_TIME env var, using default", "err", err, "value", str)
+		}
+	}
+	// TOTP secrets are sealed with AES-256 under their own key, so JWT_SECRET
+	// can be rotated without losing the enrolled second factors
+	key, err := hex.DecodeString(os.Getenv("MFA_ENCRYPTION_KEY"))
+	if err != nil || len(key) != 32 {
+		slog.Error("MFA_ENCRYPTION_KEY env var must be set to 32 hex encoded bytes", "err", err)
+		os.Exit(1)
+	}
+	mfaKey = key
+}
+
+func signSessionToken(email string, mfa bool, ttl time.Duration) (string, error) {
+	claims := JwtClaims{Mfa: mfa}
+	claims.Subject = email
+	return SignTokenClaims(claims, ttl)
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, MFA_RECOVERY_CODES)
+	hashes := make([]string, MFA_RECOVERY_CODES)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoder.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashToken(normalizeRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// verifySecondFactor accepts a current TOTP code or an unused recovery code.
+func verifySecondFactor(ctx context.Context, store model.AppStore, mfa *model.UserMfa, code string) (bool, error) {
+	if code == "" {
+		return false, nil
+	}
+	secret, err := util.DecryptSecret(mfaKey, mfa.Secret)
+	if err != nil {
+		return false, err
+	}
+	if step, ok := util.VerifyTOTP(secret, code, time.Now(), 1); ok {
+		if err := store.UserMfa().UseStep(ctx, mfa.UserID, step); err != nil {
+			if err.Error() == "NO_ROWS_AFFECTED" {
+				slog.Warn("totp code replay", "user", mfa.UserID)
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+	err = store.UserMfa().UseRecoveryCode(ctx, mfa.UserID, hashToken(normalizeRecoveryCode(code)), time.Now())
+	if err != nil {
+		if err.Error() == "NOT_FOUND" {
+			return false, nil
+		}
+		return false, err
+	}
+	slog.Info("recovery code used", "user", mfa.UserID)
+	return true, nil
+}
+
+// mfaLocked reports whether the user has used up MFA_MAX_ATTEMPTS within
+// MFA_LOCK_TIME of the last failure.
+func mfaLocked(mfa *model.UserMfa, now time.Time) bool {
+	return mfa.FailedAttempts >= MFA_MAX_ATTEMPTS &&
+		mfa.FailedAt.Valid && now.Before(mfa.FailedAt.Time.Add(MFA_LOCK_TIME))
+}
+
+// VerifyMfa   godoc
+// @Summary      Second login step
+// @Description  Exchange the mfa_token from PUT /auth and a TOTP or recovery code for a session; locked after MFA_MAX_ATTEMPTS failed codes
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        user  body     LoginObject true  "email, mfa_token and code"
+// @Success      200  {object}  LoginObject
+// @Failure      400  {object}  HttpResult
+// @Failure      500  {object}  HttpResult
+// @Router       /auth/mfa [put]
+func AuthMfaVerify(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	var obj LoginObject
+	err := json.NewDecoder(r.Body).Decode(&obj)
+	if err != nil {
+		slog.Warn("invalid body", "err", err)
+		return fmt.Errorf("invalid body")
+	}
+	claim, err := ParseTokenScope(obj.MfaToken, "mfa")
+	if err != nil || claim.Subject != obj.Email {
+		slog.Warn("invalid mfa token", "email", obj.Email, "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	user, err := store.User().GetByEmail(ctx, obj.Email)
+	if err != nil {
+		slog.Warn("failed to get user by email", "email", obj.Email, "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	shared, err := base64.RawStdEncoding.DecodeString(user.Secret.String)
+	if !user.Secret.Valid || err != nil {
+		slog.Warn("user secret is not valid", "email", obj.Email, "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	if reason := VerifyHMAC(r, shared); reason != "" {
+		writeBadRequest(w, reason)
+		return nil
+	}
+	// the user may have been disabled since the first step
+	if active, err := userActive(ctx, store, user); err != nil {
+		slog.Warn("failed to get user status", "email", obj.Email, "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	} else if !active {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	mfa, err := store.UserMfa().Get(ctx, user.ID)
+	if err != nil || !mfa.Enabled {
+		slog.Warn("second factor not enrolled", "email", obj.Email, "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	if mfaLocked(mfa, time.Now()) {
+		slog.Warn("second factor locked", "email", obj.Email, "attempts", mfa.FailedAttempts)
+		writeBadRequest(w, "mfa_locked")
+		return nil
+	}
+	ok, err := verifySecondFactor(ctx, store, mfa, obj.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		count, err := store.UserMfa().Fail(ctx, user.ID, time.Now(), MFA_LOCK_TIME)
+		if err != nil {
+			return err
+		}
+		slog.Warn("invalid second factor", "email", obj.Email, "attempts", count)
+		writeBadRequest(w, "invalid_code")
+		return nil
+	}
+	if mfa.FailedAttempts > 0 {
+		if err = store.UserMfa().ResetAttempts(ctx, user.ID); err != nil {
+			return err
+		}
+	}
+
+	obj.Code = ""
+	obj.MfaToken = ""
+	obj.Token, err = signSessionToken(user.Email, true, TOKEN_EXPIRY)
+	if err != nil {
+		slog.Error("failed to sign token", "err", err)
+		return fmt.Errorf("login failed")
+	}
+	obj.RefreshToken, err = signSessionToken(user.Email, true, REFRESH_TOKEN_EXPIRY)
+	if err != nil {
+		slog.Error("failed to sign refresh token", "err", err)
+		return fmt.Errorf("login failed")
+	}
+	user.Token = jsql.SecretValue(obj.RefreshToken)
+	err = store.User().Update(ctx, *user, []model.UserField{model.UserField_Token})
+	if err != nil {
+		slog.Error("failed to update user token", "err", err)
+		return fmt.Errorf("login failed")
+	}
+	if obj.Cookie {
+		obj.Cookie = setSessionCookies(w, &obj)
+	}
+	obj.User, err = toLoginUser(ctx, store, user)
+	if err != nil {
+		slog.Error("failed to resolve user roles", "email", user.Email, "err", err)
+		return fmt.Errorf("login failed")
+	}
+	_ = json.NewEncoder(w).Encode(obj)
+	return nil
+}
+
+// EnrollTotp   godoc
+// @Summary      Start TOTP enrollment
+// @Description  Generate a TOTP secret and otpauth URI for the QR code, replacing a pending one. Confirm with PUT /auth/totp.
+// @Tags         auth
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {object}  TotpEnrollment
+// @Failure      400  {object}  HttpResult
+// @Failure      403  {object}  HttpResult
+// @Failure      500  {object}  HttpResult
+// @Router       /auth/totp [post]
+func AuthTotpEnroll(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	luser, ok := ctx.Value(HandlerCtxKeyUser).(*LoginUser)
+	if !ok || luser == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return nil
+	}
+	if !UserHMAC(r, luser, "auth", "totp") {
+		writeForbiden(w)
+		return nil
+	}
+	secret, err := util.GenerateTOTPSecret()
+	if err != nil {
+		return err
+	}
+	sealed, err := util.EncryptSecret(mfaKey, secret)
+	if err != nil {
+		return err
+	}
+	err = store.UserMfa().Enroll(ctx, model.UserMfa{
+		UserID:    luser.User.ID,
+		Secret:    sealed,
+		UpdatedAt: time.Now(),
+	})
+	if err != nil {
+		if err.Error() == "ALREADY_ENABLED" {
+			writeBadRequest(w, "mfa_already_enabled")
+			return nil
+		}
+		return err
+	}
+	return json.NewEncoder(w).Encode(TotpEnrollment{
+		Secret:     secret,
+		OtpauthURI: util.TOTPURI(MFA_ISSUER, luser.Email, secret),
+	})
+}
+
+// ConfirmTotp   godoc
+// @Summary      Confirm TOTP enrollment
+// @Description  Enable TOTP with the first code from the authenticator app and return recovery codes
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        param  body    TotpCode  true  "TOTP code"
+// @Success      200  {object}  TotpRecoveryCodes
+// @Failure      400  {object}  HttpResult
+// @Failure      500  {object}  HttpResult
+// @Router       /auth/totp [put]
+func AuthTotpConfirm(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	luser, ok := ctx.Value(HandlerCtxKeyUser).(*LoginUser)
+	if !ok || luser == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return nil
+	}
+	if !UserHMAC(r, luser, "auth", "totp") {
+		writeForbiden(w)
+		return nil
+	}
+	var obj TotpCode
+	err := json.NewDecoder(r.Body).Decode(&obj)
+	if err != nil {
+		slog.Warn("invalid body", "err", err)
+		return fmt.Errorf("invalid body")
+	}
+	mfa, err := store.UserMfa().Get(ctx, luser.User.ID)
+	if err != nil {
+		if err.Error() == "NOT_FOUND" {
+			writeBadRequest(w, "mfa_not_enrolled")
+			return nil
+		}
+		return err
+	}
+	if mfa.Enabled {
+		writeBadRequest(w, "mfa_already_enabled")
+		return nil
+	}
+	secret, err := util.DecryptSecret(mfaKey, mfa.Secret)
+	if err != nil {
+		return err
+	}
+	step, ok := util.VerifyTOTP(secret, obj.Code, time.Now(), 1)
+	if !ok {
+		writeBadRequest(w, "invalid_code")
+		return nil
+	}
+	mfa.Enabled = true
+	mfa.LastStep = step
+	mfa.UpdatedAt = time.Now()
+	if err = store.UserMfa().Save(ctx, *mfa); err != nil {
+		return err
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	if err = store.UserMfa().SetRecoveryCodes(ctx, mfa.UserID, hashes); err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(TotpRecoveryCodes{RecoveryCodes: codes})
+}
+
+// DisableTotp   godoc
+// @Summary      Disable TOTP
+// @Description  Remove the second factor; not allowed while a role of the user requires it
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        param  body    TotpCode  true  "TOTP or recovery code"
+// @Success      200  {object}  any
+// @Failure      400  {object}  HttpResult
+// @Failure      500  {object}  HttpResult
+// @Router       /auth/totp [delete]
+func AuthTotpDisable(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	luser, ok := ctx.Value(HandlerCtxKeyUser).(*LoginUser)
+	if !ok || luser == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return nil
+	}
+	if !UserHMAC(r, luser, "auth", "totp") {
+		writeForbiden(w)
+		return nil
+	}
+	var obj TotpCode
+	err := json.NewDecoder(r.Body).Decode(&obj)
+	if err != nil {
+		slog.Warn("invalid body", "err", err)
+		return fmt.Errorf("invalid body")
+	}
+	if luser.MfaRequired {
+		writeBadRequest(w, "mfa_required")
+		return nil
+	}
+	mfa, err := store.UserMfa().Get(ctx, luser.User.ID)
+	if err != nil {
+		if err.Error() == "NOT_FOUND" {
+			writeBadRequest(w, "mfa_not_enrolled")
+			return nil
+		}
+		return err
+	}
+	if mfa.Enabled {
+		ok, err := verifySecondFactor(ctx, store, mfa, obj.Code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			writeBadRequest(w, "invalid_code")
+			return nil
+		}
+	}
+	if err = store.UserMfa().Delete(ctx, mfa.UserID); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status": "ok"}`))
+	return nil
+}
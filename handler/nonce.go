@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/maphash"
+	"log/slog"
+	"sync"
+	"time"
+
+	"example.com/app-api/model"
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+)
+
+// NonceStore is the replay cache of BasicHMAC. Add records key until expires
+// and reports false when key was recorded before and has not expired yet.
+type NonceStore interface {
+	Add(ctx context.Context, key string, expires time.Time) (bool, error)
+}
+
+var nonceStore NonceStore = NewMemoryNonceStore(64, 100000)
+
+// SetNonceStore replaces the replay cache, e.g. with a DBNonceStore when
+// requests are balanced over several instances.
+func SetNonceStore(s NonceStore) {
+	nonceStore = s
+}
+
+// MemoryNonceStore is a process local NonceStore. Keys are spread over
+// shards so concurrent signed requests rarely wait on the same lock. Each
+// shard holds at most its share of size keys; when full, the oldest key is
+// evicted even if it has not expired yet.
+type MemoryNonceStore struct {
+	seed   maphash.Seed
+	shards []nonceShard
+}
+
+type nonceShard struct {
+	mu      sync.Mutex
+	entries *simplelru.LRU[string, time.Time]
+}
+
+func NewMemoryNonceStore(shards, size int) *MemoryNonceStore {
+	if shards < 1 {
+		shards = 1
+	}
+	s := &MemoryNonceStore{seed: maphash.MakeSeed(), shards: make([]nonceShard, shards)}
+	for i := range s.shards {
+		// only fails for a size < 1
+		s.shards[i].entries, _ = simplelru.NewLRU[string, time.Time](max(size/shards, 1), nil)
+	}
+	return s
+}
+
+func (s *MemoryNonceStore) Add(ctx context.Context, key string, expires time.Time) (bool, error) {
+	sh := &s.shards[maphash.String(s.seed, key)%uint64(len(s.shards))]
+	now := time.Now()
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	// keys expire about in the order they were added
+	for {
+		_, exp, ok := sh.entries.GetOldest()
+		if !ok || now.Before(exp) {
+			break
+		}
+		sh.entries.RemoveOldest()
+	}
+	if exp, ok := sh.entries.Peek(key); ok && now.Before(exp) {
+		return false, nil
+	}
+	sh.entries.Add(key, expires)
+	return true, nil
+}
+
+// DBNonceStore shares the replay cache through the unlogged app_nonce table,
+// so a request replayed against another instance is detected as well.
+type DBNonceStore struct {
+	store model.AppStore
+}
+
+// NewDBNonceStore deletes expired nonces every interval until ctx is done.
+func NewDBNonceStore(ctx context.Context, store model.AppStore, interval time.Duration) *DBNonceStore {
+	s := &DBNonceStore{store: store}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n, err := store.Nonce().DeleteExpired(ctx, time.Now())
+				if err != nil {
+					slog.Error("failed to delete expired nonces", "err", err)
+				} else if n > 0 {
+					slog.Debug("deleted expired nonces", "count", n)
+				}
+			}
+		}
+	}()
+	return s
+}
+
+func (s *DBNonceStore) Add(ctx context.Context, key string, expires time.Time) (bool, error) {
+	// the nonce is chosen by the client, hashing bounds the key length
+	sum := sha256.Sum256([]byte(key))
+	return s.store.Nonce().Add(ctx, hex.EncodeToString(sum[:]), expires, time.Now())
+}
@@ -0,0 +1,543 @@
+package handler
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// swagger: model OidcLoginRequest
+type OidcLoginRequest struct {
+	PublicKey string `json:"public_key,omitempty"`
+	State     string `json:"state,omitempty"`
+	Code      string `json:"code,omitempty"`
+	// Cookie asks for the cookie session mode, see SessionCookieOptions.
+	Cookie bool `json:"cookie,omitempty"`
+}
+
+// swagger: model OidcAuthorization
+type OidcAuthorization struct {
+	AuthorizationURL string `json:"authorization_url"`
+	State            string `json:"state"`
+	PublicKey        string `json:"public_key"`
+	Kid              string `json:"kid"`
+}
+
+// OIDCRoleRule grants the app_role named Role to users whose role claim holds
+// a value matching the regular expression Value (case insensitive).
+type OIDCRoleRule struct {
+	Value string `json:"value"`
+	Role  string `json:"role"`
+}
+
+// OIDCProvider is an OpenID Connect provider used with the authorization code
+// flow and PKCE. Endpoints and signing keys are discovered from Issuer.
+type OIDCProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	RoleClaim    string
+	Rules        []OIDCRoleRule
+	// Provision creates app_user rows for unknown emails, otherwise only
+	// existing users can log in.
+	Provision  bool
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	keysAt    time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+var (
+	OIDC_LOGIN_EXPIRY = 10 * time.Minute
+	oidcProvider      *OIDCProvider
+)
+
+func init() {
+	if str := os.Getenv("OIDC_LOGIN_EXPIRY"); str != "" {
+		if v, err := strconv.Atoi(str); err == nil {
+			OIDC_LOGIN_EXPIRY = time.Duration(v) * time.Minute
+		} else {
+			slog.Warn("invalid OIDC_LOGIN_EXPIRY env var, using default", "err", err, "value", str)
+		}
+	}
+	if os.Getenv("OIDC_ISSUER") != "" {
+		p, err := NewOIDCProvider("OIDC")
+		if err != nil {
+			slog.Error("invalid OIDC configuration, sso disabled", "err", err)
+		} else {
+			oidcProvider = p
+		}
+	}
+}
+
+// NewOIDCProvider reads the configuration from the env vars <prefix>_ISSUER,
+// _CLIENT_ID, _CLIENT_SECRET, _REDIRECT_URL, _SCOPES (space separated),
+// _ROLE_CLAIM, _PROVISION and _ROLE_MAP, a JSON list of OIDCRoleRule.
+func NewOIDCProvider(prefix string) (*OIDCProvider, error) {
+	p := &OIDCProvider{
+		Issuer:       strings.TrimSuffix(os.Getenv(prefix+"_ISSUER"), "/"),
+		ClientID:     os.Getenv(prefix + "_CLIENT_ID"),
+		ClientSecret: os.Getenv(prefix + "_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv(prefix + "_REDIRECT_URL"),
+		Scopes:       strings.Fields(os.Getenv(prefix + "_SCOPES")),
+		RoleClaim:    os.Getenv(prefix + "_ROLE_CLAIM"),
+		Provision:    true,
+	}
+	if p.Issuer == "" || p.ClientID == "" || p.RedirectURL == "" {
+		return nil, fmt.Errorf("%s_ISSUER, %s_CLIENT_ID and %s_REDIRECT_URL are required", prefix, prefix, prefix)
+	}
+	if str := os.Getenv(prefix + "_PROVISION"); str != "" {
+		if v, err := strconv.ParseBool(str); err == nil {
+			p.Provision = v
+		} else {
+			slog.Warn("invalid "+prefix+"_PROVISION env var, using default", "err", err, "value", str)
+		}
+	}
+	if str := os.Getenv(prefix + "_ROLE_MAP"); str != "" {
+		if err := json.Unmarshal([]byte(str), &p.Rules); err != nil {
+			return nil, fmt.Errorf("invalid %s_ROLE_MAP: %w", prefix, err)
+		}
+	}
+	for _, rule := range p.Rules {
+		if _, err := regexp.Compile(rule.Value); err != nil {
+			return nil, fmt.Errorf("invalid %s_ROLE_MAP value %q: %w", prefix, rule.Value, err)
+		}
+	}
+	return p, nil
+}
+
+// SetOIDCProvider replaces the provider used for single sign-on; nil disables it.
+func SetOIDCProvider(p *OIDCProvider) {
+	oidcProvider = p
+}
+
+func (p *OIDCProvider) client() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func (p *OIDCProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	issuer := strings.TrimSuffix(p.Issuer, "/")
+	var d oidcDiscovery
+	if err := p.getJSON(ctx, issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksURI == "" {
+		return nil, errors.New("incomplete discovery document")
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// key returns the signing key kid; the key set is refetched at most once a
+// minute when kid is unknown, which covers key rotation at the provider.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.keysAt) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var set util.JWKSet
+	if err := p.getJSON(ctx, d.JwksURI, &set); err != nil {
+		return nil, err
+	}
+	p.keysAt = time.Now()
+	p.keys = map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		k, err := jwk.PublicKey()
+		if err != nil {
+			slog.Warn("skipping invalid jwk", "kid", jwk.Kid, "err", err)
+			continue
+		}
+		p.keys[jwk.Kid] = k
+	}
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k, nil
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// AuthCodeURL returns the authorization endpoint URL with the S256 code
+// challenge of verifier.
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURL)
+	q.Set("scope", strings.Join(scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems code at the token endpoint and returns the raw ID token.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", verifier)
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&res); err != nil {
+		return "", fmt.Errorf("token response: %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token response: %s: %s %s", resp.Status, res.Error, res.ErrorDescription)
+	}
+	if res.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return res.IDToken, nil
+}
+
+// VerifyIDToken checks signature, issuer, audience, validity and nonce of raw.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, raw, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, kid)
+	}, jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "EdDSA"}),
+		jwt.WithLeeway(time.Minute),
+		jwt.WithIssuedAt(),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuer(strings.TrimSuffix(p.Issuer, "/")),
+		jwt.WithAudience(p.ClientID),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != p.ClientID {
+			return nil, errors.New("azp does not match client id")
+		}
+	}
+	got, _ := claims["nonce"].(string)
+	if subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return nil, errors.New("nonce mismatch")
+	}
+	return claims, nil
+}
+
+// claimStrings returns claim name as a list, accepting a single string too.
+func claimStrings(claims jwt.MapClaims, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		res := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+func randomString(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// StartOidc   godoc
+// @Summary      Start OpenID Connect login
+// @Description  Create an authorization request with PKCE for the client ECDH public key. Redirect the browser to authorization_url and finish with PUT /auth/oidc.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        param  body    OidcLoginRequest  true  "Client public key"
+// @Success      200  {object}  OidcAuthorization
+// @Failure      400  {object}  HttpResult
+// @Failure      404  {object}  any
+// @Failure      500  {object}  HttpResult
+// @Router       /auth/oidc [post]
+func AuthOidcStart(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	p := oidcProvider
+	if p == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	var obj OidcLoginRequest
+	err := json.NewDecoder(r.Body).Decode(&obj)
+	if err != nil {
+		slog.Warn("invalid body", "err", err)
+		return fmt.Errorf("invalid body")
+	}
+	if _, err = util.DecodePubKey(obj.PublicKey); err != nil {
+		slog.Warn("invalid public key", "err", err)
+		writeBadRequest(w, "invalid_public_key")
+		return nil
+	}
+	state, err := randomString(32)
+	if err != nil {
+		return err
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		return err
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return err
+	}
+	authURL, err := p.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		slog.Error("oidc discovery failed", "issuer", p.Issuer, "err", err)
+		return fmt.Errorf("oidc provider unavailable")
+	}
+	skey, err := serverKeys.get(ctx, store, "")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	err = store.OidcLogin().Create(ctx, model.OidcLogin{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		PublicKey:    obj.PublicKey,
+		Kid:          skey.Kid,
+		ExpiresAt:    now.Add(OIDC_LOGIN_EXPIRY),
+		CreatedAt:    now,
+	})
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(OidcAuthorization{
+		AuthorizationURL: authURL,
+		State:            state,
+		PublicKey:        skey.PublicKey,
+		Kid:              skey.Kid,
+	})
+}
+
+// LoginOidc   godoc
+// @Summary      Finish OpenID Connect login
+// @Description  Exchange the authorization code returned to the redirect URL for a session. The request is signed with the ECDH shared secret like PUT /auth.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        param  body    OidcLoginRequest  true  "State and authorization code"
+// @Success      200  {object}  LoginObject
+// @Failure      400  {object}  HttpResult
+// @Failure      404  {object}  any
+// @Failure      500  {object}  HttpResult
+// @Router       /auth/oidc [put]
+func AuthOidcLogin(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	p := oidcProvider
+	if p == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	var obj OidcLoginRequest
+	err := json.NewDecoder(r.Body).Decode(&obj)
+	if err != nil {
+		slog.Warn("invalid body", "err", err)
+		return fmt.Errorf("invalid body")
+	}
+	if obj.State == "" || obj.Code == "" {
+		writeBadRequest(w, "invalid_request")
+		return nil
+	}
+	login, err := store.OidcLogin().Consume(ctx, obj.State, time.Now())
+	if err != nil {
+		if err.Error() == "NOT_FOUND" {
+			slog.Warn("invalid or expired oidc state")
+			writeBadRequest(w, "invalid_state")
+			return nil
+		}
+		return err
+	}
+	cpub, err := util.DecodePubKey(login.PublicKey)
+	if err != nil {
+		return err
+	}
+	skey, err := serverKeys.get(ctx, store, login.Kid)
+	if err != nil {
+		slog.Warn("invalid server key", "kid", login.Kid, "err", err)
+		writeBadRequest(w, "invalid_kid")
+		return nil
+	}
+	shared, err := skey.Private.ECDH(cpub)
+	if err != nil {
+		slog.Warn("failed to compute shared secret", "err", err)
+		writeBadRequest(w, "invalid_public_key")
+		return nil
+	}
+	if reason := VerifyHMAC(r, shared); reason != "" {
+		writeBadRequest(w, reason)
+		return nil
+	}
+	rawIDToken, err := p.Exchange(ctx, obj.Code, login.CodeVerifier)
+	if err != nil {
+		slog.Warn("oidc code exchange failed", "err", err)
+		writeBadRequest(w, "invalid_code")
+		return nil
+	}
+	claims, err := p.VerifyIDToken(ctx, rawIDToken, login.Nonce)
+	if err != nil {
+		slog.Warn("invalid oidc id token", "err", err)
+		writeBadRequest(w, "invalid_id_token")
+		return nil
+	}
+	email, _ := claims["email"].(string)
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		writeBadRequest(w, "email_required")
+		return nil
+	}
+	// the email links to or creates a user, so a provider that does not
+	// assert its ownership is not trusted
+	if verified, _ := claims["email_verified"].(bool); !verified {
+		slog.Warn("oidc email is not verified", "email", email)
+		writeBadRequest(w, "email_not_verified")
+		return nil
+	}
+	user, err := store.User().GetByEmail(ctx, email)
+	if err != nil && err.Error() != "NOT_FOUND" {
+		return err
+	}
+	if user == nil && !p.Provision {
+		slog.Warn("oidc user is unknown", "email", email)
+		writeBadRequest(w, "unknown_user")
+		return nil
+	}
+	if user != nil {
+		if active, err := userActive(ctx, store, user); err != nil {
+			return err
+		} else if !active {
+			writeForbidenCode(w, "user_disabled")
+			return nil
+		}
+	}
+	name, _ := claims["name"].(string)
+	rules := make([]roleRule, 0, len(p.Rules))
+	for _, rule := range p.Rules {
+		rules = append(rules, roleRule{pattern: rule.Value, role: rule.Role})
+	}
+	roleClaim := p.RoleClaim
+	if roleClaim == "" {
+		roleClaim = "groups"
+	}
+	user, err = provisionUser(ctx, store, model.UserSourceOIDC, email, name, claimStrings(claims, roleClaim), rules, user)
+	if err != nil {
+		return err
+	}
+	return loginSession(ctx, store, w, &LoginObject{Email: user.Email, Cookie: obj.Cookie}, user, shared)
+}
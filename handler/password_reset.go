@@ -0,0 +1,265 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+)
+
+// swagger: model PasswordResetRequest
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// swagger: model PasswordResetConfirm
+type PasswordResetConfirm struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+var (
+	RESET_TOKEN_EXPIRY = 30 * time.Minute
+	RESET_URL          = "http://localhost:8080/reset-password"
+	// at most RESET_MAX_PER_EMAIL mails to a user and RESET_MAX_PER_IP
+	// requests of a client within RESET_THROTTLE_WINDOW
+	RESET_THROTTLE_WINDOW = 15 * time.Minute
+	RESET_MAX_PER_EMAIL   = 3
+	RESET_MAX_PER_IP      = 10
+	mailer                util.Mailer
+	resetClients          = &windowLimiter{counts: map[string]*windowCount{}}
+)
+
+func init() {
+	if str := os.Getenv("RESET_TOKEN_EXPIRY"); str != "" {
+		if v, err := strconv.Atoi(str); err == nil {
+			RESET_TOKEN_EXPIRY = time.Duration(v) * time.Minute
+		} else {
+			slog.Warn("invalid RESET_TOKEN_EXPIRY env var, using default", "err", err, "value", str)
+		}
+	}
+	if str := os.Getenv("RESET_URL"); str != "" {
+		RESET_URL = str
+	}
+	if str := os.Getenv("RESET_THROTTLE_WINDOW"); str != "" {
+		if v, err := strconv.Atoi(str); err == nil {
+			RESET_THROTTLE_WINDOW = time.Duration(v) * time.Minute
+		} else {
+			slog.Warn("invalid RESET_THROTTLE_WINDOW env var, using default", "err", err, "value", str)
+		}
+	}
+	if str := os.Getenv("RESET_MAX_PER_EMAIL"); str != "" {
+		if v, err := strconv.Atoi(str); err == nil {
+			RESET_MAX_PER_EMAIL = v
+		} else {
+			slog.Warn("invalid RESET_MAX_PER_EMAIL env var, using default", "err", err, "value", str)
+		}
+	}
+	if str := os.Getenv("RESET_MAX_PER_IP"); str != "" {
+		if v, err := strconv.Atoi(str); err == nil {
+			RESET_MAX_PER_IP = v
+		} else {
+			slog.Warn("invalid RESET_MAX_PER_IP env var, using default", "err", err, "value", str)
+		}
+	}
+	mailer = util.GetMailer("MAIL")
+}
+
+// SetMailer replaces the mailer used for password reset mails.
+func SetMailer(m util.Mailer) {
+	mailer = m
+}
+
+// windowLimiter counts the requests of a key within a fixed window. It is
+// kept in memory, so every instance of the server counts on its own.
+type windowLimiter struct {
+	mu     sync.Mutex
+	counts map[string]*windowCount
+}
+
+type windowCount struct {
+	start time.Time
+	n     int
+}
+
+// allow counts a request of key and reports whether it is within max.
+func (l *windowLimiter) allow(key string, max int, window time.Duration, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.counts[key]
+	if !ok || now.Sub(c.start) >= window {
+		if !ok && len(l.counts) >= 1024 {
+			for k, c := range l.counts {
+				if now.Sub(c.start) >= window {
+					delete(l.counts, k)
+				}
+			}
+		}
+		c = &windowCount{start: now}
+		l.counts[key] = c
+	}
+	c.n++
+	return c.n <= max
+}
+
+// clientIP is the address of the peer of r; the server is not told about
+// proxies in front of it.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RequestPasswordReset   godoc
+// @Summary      Request password reset
+// @Description  Mail a single-use reset link. The response does not reveal whether the email exists; a user gets at most RESET_MAX_PER_EMAIL mails and a client may send RESET_MAX_PER_IP requests within RESET_THROTTLE_WINDOW.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        param  body    PasswordResetRequest  true  "Reset request"
+// @Success      200  {object}  any
+// @Failure      400  {object}  HttpResult
+// @Failure      429  {object}  HttpResult
+// @Failure      500  {object}  HttpResult
+// @Router       /auth/reset [post]
+func AuthResetRequest(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	var obj PasswordResetRequest
+	err := json.NewDecoder(r.Body).Decode(&obj)
+	if err != nil {
+		slog.Warn("invalid body", "err", err)
+		return fmt.Errorf("invalid body")
+	}
+	if obj.Email == "" {
+		writeBadRequest(w, "email_required")
+		return nil
+	}
+	if ip := clientIP(r); !resetClients.allow(ip, RESET_MAX_PER_IP, RESET_THROTTLE_WINDOW, time.Now()) {
+		slog.Warn("password reset requests throttled", "ip", ip)
+		w.Header().Set("Retry-After", strconv.Itoa(int(RESET_THROTTLE_WINDOW.Seconds())))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(HttpResult{Code: "too_many_requests"})
+		return nil
+	}
+	user, err := store.User().GetByEmail(ctx, obj.Email)
+	if err != nil && err.Error() != "NOT_FOUND" {
+		return err
+	}
+	if user != nil {
+		// check the status, issue and deliver the token asynchronously; only
+		// the lookup above runs for every email, so the response time does
+		// not reveal whether the email exists
+		go sendPasswordReset(store, *user)
+	} else {
+		slog.Debug("password reset for unknown email")
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status": "ok"}`))
+	return nil
+}
+
+func sendPasswordReset(store model.AppStore, user model.User) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if active, err := userActive(ctx, store, &user); err != nil || !active {
+		if err != nil {
+			slog.Error("failed to get user status", "user", user.ID, "err", err)
+		}
+		return
+	}
+	now := time.Now()
+	// the tokens of the window count, used or not, so a mailbox is not
+	// flooded from many clients either
+	sent, err := store.PasswordReset().CountSince(ctx, user.ID, now.Add(-RESET_THROTTLE_WINDOW))
+	if err != nil {
+		slog.Error("failed to count password reset tokens", "user", user.ID, "err", err)
+		return
+	}
+	if sent >= RESET_MAX_PER_EMAIL {
+		slog.Warn("password reset mails throttled", "user", user.ID, "sent", sent)
+		return
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		slog.Error("failed to create password reset token", "user", user.ID, "err", err)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	_, err = store.PasswordReset().Create(ctx, model.PasswordReset{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: now.Add(RESET_TOKEN_EXPIRY),
+		CreatedAt: now,
+	})
+	if err != nil {
+		slog.Error("failed to store password reset token", "user", user.ID, "err", err)
+		return
+	}
+	mail := util.Mail{
+		To:      []string{user.Email},
+		Subject: "Password reset",
+		Body: fmt.Sprintf("Hello %s,\n\nUse the link below to reset your password. It expires in %s.\n\n%s?token=%s\n\nIf you did not request this, ignore this mail.\n",
+			user.Name, RESET_TOKEN_EXPIRY, RESET_URL, url.QueryEscape(token)),
+	}
+	if err := mailer.Send(ctx, mail); err != nil {
+		slog.Error("failed to send password reset mail", "user", user.ID, "err", err)
+	}
+}
+
+// ConfirmPasswordReset   godoc
+// @Summary      Confirm password reset
+// @Description  Set a new password with a reset token. Existing sessions are revoked.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        param  body    PasswordResetConfirm  true  "Reset token and new password"
+// @Success      200  {object}  any
+// @Failure      400  {object}  HttpResult
+// @Failure      500  {object}  HttpResult
+// @Router       /auth/reset [put]
+func AuthResetConfirm(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	var obj PasswordResetConfirm
+	err := json.NewDecoder(r.Body).Decode(&obj)
+	if err != nil {
+		slog.Warn("invalid body", "err", err)
+		return fmt.Errorf("invalid body")
+	}
+	if obj.Token == "" || obj.Password == "" {
+		writeBadRequest(w, "invalid_request")
+		return nil
+	}
+	// the token, the password and the revoked sessions change together
+	userID, err := store.PasswordReset().Consume(ctx, hashToken(obj.Token), obj.Password, time.Now())
+	if err != nil {
+		if err.Error() == "NOT_FOUND" {
+			slog.Warn("invalid or expired reset token")
+			writeBadRequest(w, "invalid_token")
+			return nil
+		}
+		return err
+	}
+	slog.Info("password reset", "user", userID)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status": "ok"}`))
+	return nil
+}
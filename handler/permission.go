@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"example.com/app-api/model"
+)
+
+// Role privileges map a resource to its actions:
+//
+//	{"param": {"read": true, "delete": "deny"}, "*": {"read": true}}
+//
+// true grants the action, "deny" forbids it even when another role grants it.
+// "*" as resource or action matches any resource or action. A role includes
+// the privileges of its parent roles, denies too.
+const (
+	privilegeDeny     = model.PrivilegeDeny
+	privilegeWildcard = "*"
+)
+
+// Effects of a permission decision.
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+	EffectNone  = "none"
+)
+
+// rolePrivileges are the parsed privileges of one role of the login user;
+// via names the user role it is inherited through.
+type rolePrivileges struct {
+	role       string
+	via        string
+	privileges map[string]any
+}
+
+// swagger: model DecisionMatch
+type DecisionMatch struct {
+	Role string `json:"role"`
+	// Via is the role of the user that includes Role, empty for the roles
+	// granted directly.
+	Via    string `json:"via,omitempty"`
+	Rule   string `json:"rule"`
+	Effect string `json:"effect"`
+	// Scope limits a grant to some rows of the resource.
+	Scope model.PrivilegeScope `json:"scope,omitempty"`
+}
+
+// Decision explains the permission check of a resource action.
+// swagger: model Decision
+type Decision struct {
+	Email    string `json:"email"`
+	Resource string `json:"resource"`
+	Action   string `json:"action"`
+	Allowed  bool   `json:"allowed"`
+	Effect   string `json:"effect"`
+	// Role and Rule name the entry that decided; empty when nothing matched.
+	Role    string          `json:"role,omitempty"`
+	Rule    string          `json:"rule,omitempty"`
+	Matches []DecisionMatch `json:"matches"`
+	// Scope limits an allowed action to some rows; nil allows all rows.
+	Scope model.PrivilegeScope `json:"scope,omitempty"`
+}
+
+// privilegeEffect returns the effect of the entries of privs matching
+// resource and action, the deciding entry as resource:action and the scope
+// of a scoped grant. A deny of any matching entry wins, so "*":"deny" is not
+// lifted by a grant of the action; otherwise the most specific grant decides.
+func privilegeEffect(privs map[string]any, resource, action string) (string, string, model.PrivilegeScope) {
+	effect, rule := EffectNone, ""
+	var scope model.PrivilegeScope
+	for _, res := range []string{resource, privilegeWildcard} {
+		pm, ok := privs[res].(map[string]any)
+		if !ok {
+			continue
+		}
+		for _, act := range []string{action, privilegeWildcard} {
+			switch v := pm[act].(type) {
+			case bool:
+				if v && effect == EffectNone {
+					effect, rule = EffectAllow, res+":"+act
+				}
+			case string:
+				if v == privilegeDeny {
+					return EffectDeny, res + ":" + act, nil
+				}
+			case map[string]any:
+				if s, ok := model.ParsePrivilegeScope(v); ok && effect == EffectNone {
+					effect, rule, scope = EffectAllow, res+":"+act, s
+				}
+			}
+		}
+	}
+	return effect, rule, scope
+}
+
+// decide checks the privileges of all roles: a deny of any role wins over
+// the grants of the others. The scope of an API key must grant the action too.
+// The decision is scoped when every grant is, see mergeScopes.
+func (luser *LoginUser) decide(resource, action string) Decision {
+	d := Decision{
+		Email:    luser.Email,
+		Resource: resource,
+		Action:   action,
+		Effect:   EffectNone,
+		Matches:  []DecisionMatch{},
+	}
+	unscoped := false
+	for _, rp := range luser.roles {
+		effect, rule, scope := privilegeEffect(rp.privileges, resource, action)
+		if effect == EffectNone {
+			continue
+		}
+		d.Matches = append(d.Matches, DecisionMatch{Role: rp.role, Via: rp.via, Rule: rule, Effect: effect, Scope: scope})
+		if d.Effect != EffectDeny && (effect == EffectDeny || d.Effect == EffectNone) {
+			d.Effect, d.Role, d.Rule = effect, rp.role, rule
+		}
+		if effect == EffectAllow {
+			if scope == nil {
+				unscoped = true
+			} else {
+				d.Scope = mergeScopes(d.Scope, scope)
+			}
+		}
+	}
+	if unscoped {
+		d.Scope = nil
+	}
+	if d.Effect == EffectAllow && luser.scope != nil {
+		role := "api_key:" + luser.APIKey
+		effect, rule, scope := privilegeEffect(luser.scope, resource, action)
+		if effect != EffectAllow {
+			// outside the scope of the key
+			effect = EffectDeny
+		}
+		d.Matches = append(d.Matches, DecisionMatch{Role: role, Rule: rule, Effect: effect, Scope: scope})
+		if effect == EffectDeny {
+			d.Effect, d.Role, d.Rule = effect, role, rule
+		} else if scope != nil {
+			d.Scope = narrowScope(d.Scope, scope)
+		}
+	}
+	d.Allowed = d.Effect == EffectAllow
+	if !d.Allowed {
+		d.Scope = nil
+	}
+	return d
+}
+
+// Explain   godoc
+// @Summary      Explain a permission decision
+// @Description  Show which role grants or denies an action. Explaining another user requires app_user:read.
+// @Tags         auth
+// @Produce      json
+// @Security     BearerAuth
+// @Param        resource  query  string  true   "resource, e.g. param"
+// @Param        action    query  string  true   "action, e.g. read"
+// @Param        email     query  string  false  "user to explain, default the login user"
+// @Success      200  {object}  Decision
+// @Failure      400  {object}  HttpResult
+// @Failure      403  {object}  HttpResult
+// @Router       /auth/explain [get]
+func AuthExplain(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	luser, ok := ctx.Value(HandlerCtxKeyUser).(*LoginUser)
+	if !ok || luser == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return nil
+	}
+	q := r.URL.Query()
+	resource, action := q.Get("resource"), q.Get("action")
+	if resource == "" || action == "" {
+		writeBadRequest(w, "resource_and_action_required")
+		return nil
+	}
+	target := luser
+	if email := q.Get("email"); email != "" && email != luser.Email {
+		if !luser.decide("app_user", "read").Allowed {
+			writeForbiden(w)
+			return nil
+		}
+		user, err := store.User().GetByEmail(ctx, email)
+		if err != nil && err.Error() != "NOT_FOUND" {
+			return err
+		}
+		if user == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return nil
+		}
+		if target, err = toLoginUser(ctx, store, user); err != nil {
+			return err
+		}
+	}
+	d := target.decide(resource, action)
+	slog.Debug("permission explained", "by", luser.Email, "email", d.Email, "resource", resource, "action", action, "effect", d.Effect)
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(d)
+}
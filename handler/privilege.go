@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+
+	"example.com/app-api/model"
+)
+
+// PrivilegeResource lists the actions checked on a resource.
+// swagger: model PrivilegeResource
+type PrivilegeResource struct {
+	Resource string   `json:"resource"`
+	Actions  []string `json:"actions"`
+	// Scopes are the attributes a grant may be narrowed to, see
+	// model.PrivilegeScope.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// privilegeRegistry holds the resource and action names the registered
+// handlers check; role privileges may only name those.
+var privilegeRegistry = struct {
+	mu        sync.RWMutex
+	resources map[string][]string
+	scopes    map[string][]string
+}{resources: map[string][]string{}, scopes: map[string][]string{}}
+
+// RegisterPrivileges adds the actions of resource to the catalog. The
+// *HandlerRegister call it for the privileges they check, APIStore for those
+// of the generated handlers it wraps; call it for resources checked outside
+// of this package.
+func RegisterPrivileges(resource string, actions ...string) {
+	privilegeRegistry.mu.Lock()
+	defer privilegeRegistry.mu.Unlock()
+	known := privilegeRegistry.resources[resource]
+	for _, action := range actions {
+		if !slices.Contains(known, action) {
+			known = append(known, action)
+		}
+	}
+	privilegeRegistry.resources[resource] = known
+}
+
+// RegisterScope adds the attributes the grants on resource may be scoped
+// to; the handlers of the resource must apply them, see scopeOf.
+func RegisterScope(resource string, attributes ...string) {
+	privilegeRegistry.mu.Lock()
+	defer privilegeRegistry.mu.Unlock()
+	known := privilegeRegistry.scopes[resource]
+	for _, attr := range attributes {
+		if !slices.Contains(known, attr) {
+			known = append(known, attr)
+		}
+	}
+	privilegeRegistry.scopes[resource] = known
+}
+
+// PrivilegeCatalog returns the registered resources and actions sorted by name.
+func PrivilegeCatalog() []PrivilegeResource {
+	privilegeRegistry.mu.RLock()
+	defer privilegeRegistry.mu.RUnlock()
+	res := make([]PrivilegeResource, 0, len(privilegeRegistry.resources))
+	for resource, actions := range privilegeRegistry.resources {
+		res = append(res, PrivilegeResource{
+			Resource: resource,
+			Actions:  slices.Sorted(slices.Values(actions)),
+			Scopes:   slices.Sorted(slices.Values(privilegeRegistry.scopes[resource])),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Resource < res[j].Resource })
+	return res
+}
+
+func registeredPrivilege(resource, action string) bool {
+	privilegeRegistry.mu.RLock()
+	defer privilegeRegistry.mu.RUnlock()
+	if resource == privilegeWildcard {
+		if action == privilegeWildcard {
+			return true
+		}
+		for _, actions := range privilegeRegistry.resources {
+			if slices.Contains(actions, action) {
+				return true
+			}
+		}
+		return false
+	}
+	actions, ok := privilegeRegistry.resources[resource]
+	return ok && (action == privilegeWildcard || slices.Contains(actions, action))
+}
+
+func registeredScope(resource, attr string) bool {
+	privilegeRegistry.mu.RLock()
+	defer privilegeRegistry.mu.RUnlock()
+	return slices.Contains(privilegeRegistry.scopes[resource], attr)
+}
+
+// ValidatePrivileges checks that the role privileges str only name
+// registered resources and actions with a true, false or "deny" value, or a
+// scope of registered attributes.
+func ValidatePrivileges(str string) error {
+	privs, err := model.ParsePrivileges(str)
+	if err != nil {
+		return err
+	}
+	for resource, actions := range privs {
+		for action, v := range actions {
+			if !registeredPrivilege(resource, action) {
+				return fmt.Errorf("unknown privilege %s:%s", resource, action)
+			}
+			scope, ok := model.ParsePrivilegeScope(v)
+			if !ok {
+				continue
+			}
+			for attr := range scope {
+				if !registeredScope(resource, attr) {
+					return fmt.Errorf("unknown scope %s:%s:%s", resource, action, attr)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ListPrivileges   godoc
+// @Summary      Privilege catalog
+// @Description  Resources and actions that role privileges may grant or deny
+// @Tags         auth
+// @Produce      json
+// @Security     BearerAuth
+// @Success      200  {array}   PrivilegeResource
+// @Router       /auth/privileges [get]
+func AuthPrivileges(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	if luser, ok := ctx.Value(HandlerCtxKeyUser).(*LoginUser); !ok || luser == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(PrivilegeCatalog())
+}
@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"example.com/app-api/model"
+)
+
+// StartRoleExpirySweeper records the role assignments that ran out in the
+// audit log every interval until ctx is done. Expired assignments are not
+// in effect anyway, the sweeper only makes their end visible.
+func StartRoleExpirySweeper(ctx context.Context, store model.AppStore, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n, err := store.UserRole().RecordExpiredRoles(ctx, time.Now())
+				if err != nil {
+					slog.Error("failed to record expired roles", "err", err)
+				} else if n > 0 {
+					slog.Info("recorded expired roles", "count", n)
+				}
+			}
+		}
+	}()
+}
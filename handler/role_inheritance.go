@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+
+	"example.com/app-api/model"
+)
+
+// effectiveRole is a role together with the roles it includes through its
+// parents, the role first.
+type effectiveRole struct {
+	version     int64
+	mfaRequired bool
+	roles       []inheritedRole
+}
+
+type inheritedRole struct {
+	name       string
+	privileges string
+	parsed     map[string]any
+}
+
+// effectiveRoles caches the effective roles by role ID. The store bumps the
+// version of a role whenever the role or one it includes changes, so an entry
+// is valid as long as its version matches the current version of the role.
+var effectiveRoles = struct {
+	mu    sync.Mutex
+	roles map[int64]*effectiveRole
+}{roles: map[int64]*effectiveRole{}}
+
+// resolveRoles returns the effective roles of the role ids by role ID,
+// loading the roles missing in the cache or cached for an older version.
+func resolveRoles(ctx context.Context, store model.AppStore, ids []int64) (map[int64]*effectiveRole, error) {
+	res := make(map[int64]*effectiveRole, len(ids))
+	if len(ids) == 0 {
+		return res, nil
+	}
+	versions, err := store.RolePolicy().Versions(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	missing := []int64{}
+	effectiveRoles.mu.Lock()
+	for _, id := range ids {
+		version, ok := versions[id]
+		if !ok {
+			// deleted since the user was loaded
+			continue
+		}
+		if e, ok := effectiveRoles.roles[id]; ok && e.version == version {
+			res[id] = e
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	effectiveRoles.mu.Unlock()
+	if len(missing) == 0 {
+		return res, nil
+	}
+	closure, err := store.RolePolicy().Closure(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[int64]model.RoleNode, len(closure))
+	for _, role := range closure {
+		nodes[role.ID] = role
+	}
+	effectiveRoles.mu.Lock()
+	defer effectiveRoles.mu.Unlock()
+	for _, id := range missing {
+		if _, ok := nodes[id]; !ok {
+			// deleted since the versions were loaded
+			continue
+		}
+		e := buildEffectiveRole(nodes, id)
+		effectiveRoles.roles[id] = e
+		res[id] = e
+	}
+	return res, nil
+}
+
+// buildEffectiveRole walks the parents of the role depth first. The store
+// forbids cycles, but a cycle must not hang the login: the closing link is
+// skipped.
+func buildEffectiveRole(nodes map[int64]model.RoleNode, root int64) *effectiveRole {
+	e := &effectiveRole{version: nodes[root].Version}
+	visited := map[int64]bool{}
+	path := map[int64]bool{}
+	var walk func(id int64)
+	walk = func(id int64) {
+		if path[id] {
+			slog.Warn("role inheritance cycle skipped", "role", nodes[root].Name, "parent", nodes[id].Name)
+			return
+		}
+		if visited[id] {
+			return
+		}
+		node, ok := nodes[id]
+		if !ok {
+			return
+		}
+		visited[id], path[id] = true, true
+		defer delete(path, id)
+		p := map[string]any{}
+		if err := json.Unmarshal([]byte(node.Privileges), &p); err != nil {
+			slog.Warn("failed to unmarshal role privileges", "role", node.Name, "privileges", node.Privileges, "err", err)
+		}
+		e.mfaRequired = e.mfaRequired || node.MfaRequired
+		e.roles = append(e.roles, inheritedRole{name: node.Name, privileges: node.Privileges, parsed: p})
+		for _, parent := range node.Parents {
+			walk(parent)
+		}
+	}
+	walk(root)
+	return e
+}
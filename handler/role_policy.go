@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"example.com/app-api/model"
+)
+
+// The policy of a role is read and changed with the privileges of the role
+// itself; a change of the parents changes the privileges of the role and
+// needs approval like them, see ApprovalOptions.
+
+// swagger: model RolePolicyUpdateParam
+type RolePolicyUpdateParam struct {
+	Value  model.RolePolicy        `json:"value"`
+	Fields []model.RolePolicyField `json:"fields"`
+}
+
+func RolePolicyHandlerRegister(mux *http.ServeMux, base string, store model.AppStore, authenticate Authenticate) {
+	mux.HandleFunc("GET "+base+"/role/{id}/policy", func(w http.ResponseWriter, r *http.Request) {
+		if !authenticate(r, "app_role", "read") {
+			writeForbiden(w)
+			return
+		}
+		if err := RolePolicyGet(r.Context(), store, w, r); err != nil {
+			slog.Warn("error in RolePolicyGet", "err", err)
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("PATCH "+base+"/role/{id}/policy", func(w http.ResponseWriter, r *http.Request) {
+		if !authenticate(r, "app_role", "update") {
+			writeForbiden(w)
+			return
+		}
+		if err := RolePolicyUpdate(r.Context(), store, w, r); err != nil {
+			slog.Warn("error in RolePolicyUpdate", "err", err)
+			writeInternalError(w, err)
+		}
+	})
+}
+
+// rolePolicyID returns the role ID of the path, 0 after writing a 400.
+func rolePolicyID(w http.ResponseWriter, r *http.Request) int64 {
+	pid := r.PathValue("id")
+	id, err := strconv.ParseInt(pid, 10, 64)
+	if err != nil {
+		slog.Warn("invalid id", "id", pid, "err", err)
+		writeBadRequest(w, "invalid_id")
+		return 0
+	}
+	return id
+}
+
+// ShowRolePolicy   godoc
+// @Summary      Get role policy
+// @Description  The version, the parents, the exclusive roles and the second factor requirement of a role
+// @Tags         role
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      integer  true  "Role ID"
+// @Success      200  {object}  model.RolePolicy
+// @Failure      400  {object}  HttpResult
+// @Failure      404  {object}  HttpResult
+// @Failure      500  {object}  HttpResult
+// @Router       /role/{id}/policy [get]
+func RolePolicyGet(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	id := rolePolicyID(w, r)
+	if id == 0 {
+		return nil
+	}
+	obj, err := store.RolePolicy().Get(ctx, id)
+	if err != nil {
+		if err.Error() == "NOT_FOUND" {
+			writeNotFound(w)
+			return nil
+		}
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(obj)
+}
+
+// UpdateRolePolicy   godoc
+// @Summary      Update role policy
+// @Description  Replace the fields of the policy of a role; value.version must be the current version.
+// @Tags         role
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id     path    integer                true  "Role ID"
+// @Param        param  body    RolePolicyUpdateParam  true  "Role policy"
+// @Success      200  {object}  model.RolePolicy
+// @Success      202  {object}  model.ChangeRequest
+// @Failure      400  {object}  HttpResult
+// @Failure      404  {object}  HttpResult
+// @Failure      409  {object}  HttpResult
+// @Failure      422  {object}  RoleConflict
+// @Failure      500  {object}  HttpResult
+// @Router       /role/{id}/policy [patch]
+func RolePolicyUpdate(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	id := rolePolicyID(w, r)
+	if id == 0 {
+		return nil
+	}
+	var obj RolePolicyUpdateParam
+	if err := json.NewDecoder(r.Body).Decode(&obj); err != nil {
+		slog.Warn("invalid body", "err", err)
+		writeBadRequest(w, "invalid_body")
+		return nil
+	}
+	obj.Value.RoleID = id
+	if rolePolicyChangeNeedsApproval(obj) {
+		return requestChange(ctx, store, w, "app_role", id, roleChange{Policy: &obj})
+	}
+	err := store.RolePolicy().Update(ctx, obj.Value, obj.Fields)
+	if err != nil {
+		slog.Warn("error update RolePolicy", "obj", obj, "err", err)
+		if err.Error() == "NO_ROWS_AFFECTED" {
+			// gone or changed since it was read
+			if _, err := store.RolePolicy().Get(ctx, id); err != nil && err.Error() == "NOT_FOUND" {
+				writeNotFound(w)
+				return nil
+			}
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(HttpResult{Code: "conflict"})
+			return nil
+		}
+		if writeRoleError(w, err) {
+			return nil
+		}
+		return err
+	}
+	res, err := store.RolePolicy().Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(res)
+}
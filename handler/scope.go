@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"example.com/app-api/model"
+)
+
+// A scoped grant allows an action on some rows of a resource only. The API
+// store asks scopeOf for the scope of the login user and narrows the store
+// calls with it: Find only sees the rows in scope, Get, Create, Update and
+// Delete reject the rows out of scope.
+
+// mergeScopes returns the scope of two grants of different roles: the values
+// of an attribute both restrict add up; an attribute only one of them
+// restricts does not restrict the merged grant.
+func mergeScopes(a, b model.PrivilegeScope) model.PrivilegeScope {
+	if a == nil {
+		return b
+	}
+	res := model.PrivilegeScope{}
+	for attr, values := range a {
+		if other, ok := b[attr]; ok {
+			res[attr] = slices.Compact(slices.Sorted(slices.Values(append(slices.Clone(values), other...))))
+		}
+	}
+	return res
+}
+
+// narrowScope returns the scope of a grant a limited by b, the scope of an
+// API key: the attributes of both must match.
+func narrowScope(a, b model.PrivilegeScope) model.PrivilegeScope {
+	res := model.PrivilegeScope{}
+	for attr, values := range a {
+		res[attr] = values
+	}
+	for attr, values := range b {
+		if current, ok := res[attr]; ok {
+			values = slices.DeleteFunc(slices.Clone(values), func(v string) bool {
+				return !slices.Contains(current, v)
+			})
+		}
+		res[attr] = values
+	}
+	return res
+}
+
+// scopeOf returns the scope of the action of the login user; nil when all
+// rows are allowed.
+func scopeOf(ctx context.Context, resource, action string) model.PrivilegeScope {
+	luser, ok := ctx.Value(HandlerCtxKeyUser).(*LoginUser)
+	if !ok || luser == nil {
+		return nil
+	}
+	return luser.decide(resource, action).Scope
+}
+
+// inScope reports whether a row with the attributes attr is allowed by scope.
+func inScope(scope model.PrivilegeScope, attr func(name string) string) bool {
+	for name, values := range scope {
+		if !slices.Contains(values, attr(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// outOfScopeError rejects a store call of the API store on a row out of
+// the scope of the login user.
+func outOfScopeError() *httpError {
+	return &httpError{
+		status: http.StatusForbidden,
+		code:   "out_of_scope",
+		body:   HttpResult{Code: "out_of_scope"},
+	}
+}
+
+func paramAttribute(p model.Param) func(name string) string {
+	return func(name string) string {
+		switch name {
+		case "groups":
+			return p.Group
+		}
+		return ""
+	}
+}
+
+// paramInScope reports whether the login user may run action on p.
+func paramInScope(ctx context.Context, action string, p model.Param) bool {
+	return inScope(scopeOf(ctx, "param", action), paramAttribute(p))
+}
+
+// paramStoredInScope checks the stored param id against the scope of action.
+// A missing param is left to the store call that follows.
+func paramStoredInScope(ctx context.Context, store model.ParamStore, action string, id int64) error {
+	scope := scopeOf(ctx, "param", action)
+	if scope == nil {
+		return nil
+	}
+	current, err := store.Get(ctx, id)
+	if err != nil {
+		if err.Error() == "NOT_FOUND" {
+			return nil
+		}
+		return err
+	}
+	if !inScope(scope, paramAttribute(*current)) {
+		slog.Warn("param out of scope", "id", id, "action", action, "scope", scope)
+		return outOfScopeError()
+	}
+	return nil
+}
@@ -0,0 +1,393 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/app-api/model"
+	"example.com/app-api/util"
+)
+
+// ServerKey is an ECDH P-256 key pair of the login handshake. The kid is
+// returned with the public key so the client can name the key it derived the
+// shared secret with, even after a rotation or on another instance.
+type ServerKey struct {
+	Kid       string
+	Private   *ecdh.PrivateKey
+	PublicKey string
+	// NotAfter ends the validity of the key; zero never expires.
+	NotAfter time.Time
+}
+
+// NewServerKey wraps priv; a nil priv generates a new key.
+func NewServerKey(priv *ecdh.PrivateKey) (*ServerKey, error) {
+	if priv == nil {
+		var err error
+		if priv, err = curve.GenerateKey(rand.Reader); err != nil {
+			return nil, err
+		}
+	}
+	if priv.Curve() != curve {
+		return nil, errors.New("server key must use P-256")
+	}
+	pub, err := util.EncodePubKey(priv.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(priv.PublicKey().Bytes())
+	return &ServerKey{
+		Kid:       base64.RawURLEncoding.EncodeToString(sum[:12]),
+		Private:   priv,
+		PublicKey: pub,
+	}, nil
+}
+
+// LoadServerKeyFile reads a PEM encoded PKCS#8 or SEC 1 P-256 private key.
+func LoadServerKeyFile(path string) (*ServerKey, error) {
+	bb, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(bb)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", path)
+	}
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var priv *ecdh.PrivateKey
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		priv, err = k.ECDH()
+	case *ecdh.PrivateKey:
+		priv = k
+	default:
+		err = fmt.Errorf("unsupported key type %T", key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	k, err := NewServerKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+// serverKeyring holds the handshake keys, current key first. With a DB
+// source the keys are reloaded at most once a minute and a new key is
+// created when the current one is older than rotation. The DB is read and
+// written under loading only, mu guards the fields and is never held across
+// a query.
+type serverKeyring struct {
+	loading  sync.Mutex
+	mu       sync.Mutex
+	keys     []*ServerKey
+	db       bool
+	rotation time.Duration
+	overlap  time.Duration
+	loadedAt time.Time
+	sealKey  []byte
+}
+
+var serverKeys = &serverKeyring{}
+
+func init() {
+	// keys persisted in the DB are sealed with AES-256 under their own key, so
+	// JWT_SECRET can be rotated without losing them
+	if str := os.Getenv("ECDH_ENCRYPTION_KEY"); str != "" {
+		key, err := hex.DecodeString(str)
+		if err != nil || len(key) != 32 {
+			slog.Error("ECDH_ENCRYPTION_KEY must be 32 hex encoded bytes", "err", err)
+			os.Exit(1)
+		}
+		serverKeys.sealKey = key
+	}
+	switch source := os.Getenv("ECDH_KEY_SOURCE"); source {
+	case "db":
+		if serverKeys.sealKey == nil {
+			slog.Error("ECDH_ENCRYPTION_KEY env var is not set")
+			os.Exit(1)
+		}
+		rotation, overlap := 24*time.Hour, time.Hour
+		if str := os.Getenv("ECDH_KEY_ROTATION"); str != "" {
+			if v, err := strconv.Atoi(str); err == nil && v > 0 {
+				rotation = time.Duration(v) * time.Minute
+			} else {
+				slog.Warn("invalid ECDH_KEY_ROTATION env var, using default", "err", err, "value", str)
+			}
+		}
+		if str := os.Getenv("ECDH_KEY_OVERLAP"); str != "" {
+			if v, err := strconv.Atoi(str); err == nil && v >= 0 {
+				overlap = time.Duration(v) * time.Minute
+			} else {
+				slog.Warn("invalid ECDH_KEY_OVERLAP env var, using default", "err", err, "value", str)
+			}
+		}
+		UseDBServerKeys(rotation, overlap)
+	case "file", "":
+		var keys []*ServerKey
+		if path := os.Getenv("ECDH_KEY_FILE"); path != "" {
+			k, err := LoadServerKeyFile(path)
+			if err != nil {
+				slog.Error("failed to load ECDH_KEY_FILE", "err", err)
+				os.Exit(1)
+			}
+			keys = append(keys, k)
+		} else if source == "file" {
+			slog.Error("ECDH_KEY_FILE env var is not set")
+			os.Exit(1)
+		}
+		for _, path := range strings.Split(os.Getenv("ECDH_PREVIOUS_KEY_FILES"), ",") {
+			if path = strings.TrimSpace(path); path == "" {
+				continue
+			}
+			k, err := LoadServerKeyFile(path)
+			if err != nil {
+				slog.Error("failed to load ECDH_PREVIOUS_KEY_FILES", "err", err)
+				os.Exit(1)
+			}
+			keys = append(keys, k)
+		}
+		if len(keys) == 0 {
+			slog.Warn("no ECDH key configured, using an ephemeral key; logins do not survive restarts or span instances")
+			k, err := NewServerKey(nil)
+			if err != nil {
+				slog.Error("failed to generate ECDH key", "err", err)
+				os.Exit(1)
+			}
+			keys = append(keys, k)
+		}
+		SetServerKeys(keys...)
+	default:
+		slog.Error("invalid ECDH_KEY_SOURCE env var", "value", source)
+		os.Exit(1)
+	}
+}
+
+// SetServerKeys uses static handshake keys; the first one is current, the
+// others are still accepted from clients that fetched them earlier.
+func SetServerKeys(keys ...*ServerKey) {
+	serverKeys.mu.Lock()
+	defer serverKeys.mu.Unlock()
+	serverKeys.keys = keys
+	serverKeys.db = false
+}
+
+// UseDBServerKeys shares the handshake keys through app_server_key. A key is
+// current for rotation and accepted for overlap after its successor appeared.
+func UseDBServerKeys(rotation, overlap time.Duration) {
+	serverKeys.mu.Lock()
+	defer serverKeys.mu.Unlock()
+	serverKeys.keys = nil
+	serverKeys.db = true
+	serverKeys.rotation = rotation
+	serverKeys.overlap = overlap
+	serverKeys.loadedAt = time.Time{}
+}
+
+// RotateServerKeys creates a new current key in the DB regardless of the age
+// of the current one.
+func RotateServerKeys(ctx context.Context, store model.AppStore) (*ServerKey, error) {
+	serverKeys.loading.Lock()
+	defer serverKeys.loading.Unlock()
+	cfg, ok := serverKeys.config()
+	if !ok {
+		return nil, errors.New("server keys are not stored in the db")
+	}
+	now := time.Now()
+	if err := cfg.create(ctx, store, now); err != nil {
+		return nil, err
+	}
+	keys, err := cfg.load(ctx, store, now, false)
+	if err != nil {
+		return nil, err
+	}
+	serverKeys.swap(keys, now)
+	return keys[0], nil
+}
+
+// keyringConfig is the part of the keyring needed to talk to the DB.
+type keyringConfig struct {
+	rotation time.Duration
+	overlap  time.Duration
+	sealKey  []byte
+}
+
+// config returns the DB settings and whether the keys are stored in the DB.
+func (r *serverKeyring) config() (keyringConfig, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return keyringConfig{rotation: r.rotation, overlap: r.overlap, sealKey: r.sealKey}, r.db
+}
+
+func (r *serverKeyring) swap(keys []*ServerKey, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.db {
+		r.keys = keys
+		r.loadedAt = now
+	}
+}
+
+func (c keyringConfig) create(ctx context.Context, store model.AppStore, now time.Time) error {
+	if c.sealKey == nil {
+		return errors.New("ECDH_ENCRYPTION_KEY is not set")
+	}
+	k, err := NewServerKey(nil)
+	if err != nil {
+		return err
+	}
+	sealed, err := util.EncryptSecret(c.sealKey, hex.EncodeToString(k.Private.Bytes()))
+	if err != nil {
+		return err
+	}
+	slog.Info("created ECDH server key", "kid", k.Kid)
+	return store.ServerKey().Create(ctx, model.ServerKey{
+		Kid:        k.Kid,
+		PrivateKey: sealed,
+		CreatedAt:  now,
+		NotAfter:   now.Add(c.rotation + c.overlap),
+	})
+}
+
+func (c keyringConfig) load(ctx context.Context, store model.AppStore, now time.Time, rotate bool) ([]*ServerKey, error) {
+	if c.sealKey == nil {
+		return nil, errors.New("ECDH_ENCRYPTION_KEY is not set")
+	}
+	rows, err := store.ServerKey().List(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	if rotate && (len(rows) == 0 || now.Sub(rows[0].CreatedAt) >= c.rotation) {
+		if err = store.ServerKey().DeleteExpired(ctx, now); err != nil {
+			return nil, err
+		}
+		if err = c.create(ctx, store, now); err != nil {
+			return nil, err
+		}
+		if rows, err = store.ServerKey().List(ctx, now); err != nil {
+			return nil, err
+		}
+	}
+	keys := make([]*ServerKey, 0, len(rows))
+	for _, row := range rows {
+		str, err := util.DecryptSecret(c.sealKey, row.PrivateKey)
+		if err != nil {
+			slog.Error("failed to decrypt ECDH server key", "kid", row.Kid, "err", err)
+			continue
+		}
+		raw, err := hex.DecodeString(str)
+		if err != nil {
+			return nil, err
+		}
+		priv, err := curve.NewPrivateKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		k, err := NewServerKey(priv)
+		if err != nil {
+			return nil, err
+		}
+		k.NotAfter = row.NotAfter
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no valid ECDH server key")
+	}
+	return keys, nil
+}
+
+// reload reads the keys from the DB unless another caller did so since
+// loadedAt, and swaps them in.
+func (r *serverKeyring) reload(ctx context.Context, store model.AppStore, loadedAt time.Time, rotate bool) error {
+	r.loading.Lock()
+	defer r.loading.Unlock()
+	r.mu.Lock()
+	done := r.loadedAt.After(loadedAt)
+	r.mu.Unlock()
+	if done {
+		return nil
+	}
+	cfg, ok := r.config()
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	keys, err := cfg.load(ctx, store, now, rotate)
+	if err != nil {
+		return err
+	}
+	r.swap(keys, now)
+	return nil
+}
+
+// lookup finds kid in the loaded keys and reports when they are due for a
+// reload from the DB.
+func (r *serverKeyring) lookup(kid string, now time.Time) (k *ServerKey, db bool, loadedAt time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.find(kid, now), r.db, r.loadedAt
+}
+
+// get returns the key named kid, the current key for an empty kid.
+func (r *serverKeyring) get(ctx context.Context, store model.AppStore, kid string) (*ServerKey, error) {
+	now := time.Now()
+	k, db, loadedAt := r.lookup(kid, now)
+	if db && now.Sub(loadedAt) >= time.Minute {
+		if err := r.reload(ctx, store, loadedAt, true); err != nil {
+			return nil, err
+		}
+		k, _, loadedAt = r.lookup(kid, now)
+	}
+	if k == nil && kid != "" && db {
+		// another instance may have rotated since the last load
+		if err := r.reload(ctx, store, loadedAt, false); err != nil {
+			return nil, err
+		}
+		k, _, _ = r.lookup(kid, now)
+	}
+	if k != nil {
+		return k, nil
+	}
+	if kid == "" {
+		return nil, errors.New("no valid ECDH server key")
+	}
+	return nil, fmt.Errorf("unknown ECDH server key %q", kid)
+}
+
+func (r *serverKeyring) find(kid string, now time.Time) *ServerKey {
+	for _, k := range r.keys {
+		if kid == "" || k.Kid == kid {
+			if k.NotAfter.IsZero() || now.Before(k.NotAfter) {
+				return k
+			}
+			return nil
+		}
+	}
+	return nil
+}
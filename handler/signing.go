@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SignPolicy tells BasicAuthenticate whether a request must carry a valid
+// X-Req-Signature.
+type SignPolicy string
+
+const (
+	// SignRequired rejects unsigned requests.
+	SignRequired SignPolicy = "required"
+	// SignOptional verifies the signature only when the request has one.
+	SignOptional SignPolicy = "optional"
+	// SignOff ignores the signature headers.
+	SignOff SignPolicy = "off"
+)
+
+// SigningRule sets the policy of the requests matching resource, action and
+// HTTP method; "*" or an empty value matches any.
+type SigningRule struct {
+	Resource string
+	Action   string
+	Method   string
+	Policy   SignPolicy
+}
+
+func (rule SigningRule) match(resource, action, method string) bool {
+	return matchRulePart(rule.Resource, resource) &&
+		matchRulePart(rule.Action, action) &&
+		matchRulePart(strings.ToUpper(rule.Method), method)
+}
+
+func matchRulePart(pattern, value string) bool {
+	return pattern == "" || pattern == "*" || pattern == value
+}
+
+// defaultSigningRules require a signature for writes, for the finds of the
+// generated POST routes and for the reads of users, and verify it for the
+// other reads when present.
+var defaultSigningRules = []SigningRule{
+	{Method: http.MethodPatch, Policy: SignRequired},
+	{Method: http.MethodPut, Policy: SignRequired},
+	{Method: http.MethodDelete, Policy: SignRequired},
+	{Method: http.MethodPost, Policy: SignRequired},
+	{Resource: "app_user", Action: "read", Method: http.MethodGet, Policy: SignRequired},
+	{Policy: SignOptional},
+}
+
+// defaultSignedHeaders must be signed whenever the request carries them, so
+// the body cannot be replayed under another content type.
+var defaultSignedHeaders = []string{"Content-Type"}
+
+// Reason codes returned when a request signature is rejected.
+const (
+	SignatureMissing        = "signature_missing"
+	SignatureMismatch       = "signature_mismatch"
+	SignatureSecretMissing  = "signature_secret_missing"
+	SignatureNonceMissing   = "nonce_missing"
+	SignatureNonceReplay    = "nonce_replay"
+	SignatureNonceError     = "nonce_store_error"
+	SignatureTimestampError = "timestamp_invalid"
+	SignatureTimestampSkew  = "timestamp_skew"
+	SignatureBodyMismatch   = "body_hash_mismatch"
+	SignatureHeaderUnsigned = "header_not_signed"
+)
+
+var signing = struct {
+	mu      sync.RWMutex
+	rules   []SigningRule
+	skew    time.Duration
+	headers []string
+}{
+	rules:   defaultSigningRules,
+	skew:    time.Minute,
+	headers: defaultSignedHeaders,
+}
+
+func init() {
+	if str := os.Getenv("HMAC_SIGNING_POLICY"); str != "" {
+		rules, err := ParseSigningRules(str)
+		if err != nil {
+			slog.Error("invalid HMAC_SIGNING_POLICY env var", "err", err, "value", str)
+			os.Exit(1)
+		}
+		SetSigningRules(rules...)
+	}
+	if str := os.Getenv("HMAC_CLOCK_SKEW"); str != "" {
+		if v, err := strconv.Atoi(str); err == nil && v > 0 {
+			SetHMACClockSkew(time.Duration(v) * time.Second)
+		} else {
+			slog.Warn("invalid HMAC_CLOCK_SKEW env var, using default", "err", err, "value", str)
+		}
+	}
+	if str := os.Getenv("HMAC_SIGNED_HEADERS"); str != "" {
+		SetHMACSignedHeaders(strings.Split(str, ",")...)
+	}
+}
+
+// ParseSigningRules parses a comma separated list of
+// resource:action[:METHOD]=policy entries, e.g.
+// "app_user:read=required,param:*:GET=off".
+func ParseSigningRules(str string) ([]SigningRule, error) {
+	var rules []SigningRule
+	for _, entry := range strings.Split(str, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		target, policy, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("missing policy in %q", entry)
+		}
+		rule := SigningRule{Policy: SignPolicy(strings.TrimSpace(policy))}
+		switch rule.Policy {
+		case SignRequired, SignOptional, SignOff:
+		default:
+			return nil, fmt.Errorf("invalid policy %q in %q", policy, entry)
+		}
+		parts := strings.Split(strings.TrimSpace(target), ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("expected resource:action[:METHOD] in %q", entry)
+		}
+		rule.Resource, rule.Action = parts[0], parts[1]
+		if len(parts) == 3 {
+			rule.Method = strings.ToUpper(parts[2])
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// SetSigningRules evaluates rules in order before the defaults; the first
+// match decides.
+func SetSigningRules(rules ...SigningRule) {
+	signing.mu.Lock()
+	defer signing.mu.Unlock()
+	signing.rules = append(append([]SigningRule{}, rules...), defaultSigningRules...)
+}
+
+// SetHMACClockSkew sets the accepted distance between X-Req-Timestamp and
+// the server clock.
+func SetHMACClockSkew(d time.Duration) {
+	signing.mu.Lock()
+	defer signing.mu.Unlock()
+	signing.skew = d
+}
+
+// SetHMACSignedHeaders names the headers that must be listed in
+// X-Req-Signed-Headers whenever the request carries them, replacing the
+// default Content-Type; no header signs the headers only on the client's
+// choice.
+func SetHMACSignedHeaders(headers ...string) {
+	var hs []string
+	for _, h := range headers {
+		if h = strings.TrimSpace(h); h != "" {
+			hs = append(hs, http.CanonicalHeaderKey(h))
+		}
+	}
+	signing.mu.Lock()
+	defer signing.mu.Unlock()
+	signing.headers = hs
+}
+
+func signingPolicy(resource, action, method string) SignPolicy {
+	signing.mu.RLock()
+	defer signing.mu.RUnlock()
+	for _, rule := range signing.rules {
+		if rule.match(resource, action, method) {
+			return rule.Policy
+		}
+	}
+	return SignOptional
+}
+
+func hmacClockSkew() time.Duration {
+	signing.mu.RLock()
+	defer signing.mu.RUnlock()
+	return signing.skew
+}
+
+func hmacSignedHeaders() []string {
+	signing.mu.RLock()
+	defer signing.mu.RUnlock()
+	return signing.headers
+}
+
+// signatureStatus carries the reason of a rejected signature from
+// BasicAuthenticate back to Secure, which reports it to the client.
+type signatureStatus struct {
+	reason string
+}
+
+func setSignatureError(r *http.Request, reason string) {
+	if st, ok := r.Context().Value(HandlerCtxKeySignature).(*signatureStatus); ok {
+		st.reason = reason
+	}
+}
+
+func withSignatureStatus(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request) {
+	st := &signatureStatus{}
+	return &signatureErrorWriter{ResponseWriter: w, status: st},
+		r.WithContext(context.WithValue(r.Context(), HandlerCtxKeySignature, st))
+}
+
+// signatureErrorWriter replaces the generic forbidden response of a handler
+// with the reason code of the rejected signature.
+type signatureErrorWriter struct {
+	http.ResponseWriter
+	status   *signatureStatus
+	replaced bool
+}
+
+func (w *signatureErrorWriter) WriteHeader(code int) {
+	if code == http.StatusForbidden && w.status.reason != "" {
+		w.replaced = true
+		w.Header().Set("Content-Type", "application/json")
+		writeForbidenCode(w.ResponseWriter, w.status.reason)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *signatureErrorWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach Flush and the other optional
+// interfaces of the underlying writer.
+func (w *signatureErrorWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"example.com/app-api/model"
+)
+
+// The role assignments of a user are its roles field: the generated user
+// handlers assign roles without bounds, these set and show their validity
+// window.
+
+// UserRoleParam is the validity window of a role assignment; nil is
+// unbounded.
+// swagger: model UserRoleParam
+type UserRoleParam struct {
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+}
+
+func UserRoleHandlerRegister(mux *http.ServeMux, base string, store model.AppStore, authenticate Authenticate) {
+	mux.HandleFunc("GET "+base+"/user/{id}/role", func(w http.ResponseWriter, r *http.Request) {
+		if !authenticate(r, "app_user", "read") {
+			writeForbiden(w)
+			return
+		}
+		if err := UserRoleFind(r.Context(), store, w, r); err != nil {
+			slog.Warn("error in UserRoleFind", "err", err)
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("PUT "+base+"/user/{id}/role/{role}", func(w http.ResponseWriter, r *http.Request) {
+		if !authenticate(r, "app_user", "update") {
+			writeForbiden(w)
+			return
+		}
+		if err := UserRoleAssign(r.Context(), store, w, r); err != nil {
+			slog.Warn("error in UserRoleAssign", "err", err)
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("DELETE "+base+"/user/{id}/role/{role}", func(w http.ResponseWriter, r *http.Request) {
+		if !authenticate(r, "app_user", "update") {
+			writeForbiden(w)
+			return
+		}
+		if err := UserRoleRemove(r.Context(), store, w, r); err != nil {
+			slog.Warn("error in UserRoleRemove", "err", err)
+			writeInternalError(w, err)
+		}
+	})
+}
+
+// userRolePath returns the IDs of the named path values, nil after writing
+// a 400.
+func userRolePath(w http.ResponseWriter, r *http.Request, names ...string) []int64 {
+	ids := make([]int64, 0, len(names))
+	for _, name := range names {
+		pid := r.PathValue(name)
+		id, err := strconv.ParseInt(pid, 10, 64)
+		if err != nil {
+			slog.Warn("invalid id", name, pid, "err", err)
+			writeBadRequest(w, "invalid_id")
+			return nil
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// writeUserRoles writes the assignments of the user, or 404 when the user
+// does not exist.
+func writeUserRoles(ctx context.Context, store model.AppStore, w http.ResponseWriter, userID int64) error {
+	if _, err := store.User().Get(ctx, userID); err != nil {
+		if err.Error() == "NOT_FOUND" {
+			writeNotFound(w)
+			return nil
+		}
+		return err
+	}
+	list, err := store.UserRole().Find(ctx, userID)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(list)
+}
+
+// FindUserRoles   godoc
+// @Summary      Get user role assignments
+// @Description  The roles assigned to a user with their validity window, in effect or not
+// @Tags         user
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      integer  true  "User ID"
+// @Success      200  {array}   model.UserRole
+// @Failure      400  {object}  HttpResult
+// @Failure      403  {object}  HttpResult
+// @Failure      404  {object}  HttpResult
+// @Failure      500  {object}  HttpResult
+// @Router       /user/{id}/role [get]
+func UserRoleFind(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	ids := userRolePath(w, r, "id")
+	if ids == nil {
+		return nil
+	}
+	if !fieldAllowed(ctx, "app_user", string(model.UserField_Roles), "read") {
+		writeForbiden(w)
+		return nil
+	}
+	return writeUserRoles(ctx, store, w, ids[0])
+}
+
+// AssignUserRole   godoc
+// @Summary      Assign a role to a user
+// @Description  Assign the role, or replace the validity window of its assignment
+// @Tags         user
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id     path    integer        true   "User ID"
+// @Param        role   path    integer        true   "Role ID"
+// @Param        param  body    UserRoleParam  false  "Validity window"
+// @Success      200  {array}   model.UserRole
+// @Success      202  {object}  model.ChangeRequest
+// @Failure      400  {object}  HttpResult
+// @Failure      403  {object}  FieldForbidden
+// @Failure      404  {object}  HttpResult
+// @Failure      422  {object}  RoleConflict
+// @Failure      500  {object}  HttpResult
+// @Router       /user/{id}/role/{role} [put]
+func UserRoleAssign(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	ids := userRolePath(w, r, "id", "role")
+	if ids == nil {
+		return nil
+	}
+	if writeFieldForbidden(w, "app_user", unwritableFields(ctx, "app_user", []model.UserField{model.UserField_Roles})) {
+		return nil
+	}
+	var obj UserRoleParam
+	if err := json.NewDecoder(r.Body).Decode(&obj); err != nil && !errors.Is(err, io.EOF) {
+		slog.Warn("invalid body", "err", err)
+		writeBadRequest(w, "invalid_body")
+		return nil
+	}
+	if obj.ValidFrom != nil && obj.ValidUntil != nil && !obj.ValidFrom.Before(*obj.ValidUntil) {
+		writeBadRequest(w, "invalid_validity")
+		return nil
+	}
+	_, err := store.User().Get(ctx, ids[0])
+	if err == nil {
+		_, err = store.Role().Get(ctx, ids[1])
+	}
+	if err != nil {
+		if err.Error() == "NOT_FOUND" {
+			writeNotFound(w)
+			return nil
+		}
+		return err
+	}
+	if userRoleAssignNeedsApproval() {
+		return requestChange(ctx, store, w, "app_user", ids[0], userChange{
+			Assign: &userRoleAssignment{RoleID: ids[1], UserRoleParam: obj},
+		})
+	}
+	err = store.UserRole().Assign(ctx, model.UserRole{
+		UserID:     ids[0],
+		RoleID:     ids[1],
+		ValidFrom:  obj.ValidFrom,
+		ValidUntil: obj.ValidUntil,
+	})
+	if err != nil {
+		if writeRoleConflict(w, err) {
+			return nil
+		}
+		return err
+	}
+	return writeUserRoles(ctx, store, w, ids[0])
+}
+
+// RemoveUserRole   godoc
+// @Summary      Remove a role from a user
+// @Tags         user
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id     path    integer  true  "User ID"
+// @Param        role   path    integer  true  "Role ID"
+// @Success      200  {array}   model.UserRole
+// @Failure      400  {object}  HttpResult
+// @Failure      403  {object}  FieldForbidden
+// @Failure      404  {object}  HttpResult
+// @Failure      500  {object}  HttpResult
+// @Router       /user/{id}/role/{role} [delete]
+func UserRoleRemove(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	ids := userRolePath(w, r, "id", "role")
+	if ids == nil {
+		return nil
+	}
+	if writeFieldForbidden(w, "app_user", unwritableFields(ctx, "app_user", []model.UserField{model.UserField_Roles})) {
+		return nil
+	}
+	if err := store.UserRole().Remove(ctx, ids[0], ids[1]); err != nil {
+		if err.Error() == "NOT_FOUND" {
+			writeNotFound(w)
+			return nil
+		}
+		return err
+	}
+	return writeUserRoles(ctx, store, w, ids[0])
+}
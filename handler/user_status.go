@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"example.com/app-api/model"
+)
+
+// A disabled or locked user keeps its row, so the created_by and updated_by
+// references stay intact, but getUser and Secure refuse it and the change
+// revokes its sessions. The generated user handlers neither show nor change
+// the status, these do.
+
+// UserStatusParam is the body of a user status change. Status is disabled
+// or locked when disabling a user, and ignored when enabling it.
+// swagger: model UserStatusParam
+type UserStatusParam struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// userActive reports whether the user may log in, logging the status of a
+// user that may not.
+func userActive(ctx context.Context, store model.AppStore, user *model.User) (bool, error) {
+	status, err := store.UserStatus().Get(ctx, user.ID)
+	if err != nil {
+		return false, err
+	}
+	if !status.Active() {
+		slog.Warn("user is not active", "email", user.Email, "status", status.Status)
+		return false, nil
+	}
+	return true, nil
+}
+
+func UserStatusHandlerRegister(mux *http.ServeMux, base string, store model.AppStore, authenticate Authenticate) {
+	mux.HandleFunc("GET "+base+"/user/{id}/status", func(w http.ResponseWriter, r *http.Request) {
+		if !authenticate(r, "app_user", "read") {
+			writeForbiden(w)
+			return
+		}
+		if err := UserStatusGet(r.Context(), store, w, r); err != nil {
+			slog.Warn("error in UserStatusGet", "err", err)
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("POST "+base+"/user/{id}/disable", func(w http.ResponseWriter, r *http.Request) {
+		if !authenticate(r, "app_user", "update") {
+			writeForbiden(w)
+			return
+		}
+		if err := UserStatusChange(r.Context(), store, w, r, model.UserStatusDisabled); err != nil {
+			slog.Warn("error in UserStatusChange", "err", err)
+			writeInternalError(w, err)
+		}
+	})
+	mux.HandleFunc("POST "+base+"/user/{id}/enable", func(w http.ResponseWriter, r *http.Request) {
+		if !authenticate(r, "app_user", "update") {
+			writeForbiden(w)
+			return
+		}
+		if err := UserStatusChange(r.Context(), store, w, r, model.UserStatusActive); err != nil {
+			slog.Warn("error in UserStatusChange", "err", err)
+			writeInternalError(w, err)
+		}
+	})
+}
+
+// userStatusID returns the user ID of the path, 0 after writing a 400.
+func userStatusID(w http.ResponseWriter, r *http.Request) int64 {
+	pid := r.PathValue("id")
+	id, err := strconv.ParseInt(pid, 10, 64)
+	if err != nil {
+		slog.Warn("invalid id", "id", pid, "err", err)
+		writeBadRequest(w, "invalid_id")
+		return 0
+	}
+	return id
+}
+
+// writeUserStatus writes the status of the user, or 404 when the user does
+// not exist.
+func writeUserStatus(ctx context.Context, store model.AppStore, w http.ResponseWriter, id int64) error {
+	obj, err := store.UserStatus().Get(ctx, id)
+	if err != nil {
+		if err.Error() == "NOT_FOUND" {
+			writeNotFound(w)
+			return nil
+		}
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(obj)
+}
+
+// ShowUserStatus   godoc
+// @Summary      Get user status
+// @Description  The status of a user with the reason and the time of its last change
+// @Tags         user
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id   path      integer  true  "User ID"
+// @Success      200  {object}  model.UserStatus
+// @Failure      400  {object}  HttpResult
+// @Failure      404  {object}  HttpResult
+// @Failure      500  {object}  HttpResult
+// @Router       /user/{id}/status [get]
+func UserStatusGet(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request) error {
+	id := userStatusID(w, r)
+	if id == 0 {
+		return nil
+	}
+	return writeUserStatus(ctx, store, w, id)
+}
+
+// UserStatusChange   godoc
+// @Summary      Disable or enable a user
+// @Description  Disabling sets the status to disabled or locked and revokes the sessions of the user; enabling sets it back to active.
+// @Tags         user
+// @Accept       json
+// @Produce      json
+// @Security     BearerAuth
+// @Param        id     path    integer          true   "User ID"
+// @Param        param  body    UserStatusParam  false  "Status and reason"
+// @Success      200  {object}  model.UserStatus
+// @Failure      400  {object}  HttpResult
+// @Failure      404  {object}  HttpResult
+// @Failure      500  {object}  HttpResult
+// @Router       /user/{id}/disable [post]
+// @Router       /user/{id}/enable [post]
+func UserStatusChange(ctx context.Context, store model.AppStore, w http.ResponseWriter, r *http.Request, status string) error {
+	luser, ok := ctx.Value(HandlerCtxKeyUser).(*LoginUser)
+	if !ok || luser == nil || luser.User == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("unauthorized"))
+		return nil
+	}
+	id := userStatusID(w, r)
+	if id == 0 {
+		return nil
+	}
+	var obj UserStatusParam
+	if err := json.NewDecoder(r.Body).Decode(&obj); err != nil && !errors.Is(err, io.EOF) {
+		slog.Warn("invalid body", "err", err)
+		writeBadRequest(w, "invalid_body")
+		return nil
+	}
+	if status != model.UserStatusActive {
+		switch obj.Status {
+		case "":
+		case model.UserStatusDisabled, model.UserStatusLocked:
+			status = obj.Status
+		default:
+			writeBadRequest(w, "invalid_status")
+			return nil
+		}
+		if id == luser.actorID() {
+			writeBadRequest(w, "disable_self")
+			return nil
+		}
+	}
+	err := store.UserStatus().Set(ctx, id, status, obj.Reason, luser.auditActor(), time.Now())
+	if err != nil {
+		if err.Error() == "NOT_FOUND" {
+			writeNotFound(w)
+			return nil
+		}
+		return err
+	}
+	slog.Info("user status changed", "id", id, "status", status, "actor", luser.auditActor())
+	return writeUserStatus(ctx, store, w, id)
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"example.com/app-api/handler"
 	"example.com/app-api/model"
@@ -36,13 +38,24 @@ import (
 // @externalDocs.description  OpenAPI
 // @externalDocs.url          https://swagger.io/resources/open-api/
 func main() {
-	store := model.GetStore()
+	store := model.GetAppStore()
+	if os.Getenv("NONCE_STORE") == "db" {
+		// detect replayed requests across all instances
+		handler.SetNonceStore(handler.NewDBNonceStore(context.Background(), store, time.Minute))
+	}
+	handler.StartRoleExpirySweeper(context.Background(), store, time.Minute)
 
 	api := http.NewServeMux()
-	handler.UserHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
-	handler.RoleHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
-	handler.ParamHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
+	apiStore := handler.APIStore(store)
+	handler.UserHandlerRegister(api, "/api/v1", apiStore, handler.BasicAuthenticate)
+	handler.UserStatusHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
+	handler.UserRoleHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
+	handler.RoleHandlerRegister(api, "/api/v1", apiStore, handler.BasicAuthenticate)
+	handler.RolePolicyHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
+	handler.ParamHandlerRegister(api, "/api/v1", apiStore, handler.BasicAuthenticate)
+	handler.ChangeRequestHandlerRegister(api, "/api/v1", store, handler.BasicAuthenticate)
 	handler.AuthHandlerRegister(api, store)
+	handler.MeHandlerRegister(api, "/api/v1", store)
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
@@ -51,8 +64,9 @@ func main() {
 	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 	})
+	handler.WellKnownHandlerRegister(mux)
 
-	mux.Handle("/api/v1/", handler.Secure(store, api))
+	mux.Handle("/api/v1/", handler.Secure(store, handler.E2EEncryption(api)))
 
 	if os.Getenv("API_DOCS") == "true" {
 		// Serve Swagger UI and JSON when in development
@@ -0,0 +1,14 @@
+-- DB: db
+
+CREATE TABLE app_password_reset (
+    id BIGSERIAL,
+    app_user INTEGER NOT NULL,
+    token_hash VARCHAR(128) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (app_user) REFERENCES app_user (id),
+    PRIMARY KEY (id)
+);
+
+ALTER TABLE app_password_reset ADD CONSTRAINT PasswordResetToken UNIQUE (token_hash);
@@ -0,0 +1,4 @@
+-- DB: db
+
+DROP TABLE IF EXISTS app_user_recovery_code;
+DROP TABLE IF EXISTS app_user_mfa;
@@ -0,0 +1,19 @@
+-- DB: db
+
+CREATE TABLE app_user_mfa (
+    app_user INTEGER NOT NULL,
+    secret VARCHAR(2000) NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    last_step BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (app_user) REFERENCES app_user (id),
+    PRIMARY KEY (app_user)
+);
+
+CREATE TABLE app_user_recovery_code (
+    app_user INTEGER NOT NULL,
+    code_hash VARCHAR(128) NOT NULL,
+    used_at TIMESTAMP,
+    FOREIGN KEY (app_user) REFERENCES app_user (id),
+    PRIMARY KEY (app_user, code_hash)
+);
@@ -0,0 +1,3 @@
+-- DB: db
+
+ALTER TABLE app_role DROP COLUMN IF EXISTS mfa_required;
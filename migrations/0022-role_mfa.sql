@@ -0,0 +1,3 @@
+-- DB: db
+
+ALTER TABLE app_role ADD COLUMN mfa_required BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,4 @@
+-- DB: db
+
+ALTER TABLE app_user_mfa DROP COLUMN IF EXISTS failed_at;
+ALTER TABLE app_user_mfa DROP COLUMN IF EXISTS failed_attempts;
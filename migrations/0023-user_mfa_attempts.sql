@@ -0,0 +1,4 @@
+-- DB: db
+
+ALTER TABLE app_user_mfa ADD COLUMN failed_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE app_user_mfa ADD COLUMN failed_at TIMESTAMP;
@@ -0,0 +1,3 @@
+-- DB: db
+
+ALTER TABLE app_user DROP COLUMN IF EXISTS source;
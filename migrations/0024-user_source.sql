@@ -0,0 +1,5 @@
+-- DB: db
+
+-- the authenticator that provisioned the user, or the one it was linked to;
+-- NULL for users created locally
+ALTER TABLE app_user ADD COLUMN source VARCHAR(20);
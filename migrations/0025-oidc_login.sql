@@ -0,0 +1,11 @@
+-- DB: db
+
+CREATE TABLE app_oidc_login (
+    state VARCHAR(128) NOT NULL,
+    nonce VARCHAR(128) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    public_key VARCHAR(2000) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (state)
+);
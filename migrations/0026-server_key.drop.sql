@@ -0,0 +1,4 @@
+-- DB: db
+
+ALTER TABLE app_oidc_login DROP COLUMN IF EXISTS kid;
+DROP TABLE IF EXISTS app_server_key;
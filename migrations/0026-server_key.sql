@@ -0,0 +1,11 @@
+-- DB: db
+
+CREATE TABLE app_server_key (
+    kid VARCHAR(64) NOT NULL,
+    private_key VARCHAR(2000) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    not_after TIMESTAMP NOT NULL,
+    PRIMARY KEY (kid)
+);
+
+ALTER TABLE app_oidc_login ADD COLUMN kid VARCHAR(64) NOT NULL DEFAULT '';
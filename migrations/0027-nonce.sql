@@ -0,0 +1,10 @@
+-- DB: db
+
+-- replay cache of signed requests; losing it on a crash only reopens the short timestamp window
+CREATE UNLOGGED TABLE app_nonce (
+    nonce_key VARCHAR(64) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (nonce_key)
+);
+
+CREATE INDEX app_nonce_expires_at ON app_nonce (expires_at);
@@ -0,0 +1,18 @@
+-- DB: db
+
+CREATE TABLE app_api_key (
+    id BIGSERIAL,
+    app_user INTEGER NOT NULL,
+    name VARCHAR(200) NOT NULL,
+    prefix VARCHAR(32) NOT NULL,
+    secret_hash VARCHAR(128) NOT NULL,
+    privileges VARCHAR(4000) NOT NULL DEFAULT '',
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (app_user) REFERENCES app_user (id),
+    PRIMARY KEY (id)
+);
+
+ALTER TABLE app_api_key ADD CONSTRAINT ApiKeyPrefix UNIQUE (prefix);
+CREATE INDEX app_api_key_app_user ON app_api_key (app_user);
@@ -0,0 +1,4 @@
+-- DB: db
+
+DROP TABLE IF EXISTS app_role_parent;
+ALTER TABLE app_role DROP COLUMN IF EXISTS version;
@@ -0,0 +1,14 @@
+-- DB: db
+
+ALTER TABLE app_role ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+
+CREATE TABLE app_role_parent (
+    app_role BIGINT NOT NULL,
+    parent BIGINT NOT NULL,
+    FOREIGN KEY (app_role) REFERENCES app_role (id) ON DELETE CASCADE,
+    FOREIGN KEY (parent) REFERENCES app_role (id) ON DELETE CASCADE,
+    CHECK (app_role <> parent),
+    PRIMARY KEY (app_role, parent)
+);
+
+CREATE INDEX app_role_parent_parent ON app_role_parent (parent);
@@ -0,0 +1,5 @@
+-- DB: db
+
+DROP TRIGGER IF EXISTS app_role_delete ON app_role;
+DROP TRIGGER IF EXISTS app_role_update ON app_role;
+DROP FUNCTION IF EXISTS app_role_bump_version();
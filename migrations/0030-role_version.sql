@@ -0,0 +1,30 @@
+-- DB: db
+
+-- the generated role store leaves the version alone: bump it, and the
+-- version of every role including the role, when the name, the privileges
+-- or the second factor requirement change or the role is deleted; the
+-- effective roles cached by the handlers hold all three
+CREATE FUNCTION app_role_bump_version() RETURNS TRIGGER AS $$
+BEGIN
+    WITH RECURSIVE descendant(id) AS (
+        SELECT app_role FROM app_role_parent WHERE parent = OLD.id
+        UNION
+        SELECT p.app_role FROM app_role_parent p JOIN descendant d ON p.parent = d.id
+    )
+    UPDATE app_role SET version = version + 1 WHERE id IN (SELECT id FROM descendant);
+    IF TG_OP = 'DELETE' THEN
+        RETURN OLD;
+    END IF;
+    NEW.version := OLD.version + 1;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER app_role_update BEFORE UPDATE OF name, privileges, mfa_required ON app_role
+    FOR EACH ROW WHEN (OLD.name IS DISTINCT FROM NEW.name
+        OR OLD.privileges IS DISTINCT FROM NEW.privileges
+        OR OLD.mfa_required IS DISTINCT FROM NEW.mfa_required)
+    EXECUTE FUNCTION app_role_bump_version();
+
+CREATE TRIGGER app_role_delete BEFORE DELETE ON app_role
+    FOR EACH ROW EXECUTE FUNCTION app_role_bump_version();
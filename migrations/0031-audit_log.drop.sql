@@ -0,0 +1,3 @@
+-- DB: db
+
+DROP TABLE IF EXISTS app_audit_log;
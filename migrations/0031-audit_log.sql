@@ -0,0 +1,14 @@
+-- DB: db
+
+CREATE TABLE app_audit_log (
+    id BIGSERIAL,
+    created_at TIMESTAMP NOT NULL,
+    actor VARCHAR(200) NOT NULL,
+    action VARCHAR(100) NOT NULL,
+    resource VARCHAR(100) NOT NULL,
+    resource_id VARCHAR(200) NOT NULL DEFAULT '',
+    detail TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX app_audit_log_resource ON app_audit_log (resource, resource_id);
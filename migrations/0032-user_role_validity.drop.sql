@@ -0,0 +1,7 @@
+-- DB: db
+
+DROP INDEX IF EXISTS app_user_role_valid_until;
+ALTER TABLE app_user_role DROP COLUMN IF EXISTS expiry_recorded;
+ALTER TABLE app_user_role DROP COLUMN IF EXISTS valid_until;
+ALTER TABLE app_user_role DROP COLUMN IF EXISTS valid_from;
+ALTER TABLE app_user_role DROP CONSTRAINT IF EXISTS app_user_role_pkey;
@@ -0,0 +1,12 @@
+-- DB: db
+
+-- a role is assigned at most once, with one validity window
+DELETE FROM app_user_role a USING app_user_role b
+WHERE a.ctid < b.ctid AND a.app_user = b.app_user AND a.app_role = b.app_role;
+ALTER TABLE app_user_role ADD CONSTRAINT app_user_role_pkey PRIMARY KEY (app_user, app_role);
+
+ALTER TABLE app_user_role ADD COLUMN valid_from TIMESTAMP;
+ALTER TABLE app_user_role ADD COLUMN valid_until TIMESTAMP;
+ALTER TABLE app_user_role ADD COLUMN expiry_recorded BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX app_user_role_valid_until ON app_user_role (valid_until) WHERE NOT expiry_recorded;
@@ -0,0 +1,5 @@
+-- DB: db
+
+DROP TRIGGER IF EXISTS app_user_role_exclusion ON app_user_role;
+DROP FUNCTION IF EXISTS app_user_role_check_exclusion();
+DROP TABLE IF EXISTS app_role_exclusion;
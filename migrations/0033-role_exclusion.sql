@@ -0,0 +1,56 @@
+-- DB: db
+
+-- separation of duties: a user must not hold both roles at the same time
+CREATE TABLE app_role_exclusion (
+    role_a BIGINT NOT NULL,
+    role_b BIGINT NOT NULL,
+    FOREIGN KEY (role_a) REFERENCES app_role (id) ON DELETE CASCADE,
+    FOREIGN KEY (role_b) REFERENCES app_role (id) ON DELETE CASCADE,
+    CHECK (role_a < role_b),
+    PRIMARY KEY (role_a, role_b)
+);
+
+CREATE INDEX app_role_exclusion_role_b ON app_role_exclusion (role_b);
+
+-- the API checks the exclusions before the roles are written, outside of
+-- the transaction writing them: check them again for every assignment
+-- written, with the user row locked so concurrent assignments of the user
+-- wait for each other. See roleConflictQuery of the model.
+CREATE FUNCTION app_user_role_check_exclusion() RETURNS TRIGGER AS $$
+DECLARE
+    conflict RECORD;
+BEGIN
+    PERFORM 1 FROM app_user WHERE id = NEW.app_user FOR UPDATE;
+    WITH RECURSIVE assigned(id, valid_from, valid_until) AS (
+        SELECT app_role, valid_from, valid_until
+        FROM app_user_role
+        WHERE app_user = NEW.app_user AND (valid_until IS NULL OR valid_until > now())
+        UNION
+        SELECT p.parent, a.valid_from, a.valid_until
+        FROM app_role_parent p JOIN assigned a ON p.app_role = a.id
+    )
+    SELECT ra.name AS role_a, rb.name AS role_b INTO conflict
+    FROM app_role_exclusion x
+      JOIN assigned a ON a.id = x.role_a
+      JOIN assigned b ON b.id = x.role_b
+      JOIN app_role ra ON ra.id = x.role_a
+      JOIN app_role rb ON rb.id = x.role_b
+    WHERE (a.valid_from IS NULL OR b.valid_until IS NULL OR a.valid_from < b.valid_until)
+      AND (b.valid_from IS NULL OR a.valid_until IS NULL OR b.valid_from < a.valid_until)
+    ORDER BY ra.name, rb.name
+    LIMIT 1;
+    IF FOUND THEN
+        RAISE EXCEPTION 'user % would hold the exclusive roles % and %', NEW.app_user, conflict.role_a, conflict.role_b
+            USING ERRCODE = 'check_violation',
+                CONSTRAINT = 'app_user_role_exclusion',
+                DETAIL = json_build_object(
+                    'user_id', NEW.app_user,
+                    'email', (SELECT email FROM app_user WHERE id = NEW.app_user),
+                    'roles', json_build_array(conflict.role_a, conflict.role_b))::TEXT;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER app_user_role_exclusion AFTER INSERT OR UPDATE ON app_user_role
+    FOR EACH ROW EXECUTE FUNCTION app_user_role_check_exclusion();
@@ -0,0 +1,20 @@
+-- DB: db
+
+CREATE TABLE app_change_request (
+    id BIGSERIAL,
+    resource VARCHAR(100) NOT NULL,
+    resource_id BIGINT NOT NULL,
+    change JSONB NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    requested_by INTEGER NOT NULL,
+    requested_at TIMESTAMP NOT NULL,
+    decided_by INTEGER,
+    decided_at TIMESTAMP,
+    comment TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    FOREIGN KEY (requested_by) REFERENCES app_user (id),
+    FOREIGN KEY (decided_by) REFERENCES app_user (id),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX app_change_request_status ON app_change_request (status, resource);
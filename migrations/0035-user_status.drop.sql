@@ -0,0 +1,5 @@
+-- DB: db
+
+ALTER TABLE app_user DROP COLUMN IF EXISTS status_changed_at;
+ALTER TABLE app_user DROP COLUMN IF EXISTS status_reason;
+ALTER TABLE app_user DROP COLUMN IF EXISTS status;
@@ -0,0 +1,7 @@
+-- DB: db
+
+-- users are disabled or locked instead of deleted, keeping the references
+-- of created_by and updated_by
+ALTER TABLE app_user ADD COLUMN status VARCHAR(20) NOT NULL DEFAULT 'active';
+ALTER TABLE app_user ADD COLUMN status_reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE app_user ADD COLUMN status_changed_at TIMESTAMP;
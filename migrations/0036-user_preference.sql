@@ -0,0 +1,9 @@
+-- DB: db
+
+CREATE TABLE app_user_preference (
+    app_user INTEGER NOT NULL,
+    preferences TEXT NOT NULL DEFAULT '{}',
+    updated_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (app_user) REFERENCES app_user (id) ON DELETE CASCADE,
+    PRIMARY KEY (app_user)
+);
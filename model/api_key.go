@@ -0,0 +1,201 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// APIKey is a long-lived credential of a service account. Only the SHA-256
+// hash of the secret part is persisted; the prefix identifies the key.
+// Privileges, in the format of role privileges, narrows what the key may do
+// to a subset of the privileges of its user; empty grants all of them.
+type APIKey struct {
+	ID         int64        `json:"id"`
+	UserID     int64        `json:"user_id"`
+	Name       string       `json:"name"`
+	Prefix     string       `json:"prefix"`
+	SecretHash string       `json:"-"`
+	Privileges string       `json:"privileges"`
+	ExpiresAt  sql.NullTime `json:"expires_at"`
+	LastUsedAt sql.NullTime `json:"last_used_at"`
+	CreatedAt  time.Time    `json:"created_at"`
+}
+
+type APIKeyStore interface {
+	Create(ctx context.Context, obj APIKey) (*APIKey, error)
+	GetByPrefix(ctx context.Context, prefix string) (*APIKey, error)
+	ListByUser(ctx context.Context, userID int64) ([]APIKey, error)
+	// Expire ends the validity of the key at at, unless it already ends earlier.
+	Expire(ctx context.Context, id int64, at time.Time) error
+	// Rotate creates obj and ends the validity of the key id at at in one
+	// transaction, so the old key stays untouched when the insert fails.
+	Rotate(ctx context.Context, id int64, at time.Time, obj APIKey) (*APIKey, error)
+	Touch(ctx context.Context, id int64, now time.Time) error
+}
+
+type APIKeyStoreImpl struct {
+	*StoreImpl
+}
+
+func (r *StoreImpl) APIKey() APIKeyStore {
+	return &APIKeyStoreImpl{StoreImpl: r}
+}
+
+const qrySelectAPIKey = `
+    SELECT id, app_user, name, prefix, secret_hash, privileges, expires_at, last_used_at, created_at
+    FROM app_api_key`
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	var obj APIKey
+	err := row.Scan(&obj.ID, &obj.UserID, &obj.Name, &obj.Prefix, &obj.SecretHash,
+		&obj.Privileges, &obj.ExpiresAt, &obj.LastUsedAt, &obj.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &obj, nil
+}
+
+const qryInsertAPIKey = `
+    INSERT INTO app_api_key (
+      app_user,
+      name,
+      prefix,
+      secret_hash,
+      privileges,
+      expires_at,
+      created_at
+    ) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+
+func (r *APIKeyStoreImpl) Create(ctx context.Context, obj APIKey) (*APIKey, error) {
+	qry := qryInsertAPIKey
+	slog.Debug("store.APIKey.Create",
+		slog.String("qry", qry),
+		slog.Int64("app_user", obj.UserID),
+		slog.String("name", obj.Name),
+		slog.String("prefix", obj.Prefix),
+		slog.Any("expires_at", obj.ExpiresAt),
+	)
+	err := r.db.QueryRowContext(ctx, qry,
+		obj.UserID,
+		obj.Name,
+		obj.Prefix,
+		obj.SecretHash,
+		obj.Privileges,
+		obj.ExpiresAt,
+		obj.CreatedAt,
+	).Scan(&obj.ID)
+	if err != nil {
+		return nil, insertPostgresError(r.db, "store.APIKey.Create", err,
+			slog.String("qry", qry),
+			slog.Int64("app_user", obj.UserID),
+			slog.String("prefix", obj.Prefix),
+		)
+	}
+	return &obj, nil
+}
+
+func (r *APIKeyStoreImpl) GetByPrefix(ctx context.Context, prefix string) (*APIKey, error) {
+	qry := qrySelectAPIKey + `
+    WHERE prefix = $1`
+	slog.Debug("store.APIKey.GetByPrefix", slog.String("qry", qry), slog.String("prefix", prefix))
+	obj, err := scanAPIKey(r.db.QueryRowContext(ctx, qry, prefix))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("NOT_FOUND")
+	} else if err != nil {
+		slog.Error("store.APIKey.GetByPrefix", slog.String("qry", qry), slog.Any("Error", err))
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (r *APIKeyStoreImpl) ListByUser(ctx context.Context, userID int64) ([]APIKey, error) {
+	qry := qrySelectAPIKey + `
+    WHERE app_user = $1
+    ORDER BY created_at DESC, id DESC`
+	slog.Debug("store.APIKey.ListByUser", slog.String("qry", qry), slog.Int64("app_user", userID))
+	rows, err := r.db.QueryContext(ctx, qry, userID)
+	if err != nil {
+		slog.Error("store.APIKey.ListByUser", slog.String("qry", qry), slog.Any("Error", err))
+		return nil, err
+	}
+	defer rows.Close()
+	res := []APIKey{}
+	for rows.Next() {
+		obj, err := scanAPIKey(rows)
+		if err != nil {
+			slog.Error("store.APIKey.ListByUser.Scan", slog.String("qry", qry), slog.Any("Error", err))
+			return nil, err
+		}
+		res = append(res, *obj)
+	}
+	return res, rows.Err()
+}
+
+func (r *APIKeyStoreImpl) Expire(ctx context.Context, id int64, at time.Time) error {
+	qry := `
+    UPDATE app_api_key SET expires_at = $2
+    WHERE id = $1 AND (expires_at IS NULL OR expires_at > $2)`
+	args := []any{id, at}
+	slog.Debug("store.APIKey.Expire", logQueryArgs(qry, args, nil)...)
+	if _, err := r.db.ExecContext(ctx, qry, args...); err != nil {
+		return updatePostgresError(r.db, "store.APIKey.Expire", err, "qry", qry)
+	}
+	return nil
+}
+
+func (r *APIKeyStoreImpl) Rotate(ctx context.Context, id int64, at time.Time, obj APIKey) (*APIKey, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	qry := qryInsertAPIKey
+	slog.Debug("store.APIKey.Rotate.Create",
+		slog.String("qry", qry),
+		slog.Int64("app_user", obj.UserID),
+		slog.String("name", obj.Name),
+		slog.String("prefix", obj.Prefix),
+		slog.Any("expires_at", obj.ExpiresAt),
+	)
+	err = tx.QueryRowContext(ctx, qry,
+		obj.UserID,
+		obj.Name,
+		obj.Prefix,
+		obj.SecretHash,
+		obj.Privileges,
+		obj.ExpiresAt,
+		obj.CreatedAt,
+	).Scan(&obj.ID)
+	if err != nil {
+		return nil, insertPostgresError(r.db, "store.APIKey.Rotate.Create", err,
+			slog.String("qry", qry),
+			slog.Int64("app_user", obj.UserID),
+			slog.String("prefix", obj.Prefix),
+		)
+	}
+	qry = `
+    UPDATE app_api_key SET expires_at = $2
+    WHERE id = $1 AND (expires_at IS NULL OR expires_at > $2)`
+	args := []any{id, at}
+	slog.Debug("store.APIKey.Rotate.Expire", logQueryArgs(qry, args, nil)...)
+	if _, err = tx.ExecContext(ctx, qry, args...); err != nil {
+		return nil, updatePostgresError(r.db, "store.APIKey.Rotate.Expire", err, "qry", qry)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &obj, nil
+}
+
+func (r *APIKeyStoreImpl) Touch(ctx context.Context, id int64, now time.Time) error {
+	qry := `UPDATE app_api_key SET last_used_at = $2 WHERE id = $1`
+	args := []any{id, now}
+	slog.Debug("store.APIKey.Touch", logQueryArgs(qry, args, nil)...)
+	if _, err := r.db.ExecContext(ctx, qry, args...); err != nil {
+		return updatePostgresError(r.db, "store.APIKey.Touch", err, "qry", qry)
+	}
+	return nil
+}
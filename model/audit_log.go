@@ -0,0 +1,96 @@
+package model
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// AuditLog records a security relevant change: who did what to which
+// resource. Detail holds a JSON object with the specifics of the action.
+type AuditLog struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	Actor      string    `json:"actor"`
+	Action     string    `json:"action"`
+	Resource   string    `json:"resource"`
+	ResourceID string    `json:"resource_id"`
+	Detail     string    `json:"detail"`
+}
+
+// AuditActorSystem is the actor of the changes made by background jobs.
+const AuditActorSystem = "system"
+
+type AuditLogStore interface {
+	Create(ctx context.Context, obj AuditLog) (*AuditLog, error)
+	// ListByResource returns the latest entries of a resource, newest first.
+	ListByResource(ctx context.Context, resource, resourceID string, limit int) ([]AuditLog, error)
+}
+
+type AuditLogStoreImpl struct {
+	*StoreImpl
+}
+
+func (r *StoreImpl) AuditLog() AuditLogStore {
+	return &AuditLogStoreImpl{StoreImpl: r}
+}
+
+func (r *AuditLogStoreImpl) Create(ctx context.Context, obj AuditLog) (*AuditLog, error) {
+	qry := `
+    INSERT INTO app_audit_log (
+      created_at,
+      actor,
+      action,
+      resource,
+      resource_id,
+      detail
+    ) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+	slog.Debug("store.AuditLog.Create",
+		slog.String("qry", qry),
+		slog.String("actor", obj.Actor),
+		slog.String("action", obj.Action),
+		slog.String("resource", obj.Resource),
+		slog.String("resource_id", obj.ResourceID),
+	)
+	err := r.db.QueryRowContext(ctx, qry,
+		obj.CreatedAt,
+		obj.Actor,
+		obj.Action,
+		obj.Resource,
+		obj.ResourceID,
+		obj.Detail,
+	).Scan(&obj.ID)
+	if err != nil {
+		return nil, insertPostgresError(r.db, "store.AuditLog.Create", err,
+			slog.String("qry", qry),
+			slog.String("action", obj.Action),
+		)
+	}
+	return &obj, nil
+}
+
+func (r *AuditLogStoreImpl) ListByResource(ctx context.Context, resource, resourceID string, limit int) ([]AuditLog, error) {
+	qry := `
+    SELECT id, created_at, actor, action, resource, resource_id, detail
+    FROM app_audit_log
+    WHERE resource = $1 AND resource_id = $2
+    ORDER BY id DESC
+    LIMIT $3`
+	slog.Debug("store.AuditLog.ListByResource", slog.String("qry", qry), slog.String("resource", resource), slog.String("resource_id", resourceID))
+	rows, err := r.db.QueryContext(ctx, qry, resource, resourceID, limit)
+	if err != nil {
+		slog.Error("store.AuditLog.ListByResource", slog.String("qry", qry), slog.Any("Error", err))
+		return nil, err
+	}
+	defer rows.Close()
+	list := []AuditLog{}
+	for rows.Next() {
+		var obj AuditLog
+		err := rows.Scan(&obj.ID, &obj.CreatedAt, &obj.Actor, &obj.Action, &obj.Resource, &obj.ResourceID, &obj.Detail)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, obj)
+	}
+	return list, rows.Err()
+}
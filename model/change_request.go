@@ -0,0 +1,200 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"example.com/app-api/util"
+	"github.com/lib/pq"
+)
+
+// Statuses of a change request.
+const (
+	ChangeStatusPending  = "pending"
+	ChangeStatusApproved = "approved"
+	ChangeStatusRejected = "rejected"
+	// ChangeStatusFailed is an approved change the update of the resource
+	// failed for, see ChangeRequest.Error.
+	ChangeStatusFailed = "failed"
+)
+
+// Audit log actions of change requests.
+const (
+	AuditActionChangeRequested = "change_requested"
+	AuditActionChangeApproved  = "change_approved"
+	AuditActionChangeRejected  = "change_rejected"
+)
+
+// ChangeRequest holds an update of a resource until a second person
+// approves or rejects it. Change is the body of the PATCH request, the
+// value and fields of the update.
+// swagger: model ChangeRequest
+type ChangeRequest struct {
+	ID          int64           `json:"id"`
+	Resource    string          `json:"resource"`
+	ResourceID  int64           `json:"resource_id"`
+	Change      json.RawMessage `json:"change" swaggertype:"object"`
+	Status      string          `json:"status"`
+	RequestedBy int64           `json:"requested_by"`
+	RequestedAt time.Time       `json:"requested_at"`
+	DecidedBy   *int64          `json:"decided_by,omitempty"`
+	DecidedAt   *time.Time      `json:"decided_at,omitempty"`
+	Comment     string          `json:"comment"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// swagger: model ChangeRequestFilter
+type ChangeRequestFilter struct {
+	// Resources limits the result to these resources; all when empty.
+	Resources  []string `json:"resources"`
+	ResourceID int64    `json:"resource_id"`
+	Status     string   `json:"status"`
+}
+
+type ChangeRequestStore interface {
+	Create(ctx context.Context, obj ChangeRequest) (*ChangeRequest, error)
+	Get(ctx context.Context, id int64) (*ChangeRequest, error)
+	// Find returns the matching requests, newest first.
+	Find(ctx context.Context, filter ChangeRequestFilter, limit int, offset int64) ([]ChangeRequest, error)
+	// Decide moves a pending request to status; it fails with NOT_PENDING
+	// when the request was decided already.
+	Decide(ctx context.Context, id int64, status string, decidedBy int64, comment string, at time.Time) error
+	// Fail marks an approved request whose update failed.
+	Fail(ctx context.Context, id int64, msg string) error
+}
+
+type ChangeRequestStoreImpl struct {
+	*StoreImpl
+}
+
+func (r *StoreImpl) ChangeRequest() ChangeRequestStore {
+	return &ChangeRequestStoreImpl{StoreImpl: r}
+}
+
+const qrySelectChangeRequest = `
+    SELECT id, resource, resource_id, change, status, requested_by, requested_at,
+      decided_by, decided_at, comment, error
+    FROM app_change_request`
+
+func scanChangeRequest(row interface{ Scan(...any) error }) (*ChangeRequest, error) {
+	var obj ChangeRequest
+	var change []byte
+	err := row.Scan(&obj.ID, &obj.Resource, &obj.ResourceID, &change, &obj.Status,
+		&obj.RequestedBy, &obj.RequestedAt, &obj.DecidedBy, &obj.DecidedAt, &obj.Comment, &obj.Error)
+	if err != nil {
+		return nil, err
+	}
+	obj.Change = change
+	obj.RequestedAt = util.AsZoneWallClock(obj.RequestedAt)
+	obj.DecidedAt = asZoneWallClockPtr(obj.DecidedAt)
+	return &obj, nil
+}
+
+func (r *ChangeRequestStoreImpl) Create(ctx context.Context, obj ChangeRequest) (*ChangeRequest, error) {
+	qry := `
+    INSERT INTO app_change_request (
+      resource,
+      resource_id,
+      change,
+      status,
+      requested_by,
+      requested_at
+    ) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+	slog.Debug("store.ChangeRequest.Create",
+		slog.String("qry", qry),
+		slog.String("resource", obj.Resource),
+		slog.Int64("resource_id", obj.ResourceID),
+		slog.Int64("requested_by", obj.RequestedBy),
+	)
+	err := r.db.QueryRowContext(ctx, qry,
+		obj.Resource,
+		obj.ResourceID,
+		[]byte(obj.Change),
+		obj.Status,
+		obj.RequestedBy,
+		obj.RequestedAt,
+	).Scan(&obj.ID)
+	if err != nil {
+		return nil, insertPostgresError(r.db, "store.ChangeRequest.Create", err,
+			slog.String("qry", qry),
+			slog.String("resource", obj.Resource),
+			slog.Int64("resource_id", obj.ResourceID),
+		)
+	}
+	return &obj, nil
+}
+
+func (r *ChangeRequestStoreImpl) Get(ctx context.Context, id int64) (*ChangeRequest, error) {
+	qry := qrySelectChangeRequest + `
+    WHERE id = $1`
+	slog.Debug("store.ChangeRequest.Get", slog.String("qry", qry), slog.Int64("id", id))
+	obj, err := scanChangeRequest(r.db.QueryRowContext(ctx, qry, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("NOT_FOUND")
+	} else if err != nil {
+		slog.Error("store.ChangeRequest.Get", slog.String("qry", qry), slog.Any("Error", err))
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (r *ChangeRequestStoreImpl) Find(ctx context.Context, filter ChangeRequestFilter, limit int, offset int64) ([]ChangeRequest, error) {
+	qry := qrySelectChangeRequest + `
+    WHERE (cardinality($1::TEXT[]) = 0 OR resource = ANY($1::TEXT[]))
+      AND ($2 = 0 OR resource_id = $2)
+      AND ($3 = '' OR status = $3)
+    ORDER BY id DESC
+    LIMIT $4 OFFSET $5`
+	args := []any{pq.Array(filter.Resources), filter.ResourceID, filter.Status, limit, offset}
+	slog.Debug("store.ChangeRequest.Find", logQueryArgs(qry, args, nil)...)
+	rows, err := r.db.QueryContext(ctx, qry, args...)
+	if err != nil {
+		slog.Error("store.ChangeRequest.Find", logQueryArgs(qry, args, err)...)
+		return nil, err
+	}
+	defer rows.Close()
+	res := []ChangeRequest{}
+	for rows.Next() {
+		obj, err := scanChangeRequest(rows)
+		if err != nil {
+			slog.Error("store.ChangeRequest.Find.Scan", logQueryArgs(qry, args, err)...)
+			return nil, err
+		}
+		res = append(res, *obj)
+	}
+	return res, rows.Err()
+}
+
+func (r *ChangeRequestStoreImpl) Decide(ctx context.Context, id int64, status string, decidedBy int64, comment string, at time.Time) error {
+	qry := `
+    UPDATE app_change_request SET status = $2, decided_by = $3, comment = $4, decided_at = $5
+    WHERE id = $1 AND status = 'pending'`
+	args := []any{id, status, decidedBy, comment, at}
+	slog.Debug("store.ChangeRequest.Decide", logQueryArgs(qry, args, nil)...)
+	res, err := r.db.ExecContext(ctx, qry, args...)
+	if err != nil {
+		return updatePostgresError(r.db, "store.ChangeRequest.Decide", err, "qry", qry)
+	}
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if ra == 0 {
+		return fmt.Errorf("NOT_PENDING")
+	}
+	return nil
+}
+
+func (r *ChangeRequestStoreImpl) Fail(ctx context.Context, id int64, msg string) error {
+	qry := `UPDATE app_change_request SET status = 'failed', error = $2 WHERE id = $1`
+	args := []any{id, msg}
+	slog.Debug("store.ChangeRequest.Fail", logQueryArgs(qry, args, nil)...)
+	if _, err := r.db.ExecContext(ctx, qry, args...); err != nil {
+		return updatePostgresError(r.db, "store.ChangeRequest.Fail", err, "qry", qry)
+	}
+	return nil
+}
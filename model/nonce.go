@@ -0,0 +1,59 @@
+package model
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// NonceStore records the nonces of signed requests shared by all instances.
+type NonceStore interface {
+	// Add records key until expiresAt and reports false when key is
+	// already recorded and not yet expired at now.
+	Add(ctx context.Context, key string, expiresAt, now time.Time) (bool, error)
+	DeleteExpired(ctx context.Context, now time.Time) (int64, error)
+}
+
+type NonceStoreImpl struct {
+	*StoreImpl
+}
+
+func (r *StoreImpl) Nonce() NonceStore {
+	return &NonceStoreImpl{StoreImpl: r}
+}
+
+func (r *NonceStoreImpl) Add(ctx context.Context, key string, expiresAt, now time.Time) (bool, error) {
+	// an expired row left over by the cleanup is taken over instead of reported as replay
+	qry := `
+    INSERT INTO app_nonce (nonce_key, expires_at)
+    VALUES ($1, $2)
+    ON CONFLICT (nonce_key) DO UPDATE SET expires_at = EXCLUDED.expires_at
+    WHERE app_nonce.expires_at <= $3`
+	slog.Debug("store.Nonce.Add",
+		slog.String("qry", qry),
+		slog.String("key", key),
+		slog.Time("expires_at", expiresAt),
+	)
+	res, err := r.db.ExecContext(ctx, qry, key, expiresAt, now)
+	if err != nil {
+		return false, insertPostgresError(r.db, "store.Nonce.Add", err,
+			slog.String("qry", qry),
+			slog.String("key", key),
+		)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (r *NonceStoreImpl) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	qry := `DELETE FROM app_nonce WHERE expires_at <= $1`
+	slog.Debug("store.Nonce.DeleteExpired", slog.String("qry", qry), slog.Time("now", now))
+	res, err := r.db.ExecContext(ctx, qry, now)
+	if err != nil {
+		return 0, deletePostgresError(r.db, "store.Nonce.DeleteExpired", err, slog.String("qry", qry))
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,100 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// OidcLogin is a pending OpenID Connect authorization request, keyed by its
+// state parameter. PublicKey is the client ECDH key of the session to set up
+// and Kid the server key it was paired with.
+type OidcLogin struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	PublicKey    string
+	Kid          string
+	ExpiresAt    time.Time
+	CreatedAt    time.Time
+}
+
+type OidcLoginStore interface {
+	Create(ctx context.Context, obj OidcLogin) error
+	Consume(ctx context.Context, state string, now time.Time) (*OidcLogin, error)
+}
+
+type OidcLoginStoreImpl struct {
+	*StoreImpl
+}
+
+func (r *StoreImpl) OidcLogin() OidcLoginStore {
+	return &OidcLoginStoreImpl{StoreImpl: r}
+}
+
+// Create stores obj and purges expired requests.
+func (r *OidcLoginStoreImpl) Create(ctx context.Context, obj OidcLogin) error {
+	qry := `DELETE FROM app_oidc_login WHERE expires_at < $1`
+	slog.Debug("store.OidcLogin.Create.Purge", slog.String("qry", qry), slog.Time("now", obj.CreatedAt))
+	if _, err := r.db.ExecContext(ctx, qry, obj.CreatedAt); err != nil {
+		return deletePostgresError(r.db, "store.OidcLogin.Create.Purge", err, slog.String("qry", qry))
+	}
+	qry = `
+    INSERT INTO app_oidc_login (
+      state,
+      nonce,
+      code_verifier,
+      public_key,
+      kid,
+      expires_at,
+      created_at
+    ) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	slog.Debug("store.OidcLogin.Create",
+		slog.String("qry", qry),
+		slog.Time("expires_at", obj.ExpiresAt),
+		slog.Time("created_at", obj.CreatedAt),
+	)
+	_, err := r.db.ExecContext(ctx, qry,
+		obj.State,
+		obj.Nonce,
+		obj.CodeVerifier,
+		obj.PublicKey,
+		obj.Kid,
+		obj.ExpiresAt,
+		obj.CreatedAt,
+	)
+	if err != nil {
+		return insertPostgresError(r.db, "store.OidcLogin.Create", err,
+			slog.String("qry", qry),
+		)
+	}
+	return nil
+}
+
+// Consume deletes the unexpired request with state and returns it.
+func (r *OidcLoginStoreImpl) Consume(ctx context.Context, state string, now time.Time) (*OidcLogin, error) {
+	qry := `
+    DELETE FROM app_oidc_login
+    WHERE state = $1 AND expires_at > $2
+    RETURNING state, nonce, code_verifier, public_key, kid, expires_at, created_at`
+	slog.Debug("store.OidcLogin.Consume", slog.String("qry", qry), slog.Time("now", now))
+	var obj OidcLogin
+	err := r.db.QueryRowContext(ctx, qry, state, now).Scan(
+		&obj.State,
+		&obj.Nonce,
+		&obj.CodeVerifier,
+		&obj.PublicKey,
+		&obj.Kid,
+		&obj.ExpiresAt,
+		&obj.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("NOT_FOUND")
+	} else if err != nil {
+		slog.Error("store.OidcLogin.Consume", slog.String("qry", qry), slog.Any("Error", err))
+		return nil, err
+	}
+	return &obj, nil
+}
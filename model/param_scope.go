@@ -0,0 +1,26 @@
+package model
+
+import (
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ParamInGroups returns the param store limited to the params of groups:
+// Get does not find the others and Find leaves them out of the list and of
+// the total. No groups is no params.
+func (r *StoreImpl) ParamInGroups(groups []string) ParamStore {
+	robj := r.Param().(*ParamStoreImpl)
+	list := "NULL"
+	if len(groups) > 0 {
+		quoted := make([]string, 0, len(groups))
+		for _, group := range groups {
+			quoted = append(quoted, pq.QuoteLiteral(group))
+		}
+		list = strings.Join(quoted, ", ")
+	}
+	robj.qryFromObj = func() string {
+		return `(SELECT * FROM param WHERE group_name IN (` + list + `)) obj`
+	}
+	return robj
+}
@@ -0,0 +1,134 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"example.com/app-api/util"
+	"example.com/app-api/util/jsql"
+)
+
+// PasswordReset is a single-use reset token issued by the forgot-password flow.
+// Only the SHA-256 hash of the token is persisted.
+type PasswordReset struct {
+	ID        int64
+	UserID    int64
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    sql.NullTime
+	CreatedAt time.Time
+}
+
+type PasswordResetStore interface {
+	Create(ctx context.Context, obj PasswordReset) (*PasswordReset, error)
+	Consume(ctx context.Context, tokenHash string, password string, now time.Time) (int64, error)
+	CountSince(ctx context.Context, userID int64, since time.Time) (int, error)
+}
+
+type PasswordResetStoreImpl struct {
+	*StoreImpl
+}
+
+func (r *StoreImpl) PasswordReset() PasswordResetStore {
+	return &PasswordResetStoreImpl{StoreImpl: r}
+}
+
+func (r *PasswordResetStoreImpl) Create(ctx context.Context, obj PasswordReset) (*PasswordReset, error) {
+	qry := `
+    INSERT INTO app_password_reset (
+      app_user,
+      token_hash,
+      expires_at,
+      created_at
+    ) VALUES ($1, $2, $3, $4) RETURNING id`
+	slog.Debug("store.PasswordReset.Create",
+		slog.String("qry", qry),
+		slog.Int64("app_user", obj.UserID),
+		slog.Time("expires_at", obj.ExpiresAt),
+		slog.Time("created_at", obj.CreatedAt),
+	)
+	err := r.db.QueryRowContext(ctx, qry,
+		obj.UserID,
+		obj.TokenHash,
+		obj.ExpiresAt,
+		obj.CreatedAt,
+	).Scan(&obj.ID)
+	if err != nil {
+		return nil, insertPostgresError(r.db, "store.PasswordReset.Create", err,
+			slog.String("qry", qry),
+			slog.Int64("app_user", obj.UserID),
+		)
+	}
+	return &obj, nil
+}
+
+// Consume marks the unexpired, unused token as used, sets the password of its
+// user and revokes the sessions of the user, and returns the user. Every other
+// pending token of that user is invalidated in the same transaction.
+func (r *PasswordResetStoreImpl) Consume(ctx context.Context, tokenHash string, password string, now time.Time) (int64, error) {
+	hashed, err := util.HashPassword(jsql.SecretValue(password))
+	if err != nil {
+		return 0, err
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	qry := `
+    UPDATE app_password_reset SET used_at = $1
+    WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1
+    RETURNING app_user`
+	args := []any{now, tokenHash}
+	slog.Debug("store.PasswordReset.Consume", logQueryArgs(qry, args, nil)...)
+	var userID int64
+	err = tx.QueryRowContext(ctx, qry, args...).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("NOT_FOUND")
+	} else if err != nil {
+		slog.Error("store.PasswordReset.Consume", logQueryArgs(qry, args, err)...)
+		return 0, err
+	}
+	qry = `
+    UPDATE app_password_reset SET used_at = $1
+    WHERE app_user = $2 AND used_at IS NULL`
+	args = []any{now, userID}
+	slog.Debug("store.PasswordReset.Consume.Invalidate", logQueryArgs(qry, args, nil)...)
+	if _, err = tx.ExecContext(ctx, qry, args...); err != nil {
+		slog.Error("store.PasswordReset.Consume.Invalidate", logQueryArgs(qry, args, err)...)
+		return 0, err
+	}
+	qry = `
+    UPDATE app_user SET password = $1, token = NULL, secret = NULL, version = version + 1
+    WHERE id = $2`
+	args = []any{hashed, userID}
+	slog.Debug("store.PasswordReset.Consume.Password", slog.String("qry", qry), slog.Int64("id", userID))
+	if _, err = tx.ExecContext(ctx, qry, args...); err != nil {
+		return 0, updatePostgresError(r.db, "store.PasswordReset.Consume.Password", err,
+			slog.String("qry", qry), slog.Int64("id", userID),
+		)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// CountSince returns the number of tokens issued to the user after since,
+// used or not.
+func (r *PasswordResetStoreImpl) CountSince(ctx context.Context, userID int64, since time.Time) (int, error) {
+	qry := `
+    SELECT count(*) FROM app_password_reset
+    WHERE app_user = $1 AND created_at > $2`
+	args := []any{userID, since}
+	slog.Debug("store.PasswordReset.CountSince", logQueryArgs(qry, args, nil)...)
+	var n int
+	if err := r.db.QueryRowContext(ctx, qry, args...).Scan(&n); err != nil {
+		slog.Error("store.PasswordReset.CountSince", logQueryArgs(qry, args, err)...)
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,76 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// PrivilegeDeny forbids an action even when another role grants it.
+const PrivilegeDeny = "deny"
+
+// Privileges is the parsed form of Role.Privileges: resource, action and
+// either a bool, PrivilegeDeny or a scope.
+type Privileges map[string]map[string]any
+
+// PrivilegeScope grants an action on the rows of a resource whose
+// attributes have one of the listed values only:
+//
+//	{"param": {"read": {"groups": ["GL", "FEE"]}}}
+//
+// Every attribute of the scope must match.
+type PrivilegeScope map[string][]string
+
+// ParsePrivilegeScope converts the scope value v of a privilege; ok is false
+// when v is not a scope.
+func ParsePrivilegeScope(v any) (PrivilegeScope, bool) {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	scope := PrivilegeScope{}
+	for attr, values := range m {
+		list, ok := values.([]any)
+		if !ok {
+			return nil, false
+		}
+		scope[attr] = []string{}
+		for _, value := range list {
+			str, ok := value.(string)
+			if !ok {
+				return nil, false
+			}
+			scope[attr] = append(scope[attr], str)
+		}
+	}
+	return scope, true
+}
+
+// ParsePrivileges parses and checks the structure of role privileges; an
+// empty string has no privileges.
+func ParsePrivileges(str string) (Privileges, error) {
+	res := Privileges{}
+	if str == "" {
+		return res, nil
+	}
+	if err := json.Unmarshal([]byte(str), &res); err != nil {
+		return nil, fmt.Errorf("invalid privileges: %w", err)
+	}
+	for resource, actions := range res {
+		for action, v := range actions {
+			switch v := v.(type) {
+			case bool:
+			case string:
+				if v != PrivilegeDeny {
+					return nil, fmt.Errorf("invalid privilege value %s:%s: %q", resource, action, v)
+				}
+			case map[string]any:
+				if _, ok := ParsePrivilegeScope(v); !ok {
+					return nil, fmt.Errorf("invalid privilege scope %s:%s: %v", resource, action, v)
+				}
+			default:
+				return nil, fmt.Errorf("invalid privilege value %s:%s: %v", resource, action, v)
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,213 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Mutually exclusive roles are kept in app_role_exclusion as ordered pairs,
+// the lower role ID first. A user must not hold both roles of a pair, directly
+// or through the parents of the roles, with overlapping validity windows.
+
+// RoleConflictError rejects a change that would let a user hold two
+// mutually exclusive roles.
+type RoleConflictError struct {
+	UserID int64
+	Email  string
+	Roles  []string
+}
+
+func (e *RoleConflictError) Error() string {
+	return "ROLE_CONFLICT"
+}
+
+// roleConflictConstraint is named by the error of the app_user_role trigger
+// that checks the exclusions of every assignment written; its detail holds
+// the conflict as JSON.
+const roleConflictConstraint = "app_user_role_exclusion"
+
+// AsRoleConflictError returns the conflict err reports: a *RoleConflictError
+// or the error of the app_user_role trigger, which the generated user store
+// returns as is. It returns nil for any other error.
+func AsRoleConflictError(err error) *RoleConflictError {
+	var conflict *RoleConflictError
+	if errors.As(err, &conflict) {
+		return conflict
+	}
+	var perr *pq.Error
+	if !errors.As(err, &perr) || perr.Constraint != roleConflictConstraint {
+		return nil
+	}
+	var detail struct {
+		UserID int64    `json:"user_id"`
+		Email  string   `json:"email"`
+		Roles  []string `json:"roles"`
+	}
+	if err := json.Unmarshal([]byte(perr.Detail), &detail); err != nil {
+		slog.Error("invalid role conflict detail", "detail", perr.Detail, "err", err)
+	}
+	return &RoleConflictError{UserID: detail.UserID, Email: detail.Email, Roles: detail.Roles}
+}
+
+func getRoleExcludes(ctx context.Context, db roleQueryer, id int64) ([]int64, error) {
+	qry := `
+    SELECT CASE WHEN role_a = $1 THEN role_b ELSE role_a END AS role
+    FROM app_role_exclusion
+    WHERE role_a = $1 OR role_b = $1
+    ORDER BY role`
+	slog.Debug("store.Role.Excludes", slog.String("qry", qry), slog.Int64("id", id))
+	rows, err := db.QueryContext(ctx, qry, id)
+	if err != nil {
+		slog.Error("store.Role.Excludes", slog.String("qry", qry), slog.Int64("id", id), slog.Any("Error", err))
+		return nil, err
+	}
+	defer rows.Close()
+	excludes := []int64{}
+	for rows.Next() {
+		var role int64
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		excludes = append(excludes, role)
+	}
+	return excludes, rows.Err()
+}
+
+// setRoleExcludes replaces the roles exclusive with the role; it fails with
+// ROLE_EXCLUDES_ITSELF or ROLE_NOT_FOUND for invalid roles.
+func setRoleExcludes(ctx context.Context, tx *sql.Tx, id int64, excludes []int64) error {
+	excludes = slices.Compact(slices.Sorted(slices.Values(excludes)))
+	if slices.Contains(excludes, id) {
+		return fmt.Errorf("ROLE_EXCLUDES_ITSELF")
+	}
+	if len(excludes) > 0 {
+		var found int
+		err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM app_role WHERE id = ANY($1::BIGINT[])`, pq.Array(excludes)).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if found != len(excludes) {
+			return fmt.Errorf("ROLE_NOT_FOUND")
+		}
+	}
+	qry := `DELETE FROM app_role_exclusion WHERE role_a = $1 OR role_b = $1`
+	slog.Debug("store.Role.Excludes.Delete", slog.String("qry", qry), slog.Int64("id", id))
+	if _, err := tx.ExecContext(ctx, qry, id); err != nil {
+		return err
+	}
+	for _, other := range excludes {
+		qry := `INSERT INTO app_role_exclusion (role_a, role_b) VALUES ($1, $2)`
+		args := []any{min(id, other), max(id, other)}
+		slog.Debug("store.Role.Excludes.Insert", logQueryArgs(qry, args, nil)...)
+		if _, err := tx.ExecContext(ctx, qry, args...); err != nil {
+			slog.Error("store.Role.Excludes.Insert", logQueryArgs(qry, args, err)...)
+			return err
+		}
+	}
+	return nil
+}
+
+// roleConflictQuery finds the first pair of exclusive roles in the assigned
+// CTE, a user's roles with their validity windows; the parents of a role
+// are assigned with the window of the role.
+const roleConflictQuery = `
+    assigned(app_user, id, valid_from, valid_until) AS (%s
+      UNION
+      SELECT a.app_user, p.parent, a.valid_from, a.valid_until
+      FROM app_role_parent p JOIN assigned a ON p.app_role = a.id
+    )
+    SELECT a.app_user, ra.name, rb.name
+    FROM app_role_exclusion x
+      JOIN assigned a ON a.id = x.role_a
+      JOIN assigned b ON b.id = x.role_b AND b.app_user = a.app_user
+      JOIN app_role ra ON ra.id = x.role_a
+      JOIN app_role rb ON rb.id = x.role_b
+    WHERE (a.valid_from IS NULL OR b.valid_until IS NULL OR a.valid_from < b.valid_until)
+      AND (b.valid_from IS NULL OR a.valid_until IS NULL OR b.valid_from < a.valid_until)
+    ORDER BY a.app_user, ra.name, rb.name
+    LIMIT 1`
+
+// findRoleConflict runs the roleConflictQuery with the assignments of base
+// and returns the conflict found, nil for none. The Email of the conflict
+// is not set.
+func findRoleConflict(ctx context.Context, db rowQueryer, msg, with, base string, args ...any) (*RoleConflictError, error) {
+	qry := "WITH RECURSIVE " + with + fmt.Sprintf(roleConflictQuery, base)
+	slog.Debug(msg, logQueryArgs(qry, args, nil)...)
+	conflict := &RoleConflictError{Roles: make([]string, 2)}
+	err := db.QueryRowContext(ctx, qry, args...).Scan(&conflict.UserID, &conflict.Roles[0], &conflict.Roles[1])
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		slog.Error(msg, logQueryArgs(qry, args, err)...)
+		return nil, err
+	}
+	return conflict, nil
+}
+
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// checkRoleConflicts returns a *RoleConflictError for the first user holding
+// the role, or a role including it, that holds two exclusive roles with
+// overlapping validity. Assignments ended before now are ignored.
+func checkRoleConflicts(ctx context.Context, tx *sql.Tx, roleID int64, now time.Time) error {
+	with := `
+    descendant(id) AS (
+      SELECT $1::BIGINT
+      UNION
+      SELECT p.app_role FROM app_role_parent p JOIN descendant d ON p.parent = d.id
+    ),`
+	base := `
+      SELECT app_user, app_role, valid_from, valid_until
+      FROM app_user_role
+      WHERE (valid_until IS NULL OR valid_until > $2) AND app_user IN (
+        SELECT app_user FROM app_user_role WHERE app_role IN (SELECT id FROM descendant)
+      )`
+	conflict, err := findRoleConflict(ctx, tx, "store.Role.Conflicts", with, base, roleID, now)
+	if err != nil || conflict == nil {
+		return err
+	}
+	return conflictWithEmail(ctx, tx, conflict)
+}
+
+func conflictWithEmail(ctx context.Context, db rowQueryer, conflict *RoleConflictError) error {
+	err := db.QueryRowContext(ctx, `SELECT email FROM app_user WHERE id = $1`, conflict.UserID).Scan(&conflict.Email)
+	if err != nil {
+		return err
+	}
+	slog.Warn("store.Role.Conflicts", "user", conflict.Email, "roles", conflict.Roles)
+	return conflict
+}
+
+// Conflicts checks the roles of user before the generated user store
+// assigns them: the assignments kept keep their validity window, the new
+// ones are unbounded. The app_user_role trigger checks them again in the
+// transaction writing them, see AsRoleConflictError.
+func (r *UserRoleStoreImpl) Conflicts(ctx context.Context, user User) error {
+	ids := make([]int64, 0, len(user.Roles))
+	for _, role := range user.Roles {
+		ids = append(ids, role.ID)
+	}
+	base := `
+      SELECT $1::BIGINT, r.id, a.valid_from, a.valid_until
+      FROM unnest($2::BIGINT[]) r(id)
+        LEFT JOIN app_user_role a ON a.app_user = $1 AND a.app_role = r.id
+      WHERE a.valid_until IS NULL OR a.valid_until > $3`
+	conflict, err := findRoleConflict(ctx, r.db, "store.UserRole.Conflicts", "", base, user.ID, pq.Array(ids), time.Now())
+	if err != nil || conflict == nil {
+		return err
+	}
+	conflict.Email = user.Email
+	slog.Warn("store.UserRole.Conflicts", "user", conflict.Email, "roles", conflict.Roles)
+	return conflict
+}
@@ -0,0 +1,114 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/lib/pq"
+)
+
+// A role includes the privileges of its parents and, transitively, of their
+// parents; the links are kept in app_role_parent. The store keeps the graph
+// acyclic and bumps the version of every role including a changed role, so
+// the version of a role changes whenever its effective privileges may change.
+// Migration 0034 does the same for the privileges changed by the generated
+// role store and for deleted roles.
+
+type roleQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func getRoleParents(ctx context.Context, db roleQueryer, id int64) ([]int64, error) {
+	qry := `SELECT parent FROM app_role_parent WHERE app_role = $1 ORDER BY parent`
+	slog.Debug("store.Role.Parents", slog.String("qry", qry), slog.Int64("id", id))
+	rows, err := db.QueryContext(ctx, qry, id)
+	if err != nil {
+		slog.Error("store.Role.Parents", slog.String("qry", qry), slog.Int64("id", id), slog.Any("Error", err))
+		return nil, err
+	}
+	defer rows.Close()
+	parents := []int64{}
+	for rows.Next() {
+		var parent int64
+		if err := rows.Scan(&parent); err != nil {
+			return nil, err
+		}
+		parents = append(parents, parent)
+	}
+	return parents, rows.Err()
+}
+
+// setRoleParents replaces the parents of the role; it fails with ROLE_CYCLE
+// when the role would include itself and with ROLE_PARENT_NOT_FOUND when a
+// parent does not exist.
+func setRoleParents(ctx context.Context, tx *sql.Tx, id int64, parents []int64) error {
+	parents = slices.Compact(slices.Sorted(slices.Values(parents)))
+	// serialize the writers, two concurrent updates could close a cycle
+	// neither of them sees
+	if _, err := tx.ExecContext(ctx, `LOCK TABLE app_role_parent IN SHARE ROW EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+	if len(parents) > 0 {
+		var found int
+		err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM app_role WHERE id = ANY($1::BIGINT[])`, pq.Array(parents)).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if found != len(parents) {
+			return fmt.Errorf("ROLE_PARENT_NOT_FOUND")
+		}
+		qry := `
+    WITH RECURSIVE ancestor(id) AS (
+      SELECT unnest($1::BIGINT[])
+      UNION
+      SELECT p.parent FROM app_role_parent p JOIN ancestor a ON p.app_role = a.id
+    )
+    SELECT EXISTS (SELECT 1 FROM ancestor WHERE id = $2)`
+		args := []any{pq.Array(parents), id}
+		slog.Debug("store.Role.Parents.Cycle", logQueryArgs(qry, args, nil)...)
+		var cycle bool
+		if err := tx.QueryRowContext(ctx, qry, args...).Scan(&cycle); err != nil {
+			slog.Error("store.Role.Parents.Cycle", logQueryArgs(qry, args, err)...)
+			return err
+		}
+		if cycle {
+			return fmt.Errorf("ROLE_CYCLE")
+		}
+	}
+	qry := `DELETE FROM app_role_parent WHERE app_role = $1`
+	slog.Debug("store.Role.Parents.Delete", slog.String("qry", qry), slog.Int64("id", id))
+	if _, err := tx.ExecContext(ctx, qry, id); err != nil {
+		return err
+	}
+	for _, parent := range parents {
+		qry := `INSERT INTO app_role_parent (app_role, parent) VALUES ($1, $2)`
+		args := []any{id, parent}
+		slog.Debug("store.Role.Parents.Insert", logQueryArgs(qry, args, nil)...)
+		if _, err := tx.ExecContext(ctx, qry, args...); err != nil {
+			slog.Error("store.Role.Parents.Insert", logQueryArgs(qry, args, err)...)
+			return err
+		}
+	}
+	return nil
+}
+
+// bumpRoleDescendants increments the version of the roles including id.
+func bumpRoleDescendants(ctx context.Context, tx *sql.Tx, id int64) error {
+	qry := `
+    WITH RECURSIVE descendant(id) AS (
+      SELECT app_role FROM app_role_parent WHERE parent = $1
+      UNION
+      SELECT p.app_role FROM app_role_parent p JOIN descendant d ON p.parent = d.id
+    )
+    UPDATE app_role SET version = version + 1
+    WHERE id IN (SELECT id FROM descendant)`
+	slog.Debug("store.Role.Descendants.Version", slog.String("qry", qry), slog.Int64("id", id))
+	_, err := tx.ExecContext(ctx, qry, id)
+	if err != nil {
+		slog.Error("store.Role.Descendants.Version", slog.String("qry", qry), slog.Int64("id", id), slog.Any("Error", err))
+	}
+	return err
+}
@@ -0,0 +1,228 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// RolePolicy is how a role is enforced, kept next to the generated Role: the
+// roles whose privileges it includes, the roles a user must not hold with it
+// and whether it needs a second factor.
+// swagger: model RolePolicy
+type RolePolicy struct {
+	RoleID int64 `json:"role_id"`
+	// Version changes with every change of the role or of a role it
+	// includes; Update only succeeds with the current version.
+	Version int64 `json:"version"`
+	// Parents are the IDs of the roles whose privileges the role includes.
+	Parents []int64 `json:"parents"`
+	// Excludes are the IDs of the roles a user must not hold together with
+	// the role, see RoleConflictError.
+	Excludes []int64 `json:"excludes"`
+	// MfaRequired makes the users of the role, or of a role including it,
+	// complete a second factor before they get a session.
+	MfaRequired bool `json:"mfa_required"`
+}
+
+type RolePolicyField string
+
+const (
+	RolePolicyField_Parents     RolePolicyField = "parents"
+	RolePolicyField_Excludes    RolePolicyField = "excludes"
+	RolePolicyField_MfaRequired RolePolicyField = "mfa_required"
+)
+
+// RoleNode is a role of the inheritance graph with the IDs of its parents.
+type RoleNode struct {
+	ID          int64
+	Name        string
+	Privileges  string
+	MfaRequired bool
+	Version     int64
+	Parents     []int64
+}
+
+type RolePolicyStore interface {
+	Get(ctx context.Context, roleID int64) (*RolePolicy, error)
+	// Update replaces the fields of the policy of obj.RoleID and bumps the
+	// version of the role and of the roles including it. It fails with
+	// NO_ROWS_AFFECTED when obj.Version is not the current version.
+	Update(ctx context.Context, obj RolePolicy, fields []RolePolicyField) error
+	// Versions returns the current version of the roles ids by role ID;
+	// deleted roles are missing.
+	Versions(ctx context.Context, ids []int64) (map[int64]int64, error)
+	// Closure returns the roles ids and all roles they include, directly or
+	// through their parents.
+	Closure(ctx context.Context, ids []int64) ([]RoleNode, error)
+}
+
+type RolePolicyStoreImpl struct {
+	*StoreImpl
+}
+
+func (r *StoreImpl) RolePolicy() RolePolicyStore {
+	return &RolePolicyStoreImpl{StoreImpl: r}
+}
+
+func (r *RolePolicyStoreImpl) Get(ctx context.Context, roleID int64) (*RolePolicy, error) {
+	qry := `SELECT id, version, mfa_required FROM app_role WHERE id = $1`
+	slog.Debug("store.RolePolicy.Get", slog.String("qry", qry), slog.Int64("id", roleID))
+	var obj RolePolicy
+	err := r.db.QueryRowContext(ctx, qry, roleID).Scan(&obj.RoleID, &obj.Version, &obj.MfaRequired)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("NOT_FOUND")
+	} else if err != nil {
+		slog.Error("store.RolePolicy.Get", slog.String("qry", qry), slog.Int64("id", roleID), slog.Any("Error", err))
+		return nil, err
+	}
+	obj.Parents, err = getRoleParents(ctx, r.db, roleID)
+	if err != nil {
+		return nil, err
+	}
+	obj.Excludes, err = getRoleExcludes(ctx, r.db, roleID)
+	if err != nil {
+		return nil, err
+	}
+	return &obj, nil
+}
+
+func (r *RolePolicyStoreImpl) Update(ctx context.Context, obj RolePolicy, fields []RolePolicyField) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	args := []any{}
+	qry := `UPDATE app_role SET version = version + 1`
+	var parents, excludes bool
+	for _, f := range fields {
+		switch f {
+		case RolePolicyField_Parents:
+			parents = true
+		case RolePolicyField_Excludes:
+			excludes = true
+		case RolePolicyField_MfaRequired:
+			args = append(args, obj.MfaRequired)
+			qry += fmt.Sprintf(", mfa_required = $%d", len(args))
+		default:
+			return fmt.Errorf("field %v is unknown", f)
+		}
+	}
+	args = append(args, obj.RoleID)
+	qry += fmt.Sprintf("\nWHERE id = $%d", len(args))
+	args = append(args, obj.Version)
+	qry += fmt.Sprintf(" AND version = $%d", len(args))
+	slog.Debug("store.RolePolicy.Update", logQueryArgs(qry, args, nil)...)
+	res, err := tx.ExecContext(ctx, qry, args...)
+	if err != nil {
+		nargs := append(append([]any{}, "qry", qry), args...)
+		return updatePostgresError(r.db, "store.RolePolicy.Update", err, nargs...)
+	}
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if ra == 0 {
+		return fmt.Errorf("NO_ROWS_AFFECTED")
+	}
+	if parents {
+		err = setRoleParents(ctx, tx, obj.RoleID, obj.Parents)
+		if err != nil {
+			return err
+		}
+	}
+	if excludes {
+		err = setRoleExcludes(ctx, tx, obj.RoleID, obj.Excludes)
+		if err != nil {
+			return err
+		}
+	}
+	if parents || excludes {
+		// the users of the role, or of the roles including it, may now
+		// hold exclusive roles
+		err = checkRoleConflicts(ctx, tx, obj.RoleID, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	err = bumpRoleDescendants(ctx, tx, obj.RoleID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *RolePolicyStoreImpl) Versions(ctx context.Context, ids []int64) (map[int64]int64, error) {
+	qry := `SELECT id, version FROM app_role WHERE id = ANY($1::BIGINT[])`
+	args := []any{pq.Array(ids)}
+	slog.Debug("store.RolePolicy.Versions", logQueryArgs(qry, args, nil)...)
+	rows, err := r.db.QueryContext(ctx, qry, args...)
+	if err != nil {
+		slog.Error("store.RolePolicy.Versions", logQueryArgs(qry, args, err)...)
+		return nil, err
+	}
+	defer rows.Close()
+	versions := make(map[int64]int64, len(ids))
+	for rows.Next() {
+		var id, version int64
+		if err := rows.Scan(&id, &version); err != nil {
+			return nil, err
+		}
+		versions[id] = version
+	}
+	return versions, rows.Err()
+}
+
+func (r *RolePolicyStoreImpl) Closure(ctx context.Context, ids []int64) ([]RoleNode, error) {
+	qry := `
+    WITH RECURSIVE closure(id) AS (
+      SELECT unnest($1::BIGINT[])
+      UNION
+      SELECT p.parent FROM app_role_parent p JOIN closure c ON p.app_role = c.id
+    )
+    SELECT
+      obj.id,
+      obj.name,
+      obj.privileges,
+      obj.mfa_required,
+      obj.version,
+      COALESCE(array_agg(p.parent ORDER BY p.parent) FILTER (WHERE p.parent IS NOT NULL), '{}')
+    FROM
+      app_role obj
+      JOIN closure c ON obj.id = c.id
+      LEFT JOIN app_role_parent p ON p.app_role = obj.id
+    GROUP BY obj.id
+    ORDER BY obj.id`
+	args := []any{pq.Array(ids)}
+	slog.Debug("store.RolePolicy.Closure", logQueryArgs(qry, args, nil)...)
+	rows, err := r.db.QueryContext(ctx, qry, args...)
+	if err != nil {
+		slog.Error("store.RolePolicy.Closure", logQueryArgs(qry, args, err)...)
+		return nil, err
+	}
+	defer rows.Close()
+	list := []RoleNode{}
+	for rows.Next() {
+		var obj RoleNode
+		var parents pq.Int64Array
+		err = rows.Scan(
+			&obj.ID,
+			&obj.Name,
+			&obj.Privileges,
+			&obj.MfaRequired,
+			&obj.Version,
+			&parents)
+		if err != nil {
+			slog.Error("store.RolePolicy.Closure.Scan", logQueryArgs(qry, args, err)...)
+			return nil, err
+		}
+		obj.Parents = parents
+		list = append(list, obj)
+	}
+	return list, rows.Err()
+}
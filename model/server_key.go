@@ -0,0 +1,90 @@
+package model
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"example.com/app-api/util/jsql"
+)
+
+// ServerKey is a persisted ECDH key pair of the login handshake, shared by
+// all instances. PrivateKey is encrypted by the handler before it reaches the
+// store.
+type ServerKey struct {
+	Kid        string
+	PrivateKey jsql.Secret
+	CreatedAt  time.Time
+	NotAfter   time.Time
+}
+
+type ServerKeyStore interface {
+	List(ctx context.Context, now time.Time) ([]ServerKey, error)
+	Create(ctx context.Context, obj ServerKey) error
+	DeleteExpired(ctx context.Context, now time.Time) error
+}
+
+type ServerKeyStoreImpl struct {
+	*StoreImpl
+}
+
+func (r *StoreImpl) ServerKey() ServerKeyStore {
+	return &ServerKeyStoreImpl{StoreImpl: r}
+}
+
+// List returns the keys valid at now, newest first.
+func (r *ServerKeyStoreImpl) List(ctx context.Context, now time.Time) ([]ServerKey, error) {
+	qry := `
+    SELECT kid, private_key, created_at, not_after
+    FROM app_server_key
+    WHERE not_after > $1
+    ORDER BY created_at DESC, kid`
+	slog.Debug("store.ServerKey.List", slog.String("qry", qry), slog.Time("now", now))
+	rows, err := r.db.QueryContext(ctx, qry, now)
+	if err != nil {
+		slog.Error("store.ServerKey.List", slog.String("qry", qry), slog.Any("Error", err))
+		return nil, err
+	}
+	defer rows.Close()
+	res := []ServerKey{}
+	for rows.Next() {
+		var obj ServerKey
+		if err = rows.Scan(&obj.Kid, &obj.PrivateKey, &obj.CreatedAt, &obj.NotAfter); err != nil {
+			slog.Error("store.ServerKey.List.Scan", slog.String("qry", qry), slog.Any("Error", err))
+			return nil, err
+		}
+		res = append(res, obj)
+	}
+	return res, rows.Err()
+}
+
+// Create stores obj; a key with the same kid is left unchanged.
+func (r *ServerKeyStoreImpl) Create(ctx context.Context, obj ServerKey) error {
+	qry := `
+    INSERT INTO app_server_key (kid, private_key, created_at, not_after)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (kid) DO NOTHING`
+	slog.Debug("store.ServerKey.Create",
+		slog.String("qry", qry),
+		slog.String("kid", obj.Kid),
+		slog.Time("created_at", obj.CreatedAt),
+		slog.Time("not_after", obj.NotAfter),
+	)
+	_, err := r.db.ExecContext(ctx, qry, obj.Kid, obj.PrivateKey, obj.CreatedAt, obj.NotAfter)
+	if err != nil {
+		return insertPostgresError(r.db, "store.ServerKey.Create", err,
+			slog.String("qry", qry),
+			slog.String("kid", obj.Kid),
+		)
+	}
+	return nil
+}
+
+func (r *ServerKeyStoreImpl) DeleteExpired(ctx context.Context, now time.Time) error {
+	qry := `DELETE FROM app_server_key WHERE not_after <= $1`
+	slog.Debug("store.ServerKey.DeleteExpired", slog.String("qry", qry), slog.Time("now", now))
+	if _, err := r.db.ExecContext(ctx, qry, now); err != nil {
+		return deletePostgresError(r.db, "store.ServerKey.DeleteExpired", err, slog.String("qry", qry))
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package model
+
+// AppStore is the generated Store with the stores kept next to the generated
+// ones; StoreImpl implements both. The generated handlers take the Store, the
+// hand-written code the AppStore.
+type AppStore interface {
+	Store
+	PasswordReset() PasswordResetStore
+	UserMfa() UserMfaStore
+	OidcLogin() OidcLoginStore
+	ServerKey() ServerKeyStore
+	Nonce() NonceStore
+	APIKey() APIKeyStore
+	AuditLog() AuditLogStore
+	ChangeRequest() ChangeRequestStore
+	UserPreference() UserPreferenceStore
+	RolePolicy() RolePolicyStore
+	UserRole() UserRoleStore
+	UserStatus() UserStatusStore
+	UserSource() UserSourceStore
+	// ParamInGroups returns the param store limited to the params of groups.
+	ParamInGroups(groups []string) ParamStore
+}
+
+var _ AppStore = (*StoreImpl)(nil)
+
+// GetAppStore is GetStore with the stores of AppStore.
+func GetAppStore() AppStore {
+	return GetStore().(*StoreImpl)
+}
@@ -0,0 +1,244 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"example.com/app-api/util/jsql"
+)
+
+// UserMfa holds the TOTP enrollment of a user. Secret is encrypted by the
+// handler before it reaches the store.
+type UserMfa struct {
+	UserID         int64
+	Secret         jsql.Secret
+	Enabled        bool
+	LastStep       int64
+	UpdatedAt      time.Time
+	FailedAttempts int
+	FailedAt       sql.NullTime
+}
+
+type UserMfaStore interface {
+	Get(ctx context.Context, userID int64) (*UserMfa, error)
+	Save(ctx context.Context, obj UserMfa) error
+	Enroll(ctx context.Context, obj UserMfa) error
+	Delete(ctx context.Context, userID int64) error
+	UseStep(ctx context.Context, userID int64, step int64) error
+	SetRecoveryCodes(ctx context.Context, userID int64, hashes []string) error
+	UseRecoveryCode(ctx context.Context, userID int64, hash string, now time.Time) error
+	Fail(ctx context.Context, userID int64, now time.Time, window time.Duration) (int, error)
+	ResetAttempts(ctx context.Context, userID int64) error
+}
+
+type UserMfaStoreImpl struct {
+	*StoreImpl
+}
+
+func (r *StoreImpl) UserMfa() UserMfaStore {
+	return &UserMfaStoreImpl{StoreImpl: r}
+}
+
+func (r *UserMfaStoreImpl) Get(ctx context.Context, userID int64) (*UserMfa, error) {
+	qry := `
+    SELECT app_user, secret, enabled, last_step, updated_at, failed_attempts, failed_at
+    FROM app_user_mfa
+    WHERE app_user = $1`
+	slog.Debug("store.UserMfa.Get", slog.String("qry", qry), slog.Int64("app_user", userID))
+	var obj UserMfa
+	err := r.db.QueryRowContext(ctx, qry, userID).Scan(
+		&obj.UserID,
+		&obj.Secret,
+		&obj.Enabled,
+		&obj.LastStep,
+		&obj.UpdatedAt,
+		&obj.FailedAttempts,
+		&obj.FailedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("NOT_FOUND")
+	} else if err != nil {
+		slog.Error("store.UserMfa.Get", slog.String("qry", qry), slog.Int64("app_user", userID), slog.Any("Error", err))
+		return nil, err
+	}
+	return &obj, nil
+}
+
+func (r *UserMfaStoreImpl) Save(ctx context.Context, obj UserMfa) error {
+	qry := `
+    INSERT INTO app_user_mfa (app_user, secret, enabled, last_step, updated_at)
+    VALUES ($1, $2, $3, $4, $5)
+    ON CONFLICT (app_user) DO UPDATE SET
+      secret = EXCLUDED.secret,
+      enabled = EXCLUDED.enabled,
+      last_step = EXCLUDED.last_step,
+      updated_at = EXCLUDED.updated_at`
+	slog.Debug("store.UserMfa.Save",
+		slog.String("qry", qry),
+		slog.Int64("app_user", obj.UserID),
+		slog.Bool("enabled", obj.Enabled),
+		slog.Int64("last_step", obj.LastStep),
+	)
+	_, err := r.db.ExecContext(ctx, qry, obj.UserID, obj.Secret, obj.Enabled, obj.LastStep, obj.UpdatedAt)
+	if err != nil {
+		return updatePostgresError(r.db, "store.UserMfa.Save", err,
+			slog.String("qry", qry),
+			slog.Int64("app_user", obj.UserID),
+		)
+	}
+	return nil
+}
+
+// Enroll stores the pending secret of obj, replacing a pending one. It fails
+// with ALREADY_ENABLED when the user has confirmed a secret, also one
+// confirmed since it was read.
+func (r *UserMfaStoreImpl) Enroll(ctx context.Context, obj UserMfa) error {
+	qry := `
+    INSERT INTO app_user_mfa (app_user, secret, enabled, last_step, updated_at)
+    VALUES ($1, $2, FALSE, 0, $3)
+    ON CONFLICT (app_user) DO UPDATE SET
+      secret = EXCLUDED.secret,
+      last_step = 0,
+      updated_at = EXCLUDED.updated_at
+    WHERE app_user_mfa.enabled = FALSE`
+	slog.Debug("store.UserMfa.Enroll", slog.String("qry", qry), slog.Int64("app_user", obj.UserID))
+	res, err := r.db.ExecContext(ctx, qry, obj.UserID, obj.Secret, obj.UpdatedAt)
+	if err != nil {
+		return updatePostgresError(r.db, "store.UserMfa.Enroll", err,
+			slog.String("qry", qry),
+			slog.Int64("app_user", obj.UserID),
+		)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("ALREADY_ENABLED")
+	}
+	return nil
+}
+
+func (r *UserMfaStoreImpl) Delete(ctx context.Context, userID int64) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, qry := range []string{
+		`DELETE FROM app_user_recovery_code WHERE app_user = $1`,
+		`DELETE FROM app_user_mfa WHERE app_user = $1`,
+	} {
+		slog.Debug("store.UserMfa.Delete", "qry", qry, "app_user", userID)
+		if _, err = tx.ExecContext(ctx, qry, userID); err != nil {
+			return deletePostgresError(r.db, "store.UserMfa.Delete", err,
+				slog.String("qry", qry), "app_user", userID,
+			)
+		}
+	}
+	return tx.Commit()
+}
+
+// UseStep records step as the last accepted TOTP step; an older or equal step
+// is a replay and fails with NO_ROWS_AFFECTED.
+func (r *UserMfaStoreImpl) UseStep(ctx context.Context, userID int64, step int64) error {
+	qry := `
+    UPDATE app_user_mfa SET last_step = $1
+    WHERE app_user = $2 AND last_step < $1`
+	args := []any{step, userID}
+	slog.Debug("store.UserMfa.UseStep", logQueryArgs(qry, args, nil)...)
+	res, err := r.db.ExecContext(ctx, qry, args...)
+	if err != nil {
+		return updatePostgresError(r.db, "store.UserMfa.UseStep", err, logQueryArgs(qry, args, nil)...)
+	}
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if ra == 0 {
+		return fmt.Errorf("NO_ROWS_AFFECTED")
+	}
+	return nil
+}
+
+// SetRecoveryCodes replaces all recovery codes of the user with hashes.
+func (r *UserMfaStoreImpl) SetRecoveryCodes(ctx context.Context, userID int64, hashes []string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	qry := `DELETE FROM app_user_recovery_code WHERE app_user = $1`
+	slog.Debug("store.UserMfa.SetRecoveryCodes.Delete", "qry", qry, "app_user", userID)
+	if _, err = tx.ExecContext(ctx, qry, userID); err != nil {
+		return updatePostgresDeleteError(r.db, "store.UserMfa.SetRecoveryCodes.Delete", err,
+			slog.String("qry", qry), "app_user", userID,
+		)
+	}
+	qry = `INSERT INTO app_user_recovery_code (app_user, code_hash) VALUES ($1, $2)`
+	for _, h := range hashes {
+		slog.Debug("store.UserMfa.SetRecoveryCodes.Insert", "qry", qry, "app_user", userID)
+		if _, err = tx.ExecContext(ctx, qry, userID, h); err != nil {
+			return updatePostgresInsertError(r.db, "store.UserMfa.SetRecoveryCodes.Insert", err,
+				slog.String("qry", qry), "app_user", userID,
+			)
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *UserMfaStoreImpl) UseRecoveryCode(ctx context.Context, userID int64, hash string, now time.Time) error {
+	qry := `
+    UPDATE app_user_recovery_code SET used_at = $1
+    WHERE app_user = $2 AND code_hash = $3 AND used_at IS NULL`
+	args := []any{now, userID, hash}
+	slog.Debug("store.UserMfa.UseRecoveryCode", slog.String("qry", qry), slog.Int64("app_user", userID))
+	res, err := r.db.ExecContext(ctx, qry, args...)
+	if err != nil {
+		return updatePostgresError(r.db, "store.UserMfa.UseRecoveryCode", err,
+			slog.String("qry", qry), slog.Int64("app_user", userID),
+		)
+	}
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if ra == 0 {
+		return fmt.Errorf("NOT_FOUND")
+	}
+	return nil
+}
+
+// Fail counts a failed second factor attempt and returns the number of
+// failures within window; older failures are forgotten.
+func (r *UserMfaStoreImpl) Fail(ctx context.Context, userID int64, now time.Time, window time.Duration) (int, error) {
+	qry := `
+    UPDATE app_user_mfa SET
+      failed_attempts = CASE WHEN failed_at IS NULL OR failed_at < $2 THEN 1 ELSE failed_attempts + 1 END,
+      failed_at = $1
+    WHERE app_user = $3
+    RETURNING failed_attempts`
+	args := []any{now, now.Add(-window), userID}
+	slog.Debug("store.UserMfa.Fail", logQueryArgs(qry, args, nil)...)
+	var count int
+	err := r.db.QueryRowContext(ctx, qry, args...).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("NOT_FOUND")
+	} else if err != nil {
+		return 0, updatePostgresError(r.db, "store.UserMfa.Fail", err, logQueryArgs(qry, args, nil)...)
+	}
+	return count, nil
+}
+
+func (r *UserMfaStoreImpl) ResetAttempts(ctx context.Context, userID int64) error {
+	qry := `
+    UPDATE app_user_mfa SET failed_attempts = 0, failed_at = NULL
+    WHERE app_user = $1`
+	args := []any{userID}
+	slog.Debug("store.UserMfa.ResetAttempts", logQueryArgs(qry, args, nil)...)
+	if _, err := r.db.ExecContext(ctx, qry, args...); err != nil {
+		return updatePostgresError(r.db, "store.UserMfa.ResetAttempts", err, logQueryArgs(qry, args, nil)...)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// UserPreference holds the preferences a user keeps for itself, a JSON object
+// the server stores but does not interpret.
+type UserPreference struct {
+	UserID      int64
+	Preferences string
+	UpdatedAt   time.Time
+}
+
+type UserPreferenceStore interface {
+	Get(ctx context.Context, userID int64) (*UserPreference, error)
+	Save(ctx context.Context, obj UserPreference) error
+}
+
+type UserPreferenceStoreImpl struct {
+	*StoreImpl
+}
+
+func (r *StoreImpl) UserPreference() UserPreferenceStore {
+	return &UserPreferenceStoreImpl{StoreImpl: r}
+}
+
+func (r *UserPreferenceStoreImpl) Get(ctx context.Context, userID int64) (*UserPreference, error) {
+	qry := `
+    SELECT app_user, preferences, updated_at
+    FROM app_user_preference
+    WHERE app_user = $1`
+	slog.Debug("store.UserPreference.Get", slog.String("qry", qry), slog.Int64("app_user", userID))
+	var obj UserPreference
+	err := r.db.QueryRowContext(ctx, qry, userID).Scan(
+		&obj.UserID,
+		&obj.Preferences,
+		&obj.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("NOT_FOUND")
+	} else if err != nil {
+		slog.Error("store.UserPreference.Get", slog.String("qry", qry), slog.Int64("app_user", userID), slog.Any("Error", err))
+		return nil, err
+	}
+	return &obj, nil
+}
+
+func (r *UserPreferenceStoreImpl) Save(ctx context.Context, obj UserPreference) error {
+	qry := `
+    INSERT INTO app_user_preference (app_user, preferences, updated_at)
+    VALUES ($1, $2, $3)
+    ON CONFLICT (app_user) DO UPDATE SET
+      preferences = EXCLUDED.preferences,
+      updated_at = EXCLUDED.updated_at`
+	slog.Debug("store.UserPreference.Save",
+		slog.String("qry", qry),
+		slog.Int64("app_user", obj.UserID),
+		slog.Int("preferences_len", len(obj.Preferences)),
+	)
+	_, err := r.db.ExecContext(ctx, qry, obj.UserID, obj.Preferences, obj.UpdatedAt)
+	if err != nil {
+		return updatePostgresError(r.db, "store.UserPreference.Save", err,
+			slog.String("qry", qry),
+			slog.Int64("app_user", obj.UserID),
+		)
+	}
+	return nil
+}
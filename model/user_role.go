@@ -0,0 +1,159 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"example.com/app-api/util"
+)
+
+// The generated user store assigns roles without bounds; UserRole reads and
+// sets the validity window kept next to the assignment in app_user_role.
+
+// AuditActionRoleExpired is logged for a role assignment past its valid_until.
+const AuditActionRoleExpired = "role_expired"
+
+// UserRole is the assignment of a role to a user.
+// swagger: model UserRole
+type UserRole struct {
+	UserID   int64  `json:"user_id"`
+	RoleID   int64  `json:"role_id"`
+	RoleName string `json:"role_name"`
+	// ValidFrom and ValidUntil bound the assignment, nil is unbounded.
+	ValidFrom  *time.Time `json:"valid_from,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+}
+
+// InEffect reports whether now is within the validity window.
+func (m *UserRole) InEffect(now time.Time) bool {
+	if m.ValidFrom != nil && now.Before(*m.ValidFrom) {
+		return false
+	}
+	return m.ValidUntil == nil || now.Before(*m.ValidUntil)
+}
+
+type UserRoleStore interface {
+	// Find returns the role assignments of the user, in effect or not.
+	Find(ctx context.Context, userID int64) ([]UserRole, error)
+	// Assign assigns the role, or replaces the validity window of an
+	// existing assignment.
+	Assign(ctx context.Context, obj UserRole) error
+	// Conflicts returns a *RoleConflictError when user would hold two
+	// exclusive roles with user.Roles assigned.
+	Conflicts(ctx context.Context, user User) error
+	// Remove fails with NOT_FOUND when the role is not assigned.
+	Remove(ctx context.Context, userID, roleID int64) error
+	// RecordExpiredRoles writes an audit log entry for every role assignment
+	// that ended before now and was not recorded yet.
+	RecordExpiredRoles(ctx context.Context, now time.Time) (int64, error)
+}
+
+type UserRoleStoreImpl struct {
+	*StoreImpl
+}
+
+func (r *StoreImpl) UserRole() UserRoleStore {
+	return &UserRoleStoreImpl{StoreImpl: r}
+}
+
+func asZoneWallClockPtr(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	wt := util.AsZoneWallClock(*t)
+	return &wt
+}
+
+func (r *UserRoleStoreImpl) Find(ctx context.Context, userID int64) ([]UserRole, error) {
+	qry := `
+    SELECT objRef.app_user, obj.id, obj.name, objRef.valid_from, objRef.valid_until
+    FROM app_role obj JOIN app_user_role objRef ON obj.id = objRef.app_role
+    WHERE objRef.app_user = $1
+    ORDER BY obj.id`
+	slog.Debug("store.UserRole.Find", slog.String("qry", qry), slog.Int64("user", userID))
+	rows, err := r.db.QueryContext(ctx, qry, userID)
+	if err != nil {
+		slog.Error("store.UserRole.Find", slog.String("qry", qry), slog.Int64("user", userID), slog.Any("Error", err))
+		return nil, err
+	}
+	defer rows.Close()
+	list := []UserRole{}
+	for rows.Next() {
+		var obj UserRole
+		err = rows.Scan(&obj.UserID, &obj.RoleID, &obj.RoleName, &obj.ValidFrom, &obj.ValidUntil)
+		if err != nil {
+			return nil, err
+		}
+		obj.ValidFrom = asZoneWallClockPtr(obj.ValidFrom)
+		obj.ValidUntil = asZoneWallClockPtr(obj.ValidUntil)
+		list = append(list, obj)
+	}
+	return list, rows.Err()
+}
+
+func (r *UserRoleStoreImpl) Assign(ctx context.Context, obj UserRole) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	qry := `
+    INSERT INTO app_user_role (app_user, app_role, valid_from, valid_until)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (app_user, app_role) DO UPDATE SET
+      valid_from = EXCLUDED.valid_from,
+      valid_until = EXCLUDED.valid_until,
+      expiry_recorded = FALSE`
+	args := []any{obj.UserID, obj.RoleID, obj.ValidFrom, obj.ValidUntil}
+	slog.Debug("store.UserRole.Assign", logQueryArgs(qry, args, nil)...)
+	if _, err := tx.ExecContext(ctx, qry, args...); err != nil {
+		if conflict := AsRoleConflictError(err); conflict != nil {
+			return conflict
+		}
+		nargs := append(append([]any{}, "qry", qry), args...)
+		return insertPostgresError(r.db, "store.UserRole.Assign", err, nargs...)
+	}
+	return tx.Commit()
+}
+
+func (r *UserRoleStoreImpl) Remove(ctx context.Context, userID, roleID int64) error {
+	qry := `DELETE FROM app_user_role WHERE app_user = $1 AND app_role = $2`
+	args := []any{userID, roleID}
+	slog.Debug("store.UserRole.Remove", logQueryArgs(qry, args, nil)...)
+	res, err := r.db.ExecContext(ctx, qry, args...)
+	if err != nil {
+		nargs := append(append([]any{}, "qry", qry), args...)
+		return updatePostgresError(r.db, "store.UserRole.Remove", err, nargs...)
+	}
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if ra == 0 {
+		return fmt.Errorf("NOT_FOUND")
+	}
+	return nil
+}
+
+func (r *UserRoleStoreImpl) RecordExpiredRoles(ctx context.Context, now time.Time) (int64, error) {
+	// marking and logging in one statement records every expiration once,
+	// even with several instances sweeping
+	qry := `
+    WITH expired AS (
+      UPDATE app_user_role SET expiry_recorded = TRUE
+      WHERE valid_until <= $1 AND NOT expiry_recorded
+      RETURNING app_user, app_role, valid_until
+    )
+    INSERT INTO app_audit_log (created_at, actor, action, resource, resource_id, detail)
+    SELECT $1, $2, $3, 'app_user', e.app_user::TEXT,
+      json_build_object('role_id', e.app_role, 'role', r.name, 'valid_until', e.valid_until)::TEXT
+    FROM expired e JOIN app_role r ON r.id = e.app_role`
+	slog.Debug("store.UserRole.RecordExpiredRoles", slog.String("qry", qry), slog.Time("now", now))
+	res, err := r.db.ExecContext(ctx, qry, now, AuditActorSystem, AuditActionRoleExpired)
+	if err != nil {
+		return 0, updatePostgresError(r.db, "store.UserRole.RecordExpiredRoles", err, slog.String("qry", qry))
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,65 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// Sources of externally authenticated users. An authenticator only binds the
+// users of its own source, so that a directory cannot take over the users
+// of another one by their email.
+const (
+	UserSourceLDAP = "ldap"
+	UserSourceOIDC = "oidc"
+)
+
+type UserSourceStore interface {
+	// Get returns the source of the user, empty for a local user. It fails
+	// with NOT_FOUND when the user does not exist.
+	Get(ctx context.Context, userID int64) (string, error)
+	// Set provisions or links the user to source, empty for a local user.
+	Set(ctx context.Context, userID int64, source string) error
+}
+
+type UserSourceStoreImpl struct {
+	*StoreImpl
+}
+
+func (r *StoreImpl) UserSource() UserSourceStore {
+	return &UserSourceStoreImpl{StoreImpl: r}
+}
+
+func (r *UserSourceStoreImpl) Get(ctx context.Context, userID int64) (string, error) {
+	qry := `SELECT COALESCE(source, '') FROM app_user WHERE id = $1`
+	slog.Debug("store.UserSource.Get", slog.String("qry", qry), slog.Int64("id", userID))
+	var source string
+	err := r.db.QueryRowContext(ctx, qry, userID).Scan(&source)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("NOT_FOUND")
+	} else if err != nil {
+		slog.Error("store.UserSource.Get", slog.String("qry", qry), slog.Int64("id", userID), slog.Any("Error", err))
+		return "", err
+	}
+	return source, nil
+}
+
+func (r *UserSourceStoreImpl) Set(ctx context.Context, userID int64, source string) error {
+	qry := `UPDATE app_user SET source = NULLIF($2, ''), version = version + 1 WHERE id = $1`
+	args := []any{userID, source}
+	slog.Debug("store.UserSource.Set", logQueryArgs(qry, args, nil)...)
+	res, err := r.db.ExecContext(ctx, qry, args...)
+	if err != nil {
+		nargs := append(append([]any{}, "qry", qry), args...)
+		return updatePostgresError(r.db, "store.UserSource.Set", err, nargs...)
+	}
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if ra == 0 {
+		return fmt.Errorf("NOT_FOUND")
+	}
+	return nil
+}
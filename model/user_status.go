@@ -0,0 +1,135 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Statuses of a user. Only an active user can log in; the others keep the
+// user and its references but refuse every login and session.
+const (
+	UserStatusActive   = "active"
+	UserStatusDisabled = "disabled"
+	UserStatusLocked   = "locked"
+)
+
+// AuditActionUserStatusChanged is logged for every change of a user status.
+const AuditActionUserStatusChanged = "user_status_changed"
+
+// UserStatus is the status of a user, kept next to the generated User in
+// the status columns of app_user.
+// swagger: model UserStatus
+type UserStatus struct {
+	UserID int64  `json:"user_id"`
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+	// ChangedAt is nil until the status is changed.
+	ChangedAt *time.Time `json:"changed_at,omitempty"`
+}
+
+// Active reports whether the user may log in.
+func (m *UserStatus) Active() bool {
+	return m.Status == UserStatusActive
+}
+
+type UserStatusStore interface {
+	// Get fails with NOT_FOUND when the user does not exist.
+	Get(ctx context.Context, userID int64) (*UserStatus, error)
+	// Find returns the statuses of the users ids; deleted users are
+	// missing.
+	Find(ctx context.Context, ids []int64) ([]UserStatus, error)
+	// Set changes the status of the user and logs the change for actor. Any
+	// status but active revokes the sessions of the user.
+	Set(ctx context.Context, userID int64, status, reason, actor string, at time.Time) error
+}
+
+type UserStatusStoreImpl struct {
+	*StoreImpl
+}
+
+func (r *StoreImpl) UserStatus() UserStatusStore {
+	return &UserStatusStoreImpl{StoreImpl: r}
+}
+
+func (r *UserStatusStoreImpl) Get(ctx context.Context, userID int64) (*UserStatus, error) {
+	qry := `SELECT id, status, status_reason, status_changed_at FROM app_user WHERE id = $1`
+	slog.Debug("store.UserStatus.Get", slog.String("qry", qry), slog.Int64("id", userID))
+	var obj UserStatus
+	err := r.db.QueryRowContext(ctx, qry, userID).Scan(&obj.UserID, &obj.Status, &obj.Reason, &obj.ChangedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("NOT_FOUND")
+	} else if err != nil {
+		slog.Error("store.UserStatus.Get", slog.String("qry", qry), slog.Int64("id", userID), slog.Any("Error", err))
+		return nil, err
+	}
+	obj.ChangedAt = asZoneWallClockPtr(obj.ChangedAt)
+	return &obj, nil
+}
+
+func (r *UserStatusStoreImpl) Find(ctx context.Context, ids []int64) ([]UserStatus, error) {
+	qry := `
+    SELECT id, status, status_reason, status_changed_at
+    FROM app_user WHERE id = ANY($1::BIGINT[])
+    ORDER BY id`
+	args := []any{pq.Array(ids)}
+	slog.Debug("store.UserStatus.Find", logQueryArgs(qry, args, nil)...)
+	rows, err := r.db.QueryContext(ctx, qry, args...)
+	if err != nil {
+		slog.Error("store.UserStatus.Find", logQueryArgs(qry, args, err)...)
+		return nil, err
+	}
+	defer rows.Close()
+	list := make([]UserStatus, 0, len(ids))
+	for rows.Next() {
+		var obj UserStatus
+		if err := rows.Scan(&obj.UserID, &obj.Status, &obj.Reason, &obj.ChangedAt); err != nil {
+			return nil, err
+		}
+		obj.ChangedAt = asZoneWallClockPtr(obj.ChangedAt)
+		list = append(list, obj)
+	}
+	return list, rows.Err()
+}
+
+func (r *UserStatusStoreImpl) Set(ctx context.Context, userID int64, status, reason, actor string, at time.Time) error {
+	// leaving the active status revokes the refresh token and the login
+	// secret, and so every session and signed request of the user
+	qry := `
+    WITH prev AS (
+      SELECT id, status FROM app_user WHERE id = $1 FOR UPDATE
+    ), changed AS (
+      UPDATE app_user obj SET
+        status = $2::TEXT,
+        status_reason = $3::TEXT,
+        status_changed_at = $4,
+        token = CASE WHEN $2::TEXT = 'active' THEN obj.token END,
+        secret = CASE WHEN $2::TEXT = 'active' THEN obj.secret END,
+        version = obj.version + 1
+      FROM prev WHERE obj.id = prev.id
+      RETURNING obj.id, prev.status AS previous
+    )
+    INSERT INTO app_audit_log (created_at, actor, action, resource, resource_id, detail)
+    SELECT $4, $5, $6, 'app_user', id::TEXT,
+      json_build_object('status', $2::TEXT, 'previous', previous, 'reason', $3::TEXT)::TEXT
+    FROM changed`
+	args := []any{userID, status, reason, at, actor, AuditActionUserStatusChanged}
+	slog.Debug("store.UserStatus.Set", logQueryArgs(qry, args, nil)...)
+	res, err := r.db.ExecContext(ctx, qry, args...)
+	if err != nil {
+		nargs := append(append([]any{}, "qry", qry), args...)
+		return updatePostgresError(r.db, "store.UserStatus.Set", err, nargs...)
+	}
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if ra == 0 {
+		return fmt.Errorf("NOT_FOUND")
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package util
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+const apiKeyTag = "ak"
+
+var apiKeyPrefixEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// NewAPIKey returns a new key of the form ak_<prefix>_<secret> together with
+// its prefix and the hash of its secret. The key is shown to the user once;
+// only the prefix and the hash are stored.
+func NewAPIKey() (key, prefix, secretHash string, err error) {
+	p := make([]byte, 10)
+	if _, err = rand.Read(p); err != nil {
+		return "", "", "", err
+	}
+	s := make([]byte, 32)
+	if _, err = rand.Read(s); err != nil {
+		return "", "", "", err
+	}
+	prefix = apiKeyPrefixEncoding.EncodeToString(p)
+	secret := base64.RawURLEncoding.EncodeToString(s)
+	return apiKeyTag + "_" + prefix + "_" + secret, prefix, HashAPIKeySecret(secret), nil
+}
+
+// ParseAPIKey splits key into its prefix and secret.
+func ParseAPIKey(key string) (prefix, secret string, ok bool) {
+	tag, rest, ok := strings.Cut(key, "_")
+	if !ok || tag != apiKeyTag {
+		return "", "", false
+	}
+	// the secret is base64url and may contain '_', the prefix never does
+	prefix, secret, ok = strings.Cut(rest, "_")
+	if !ok || prefix == "" || secret == "" {
+		return "", "", false
+	}
+	return prefix, secret, true
+}
+
+// HashAPIKeySecret returns the hex SHA-256 of secret. The secret has 256 bits
+// of entropy, a slow password hash adds nothing but latency per request.
+func HashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+
+	"example.com/app-api/util/jsql"
+)
+
+// EncryptSecret seals value with AES-GCM; the nonce is prepended to the ciphertext.
+func EncryptSecret(key []byte, value string) (jsql.Secret, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return jsql.SecretValueNull(), err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return jsql.SecretValueNull(), err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return jsql.SecretValueNull(), err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return jsql.SecretValue(base64.RawStdEncoding.EncodeToString(sealed)), nil
+}
+
+func DecryptSecret(key []byte, value jsql.Secret) (string, error) {
+	if !value.Valid {
+		return "", errors.New("secret is null")
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(value.String)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("secret too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SetSignedHMAC is SetHMAC with the given request headers covered by the
+// signature. Set the headers before signing; they are listed in
+// X-Req-Signed-Headers so the server can rebuild the signed string.
+func SetSignedHMAC(req *http.Request, body []byte, shared []byte, headers ...string) {
+	nonce := randomString(32)
+	req.Header.Set("X-Req-Nonce", nonce)
+	reqTime := time.Now().Format(time.RFC3339)
+	req.Header.Set("X-Req-Timestamp", reqTime)
+	mac := hmac.New(sha256.New, []byte(nonce))
+	mac.Write(body)
+	bodyHash := base64.RawStdEncoding.EncodeToString(mac.Sum(nil))
+	req.Header.Set("X-Body-Hash", bodyHash)
+	mac = hmac.New(sha256.New, []byte(shared))
+	mac.Write([]byte(nonce))
+	mac.Write([]byte(";"))
+	mac.Write([]byte(reqTime))
+	mac.Write([]byte(";"))
+	mac.Write([]byte(req.Method))
+	mac.Write([]byte(";"))
+	mac.Write([]byte(req.URL.RequestURI()))
+	mac.Write([]byte(";"))
+	mac.Write([]byte(bodyHash))
+	names := make([]string, 0, len(headers))
+	for _, h := range headers {
+		h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+		names = append(names, h)
+		mac.Write([]byte(";"))
+		mac.Write([]byte(strings.ToLower(h) + ":" + strings.TrimSpace(req.Header.Get(h))))
+	}
+	if len(names) > 0 {
+		req.Header.Set("X-Req-Signed-Headers", strings.Join(names, ","))
+	}
+	req.Header.Set("X-Req-Signature", base64.RawStdEncoding.EncodeToString(mac.Sum(nil)))
+}
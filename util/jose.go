@@ -0,0 +1,110 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ContentTypeJOSE marks a body encrypted with EncryptJOSE.
+const ContentTypeJOSE = "application/jose+json"
+
+// JWE is the flattened JSON serialization of a JWE with direct key
+// agreement: the content key is derived from the ECDH secret of the login.
+type JWE struct {
+	Protected  string `json:"protected"`
+	IV         string `json:"iv"`
+	Ciphertext string `json:"ciphertext"`
+	Tag        string `json:"tag"`
+}
+
+type joseHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+}
+
+// protected header of every payload; it is authenticated as AAD
+var joseProtected = func() string {
+	bb, _ := json.Marshal(joseHeader{Alg: "dir", Enc: "A256GCM"})
+	return base64.RawURLEncoding.EncodeToString(bb)
+}()
+
+func joseCipher(shared []byte) (cipher.AEAD, error) {
+	if len(shared) == 0 {
+		return nil, errors.New("missing shared secret")
+	}
+	key, err := hkdf.Key(sha256.New, shared, nil, "app-api e2e A256GCM", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptJOSE seals plaintext with AES-256-GCM under a key derived from shared.
+func EncryptJOSE(shared, plaintext []byte) ([]byte, error) {
+	aead, err := joseCipher(shared)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nil, iv, plaintext, []byte(joseProtected))
+	n := len(sealed) - aead.Overhead()
+	return json.Marshal(JWE{
+		Protected:  joseProtected,
+		IV:         base64.RawURLEncoding.EncodeToString(iv),
+		Ciphertext: base64.RawURLEncoding.EncodeToString(sealed[:n]),
+		Tag:        base64.RawURLEncoding.EncodeToString(sealed[n:]),
+	})
+}
+
+// DecryptJOSE opens a body sealed by EncryptJOSE.
+func DecryptJOSE(shared, body []byte) ([]byte, error) {
+	var jwe JWE
+	if err := json.Unmarshal(body, &jwe); err != nil {
+		return nil, fmt.Errorf("invalid jwe: %w", err)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(jwe.Protected)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwe header: %w", err)
+	}
+	var hdr joseHeader
+	if err := json.Unmarshal(raw, &hdr); err != nil {
+		return nil, fmt.Errorf("invalid jwe header: %w", err)
+	}
+	if hdr.Alg != "dir" || hdr.Enc != "A256GCM" {
+		return nil, fmt.Errorf("unsupported jwe alg %q enc %q", hdr.Alg, hdr.Enc)
+	}
+	iv, err := base64.RawURLEncoding.DecodeString(jwe.IV)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwe iv: %w", err)
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(jwe.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwe ciphertext: %w", err)
+	}
+	tag, err := base64.RawURLEncoding.DecodeString(jwe.Tag)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwe tag: %w", err)
+	}
+	aead, err := joseCipher(shared)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aead.NonceSize() || len(tag) != aead.Overhead() {
+		return nil, errors.New("invalid jwe iv or tag length")
+	}
+	return aead.Open(nil, iv, append(ciphertext, tag...), []byte(jwe.Protected))
+}
@@ -0,0 +1,172 @@
+package util
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Mail struct {
+	To      []string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, m Mail) error
+}
+
+var ErrMailerNotConfigured = errors.New("mailer is not configured")
+
+// GetMailer builds a Mailer from <prefix>_DRIVER (smtp, file or log) and the
+// matching <prefix>_* environment variables. A missing or unknown driver
+// yields a mailer that refuses to send.
+func GetMailer(prefix string) Mailer {
+	from := os.Getenv(prefix + "_FROM")
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+	switch strings.ToLower(os.Getenv(prefix + "_DRIVER")) {
+	case "smtp":
+		host := os.Getenv(prefix + "_HOST")
+		if host == "" {
+			slog.Error("Environment variable for mail host is not set", "var", prefix+"_HOST")
+			os.Exit(1)
+		}
+		port := os.Getenv(prefix + "_PORT")
+		if port == "" {
+			port = "25"
+		}
+		return &SMTPMailer{
+			Addr:     net.JoinHostPort(host, port),
+			Username: os.Getenv(prefix + "_USER"),
+			Password: os.Getenv(prefix + "_PASSWORD"),
+			From:     from,
+		}
+	case "file":
+		dir := os.Getenv(prefix + "_DIR")
+		if dir == "" {
+			dir = "/app/log/mail"
+		}
+		return &FileMailer{Dir: dir, From: from}
+	case "log":
+		return &LogMailer{From: from}
+	default:
+		slog.Error("Environment variable for mail driver is not set or unknown, mail is disabled",
+			"var", prefix+"_DRIVER", "value", os.Getenv(prefix+"_DRIVER"))
+		return noMailer{}
+	}
+}
+
+type noMailer struct{}
+
+func (noMailer) Send(ctx context.Context, m Mail) error {
+	return ErrMailerNotConfigured
+}
+
+func formatMail(from string, m Mail) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + strings.Join(m.To, ", ") + "\r\n")
+	b.WriteString("Subject: " + m.Subject + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
+
+// SMTPMailer delivers mail through an SMTP relay, upgrading to TLS when the
+// server offers STARTTLS.
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTPMailer) Send(ctx context.Context, m Mail) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(s.From); err != nil {
+		return err
+	}
+	for _, to := range m.To {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(formatMail(s.From, m)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// FileMailer writes every message as an .eml file into Dir.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (f *FileMailer) Send(ctx context.Context, m Mail) error {
+	if err := os.MkdirAll(f.Dir, 0o755); err != nil {
+		return err
+	}
+	fn := filepath.Join(f.Dir, fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102T150405.000000000"), randomString(8)))
+	return os.WriteFile(fn, formatMail(f.From, m), 0o600)
+}
+
+// LogMailer logs the message instead of sending it, for local development:
+// the body carries the single-use links of the mail, so MAIL_DRIVER=log must
+// not be used in production.
+type LogMailer struct {
+	From string
+}
+
+func (l *LogMailer) Send(ctx context.Context, m Mail) error {
+	slog.Info("mail", "from", l.From, "to", m.To, "subject", m.Subject, "body", m.Body)
+	return nil
+}
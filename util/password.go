@@ -0,0 +1,207 @@
+package util
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"example.com/app-api/util/jsql"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+func init() {
+	p := HashParams()
+	envUint := func(name string, bits int, v *uint64) {
+		str := os.Getenv(name)
+		if str == "" {
+			return
+		}
+		u, err := strconv.ParseUint(str, 10, bits)
+		if err != nil || u == 0 {
+			slog.Warn("invalid "+name+" env var, using default", "err", err, "value", str)
+			return
+		}
+		*v = u
+	}
+	memory, iterations, parallelism := uint64(p.Memory), uint64(p.Iterations), uint64(p.Parallelism)
+	envUint("ARGON2_MEMORY", 32, &memory)
+	envUint("ARGON2_ITERATIONS", 32, &iterations)
+	envUint("ARGON2_PARALLELISM", 8, &parallelism)
+	p.Memory, p.Iterations, p.Parallelism = uint32(memory), uint32(iterations), uint8(parallelism)
+	// HashPassword of gen___auth.go reads hashParam unguarded, so it is only
+	// set here, before any password is hashed
+	if err := ValidHashParams(p); err != nil {
+		slog.Warn("invalid argon2 parameters, using default", "err", err)
+		return
+	}
+	*hashParam = p
+}
+
+// HashParams returns the parameters of new password hashes, set from the
+// ARGON2_* env vars at startup. Hashes made with other parameters stay valid;
+// NeedsRehash reports them until the next login.
+func HashParams() Params {
+	return *hashParam
+}
+
+// ValidHashParams checks the argon2id parameters of new password hashes.
+func ValidHashParams(p Params) error {
+	if p.Iterations < 1 || p.Parallelism < 1 || p.SaltLen < 8 || p.KeyLen < 16 {
+		return errors.New("argon2 iterations, parallelism, salt or key length too small")
+	}
+	if p.Memory < 8*uint32(p.Parallelism) {
+		return errors.New("argon2 memory must be at least 8 KiB per lane")
+	}
+	return nil
+}
+
+// CheckPassword checks value against the stored hash. Argon2id hashes are
+// verified by VerifyPassword; besides, it accepts argon2i and imported bcrypt
+// ($2a$, $2b$, $2y$) and scrypt ($scrypt$ln=,r=,p=$salt$hash) hashes.
+func CheckPassword(value string, password jsql.Secret) (bool, error) {
+	if !password.Valid {
+		return false, nil
+	}
+	if password.String == "" {
+		return false, nil
+	}
+	parts := strings.Split(password.String, "$")
+	if len(parts) < 4 || parts[0] != "" {
+		slog.Warn("invalid password format")
+		return false, errors.New("invalid PHC format")
+	}
+	switch parts[1] {
+	case "argon2id":
+		return VerifyPassword(value, password)
+	case "argon2i":
+		return verifyArgon2i(value, parts)
+	case "2a", "2b", "2y":
+		err := bcrypt.CompareHashAndPassword([]byte(password.String), []byte(value))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case "scrypt":
+		return verifyScrypt(value, parts)
+	}
+	slog.Warn("unsupported password hash", "id", parts[1])
+	return false, errors.New("unsupported password hash")
+}
+
+// NeedsRehash reports whether the stored hash is not an argon2id hash with
+// the current parameters, so it should be replaced after a successful login.
+func NeedsRehash(password jsql.Secret) bool {
+	if !password.Valid || password.String == "" {
+		return false
+	}
+	parts := strings.Split(password.String, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" || parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return true
+	}
+	kv, err := parsePHCParams(parts[3])
+	if err != nil {
+		return true
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return true
+	}
+	p := HashParams()
+	return kv["m"] != uint64(p.Memory) || kv["t"] != uint64(p.Iterations) ||
+		kv["p"] != uint64(p.Parallelism) || len(want) != int(p.KeyLen)
+}
+
+// Bounds of the parameters of imported hashes, which come from outside: a
+// stored hash must not make a login cost more memory or time than any sane
+// hash does.
+const (
+	maxArgon2Memory     = 1 << 22 // KiB, 4 GiB
+	maxArgon2Iterations = 64
+	maxScryptLogN       = 20
+	maxScryptRP         = 64
+)
+
+// parsePHCParams parses the k=v,k=v parameter part of a PHC string.
+func parsePHCParams(str string) (map[string]uint64, error) {
+	res := map[string]uint64{}
+	for _, kv := range strings.Split(str, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		u, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PHC parameter %s: %w", k, err)
+		}
+		res[k] = u
+	}
+	return res, nil
+}
+
+func verifyArgon2i(value string, parts []string) (bool, error) {
+	if len(parts) != 6 {
+		return false, errors.New("invalid PHC format")
+	}
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		slog.Warn("unsupported argon2 version", "version", parts[2])
+		return false, errors.New("unsupported argon2 version")
+	}
+	kv, err := parsePHCParams(parts[3])
+	if err != nil {
+		return false, err
+	}
+	if kv["p"] < 1 || kv["p"] > 255 {
+		return false, errors.New("invalid argon2 parallelism")
+	}
+	if kv["t"] < 1 || kv["t"] > maxArgon2Iterations {
+		return false, errors.New("invalid argon2 iterations")
+	}
+	if kv["m"] < 8*kv["p"] || kv["m"] > maxArgon2Memory {
+		return false, errors.New("invalid argon2 memory")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+	got := argon2.Key([]byte(value), salt, uint32(kv["t"]), uint32(kv["m"]), uint8(kv["p"]), uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// decodePHCBase64 accepts standard and passlib ("." for "+") unpadded base64.
+func decodePHCBase64(str string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.ReplaceAll(strings.TrimRight(str, "="), ".", "+"))
+}
+
+func verifyScrypt(value string, parts []string) (bool, error) {
+	if len(parts) != 5 {
+		return false, errors.New("invalid PHC format")
+	}
+	kv, err := parsePHCParams(parts[2])
+	if err != nil {
+		return false, err
+	}
+	if kv["ln"] < 1 || kv["ln"] > maxScryptLogN || kv["r"] < 1 || kv["p"] < 1 || kv["r"]*kv["p"] > maxScryptRP {
+		return false, errors.New("invalid scrypt parameters")
+	}
+	salt, err := decodePHCBase64(parts[3])
+	if err != nil {
+		return false, err
+	}
+	want, err := decodePHCBase64(parts[4])
+	if err != nil {
+		return false, err
+	}
+	got, err := scrypt.Key([]byte(value), salt, 1<<kv["ln"], int(kv["r"]), int(kv["p"]), len(want))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}